@@ -0,0 +1,252 @@
+package gonzo
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// pipelineStages returns the stages of an aggregation pipeline, as the
+// name and argument of each.
+func pipelineStages(pipeline []interface{}) (bson.D, error) {
+	var stages bson.D
+	for _, v := range pipeline {
+		stage := asDoc(v)
+		if len(stage) != 1 {
+			return nil, errorf(ErrBadValue, "A pipeline stage specification object must contain exactly one field.")
+		}
+		stages = append(stages, stage[0])
+	}
+	return stages, nil
+}
+
+// aggregate runs an aggregation pipeline on a collection. Only the stages
+// which need no expression language are supported: $geoNear, $match,
+// $sort, $skip, $limit, $project with inclusions or exclusions, and
+// $count. $changeStream pipelines are run by the backend instead.
+func aggregate(coll Collection, pipeline []interface{}) ([]interface{}, error) {
+	stages, err := pipelineStages(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []interface{}
+	switch {
+	case len(stages) > 0 && stages[0].Name == "$geoNear":
+		docs, err = geoNear(coll, stages[0].Value)
+		stages = stages[1:]
+	case len(stages) > 0 && stages[0].Name == "$match":
+		// A leading $match is answered using the collection's indexes.
+		var filter bson.M
+		if filter, err = asBsonM(stages[0].Value); err != nil {
+			return nil, errorf(ErrBadValue, "the match filter must be an expression in an object")
+		}
+		var result *QueryResult
+		if result, err = coll.Find(&Query{Filter: filter}); err == nil {
+			docs = result.Docs
+		}
+		stages = stages[1:]
+	default:
+		docs = coll.All()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return runStages(docs, stages)
+}
+
+// runStages runs the stages of a pipeline following the first on the
+// documents it produced.
+func runStages(docs []interface{}, stages bson.D) ([]interface{}, error) {
+	for _, stage := range stages {
+		switch stage.Name {
+		case "$geoNear":
+			return nil, errorf(ErrGeoNearNotFirst, "$geoNear is only valid as the first stage in a pipeline.")
+		case "$changeStream":
+			return nil, errorf(ErrChangeStreamNotFirst, "$changeStream is only valid as the first stage in a pipeline.")
+		case "$match":
+			filter, err := asBsonM(stage.Value)
+			if err != nil {
+				return nil, errorf(ErrBadValue, "the match filter must be an expression in an object")
+			}
+			var matched []interface{}
+			for _, doc := range docs {
+				if isPatternMatch(doc.(bson.M), filter) {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$sort":
+			spec := asDoc(stage.Value)
+			if len(spec) == 0 {
+				return nil, errorf(ErrBadValue, "$sort stage must have at least one sort key")
+			}
+			docs = append([]interface{}(nil), docs...)
+			sortDocs(docs, make([]float64, len(docs)), spec)
+		case "$skip":
+			n := int(asFloat64(stage.Value))
+			if typeOrder(stage.Value) != 10 || n < 0 {
+				return nil, errorf(ErrBadValue, "invalid argument to $skip stage: %s", formatValue(stage.Value))
+			}
+			if n > len(docs) {
+				n = len(docs)
+			}
+			docs = docs[n:]
+		case "$limit":
+			n := int(asFloat64(stage.Value))
+			if typeOrder(stage.Value) != 10 || n <= 0 {
+				return nil, errorf(ErrBadValue, "the limit must be positive")
+			}
+			if n < len(docs) {
+				docs = docs[:n]
+			}
+		case "$project":
+			proj, err := newProjection(asDoc(stage.Value))
+			if err != nil {
+				return nil, err
+			}
+			for i, doc := range docs {
+				docs[i] = proj.apply(doc.(bson.M), 0)
+			}
+		case "$count":
+			name, ok := stage.Value.(string)
+			if !ok || name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+				return nil, errorf(ErrBadValue, "the count field must be a non-empty string without '$' or '.': %s",
+					formatValue(stage.Value))
+			}
+			if len(docs) == 0 {
+				docs = nil
+			} else {
+				docs = []interface{}{bson.M{name: len(docs)}}
+			}
+		default:
+			return nil, errorf(ErrUnknownPipelineStage, "Unrecognized pipeline stage name: '%s'", stage.Name)
+		}
+	}
+	return docs, nil
+}
+
+// geoNear runs a $geoNear stage, returning documents nearest a point
+// first, with their distance from it. The stage is answered as a $near
+// or $nearSphere query on the location field of the collection's geo
+// index.
+func geoNear(coll Collection, arg interface{}) ([]interface{}, error) {
+	var near, maxDistance, minDistance interface{}
+	var distanceField, includeLocs, key string
+	var spherical bool
+	var filter bson.M
+	multiplier := 1.0
+	limit := 0
+	for _, kv := range asDoc(arg) {
+		switch kv.Name {
+		case "near":
+			near = kv.Value
+		case "distanceField":
+			distanceField, _ = kv.Value.(string)
+		case "spherical":
+			spherical = asBool(kv.Value)
+		case "maxDistance":
+			maxDistance = kv.Value
+		case "minDistance":
+			minDistance = kv.Value
+		case "query":
+			var err error
+			if filter, err = asBsonM(kv.Value); err != nil {
+				return nil, errorf(ErrBadValue, "query must be an object: %s", formatValue(kv.Value))
+			}
+		case "distanceMultiplier":
+			multiplier = asFloat64(kv.Value)
+		case "includeLocs":
+			includeLocs, _ = kv.Value.(string)
+		case "key":
+			key, _ = kv.Value.(string)
+		case "limit", "num":
+			limit = int(asFloat64(kv.Value))
+		}
+	}
+	if near == nil {
+		return nil, errorf(ErrBadValue, "$geoNear requires a 'near' option as an Array or Object")
+	}
+	if distanceField == "" {
+		return nil, errorf(ErrBadValue, "$geoNear requires a 'distanceField' option as a String")
+	}
+
+	// Find the location field of the geo index to use.
+	var fields []string
+	for _, spec := range coll.Indexes() {
+		for _, kv := range asDoc(spec.Map()["key"]) {
+			if kind, ok := kv.Value.(string); ok && (kind == "2d" || kind == "2dsphere") {
+				if key == "" || key == kv.Name {
+					fields = append(fields, kv.Name)
+				}
+			}
+		}
+	}
+	switch {
+	case len(fields) == 0 && key != "":
+		return nil, errorf(ErrBadValue, "no geo index found for key: %s", key)
+	case len(fields) == 0:
+		return nil, errorf(ErrIndexNotFound, "$geoNear requires a 2d or 2dsphere index, but none were found")
+	case len(fields) > 1:
+		return nil, errorf(ErrBadValue,
+			"more than one geo index found; specify the key to use for $geoNear")
+	}
+	path := fields[0]
+
+	// GeoJSON points are always near on the sphere, and their distances
+	// are in meters.
+	op := "$near"
+	if _, isLegacy := parseLegacyPoint(near); spherical || !isLegacy {
+		op = "$nearSphere"
+	}
+	nearOps := bson.D{{op, near}}
+	if maxDistance != nil {
+		nearOps = append(nearOps, bson.DocElem{"$maxDistance", maxDistance})
+	}
+	if minDistance != nil {
+		nearOps = append(nearOps, bson.DocElem{"$minDistance", minDistance})
+	}
+	nq, err := parseNear(path, nearOps)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{Filter: bson.M{path: nearOps}, Limit: limit}
+	for k, v := range filter {
+		if k != path {
+			q.Filter[k] = v
+		}
+	}
+	result, err := coll.Find(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []interface{}
+	for _, v := range result.Docs {
+		doc := v.(bson.M)
+		d, _ := nq.distance(doc)
+		out := copyDoc(doc)
+		setPath(out, distanceField, d*multiplier)
+		if includeLocs != "" {
+			loc, _ := lookupPath(doc, path)
+			setPath(out, includeLocs, copyValue(loc))
+		}
+		docs = append(docs, out)
+	}
+	return docs, nil
+}
+
+// setPath sets a dotted field path in a document, creating embedded
+// documents as needed.
+func setPath(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := doc[part].(bson.M)
+		if !ok {
+			sub = bson.M{}
+			doc[part] = sub
+		}
+		doc = sub
+	}
+	doc[parts[len(parts)-1]] = value
+}
@@ -0,0 +1,540 @@
+package gonzo
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scramMechanisms are the SCRAM mechanisms users may authenticate with,
+// along with the hash each uses and the number of iterations passwords
+// are salted with, as mongod's defaults.
+var scramMechanisms = map[string]struct {
+	newHash    func() hash.Hash
+	iterations int
+}{
+	"SCRAM-SHA-1":   {sha1.New, 10000},
+	"SCRAM-SHA-256": {sha256.New, 15000},
+}
+
+// authExemptCommands are the commands clients may run before they have
+// authenticated.
+var authExemptCommands = map[string]bool{
+	"authenticate": true,
+	"buildInfo":    true,
+	"buildinfo":    true,
+	"getLastError": true,
+	"getlasterror": true,
+	"getnonce":     true,
+	"getPrevError": true,
+	"getpreverror": true,
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"logout":       true,
+	"ping":         true,
+	"resetError":   true,
+	"reseterror":   true,
+	"saslContinue": true,
+	"saslStart":    true,
+	"whatsmyuri":   true,
+}
+
+// scramCredential is the SCRAM credential of a user, from which passwords
+// cannot be recovered.
+type scramCredential struct {
+	IterationCount int    `bson:"iterationCount"`
+	Salt           string `bson:"salt"`
+	StoredKey      string `bson:"storedKey"`
+	ServerKey      string `bson:"serverKey"`
+}
+
+// userCredentials are the credentials of a user for each mechanism. As
+// with mongod before 4.0, the MONGODB-CR credential is the digest of the
+// user name and password that SCRAM-SHA-1 also salts.
+type userCredentials struct {
+	MongoCR     string           `bson:"MONGODB-CR,omitempty"`
+	ScramSHA1   *scramCredential `bson:"SCRAM-SHA-1,omitempty"`
+	ScramSHA256 *scramCredential `bson:"SCRAM-SHA-256,omitempty"`
+}
+
+// scram returns the credential for a SCRAM mechanism, or nil if the user
+// has none.
+func (c *userCredentials) scram(mechanism string) *scramCredential {
+	switch mechanism {
+	case "SCRAM-SHA-1":
+		return c.ScramSHA1
+	case "SCRAM-SHA-256":
+		return c.ScramSHA256
+	}
+	return nil
+}
+
+// roleName names a role granted on a database.
+type roleName struct {
+	Role string `bson:"role"`
+	DB   string `bson:"db"`
+}
+
+// userDoc is a user, as stored in admin.system.users.
+type userDoc struct {
+	Id          string          `bson:"_id"`
+	UserId      bson.Binary     `bson:"userId"`
+	User        string          `bson:"user"`
+	DB          string          `bson:"db"`
+	Credentials userCredentials `bson:"credentials"`
+	Roles       []roleName      `bson:"roles"`
+	CustomData  bson.D          `bson:"customData,omitempty"`
+}
+
+// mongoCRDigest returns the digest of a user's password which MONGODB-CR
+// and SCRAM-SHA-1 use in place of the password.
+func mongoCRDigest(user, password string) string {
+	sum := md5.Sum([]byte(user + ":mongo:" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashSum(newHash func() hash.Hash, data []byte) []byte {
+	h := newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hmacSum(newHash func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key the size of the hash from a password, as PBKDF2
+// does to salt SCRAM passwords.
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// newScramCredential salts a password for a SCRAM mechanism.
+func newScramCredential(mechanism, password string) (*scramCredential, error) {
+	m := scramMechanisms[mechanism]
+	salt := make([]byte, m.newHash().Size()-4)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salted := pbkdf2(m.newHash, []byte(password), salt, m.iterations)
+	return &scramCredential{
+		IterationCount: m.iterations,
+		Salt:           base64.StdEncoding.EncodeToString(salt),
+		StoredKey:      base64.StdEncoding.EncodeToString(hashSum(m.newHash, hmacSum(m.newHash, salted, "Client Key"))),
+		ServerKey:      base64.StdEncoding.EncodeToString(hmacSum(m.newHash, salted, "Server Key")),
+	}, nil
+}
+
+// newCredentials returns the credentials of a user for every mechanism.
+// Passwords are used as given by SCRAM-SHA-256, without SASLprep.
+func newCredentials(user, password string) (userCredentials, error) {
+	creds, err := newDigestCredentials(mongoCRDigest(user, password))
+	if err != nil {
+		return userCredentials{}, err
+	}
+	if creds.ScramSHA256, err = newScramCredential("SCRAM-SHA-256", password); err != nil {
+		return userCredentials{}, err
+	}
+	return creds, nil
+}
+
+// newDigestCredentials returns the credentials of a user whose password is
+// only known by its MONGODB-CR digest, as drivers send passwords with
+// digestPassword false. They have none for SCRAM-SHA-256, which needs the
+// password itself.
+func newDigestCredentials(digest string) (userCredentials, error) {
+	creds := userCredentials{MongoCR: digest}
+	var err error
+	if creds.ScramSHA1, err = newScramCredential("SCRAM-SHA-1", digest); err != nil {
+		return userCredentials{}, err
+	}
+	return creds, nil
+}
+
+// convertDoc converts a document from one type to another, through BSON.
+func convertDoc(in, out interface{}) error {
+	data, err := bson.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+// user returns a user defined on a database.
+func (b *MemoryBackend) user(dbname, name string) (*userDoc, bool) {
+	docs := b.DB("admin").C("system.users").Match(bson.M{"_id": dbname + "." + name})
+	if len(docs) == 0 {
+		return nil, false
+	}
+	var u userDoc
+	if err := convertDoc(docs[0], &u); err != nil {
+		return nil, false
+	}
+	return &u, true
+}
+
+// putUser stores a user in admin.system.users, replacing the user with
+// the same name on the same database, if any.
+func (b *MemoryBackend) putUser(u *userDoc) error {
+	return b.putAuthDoc("system.users", u.Id, u)
+}
+
+// putAuthDoc stores a user or role in a collection of admin, replacing the
+// document with the same id, if any.
+func (b *MemoryBackend) putAuthDoc(cname, id string, v interface{}) error {
+	var doc bson.M
+	if err := convertDoc(v, &doc); err != nil {
+		return err
+	}
+	coll := b.DB("admin").C(cname)
+	n, _, err := coll.Update(bson.M{"_id": id}, doc, false)
+	if err != nil || n > 0 {
+		return err
+	}
+	return coll.Insert(doc)
+}
+
+// AddUser adds a user to a database, granting it roles on the database,
+// or sets the password and roles of the user if it already exists.
+// Users of $external, who authenticate with x.509 certificates, have no
+// password.
+func (b *MemoryBackend) AddUser(dbname, user, password string, roles ...string) error {
+	var creds userCredentials
+	if dbname != "$external" {
+		var err error
+		if creds, err = newCredentials(user, password); err != nil {
+			return err
+		}
+	}
+	u := &userDoc{Id: dbname + "." + user, UserId: newUUID(), User: user, DB: dbname, Credentials: creds, Roles: []roleName{}}
+	if old, ok := b.user(dbname, user); ok {
+		u.UserId = old.UserId
+	}
+	for _, role := range roles {
+		u.Roles = append(u.Roles, roleName{Role: role, DB: dbname})
+	}
+	return b.putUser(u)
+}
+
+// SetAuth sets whether clients must authenticate before running anything
+// but the commands which log in, as with mongod --auth.
+func (b *MemoryBackend) SetAuth(enabled bool) {
+	b.mu.Lock()
+	b.auth = enabled
+	b.mu.Unlock()
+}
+
+// authEnabled returns whether clients must be authorized for what they
+// run.
+func (b *MemoryBackend) authEnabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.auth
+}
+
+// authorize returns an Unauthorized error for a command, or the command a
+// legacy operation corresponds to, if authorization is enforced and the
+// users the connection has authenticated as have not been granted what it
+// needs. denied returns the error for connections which have
+// authenticated.
+func (b *MemoryBackend) authorize(c net.Conn, cmd string, needs []need, denied func() error) error {
+	if !b.authEnabled() || authExemptCommands[cmd] {
+		return nil
+	}
+	ctx := contextOf(c)
+	if len(ctx.users) == 0 {
+		return errorf(ErrUnauthorized, "command %s requires authentication", cmd)
+	}
+	if len(needs) == 0 {
+		return nil
+	}
+	privs := b.userPrivileges(ctx)
+	for _, n := range needs {
+		for _, action := range n.actions {
+			if !allowed(privs, n.resource, action) {
+				return denied()
+			}
+		}
+	}
+	return nil
+}
+
+// allowed returns whether any of privs allows an action on a resource.
+func allowed(privs []privilege, res resource, action string) bool {
+	for _, p := range privs {
+		if p.allows(res, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeCommand returns an Unauthorized error unless a connection may
+// run a command on a database. As with mongod's localhost exception,
+// clients connecting from the same host may create the first user on
+// admin without authenticating.
+func (b *MemoryBackend) authorizeCommand(c net.Conn, dbname string, query *OpQueryMsg) error {
+	cmd, _ := query.Command()
+	if cmd == "createUser" && dbname == "admin" && b.authEnabled() && isLocal(c) && !b.hasUsers() {
+		return nil
+	}
+	return b.authorize(c, cmd, commandNeeds(dbname, query), func() error {
+		return errorf(ErrUnauthorized, "not authorized on %s to execute command %s", dbname, formatValue(query.Doc))
+	})
+}
+
+// isLocal returns whether a connection is from the same host.
+func isLocal(c net.Conn) bool {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	return !ok || addr.IP.IsLoopback()
+}
+
+// hasUsers returns whether any users have been defined.
+func (b *MemoryBackend) hasUsers() bool {
+	return len(b.DB("admin").C("system.users").All()) > 0
+}
+
+// authorizeQuery checks a query or command may be run on a connection,
+// replying with an Unauthorized error if not.
+func (b *MemoryBackend) authorizeQuery(c net.Conn, query *OpQueryMsg) bool {
+	dbname, cname := splitNamespace(query.FullCollectionName)
+	if cname != "$cmd" {
+		find := []need{{resource{DB: dbname, Collection: cname}, []string{"find"}}}
+		err := b.authorize(c, "find", find, func() error {
+			return errorf(ErrUnauthorized, "not authorized for query on %s", query.FullCollectionName)
+		})
+		if err != nil {
+			respQueryError(c, query.RequestID, err)
+			return false
+		}
+		return true
+	}
+	if err := b.authorizeCommand(c, dbname, query); err != nil {
+		respError(c, query.RequestID, err)
+		return false
+	}
+	return true
+}
+
+// authorizeWrite checks a legacy insert, update or delete on a namespace
+// may be run on a connection, recording an Unauthorized error for
+// getLastError if not.
+func (b *MemoryBackend) authorizeWrite(c net.Conn, op, ns string) bool {
+	dbname, cname := splitNamespace(ns)
+	n := need{resource{DB: dbname, Collection: cname}, []string{op}}
+	switch {
+	case op == "delete":
+		n.actions = []string{"remove"}
+	case cname == "system.indexes":
+		n = need{resource{DB: dbname}, []string{"createIndex"}}
+	}
+	err := b.authorize(c, op, []need{n}, func() error {
+		return errorf(ErrUnauthorized, "not authorized for %s on %s", op, ns)
+	})
+	if err != nil {
+		contextOf(c).lastError.record(writeErrorResult(0, err))
+		return false
+	}
+	return true
+}
+
+func errAuthenticationFailed() error {
+	return errorf(ErrAuthenticationFailed, "Authentication failed.")
+}
+
+// getnonce returns a nonce for a MONGODB-CR authentication on the
+// connection.
+func getnonce(ctx *connContext) (bson.D, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ctx.nonce = hex.EncodeToString(nonce)
+	return markOk(bson.D{{"nonce", ctx.nonce}}), nil
+}
+
+// authenticate authenticates a connection as a user of a database, with
+// the key MONGODB-CR derives from the last nonce getnonce returned.
+func (b *MemoryBackend) authenticate(ctx *connContext, dbname string, query *OpQueryMsg) (bson.D, error) {
+	if v, _ := query.Get("mechanism"); v == "MONGODB-X509" {
+		return b.authenticateX509(ctx, dbname, query)
+	} else if v != nil && v != "MONGODB-CR" {
+		return nil, errorf(ErrMechanismUnavailable, "Received authentication for mechanism %s which is unknown or not enabled", formatValue(v))
+	}
+	v, _ := query.Get("user")
+	name, _ := v.(string)
+	v, _ = query.Get("nonce")
+	nonce, _ := v.(string)
+	v, _ = query.Get("key")
+	key, _ := v.(string)
+	expected := ctx.nonce
+	ctx.nonce = ""
+	u, ok := b.user(dbname, name)
+	if !ok || nonce == "" || nonce != expected || u.Credentials.MongoCR == "" {
+		return nil, errAuthenticationFailed()
+	}
+	sum := md5.Sum([]byte(nonce + name + u.Credentials.MongoCR))
+	if !hmac.Equal([]byte(key), []byte(hex.EncodeToString(sum[:]))) {
+		return nil, errAuthenticationFailed()
+	}
+	ctx.login(dbname, name)
+	return markOk(bson.D{{"dbname", dbname}, {"user", name}}), nil
+}
+
+// scramConversation is a SCRAM authentication in progress on a
+// connection.
+type scramConversation struct {
+	id          int
+	mechanism   string
+	db          string
+	user        *userDoc
+	cred        *scramCredential
+	nonce       string
+	authMessage string
+
+	// verified is set once the client has proven it has the password, and
+	// the server has signed the conversation.
+	verified bool
+}
+
+// scramAttrs parses the attributes of a SCRAM message.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// saslStart starts a SCRAM conversation, with the client's first message.
+func (b *MemoryBackend) saslStart(ctx *connContext, dbname string, query *OpQueryMsg) (bson.D, error) {
+	ctx.conversation = nil
+	v, _ := query.Get("mechanism")
+	mechanism, _ := v.(string)
+	if _, ok := scramMechanisms[mechanism]; !ok {
+		return nil, errorf(ErrMechanismUnavailable, "Received authentication for mechanism %s which is unknown or not enabled", mechanism)
+	}
+	v, _ = query.Get("payload")
+	fields := strings.SplitN(string(asBinary(v).Data), ",", 3)
+	if len(fields) < 3 || fields[0] != "n" && fields[0] != "y" {
+		return nil, errorf(ErrBadValue, "Invalid SCRAM client first message")
+	}
+	bare := fields[2]
+	attrs := scramAttrs(bare)
+	name := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+	if name == "" || attrs["r"] == "" {
+		return nil, errorf(ErrBadValue, "Invalid SCRAM client first message")
+	}
+	u, ok := b.user(dbname, name)
+	if !ok || u.Credentials.scram(mechanism) == nil {
+		return nil, errAuthenticationFailed()
+	}
+	cred := u.Credentials.scram(mechanism)
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	conv := &scramConversation{
+		id:        1,
+		mechanism: mechanism,
+		db:        dbname,
+		user:      u,
+		cred:      cred,
+		nonce:     attrs["r"] + base64.StdEncoding.EncodeToString(nonce),
+	}
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", conv.nonce, cred.Salt, cred.IterationCount)
+	conv.authMessage = bare + "," + serverFirst
+	ctx.conversation = conv
+	return markOk(bson.D{
+		{"conversationId", conv.id},
+		{"done", false},
+		{"payload", []byte(serverFirst)},
+	}), nil
+}
+
+// saslContinue continues a SCRAM conversation, verifying the client's
+// proof and replying with the server's signature, then authenticating the
+// connection once the client has verified it.
+func (b *MemoryBackend) saslContinue(ctx *connContext, dbname string, query *OpQueryMsg) (bson.D, error) {
+	conv := ctx.conversation
+	v, _ := query.Get("conversationId")
+	if id, _ := asInt64(v); conv == nil || id != int64(conv.id) || conv.db != dbname {
+		return nil, errorf(ErrProtocolError, "No SASL session state found")
+	}
+	if conv.verified {
+		ctx.conversation = nil
+		ctx.login(dbname, conv.user.User)
+		return markOk(bson.D{
+			{"conversationId", conv.id},
+			{"done", true},
+			{"payload", []byte{}},
+		}), nil
+	}
+
+	ctx.conversation = nil
+	v, _ = query.Get("payload")
+	final := string(asBinary(v).Data)
+	i := strings.LastIndex(final, ",p=")
+	if i < 0 {
+		return nil, errorf(ErrBadValue, "Invalid SCRAM client final message")
+	}
+	if scramAttrs(final)["r"] != conv.nonce {
+		return nil, errAuthenticationFailed()
+	}
+	authMessage := conv.authMessage + "," + final[:i]
+	newHash := scramMechanisms[conv.mechanism].newHash
+	proof, err := base64.StdEncoding.DecodeString(final[i+3:])
+	if err != nil {
+		return nil, errAuthenticationFailed()
+	}
+	storedKey, _ := base64.StdEncoding.DecodeString(conv.cred.StoredKey)
+	serverKey, _ := base64.StdEncoding.DecodeString(conv.cred.ServerKey)
+	// The proof is the client key, masked with the client's signature of
+	// the conversation.
+	clientKey := hmacSum(newHash, storedKey, authMessage)
+	if len(proof) != len(clientKey) {
+		return nil, errAuthenticationFailed()
+	}
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+	if !hmac.Equal(hashSum(newHash, clientKey), storedKey) {
+		return nil, errAuthenticationFailed()
+	}
+	conv.verified = true
+	ctx.conversation = conv
+	serverSignature := hmacSum(newHash, serverKey, authMessage)
+	return markOk(bson.D{
+		{"conversationId", conv.id},
+		{"done", false},
+		{"payload", []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature))},
+	}), nil
+}
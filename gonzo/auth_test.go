@@ -0,0 +1,162 @@
+package gonzo_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dialUser connects to the server as a user.
+func (s *gonzoSuite) dialUser(source, user, password, mechanism string) (*mgo.Session, error) {
+	return mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:     s.session.LiveServers(),
+		Direct:    true,
+		Timeout:   5 * time.Second,
+		Source:    source,
+		Username:  user,
+		Password:  password,
+		Mechanism: mechanism,
+	})
+}
+
+func (s *gonzoSuite) TestAuthMongoCR(c *gc.C) {
+	c.Assert(s.server.AddUser("db1", "alice", "secret", "readWrite"), gc.IsNil)
+	s.server.SetAuth(true)
+
+	// Clients which have not logged in may only log in.
+	c.Assert(s.session.Ping(), gc.IsNil)
+	err := s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1})
+	c.Assert(err, gc.ErrorMatches, "command insert requires authentication")
+	c.Assert(err.(*mgo.LastError).Code, gc.Equals, 13)
+	err = s.session.DB("db1").C("c1").Find(nil).One(nil)
+	c.Assert(err, gc.ErrorMatches, "command find requires authentication")
+	err = s.session.DB("db1").Run(bson.D{{"count", "c1"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 13)
+
+	session, err := s.dialUser("db1", "alice", "secret", "")
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+
+	_, err = s.dialUser("db1", "alice", "wrong", "")
+	c.Assert(err, gc.ErrorMatches, "Authentication failed.")
+	_, err = s.dialUser("db2", "alice", "secret", "")
+	c.Assert(err, gc.ErrorMatches, "Authentication failed.")
+}
+
+func (s *gonzoSuite) TestAuthScramSHA1(c *gc.C) {
+	c.Assert(s.server.AddUser("admin", "root", "secret", "root"), gc.IsNil)
+	s.server.SetAuth(true)
+	session, err := s.dialUser("admin", "root", "secret", "SCRAM-SHA-1")
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+
+	_, err = s.dialUser("admin", "root", "wrong", "SCRAM-SHA-1")
+	c.Assert(err, gc.ErrorMatches, "server returned error on SASL authentication step: Authentication failed.")
+
+	// Changing passwords does not log out connections already logged in.
+	c.Assert(s.server.AddUser("admin", "root", "rotated", "root"), gc.IsNil)
+	_, err = s.dialUser("admin", "root", "secret", "SCRAM-SHA-1")
+	c.Assert(err, gc.NotNil)
+	rotated, err := s.dialUser("admin", "root", "rotated", "SCRAM-SHA-1")
+	c.Assert(err, gc.IsNil)
+	rotated.Close()
+	n, err := session.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// Users are stored with their salted credentials only.
+	var users []bson.M
+	c.Assert(session.DB("admin").C("system.users").Find(nil).All(&users), gc.IsNil)
+	c.Assert(users, gc.HasLen, 1)
+	c.Assert(users[0]["_id"], gc.Equals, "admin.root")
+	creds := users[0]["credentials"].(bson.M)
+	c.Assert(creds["SCRAM-SHA-1"], gc.NotNil)
+	c.Assert(creds["SCRAM-SHA-256"], gc.NotNil)
+}
+
+// scramSHA256 logs in with SCRAM-SHA-256, which mgo does not support.
+func scramSHA256(db *mgo.Database, user, password string) error {
+	var reply struct {
+		ConversationId int `bson:"conversationId"`
+		Done           bool
+		Payload        []byte
+	}
+	clientFirst := "n=" + user + ",r=rOprNGfwEbeRWgbNEkqO"
+	err := db.Run(bson.D{{"saslStart", 1}, {"mechanism", "SCRAM-SHA-256"}, {"payload", []byte("n,," + clientFirst)}}, &reply)
+	if err != nil {
+		return err
+	}
+	serverFirst := string(reply.Payload)
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(serverFirst, ",") {
+		attrs[attr[:1]] = attr[2:]
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+
+	mac := func(key []byte, msg string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(msg))
+		return h.Sum(nil)
+	}
+	u := mac([]byte(password), string(salt)+"\x00\x00\x00\x01")
+	salted := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = mac([]byte(password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+	proof := mac(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	final := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	err = db.Run(bson.D{{"saslContinue", 1}, {"conversationId", reply.ConversationId}, {"payload", []byte(final)}}, &reply)
+	if err != nil {
+		return err
+	}
+	signature := "v=" + base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage))
+	if string(reply.Payload) != signature {
+		return fmt.Errorf("bad server signature %q", reply.Payload)
+	}
+	err = db.Run(bson.D{{"saslContinue", 1}, {"conversationId", reply.ConversationId}, {"payload", []byte{}}}, &reply)
+	if err == nil && !reply.Done {
+		err = fmt.Errorf("conversation not done")
+	}
+	return err
+}
+
+func (s *gonzoSuite) TestAuthScramSHA256(c *gc.C) {
+	c.Assert(s.server.AddUser("db1", "bob", "secret", "readWrite"), gc.IsNil)
+	s.server.SetAuth(true)
+	db := s.session.DB("db1")
+	err := scramSHA256(db, "bob", "wrong")
+	c.Assert(err, gc.ErrorMatches, "Authentication failed.")
+	c.Assert(errorCode(err), gc.Equals, 18)
+	err = scramSHA256(db, "carol", "secret")
+	c.Assert(errorCode(err), gc.Equals, 18)
+
+	c.Assert(scramSHA256(db, "bob", "secret"), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"count", "c1"}}, nil), gc.IsNil)
+	c.Assert(db.Run("logout", nil), gc.IsNil)
+	err = db.Run(bson.D{{"count", "c1"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 13)
+
+	err = db.Run(bson.D{{"saslStart", 1}, {"mechanism", "PLAIN"}, {"payload", []byte("\x00bob\x00secret")}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 334)
+}
@@ -2,12 +2,13 @@ package gonzo
 
 import (
 	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/tomb.v2"
@@ -18,6 +19,8 @@ type Backend interface {
 	HandleInsert(c net.Conn, insert *OpInsertMsg)
 	HandleUpdate(c net.Conn, update *OpUpdateMsg)
 	HandleDelete(c net.Conn, deleteMsg *OpDeleteMsg)
+	HandleGetMore(c net.Conn, getMore *OpGetMoreMsg)
+	HandleKillCursors(c net.Conn, killCursors *OpKillCursorsMsg)
 
 	DBNames() []string
 	DB(name string) DB
@@ -25,36 +28,105 @@ type Backend interface {
 
 type DB interface {
 	Empty() bool
+	Size() int64
 	CNames() []string
 	C(name string) Collection
-
-	LastError() interface{}
-	SetLastError(doc interface{})
+	Create(name string, options bson.D) (Collection, error)
+	Drop(name string) error
+	Rename(from, to string, dropTarget bool) error
 }
 
 type Collection interface {
+	Options() bson.D
+	UUID() bson.Binary
+	Size() int64
 	Id(id string) interface{}
 	All() []interface{}
 	Match(pattern bson.M) []interface{}
+	Find(q *Query) (*QueryResult, error)
 	Insert(item interface{}) error
-	Delete(pattern bson.M, limit int) int
+	Update(pattern, update bson.M, multi bool) (matched, modified int, err error)
+	Delete(pattern bson.M, limit int) (int, error)
+
+	Capped() bool
+	Tail(filter bson.M, after int64, n int) ([]interface{}, int64, error)
+	Notify() <-chan struct{}
+
+	Indexes() []bson.D
+	CreateIndex(spec bson.D) (bool, error)
+	DropIndex(name string) error
 }
 
 type MemoryCollection struct {
-	docs map[string]bson.M
+	ns      string
+	docs    map[int64]bson.M
+	lastID  int64
+	order   []int64
+	indexes []*memoryIndex
+	options bson.D
+	uuid    bson.Binary
+
+	// dataSize is the total size of the documents, in bytes.
+	dataSize int64
+
+	// capped is set for capped collections.
+	capped *cappedLimits
+
+	// inserted is closed when a document is next inserted.
+	inserted chan struct{}
+
+	// oplog records changes to the documents, if set.
+	oplog *oplog
 
 	mu sync.RWMutex
 }
 
+func NewMemoryCollection(ns string, options bson.D) *MemoryCollection {
+	idIndex, err := newMemoryIndex(idIndexSpec)
+	if err != nil {
+		panic(err)
+	}
+	idIndex.unique = true
+	capped, _ := newCappedLimits(options)
+	return &MemoryCollection{
+		ns:      ns,
+		docs:    make(map[int64]bson.M),
+		indexes: []*memoryIndex{idIndex},
+		options: options,
+		uuid:    newUUID(),
+		capped:  capped,
+	}
+}
+
+// newUUID returns a random (version 4) UUID, encoded as BSON binary subtype 4.
+func newUUID() bson.Binary {
+	b := make([]byte, 16)
+	_, err := rand.Reader.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return bson.Binary{Kind: 0x04, Data: b}
+}
+
 type MemoryDB struct {
+	name        string
 	collections map[string]*MemoryCollection
-	lastErr     interface{}
+	oplog       *oplog
+
+	// snapshot is set for a transaction's copy of a database, whose
+	// collections are copied from it as they are first used.
+	snapshot *txnSnapshot
 
 	mu sync.RWMutex
 }
 
-func NewMemoryDB() *MemoryDB {
-	return &MemoryDB{collections: make(map[string]*MemoryCollection)}
+func NewMemoryDB(name string) *MemoryDB {
+	return &MemoryDB{
+		name:        name,
+		collections: make(map[string]*MemoryCollection),
+	}
 }
 
 func (db *MemoryDB) Empty() bool {
@@ -63,6 +135,16 @@ func (db *MemoryDB) Empty() bool {
 	return len(db.collections) == 0
 }
 
+func (db *MemoryDB) Size() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var size int64
+	for _, coll := range db.collections {
+		size += coll.Size()
+	}
+	return size
+}
+
 func (db *MemoryDB) CNames() (result []string) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -77,35 +159,115 @@ func (db *MemoryDB) C(name string) Collection {
 	defer db.mu.Unlock()
 	result, ok := db.collections[name]
 	if !ok {
-		result = &MemoryCollection{docs: make(map[string]bson.M)}
+		if db.snapshot != nil {
+			result = db.snapshot.coll(db.name, name)
+		}
+		if result == nil {
+			db.oplog.preserve(db.name+"."+name, nil)
+			result = NewMemoryCollection(db.name+"."+name, nil)
+			result.oplog = db.oplog
+		}
 		db.collections[name] = result
 	}
 	return result
 }
 
-func (db *MemoryDB) LastError() interface{} {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return db.lastErr
+func (db *MemoryDB) Create(name string, options bson.D) (Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.collections[name]; ok {
+		return nil, errorf(ErrNamespaceExists, "collection already exists: %q", name)
+	}
+	if _, err := newCappedLimits(options); err != nil {
+		return nil, err
+	}
+	db.oplog.preserve(db.name+"."+name, nil)
+	result := NewMemoryCollection(db.name+"."+name, options)
+	result.oplog = db.oplog
+	db.collections[name] = result
+	return result, nil
+}
+
+// Drop removes a collection from the database.
+func (db *MemoryDB) Drop(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.dropLocked(name)
+}
+
+// dropLocked drops a collection from the database, which must be locked.
+func (db *MemoryDB) dropLocked(name string) error {
+	coll, ok := db.collections[name]
+	if !ok {
+		return errorf(ErrNamespaceNotFound, "ns not found")
+	}
+	coll.mu.RLock()
+	coll.preserveLocked()
+	coll.mu.RUnlock()
+	delete(db.collections, name)
+	db.logCommand(coll, bson.M{"drop": name})
+	return nil
 }
 
-func (db *MemoryDB) SetLastError(doc interface{}) {
+// Rename renames a collection in the database. If there is already a
+// collection named to, it is dropped if dropTarget is set.
+func (db *MemoryDB) Rename(from, to string, dropTarget bool) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if doc == nil {
-		doc = bson.D{}
+	coll, ok := db.collections[from]
+	if !ok {
+		return errorf(ErrNamespaceNotFound, "source namespace does not exist")
+	}
+	if _, ok := db.collections[to]; ok {
+		if !dropTarget {
+			return errorf(ErrNamespaceExists, "target namespace exists")
+		}
+		// The target is dropped as the drop command would, so that its
+		// drop is recorded and streams watching it are invalidated.
+		if err := db.dropLocked(to); err != nil {
+			return err
+		}
 	}
-	db.lastErr = doc
+	coll.mu.Lock()
+	coll.preserveLocked()
+	coll.ns = db.name + "." + to
+	coll.mu.Unlock()
+	db.oplog.preserve(db.name+"."+to, nil)
+	delete(db.collections, from)
+	db.collections[to] = coll
+	db.logCommand(coll, bson.M{
+		"renameCollection": db.name + "." + from,
+		"to":               db.name + "." + to,
+		"dropTarget":       dropTarget,
+	})
+	return nil
+}
+
+func (c *MemoryCollection) Options() bson.D {
+	return c.options
+}
+
+func (c *MemoryCollection) UUID() bson.Binary {
+	return c.uuid
+}
+
+// Size returns the total BSON-encoded size of the documents in the
+// collection.
+func (c *MemoryCollection) Size() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dataSize
 }
 
 func (c *MemoryCollection) Id(id string) interface{} {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for _, item := range c.docs {
-		mitem := item
-		if match, ok := mitem["_id"]; ok && match == id {
-			return item
-		}
+	idx := c.idIndex()
+	if idx == nil {
+		return nil
+	}
+	for _, recordID := range idx.lookup([]interface{}{id}) {
+		return c.docs[recordID]
 	}
 	return nil
 }
@@ -113,12 +275,54 @@ func (c *MemoryCollection) Id(id string) interface{} {
 func (c *MemoryCollection) All() (result []interface{}) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for _, doc := range c.docs {
-		result = append(result, doc)
+	for _, id := range c.recordIDs() {
+		result = append(result, c.docs[id])
 	}
 	return result
 }
 
+// recordIDs returns the ids of all records in the collection, in insertion
+// order.
+func (c *MemoryCollection) recordIDs() []int64 {
+	ids := make([]int64, 0, len(c.docs))
+	for _, id := range c.order {
+		if _, ok := c.docs[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// compactOrder drops the ids of deleted records from the insertion order
+// once they make up half of it, so that deletes take constant time
+// amortized over the records inserted.
+func (c *MemoryCollection) compactOrder() {
+	if len(c.order) < 2*len(c.docs) {
+		return
+	}
+	c.order = c.recordIDs()
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// candidates returns the ids of records which may match pattern, found
+// by the query plan which does the least work.
+func (c *MemoryCollection) candidates(pattern bson.M) ([]int64, error) {
+	run, _, err := c.choosePlan(&Query{Filter: pattern})
+	if err != nil {
+		return nil, err
+	}
+	return run.ids, nil
+}
+
+// Match returns the documents matching a pattern. It is meant for the
+// backend's own lookups, whose patterns any collection can answer; queries
+// from clients use Find, which fails if a pattern needs an index, such as a
+// text index for $text, that the collection lacks.
 func (c *MemoryCollection) Match(pattern bson.M) (result []interface{}) {
 	if pattern == nil {
 		return c.All()
@@ -126,7 +330,13 @@ func (c *MemoryCollection) Match(pattern bson.M) (result []interface{}) {
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for _, doc := range c.docs {
+	return c.matchLocked(pattern)
+}
+
+func (c *MemoryCollection) matchLocked(pattern bson.M) (result []interface{}) {
+	ids, _ := c.candidates(pattern)
+	for _, id := range ids {
+		doc := c.docs[id]
 		if isPatternMatch(doc, pattern) {
 			result = append(result, doc)
 		}
@@ -134,76 +344,298 @@ func (c *MemoryCollection) Match(pattern bson.M) (result []interface{}) {
 	return result
 }
 
-func (c *MemoryCollection) Delete(pattern bson.M, limit int) int {
+// Delete removes the documents matching a pattern, or up to limit of them
+// if limit is positive, returning how many were removed.
+func (c *MemoryCollection) Delete(pattern bson.M, limit int) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	var removeIds []string
-	for id, doc := range c.docs {
-		if isPatternMatch(doc, pattern) {
+	return c.deleteLocked(pattern, limit)
+}
+
+func (c *MemoryCollection) deleteLocked(pattern bson.M, limit int) (int, error) {
+	var removeIds []int64
+	ids, err := c.candidates(pattern)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if isPatternMatch(c.docs[id], pattern) {
 			removeIds = append(removeIds, id)
-			if limit > 0 && limit >= len(removeIds) {
+			if limit > 0 && len(removeIds) >= limit {
 				break
 			}
 		}
 	}
+	if len(removeIds) > 0 {
+		c.preserveLocked()
+	}
 	for _, id := range removeIds {
+		c.logDelete(c.docs[id])
+		c.unindexDoc(id, c.docs[id])
+		c.dataSize -= docSize(c.docs[id])
 		delete(c.docs, id)
 	}
-	return len(removeIds)
-}
-
-func isPatternMatch(doc, pattern bson.M) bool {
-	for matchKey, matchValue := range pattern {
-		value, ok := doc[matchKey]
-		if !ok || matchValue != value {
-			return false
-		}
-	}
-	return true
+	c.compactOrder()
+	return len(removeIds), nil
 }
 
 func (c *MemoryCollection) Insert(doc interface{}) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.insertLocked(doc)
+}
+
+func (c *MemoryCollection) insertLocked(doc interface{}) error {
 	mdoc, ok := doc.(bson.M)
 	if !ok {
 		return fmt.Errorf("cannot insert instance of this type: %v", doc)
 	}
-	var idStr string
-	if id, ok := mdoc["_id"]; ok {
-		idStr = id.(fmt.Stringer).String()
-	} else {
-		oid := bson.NewObjectId()
-		mdoc["_id"] = oid
-		idStr = oid.String()
+	if _, ok := mdoc["_id"]; !ok {
+		mdoc["_id"] = bson.NewObjectId()
+	}
+	return c.insertDoc(mdoc)
+}
+
+// insertDoc adds a document to the collection as it is, without giving it
+// an _id if it has none. The collection must be locked.
+func (c *MemoryCollection) insertDoc(mdoc bson.M) error {
+	c.preserveLocked()
+	id := c.lastID + 1
+	if err := c.indexDoc(id, mdoc); err != nil {
+		return err
+	}
+	c.lastID = id
+	c.docs[id] = mdoc
+	c.order = append(c.order, id)
+	c.dataSize += docSize(mdoc)
+	c.logInsert(mdoc)
+	if c.capped != nil {
+		c.evict()
 	}
-	c.docs[idStr] = mdoc
+	c.notifyInserted()
 	return nil
 }
 
+// Update applies an update specification to the documents matching
+// pattern. It returns the number of documents matched, and the number
+// actually changed by the update.
+func (c *MemoryCollection) Update(pattern, update bson.M, multi bool) (matched, modified int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updateLocked(pattern, update, multi)
+}
+
+func (c *MemoryCollection) updateLocked(pattern, update bson.M, multi bool) (matched, modified int, err error) {
+	ids, err := c.candidates(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	var updateIds []int64
+	for _, id := range ids {
+		if isPatternMatch(c.docs[id], pattern) {
+			updateIds = append(updateIds, id)
+			if !multi {
+				break
+			}
+		}
+	}
+	if len(updateIds) > 0 {
+		c.preserveLocked()
+	}
+	for _, id := range updateIds {
+		oldDoc := c.docs[id]
+		newDoc := copyDoc(oldDoc)
+		err := applyUpdate(update, newDoc)
+		if err != nil {
+			return matched, modified, err
+		}
+		if compareValues(oldDoc["_id"], newDoc["_id"]) != 0 {
+			return matched, modified, errorf(ErrImmutableField,
+				"After applying the update, the (immutable) field '_id' was found to have been altered to _id: %s",
+				formatValue(newDoc["_id"]))
+		}
+		matched++
+		if compareValues(oldDoc, newDoc) == 0 {
+			continue
+		}
+		oldSize, newSize := docSize(oldDoc), docSize(newDoc)
+		if c.capped != nil && oldSize != newSize {
+			return matched - 1, modified, errorf(ErrCannotGrowCappedDocument,
+				"Cannot change the size of a document in a capped collection: %d != %d", oldSize, newSize)
+		}
+		c.unindexDoc(id, oldDoc)
+		if err := c.indexDoc(id, newDoc); err != nil {
+			c.indexDoc(id, oldDoc)
+			return matched - 1, modified, err
+		}
+		c.docs[id] = newDoc
+		c.dataSize += newSize - oldSize
+		c.logUpdate(update, oldDoc, newDoc)
+		modified++
+	}
+	return matched, modified, nil
+}
+
+// indexDoc adds a document to all of the collection's indexes, or none of
+// them if it cannot be indexed or would duplicate a unique key.
+func (c *MemoryCollection) indexDoc(id int64, doc bson.M) error {
+	keys := make([][][]interface{}, len(c.indexes))
+	for i, idx := range c.indexes {
+		var err error
+		if keys[i], err = idx.keys(doc); err != nil {
+			return err
+		}
+		if key, dup := idx.duplicate(keys[i], id); dup {
+			return idx.dupKeyError(c.ns, key)
+		}
+	}
+	for i, idx := range c.indexes {
+		idx.insert(keys[i], id)
+	}
+	return nil
+}
+
+func (c *MemoryCollection) unindexDoc(id int64, doc bson.M) {
+	for _, idx := range c.indexes {
+		keys, err := idx.keys(doc)
+		if err != nil {
+			continue
+		}
+		idx.remove(keys, id)
+	}
+}
+
+func (c *MemoryCollection) Indexes() (result []bson.D) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, idx := range c.indexes {
+		result = append(result, idx.spec)
+	}
+	return result
+}
+
+// CreateIndex builds a new index on the collection. It returns false if
+// an identical index already exists.
+func (c *MemoryCollection) CreateIndex(spec bson.D) (bool, error) {
+	newIdx, err := newMemoryIndex(spec)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, idx := range c.indexes {
+		if idx.sameSpec(newIdx) {
+			return false, nil
+		}
+		if idx.name == newIdx.name {
+			return false, errorf(ErrIndexOptionsConflict,
+				"Index with name: %s already exists with different options", idx.name)
+		}
+		if idx.sameKey(newIdx) {
+			return false, errorf(ErrIndexOptionsConflict,
+				"Index with name: %s already exists with a different name", idx.name)
+		}
+	}
+	for _, id := range c.recordIDs() {
+		keys, err := newIdx.keys(c.docs[id])
+		if err != nil {
+			return false, err
+		}
+		if key, dup := newIdx.duplicate(keys, id); dup {
+			return false, newIdx.dupKeyError(c.ns, key)
+		}
+		newIdx.insert(keys, id)
+	}
+	c.preserveLocked()
+	c.indexes = append(c.indexes, newIdx)
+	return true, nil
+}
+
+func (c *MemoryCollection) DropIndex(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idx := c.idIndex(); idx != nil && name == idx.name {
+		return errorf(ErrInvalidOptions, "cannot drop _id index")
+	}
+	for i, idx := range c.indexes {
+		if idx.name == name {
+			c.preserveLocked()
+			c.indexes = append(c.indexes[:i], c.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return errorf(ErrIndexNotFound, "index not found with name [%s]", name)
+}
+
 type MemoryBackend struct {
 	dbs map[string]*MemoryDB
 	t   *tomb.Tomb
+
+	clock        Clock
+	clockChanged chan struct{}
+	// clockMu guards clock apart from mu, as writes read the clock with
+	// their collections locked, while mu is held to lock collections.
+	clockMu sync.Mutex
+
+	cursors    *cursorSet
+	oplog      *oplog
+	sessions   *sessionSet
+	failPoints *failPointSet
+
+	// replicas returns the number of members of the replica set sharing
+	// the backend, and how many are reachable. It is nil for standalone
+	// servers. Other members acknowledge writes after replicationLag.
+	replicas       func() (members, reachable int)
+	replicationLag time.Duration
+
+	// auth is set when clients must authenticate.
+	auth bool
+
+	mu sync.Mutex
 }
 
+// NewMemoryBackend returns a new in-memory backend, which runs its
+// background tasks until t is killed.
 func NewMemoryBackend(t *tomb.Tomb) *MemoryBackend {
-	return &MemoryBackend{
-		dbs: make(map[string]*MemoryDB),
-		t:   t,
+	b := &MemoryBackend{
+		dbs:          make(map[string]*MemoryDB),
+		t:            t,
+		clock:        WallClock,
+		clockChanged: make(chan struct{}, 1),
+		cursors:      newCursorSet(),
+		sessions:     newSessionSet(),
+		failPoints:   newFailPointSet(),
 	}
+	b.oplog = newOplog(b.Clock, bson.D{{"capped", true}, {"size", OplogSize}})
+	b.oplog.snapshots = newSnapshotSet(b.Clock)
+	t.Go(b.ttlMonitor)
+	return b
 }
 
 func (b *MemoryBackend) DBNames() (result []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for dbname, _ := range b.dbs {
 		result = append(result, dbname)
 	}
+	sort.Strings(result)
 	return result
 }
 
 func (b *MemoryBackend) DB(name string) DB {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	result, ok := b.dbs[name]
 	if !ok {
-		result = NewMemoryDB()
+		result = NewMemoryDB(name)
+		if name == "local" {
+			// Changes to the local database are not replicated, so
+			// are not recorded in its oplog.
+			result.collections["oplog.rs"] = b.oplog.coll
+		} else {
+			result.oplog = b.oplog
+		}
 		b.dbs[name] = result
 	}
 	return result
@@ -222,7 +654,55 @@ func asBsonM(v interface{}) (bson.M, error) {
 	return nil, fmt.Errorf("cannot resolve %q to bson.M", v)
 }
 
+// asBool interprets a command argument as a boolean, the way mongod accepts
+// either true/false or a non-zero number.
+func asBool(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int:
+		return b != 0
+	case int32:
+		return b != 0
+	case int64:
+		return b != 0
+	case float64:
+		return b != 0
+	}
+	return false
+}
+
 func (b *MemoryBackend) HandleQuery(c net.Conn, query *OpQueryMsg) {
+	if !b.authorizeQuery(c, query) {
+		return
+	}
+	if dbname, cname := splitNamespace(query.FullCollectionName); cname == "$cmd" {
+		cmd, _ := query.Command()
+		if data, ok := b.failPoints.failCommand(cmd, false); ok {
+			if asBool(data["blockConnection"]) {
+				ms, _ := asInt64(data["blockTimeMS"])
+				if err := b.sleep(c, time.Duration(ms)*time.Millisecond); err != nil {
+					respError(c, query.RequestID, err)
+					return
+				}
+			}
+			if asBool(data["closeConnection"]) {
+				c.Close()
+				return
+			}
+			if code, ok := asInt64(data["errorCode"]); ok {
+				respError(c, query.RequestID, errorf(ErrorCode(code), "Failing command due to 'failCommand' failpoint"))
+				return
+			}
+		}
+		if err := b.checkReadConcern(query); err != nil {
+			respError(c, query.RequestID, err)
+			return
+		}
+		if b.handleSessionCommand(c, dbname, query) || b.handleConnCommand(c, dbname, query) || b.handleUserCommand(c, dbname, query) {
+			return
+		}
+	}
 	if query.FullCollectionName == "admin.$cmd" {
 		err := b.handleAdminCommand(c, query)
 		if err != nil {
@@ -237,13 +717,14 @@ func (b *MemoryBackend) HandleQuery(c net.Conn, query *OpQueryMsg) {
 		return
 	}
 	dbname, cname := fields[0], fields[1]
-	if strings.HasPrefix(cname, "system.") {
+	// Users are stored in an ordinary collection, which may be queried.
+	if strings.HasPrefix(cname, "system.") && query.FullCollectionName != "admin.system.users" {
 		b.handleSystemQuery(c, query, dbname, cname)
 		return
 	}
 	db := b.DB(dbname)
 	if cname == "$cmd" {
-		err := b.handleDBCommand(c, db, query)
+		err := b.handleDBCommand(c, dbname, db, query)
 		if err != nil {
 			log.Println(err)
 		}
@@ -251,22 +732,38 @@ func (b *MemoryBackend) HandleQuery(c net.Conn, query *OpQueryMsg) {
 	}
 	coll := db.C(cname)
 
-	var results []interface{}
-	if match, ok := query.Get("$query"); ok {
-		matchM, err := asBsonM(match)
-		if err != nil {
-			respError(c, query.RequestID, err)
+	q, explain, err := legacyQuery(query)
+	if err != nil {
+		respQueryError(c, query.RequestID, err)
+		return
+	}
+	if query.Flags&QueryFlagOplogReplay != 0 {
+		if err := checkOplogReplay(q.Filter); err != nil {
+			respQueryError(c, query.RequestID, err)
+			return
 		}
-		results = append(results, coll.Match(matchM)...)
-	} else if len(query.Doc) == 0 {
-		results = append(results, coll.All()...)
-	} else {
-		results = append(results, coll.Match(query.Doc.Map())...)
 	}
-	respDoc(c, query.RequestID, results...)
+	if query.Flags&QueryFlagTailableCursor != 0 && !explain {
+		b.tailQuery(c, query, coll, q)
+		return
+	}
+	result, err := coll.Find(q)
+	if err != nil {
+		respQueryError(c, query.RequestID, err)
+		return
+	}
+	if explain {
+		respDoc(c, query.RequestID, explainReply(query.FullCollectionName, q, result, "allPlansExecution"))
+		return
+	}
+	docs, cursorID := b.firstBatch(query.FullCollectionName, coll, result.Docs, query.NumberToReturn)
+	respCursor(c, query.RequestID, cursorID, 0, docs)
 }
 
 func (b *MemoryBackend) HandleUpdate(c net.Conn, update *OpUpdateMsg) {
+	if !b.authorizeWrite(c, "update", update.FullCollectionName) {
+		return
+	}
 	if strings.HasPrefix(update.FullCollectionName, "admin.") {
 		respError(c, update.RequestID, fmt.Errorf("update not supported on admin.*"))
 		return
@@ -282,41 +779,15 @@ func (b *MemoryBackend) HandleUpdate(c net.Conn, update *OpUpdateMsg) {
 		respError(c, update.RequestID, fmt.Errorf("update not supported on %q", update.FullCollectionName))
 		return
 	}
-	db := b.DB(dbname)
-	coll := db.C(cname)
-	matched := coll.Match(update.Selector)
-
-	if update.Flags&UpdateFlagMultiUpdate == 0 && len(matched) > 1 {
-		matched = matched[:1]
-	}
-
-	result := &WriteResult{
-		N: len(matched),
-	}
-
-	for _, match := range matched {
-		err := applyUpdate(update.Update, match.(bson.M))
-		if err != nil {
-			respError(c, update.RequestID, err)
-			return
-		}
-		result.UpdatedExisting = true
-	}
-
-	if update.Flags&UpdateFlagUpsert != 0 && result.N == 0 {
-		id, ok := update.Update["_id"]
-		if !ok {
-			id = bson.NewObjectId()
-			update.Update["_id"] = id
-		}
-		err := coll.Insert(update.Update)
-		if err != nil {
-			db.SetLastError(errReply(err))
-			return
-		}
-		result.Upserted = id
+	le := &contextOf(c).lastError
+	coll := b.DB(dbname).C(cname)
+	result, err := updateDocs(coll, update.Selector, update.Update,
+		update.Flags&UpdateFlagMultiUpdate != 0, update.Flags&UpdateFlagUpsert != 0)
+	if err != nil {
+		le.record(writeErrorResult(0, err))
+		return
 	}
-	db.SetLastError(result)
+	le.record(result)
 }
 
 func applyUpdate(spec, target bson.M) error {
@@ -364,6 +835,9 @@ func applyUpdate(spec, target bson.M) error {
 }
 
 func (b *MemoryBackend) HandleDelete(c net.Conn, deleteMsg *OpDeleteMsg) {
+	if !b.authorizeWrite(c, "delete", deleteMsg.FullCollectionName) {
+		return
+	}
 	if strings.HasPrefix(deleteMsg.FullCollectionName, "admin.") {
 		respError(c, deleteMsg.RequestID, fmt.Errorf("delete not supported on admin.*"))
 		return
@@ -379,20 +853,25 @@ func (b *MemoryBackend) HandleDelete(c net.Conn, deleteMsg *OpDeleteMsg) {
 		respError(c, deleteMsg.RequestID, fmt.Errorf("delete %q not supported on %q", deleteMsg.Selector, deleteMsg.FullCollectionName))
 		return
 	}
-	db := b.DB(dbname)
-	coll := db.C(cname)
+	coll := b.DB(dbname).C(cname)
 	limit := 0
 	if deleteMsg.Flags&DeleteFlagSingleRemove != 0 {
 		limit = 1
 	}
-	n := coll.Delete(deleteMsg.Selector, limit)
-	// TODO: enforce safe mode with int result of the above
-	db.SetLastError(&WriteResult{
+	n, err := coll.Delete(deleteMsg.Selector, limit)
+	if err != nil {
+		contextOf(c).lastError.record(writeErrorResult(0, err))
+		return
+	}
+	contextOf(c).lastError.record(&WriteResult{
 		N: n,
 	})
 }
 
 func (b *MemoryBackend) HandleInsert(c net.Conn, insert *OpInsertMsg) {
+	if !b.authorizeWrite(c, "insert", insert.FullCollectionName) {
+		return
+	}
 	if strings.HasPrefix(insert.FullCollectionName, "admin.") {
 		respError(c, insert.RequestID, fmt.Errorf("insert not supported on admin.*"))
 		return
@@ -404,18 +883,41 @@ func (b *MemoryBackend) HandleInsert(c net.Conn, insert *OpInsertMsg) {
 		return
 	}
 	dbname, cname := fields[0], fields[1]
+	if cname == "system.indexes" {
+		b.insertSystemIndexes(c, dbname, insert)
+		return
+	}
 	if strings.HasPrefix(cname, "system.") {
 		respError(c, insert.RequestID, fmt.Errorf("insert %q not supported on %q", insert.Docs, insert.FullCollectionName))
 		return
 	}
+	le := &contextOf(c).lastError
+	coll := b.DB(dbname).C(cname)
+	_, errs := insertDocs(coll, insert.Docs, insert.Flags&InsertFlagContinueOnError == 0)
+	if len(errs) > 0 {
+		le.record(writeErrorResult(0, errs[len(errs)-1].err))
+		return
+	}
+	le.record(&WriteResult{})
+}
+
+// insertSystemIndexes creates indexes from specifications inserted into
+// system.indexes, the way clients predating createIndexes build them.
+func (b *MemoryBackend) insertSystemIndexes(c net.Conn, dbname string, insert *OpInsertMsg) {
+	le := &contextOf(c).lastError
 	db := b.DB(dbname)
-	coll := db.C(cname)
 	for _, doc := range insert.Docs {
-		err := coll.Insert(doc)
-		db.SetLastError(err)
+		ns, _ := doc["ns"].(string)
+		if !strings.HasPrefix(ns, dbname+".") {
+			le.record(writeErrorResult(0, errorf(ErrBadValue, "invalid index namespace: %q", ns)))
+			return
+		}
+		_, err := db.C(ns[len(dbname)+1:]).CreateIndex(asDoc(doc))
 		if err != nil {
+			le.record(writeErrorResult(0, err))
 			return
 		}
+		le.record(&WriteResult{})
 	}
 }
 
@@ -423,9 +925,36 @@ func (b *MemoryBackend) HandleInsert(c net.Conn, insert *OpInsertMsg) {
 func (b *MemoryBackend) handleSystemQuery(c net.Conn, query *OpQueryMsg, dbname, cname string) {
 	switch cname {
 	case "system.namespaces":
+		db := b.DB(dbname)
+		var result []interface{}
+		for _, name := range db.CNames() {
+			result = append(result, bson.D{
+				{"name", dbname + "." + name},
+				{"options", collectionOptions(db.C(name))},
+			})
+		}
+		respDoc(c, query.RequestID, result...)
+		return
+	case "system.indexes":
+		filter := query.Doc.Map()
+		if q, ok := query.Get("$query"); ok {
+			var err error
+			if filter, err = asBsonM(q); err != nil {
+				respError(c, query.RequestID, err)
+				return
+			}
+		}
+		db := b.DB(dbname)
+		cnames := db.CNames()
+		sort.Strings(cnames)
 		var result []interface{}
-		for _, name := range b.DB(dbname).CNames() {
-			result = append(result, bson.D{{"name", name}})
+		for _, name := range cnames {
+			for _, spec := range db.C(name).Indexes() {
+				spec = indexInfo(dbname+"."+name, spec)
+				if isPatternMatch(spec.Map(), filter) {
+					result = append(result, spec)
+				}
+			}
 		}
 		respDoc(c, query.RequestID, result...)
 		return
@@ -434,43 +963,490 @@ func (b *MemoryBackend) handleSystemQuery(c net.Conn, query *OpQueryMsg, dbname,
 		"unsupported system query on %s: %v", query.FullCollectionName, query.Doc))
 }
 
-func (b *MemoryBackend) handleDBCommand(c net.Conn, db DB, query *OpQueryMsg) error {
-	var err error
+// indexInfo returns the listIndexes description of an index, which is
+// its specification along with the namespace of its collection.
+func indexInfo(ns string, spec bson.D) bson.D {
+	var result bson.D
+	for _, kv := range spec {
+		result = append(result, kv)
+		if kv.Name == "name" {
+			result = append(result, bson.DocElem{"ns", ns})
+		}
+	}
+	return result
+}
+
+// hasCollection returns whether a collection exists in db.
+func hasCollection(db DB, cname string) bool {
+	for _, name := range db.CNames() {
+		if name == cname {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *MemoryBackend) createIndexes(db DB, query *OpQueryMsg) (bson.D, error) {
+	cname, ok := query.Doc[0].Value.(string)
+	if !ok || cname == "" {
+		return nil, errorf(ErrBadValue, "malformed createIndexes command: %v", query.Doc)
+	}
+	v, _ := query.Get("indexes")
+	specs, ok := v.([]interface{})
+	if !ok || len(specs) == 0 {
+		return nil, errorf(ErrBadValue, "createIndexes requires an array of index specifications")
+	}
+
+	created := !hasCollection(db, cname)
+	coll := db.C(cname)
+	before := len(coll.Indexes())
+	for _, spec := range specs {
+		_, err := coll.CreateIndex(asDoc(spec))
+		if err != nil {
+			return nil, err
+		}
+	}
+	after := len(coll.Indexes())
+	reply := bson.D{
+		{"createdCollectionAutomatically", created},
+		{"numIndexesBefore", before},
+		{"numIndexesAfter", after},
+	}
+	if before == after {
+		reply = append(reply, bson.DocElem{"note", "all indexes already exist"})
+	}
+	return markOk(reply), nil
+}
+
+func (b *MemoryBackend) dropIndexes(db DB, query *OpQueryMsg) (bson.D, error) {
+	cname, ok := query.Doc[0].Value.(string)
+	if !ok || cname == "" {
+		return nil, errorf(ErrBadValue, "malformed dropIndexes command: %v", query.Doc)
+	}
+	if !hasCollection(db, cname) {
+		return nil, errorf(ErrNamespaceNotFound, "ns not found")
+	}
+	coll := db.C(cname)
+	specs := coll.Indexes()
+	reply := markOk(bson.D{{"nIndexesWas", len(specs)}})
+
+	index, _ := query.Get("index")
+	if index == "*" {
+		for _, spec := range specs[1:] {
+			name, _ := spec.Map()["name"].(string)
+			if err := coll.DropIndex(name); err != nil {
+				return nil, err
+			}
+		}
+		return reply, nil
+	}
+	name, ok := index.(string)
+	if !ok {
+		// Find the index by its key pattern.
+		key := asDoc(index)
+		for _, spec := range specs {
+			m := spec.Map()
+			if compareDocs(asDoc(m["key"]), key) == 0 {
+				name, _ = m["name"].(string)
+				break
+			}
+		}
+		if name == "" {
+			return nil, errorf(ErrIndexNotFound, "can't find index with key: %v", index)
+		}
+	}
+	if err := coll.DropIndex(name); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// collectionOptions returns the options a collection was created with, as
+// an empty document rather than nil if there are none.
+func collectionOptions(coll Collection) bson.D {
+	options := coll.Options()
+	if options == nil {
+		options = bson.D{}
+	}
+	return options
+}
+
+// collectionInfo returns the listCollections description of a collection.
+func collectionInfo(dbname, cname string, coll Collection) bson.D {
+	return bson.D{
+		{"name", cname},
+		{"type", "collection"},
+		{"options", collectionOptions(coll)},
+		{"info", bson.D{
+			{"readOnly", false},
+			{"uuid", coll.UUID()},
+		}},
+		{"idIndex", bson.D{
+			{"v", 2},
+			{"key", bson.D{{"_id", 1}}},
+			{"name", "_id_"},
+			{"ns", dbname + "." + cname},
+		}},
+	}
+}
+
+// cursorReply returns a command reply containing a cursor document. The
+// cursor has more results to return unless cursorID is zero.
+func cursorReply(ns string, cursorID int64, batch []interface{}) bson.D {
+	if batch == nil {
+		batch = []interface{}{}
+	}
+	return markOk(bson.D{{"cursor", bson.D{
+		{"id", cursorID},
+		{"ns", ns},
+		{"firstBatch", batch},
+	}}})
+}
+
+func (b *MemoryBackend) listCollections(dbname string, db DB, query *OpQueryMsg) (bson.D, error) {
+	var filter bson.M
+	if v, ok := query.Get("filter"); ok {
+		var err error
+		filter, err = asBsonM(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var nameOnly bool
+	if v, ok := query.Get("nameOnly"); ok {
+		nameOnly = asBool(v)
+	}
+
+	cnames := db.CNames()
+	sort.Strings(cnames)
+	var batch []interface{}
+	for _, cname := range cnames {
+		var info bson.D
+		if nameOnly {
+			info = bson.D{{"name", cname}, {"type", "collection"}}
+		} else {
+			info = collectionInfo(dbname, cname, db.C(cname))
+		}
+		if filter != nil && !isPatternMatch(info.Map(), filter) {
+			continue
+		}
+		batch = append(batch, info)
+	}
+	return cursorReply(dbname+".$cmd.listCollections", 0, batch), nil
+}
+
+// createOptions are the fields of a create command which are options of the
+// collection created, as listCollections reports them. Other fields, such
+// as lsid and writeConcern, apply to the command rather than the
+// collection.
+var createOptions = map[string]bool{
+	"autoIndexId":         true,
+	"capped":              true,
+	"collation":           true,
+	"flags":               true,
+	"indexOptionDefaults": true,
+	"max":                 true,
+	"pipeline":            true,
+	"size":                true,
+	"storageEngine":       true,
+	"temp":                true,
+	"validationAction":    true,
+	"validationLevel":     true,
+	"validator":           true,
+	"viewOn":              true,
+}
+
+// createCollectionOptions returns the collection options among the fields of a
+// create command.
+func createCollectionOptions(fields bson.D) bson.D {
+	var options bson.D
+	for _, kv := range fields {
+		if createOptions[kv.Name] {
+			options = append(options, kv)
+		}
+	}
+	return options
+}
+
+func (b *MemoryBackend) handleDBCommand(c net.Conn, dbname string, db DB, query *OpQueryMsg) error {
 	switch cmd, arg := query.Command(); cmd {
-	case "getLastError":
-		fallthrough
-	case "getlasterror":
-		return respDoc(c, query.RequestID, db.LastError())
-	case "getnonce":
-		nonce := make([]byte, 32)
-		_, err := rand.Reader.Read(nonce[:])
+	case "insert", "update", "delete":
+		reply, err := b.withWriteConcern(query, func() (bson.D, error) {
+			return b.writeCommand(db, query)
+		})
 		if err != nil {
-			return err
+			return respError(c, query.RequestID, err)
 		}
-		return respDoc(c, query.RequestID, markOk(bson.D{
-			{"nonce", hex.EncodeToString(nonce)},
-		}))
-	case "authenticate":
-		// It's a test database, let everyone in.
-		return respDoc(c, query.RequestID, markOk(nil))
+		return respDoc(c, query.RequestID, reply)
+	case "createIndexes":
+		reply, err := b.createIndexes(db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "listIndexes":
+		cname, ok := arg.(string)
+		if !ok || cname == "" {
+			return respError(c, query.RequestID, errorf(ErrBadValue, "malformed listIndexes command: %v", query.Doc))
+		}
+		if !hasCollection(db, cname) {
+			return respError(c, query.RequestID, errorf(ErrNamespaceNotFound, "ns does not exist: %s.%s", dbname, cname))
+		}
+		var batch []interface{}
+		for _, spec := range db.C(cname).Indexes() {
+			batch = append(batch, indexInfo(dbname+"."+cname, spec))
+		}
+		return respDoc(c, query.RequestID, cursorReply(dbname+".$cmd.listIndexes."+cname, 0, batch))
+	case "dropIndexes", "deleteIndexes":
+		reply, err := b.dropIndexes(db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "listCollections":
+		reply, err := b.listCollections(dbname, db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "create":
+		cname, ok := arg.(string)
+		if !ok || cname == "" {
+			return respError(c, query.RequestID, fmt.Errorf("malformed create command: %q", query.Doc))
+		}
+		_, err := db.Create(cname, createCollectionOptions(query.Doc[1:]))
+		return respDoc(c, query.RequestID, errReply(err))
 	case "count":
 		cname, ok := arg.(string)
 		if !ok {
 			return respError(c, query.RequestID, fmt.Errorf("malformed count command: %q", query.Doc))
 		}
-		coll := db.C(cname)
-		var matchM bson.M
-		if q, ok := query.Get("query"); ok {
-			matchM, err = asBsonM(q)
-			if err != nil {
-				return respError(c, query.RequestID, err)
-			}
+		q, err := countQuery(query.Doc)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		result, err := db.C(cname).Find(q)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, markOk(bson.D{{"n", len(result.Docs)}}))
+	case "find":
+		reply, err := b.find(dbname, db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "aggregate":
+		reply, err := b.aggregate(dbname, db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "drop":
+		cname, ok := arg.(string)
+		if !ok || cname == "" {
+			return respError(c, query.RequestID, errorf(ErrBadValue, "malformed drop command: %v", query.Doc))
+		}
+		var nIndexes int
+		if hasCollection(db, cname) {
+			nIndexes = len(db.C(cname).Indexes())
+		}
+		if err := db.Drop(cname); err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, markOk(bson.D{
+			{"ns", dbname + "." + cname},
+			{"nIndexesWas", nIndexes},
+		}))
+	case "explain":
+		reply, err := b.explain(dbname, db, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
 		}
-		return respDoc(c, query.RequestID, markOk(bson.D{{"n", len(coll.Match(matchM))}}))
+		return respDoc(c, query.RequestID, reply)
+	case "shutdown", "currentOp", "killOp":
+		return respError(c, query.RequestID, errorf(ErrUnauthorized, "%s may only be run against the admin database.", cmd))
 	}
 	return respError(c, query.RequestID, fmt.Errorf("unsupported db command: %v", query))
 }
 
+// defaultShutdownTimeout is how long shutdown gives requests in progress to
+// finish, unless given timeoutSecs.
+const defaultShutdownTimeout = 10 * time.Second
+
+// shutdown shuts down the server the client is connected to. Unless forced,
+// requests in progress have until timeoutSecs to finish, and the server
+// accepts no new requests meanwhile. As with mongod, the client gets no
+// reply, as its connection is closed.
+func (b *MemoryBackend) shutdown(c net.Conn, query *OpQueryMsg) error {
+	var force bool
+	if v, ok := query.Get("force"); ok {
+		force = asBool(v)
+	}
+	timeout := defaultShutdownTimeout
+	if v, ok := query.Get("timeoutSecs"); ok {
+		secs, ok := asInt64(v)
+		if !ok || secs < 0 {
+			return respError(c, query.RequestID, errorf(ErrBadValue, "timeoutSecs must be a non-negative integer, not %s", formatValue(v)))
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	log.Printf("shutdown requested force=%t timeoutSecs=%d", force, timeout/time.Second)
+	if s := contextOf(c).server; s != nil {
+		s.shutdown(force, timeout)
+		return nil
+	}
+	b.t.Kill(nil)
+	return c.Close()
+}
+
+// find runs a find command, returning all of the results in the first
+// batch.
+func (b *MemoryBackend) find(dbname string, db DB, query *OpQueryMsg) (bson.D, error) {
+	_, arg := query.Command()
+	cname, ok := arg.(string)
+	if !ok || cname == "" {
+		return nil, errorf(ErrBadValue, "malformed find command: %v", query.Doc)
+	}
+	q, err := findQuery(query.Doc)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.C(cname).Find(q)
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(dbname+"."+cname, 0, result.Docs), nil
+}
+
+// aggregate runs an aggregate command on a collection, or opens a change
+// stream on a collection or database.
+func (b *MemoryBackend) aggregate(dbname string, db DB, query *OpQueryMsg) (bson.D, error) {
+	_, arg := query.Command()
+	pipeline, _ := query.Get("pipeline")
+	v, ok := pipeline.([]interface{})
+	if !ok {
+		return nil, errorf(ErrBadValue, "'pipeline' option must be specified as an array")
+	}
+	stages, err := pipelineStages(v)
+	if err != nil {
+		return nil, err
+	}
+	cname, _ := arg.(string)
+	if isChangeStream(stages) {
+		return b.changeStream(dbname, cname, stages, query)
+	}
+	if cname == "" {
+		return nil, errorf(ErrBadValue, "malformed aggregate command: %v", query.Doc)
+	}
+	docs, err := aggregate(db.C(cname), v)
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(dbname+"."+cname, 0, docs), nil
+}
+
+// renameCollection renames a collection within a database.
+func (b *MemoryBackend) renameCollection(query *OpQueryMsg) error {
+	_, arg := query.Command()
+	from, _ := arg.(string)
+	v, _ := query.Get("to")
+	to, _ := v.(string)
+	fromDB, fromColl := splitNamespace(from)
+	toDB, toColl := splitNamespace(to)
+	switch {
+	case fromColl == "" || toColl == "":
+		return errorf(ErrInvalidNamespace, "Invalid namespace specified: %q to %q", from, to)
+	case fromDB != toDB:
+		return errorf(ErrCommandNotSupported, "renaming a collection across databases is not supported")
+	case from == to:
+		return errorf(ErrIllegalOperation, "Can't rename a collection to itself")
+	}
+	dropTarget, _ := query.Get("dropTarget")
+	return b.DB(fromDB).Rename(fromColl, toColl, asBool(dropTarget))
+}
+
+// explain runs the command given to an explain command, and describes
+// how it was executed. Only find and count can be explained.
+func (b *MemoryBackend) explain(dbname string, db DB, query *OpQueryMsg) (bson.D, error) {
+	_, arg := query.Command()
+	cmd := asDoc(arg)
+	if len(cmd) == 0 {
+		return nil, errorf(ErrBadValue, "explain command requires a nested object")
+	}
+	verbosity := "allPlansExecution"
+	if v, ok := query.Get("verbosity"); ok {
+		verbosity, _ = v.(string)
+	}
+	cname, ok := cmd[0].Value.(string)
+	if !ok || cname == "" {
+		return nil, errorf(ErrBadValue, "malformed %s command: %v", cmd[0].Name, cmd)
+	}
+	var q *Query
+	var err error
+	switch cmd[0].Name {
+	case "find":
+		q, err = findQuery(cmd)
+	case "count":
+		q, err = countQuery(cmd)
+	default:
+		return nil, errorf(ErrCommandNotFound, "Explain failed due to unknown command: %s", cmd[0].Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.C(cname).Find(q)
+	if err != nil {
+		return nil, err
+	}
+	return markOk(explainReply(dbname+"."+cname, q, result, verbosity)), nil
+}
+
+func (b *MemoryBackend) listDatabases(query *OpQueryMsg) (bson.D, error) {
+	var filter bson.M
+	if v, ok := query.Get("filter"); ok {
+		var err error
+		filter, err = asBsonM(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var nameOnly bool
+	if v, ok := query.Get("nameOnly"); ok {
+		nameOnly = asBool(v)
+	}
+
+	dbinfos := []bson.D{}
+	var totalSize int64
+	for _, dbname := range b.DBNames() {
+		var dbinfo bson.D
+		var size int64
+		if nameOnly {
+			dbinfo = bson.D{{"name", dbname}}
+		} else {
+			db := b.DB(dbname)
+			size = db.Size()
+			dbinfo = bson.D{
+				{"name", dbname},
+				{"sizeOnDisk", size},
+				{"empty", db.Empty()},
+			}
+		}
+		if filter != nil && !isPatternMatch(dbinfo.Map(), filter) {
+			continue
+		}
+		dbinfos = append(dbinfos, dbinfo)
+		totalSize += size
+	}
+	if nameOnly {
+		return markOk(bson.D{{"databases", dbinfos}}), nil
+	}
+	return markOk(bson.D{
+		{"databases", dbinfos},
+		{"totalSize", totalSize},
+	}), nil
+}
+
 func (b *MemoryBackend) handleAdminCommand(c net.Conn, query *OpQueryMsg) error {
 	switch cmd, arg := query.Command(); cmd {
 	case "getLog":
@@ -488,35 +1464,56 @@ func (b *MemoryBackend) handleAdminCommand(c net.Conn, query *OpQueryMsg) error
 		}
 		return respDoc(c, query.RequestID, msg)
 	case "listDatabases":
-		var dbinfos []bson.D
-		for _, dbname := range b.DBNames() {
-			dbinfos = append(dbinfos, bson.D{
-				{"name", dbname},
-				{"empty", b.DB(dbname).Empty()},
-			})
+		reply, err := b.listDatabases(query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
 		}
-		return respDoc(c, query.RequestID, markOk(bson.D{
-			{"databases", dbinfos},
-		}))
+		return respDoc(c, query.RequestID, reply)
+	case "aggregate":
+		reply, err := b.aggregate("admin", b.DB("admin"), query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "renameCollection":
+		err := b.renameCollection(query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, markOk(nil))
 	case "replSetGetStatus":
-		return respError(c, query.RequestID, fmt.Errorf("not running with --replSet"))
+		return respError(c, query.RequestID, errorf(ErrNoReplicationEnabled, "not running with --replSet"))
+	case "configureFailPoint":
+		return respDoc(c, query.RequestID, errReply(b.failPoints.configure(query)))
+	case "startSession":
+		return respDoc(c, query.RequestID, b.startSession())
+	case "endSessions":
+		return respDoc(c, query.RequestID, errReply(b.sessions.end(asArray(arg))))
+	case "refreshSessions":
+		return respDoc(c, query.RequestID, errReply(b.sessions.refresh(asArray(arg), b.Clock().Now())))
 	case "shutdown":
-		log.Println("shutdown requested")
-		b.t.Kill(nil)
-		return c.Close()
-	case "whatsmyuri":
-		return respDoc(c, query.RequestID, bson.D{{"you", c.RemoteAddr().String()}})
-	case "ismaster":
-		return respDoc(c, query.RequestID, markOk(bson.D{{"ismaster", true}}))
-	case "getnonce":
-		nonce := make([]byte, 32)
-		_, err := rand.Reader.Read(nonce[:])
+		return b.shutdown(c, query)
+	case "currentOp":
+		reply, err := b.currentOp(c, query)
 		if err != nil {
-			return err
+			return respError(c, query.RequestID, err)
 		}
-		return respDoc(c, query.RequestID, markOk(bson.D{
-			{"nonce", hex.EncodeToString(nonce)},
-		}))
+		return respDoc(c, query.RequestID, reply)
+	case "killOp":
+		reply, err := b.killOp(c, query)
+		if err != nil {
+			return respError(c, query.RequestID, err)
+		}
+		return respDoc(c, query.RequestID, reply)
+	case "whatsmyuri":
+		return respDoc(c, query.RequestID, bson.D{{"you", c.RemoteAddr().String()}})
+	case "ismaster", "isMaster", "hello":
+		return respDoc(c, query.RequestID, handshakeReply(query, markOk(bson.D{
+			{"ismaster", true},
+			{"maxBsonObjectSize", maxBsonObjectSize},
+			{"maxMessageSizeBytes", maxMessageSizeBytes},
+			{"logicalSessionTimeoutMinutes", int(SessionTimeout / time.Minute)},
+		})))
 	case "ping":
 		return respDoc(c, query.RequestID, markOk(nil))
 	}
@@ -0,0 +1,120 @@
+package gonzo
+
+import (
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// cappedLimits bounds the size of a capped collection. Once either limit
+// is exceeded, the oldest documents are removed to make room for new ones.
+type cappedLimits struct {
+	// size is the maximum total size of the documents, in bytes.
+	size int64
+
+	// max is the maximum number of documents, if not zero.
+	max int
+}
+
+// newCappedLimits returns the limits set by the options a collection was
+// created with, or nil if it is not capped.
+func newCappedLimits(options bson.D) (*cappedLimits, error) {
+	m := options.Map()
+	if !asBool(m["capped"]) {
+		return nil, nil
+	}
+	size, ok := m["size"]
+	if !ok {
+		return nil, errorf(ErrInvalidOptions, "the 'size' field is required when 'capped' is true")
+	}
+	limits := &cappedLimits{size: int64(asFloat64(size)), max: int(asFloat64(m["max"]))}
+	if typeOrder(size) != 10 || limits.size <= 0 {
+		return nil, errorf(ErrBadValue, "size must be a positive number: %s", formatValue(size))
+	}
+	if limits.max < 0 {
+		limits.max = 0
+	}
+	return limits, nil
+}
+
+// docSize returns the BSON-encoded size of a document.
+func docSize(doc interface{}) int64 {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return 0
+	}
+	return int64(len(b))
+}
+
+// Capped returns whether the collection is capped.
+func (c *MemoryCollection) Capped() bool {
+	return c.capped != nil
+}
+
+// evict removes the oldest documents from a capped collection until it is
+// within its limits, taking them from the front of the insertion order.
+// The newest document is always kept.
+func (c *MemoryCollection) evict() {
+	for len(c.docs) > 1 && (c.capped.max > 0 && len(c.docs) > c.capped.max || c.dataSize > c.capped.size) {
+		id := c.order[0]
+		c.order = c.order[1:]
+		doc, ok := c.docs[id]
+		if !ok {
+			continue
+		}
+		c.unindexDoc(id, doc)
+		c.dataSize -= docSize(doc)
+		delete(c.docs, id)
+	}
+}
+
+// Tail returns up to n documents matching filter which were inserted
+// after the record with id after, in insertion order, or all of them if n
+// is zero. It also returns the id of the last record examined, from which
+// the next call should continue. If the record after has since been
+// removed, the position is lost, and an error is returned.
+func (c *MemoryCollection) Tail(filter bson.M, after int64, n int) ([]interface{}, int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.docs[after]; after != 0 && !ok {
+		return nil, after, errorf(ErrCappedPositionLost,
+			"CollectionScan died due to position in capped collection being deleted. "+
+				"Last seen record id: RecordId(%d)", after)
+	}
+	var docs []interface{}
+	last := after
+	start := sort.Search(len(c.order), func(i int) bool { return c.order[i] > after })
+	for _, id := range c.order[start:] {
+		doc, ok := c.docs[id]
+		if !ok {
+			continue
+		}
+		if n > 0 && len(docs) == n {
+			break
+		}
+		last = id
+		if isPatternMatch(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, last, nil
+}
+
+// Notify returns a channel which is closed when a document is next
+// inserted into the collection.
+func (c *MemoryCollection) Notify() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inserted == nil {
+		c.inserted = make(chan struct{})
+	}
+	return c.inserted
+}
+
+// notifyInserted wakes those waiting for a document to be inserted.
+func (c *MemoryCollection) notifyInserted() {
+	if c.inserted != nil {
+		close(c.inserted)
+		c.inserted = nil
+	}
+}
@@ -0,0 +1,115 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+func (s *gonzoSuite) createCapped(c *gc.C, name string, maxBytes, maxDocs int) *mgo.Collection {
+	coll := s.session.DB("db1").C(name)
+	err := coll.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: maxBytes, MaxDocs: maxDocs})
+	c.Assert(err, gc.IsNil)
+	return coll
+}
+
+func (s *gonzoSuite) TestCappedEviction(c *gc.C) {
+	coll := s.createCapped(c, "log", 4096, 3)
+	for i := 0; i < 5; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i}), gc.IsNil)
+	}
+	c.Assert(findIds(c, coll.Find(nil)), gc.DeepEquals, []int{2, 3, 4})
+
+	// The oldest document left is evicted next, whichever were removed.
+	c.Assert(coll.Remove(bson.M{"_id": 3}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"_id": 5}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"_id": 6}), gc.IsNil)
+	c.Assert(findIds(c, coll.Find(nil)), gc.DeepEquals, []int{4, 5, 6})
+
+	// Documents are also removed to stay within the size limit.
+	coll = s.createCapped(c, "big", 256, 0)
+	pad := make([]byte, 100)
+	for i := 0; i < 5; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i, "pad": pad}), gc.IsNil)
+	}
+	c.Assert(findIds(c, coll.Find(nil)), gc.DeepEquals, []int{3, 4})
+
+	err := coll.Update(bson.M{"_id": 4}, bson.M{"$set": bson.M{"pad": "short"}})
+	c.Assert(err, gc.ErrorMatches, "Cannot change the size of a document in a capped collection: .*")
+
+	err = s.session.DB("db1").Run(bson.D{{"create", "nosize"}, {"capped", true}}, nil)
+	c.Assert(err, gc.ErrorMatches, "the 'size' field is required when 'capped' is true")
+}
+
+func (s *gonzoSuite) TestTailableCursor(c *gc.C) {
+	coll := s.createCapped(c, "events", 4096, 0)
+	c.Assert(coll.Insert(bson.M{"_id": 0, "kind": "a"}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"_id": 1, "kind": "b"}), gc.IsNil)
+
+	iter := coll.Find(bson.M{"kind": "a"}).Tail(5 * time.Second)
+	defer iter.Close()
+	var doc struct {
+		Id int `bson:"_id"`
+	}
+	c.Assert(iter.Next(&doc), gc.Equals, true)
+	c.Assert(doc.Id, gc.Equals, 0)
+
+	// The next getMore waits for a matching document to be inserted.
+	session := s.session.Copy()
+	defer session.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		other := session.DB("db1").C("events")
+		other.Insert(bson.M{"_id": 2, "kind": "b"})
+		other.Insert(bson.M{"_id": 3, "kind": "a"})
+	}()
+	c.Assert(iter.Next(&doc), gc.Equals, true)
+	c.Assert(doc.Id, gc.Equals, 3)
+	c.Assert(iter.Err(), gc.IsNil)
+}
+
+func (s *gonzoSuite) TestTailableCursorTimeout(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 10 * time.Millisecond
+
+	coll := s.createCapped(c, "events", 4096, 0)
+	iter := coll.Find(nil).Tail(100 * time.Millisecond)
+	var doc bson.M
+	c.Assert(iter.Next(&doc), gc.Equals, false)
+	c.Assert(iter.Timeout(), gc.Equals, true)
+	c.Assert(iter.Err(), gc.IsNil)
+
+	// Once a document arrives, the cursor continues after the timeout.
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(iter.Next(&doc), gc.Equals, true)
+	c.Assert(doc["_id"], gc.Equals, 1)
+	c.Assert(iter.Close(), gc.IsNil)
+
+	var docs []bson.M
+	err := s.session.DB("db1").C("plain").Find(nil).Tail(-1).All(&docs)
+	c.Assert(err, gc.ErrorMatches, ".*tailable cursor requested on non capped collection")
+}
+
+func (s *gonzoSuite) TestCursorBatches(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	for i := 0; i < 250; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i}), gc.IsNil)
+	}
+
+	ids := findIds(c, coll.Find(nil).Sort("-_id"))
+	c.Assert(ids, gc.HasLen, 250)
+	c.Assert(ids[0], gc.Equals, 249)
+	c.Assert(ids[249], gc.Equals, 0)
+
+	c.Assert(findIds(c, coll.Find(nil).Batch(7).Skip(240)), gc.DeepEquals,
+		[]int{240, 241, 242, 243, 244, 245, 246, 247, 248, 249})
+	c.Assert(findIds(c, coll.Find(nil).Limit(3).Batch(2)), gc.DeepEquals, []int{0, 1, 2})
+
+	n, err := coll.Find(nil).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 250)
+}
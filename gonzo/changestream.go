@@ -0,0 +1,348 @@
+package gonzo
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// changeStream turns the entries in the oplog into the change events a
+// $changeStream stage returns, for a collection, a database, or all of
+// them.
+type changeStream struct {
+	// db and coll are the database and collection watched. coll is empty
+	// when watching a database, and both are when watching the cluster.
+	db, coll string
+
+	// updateLookup is set to return the current version of the document
+	// changed by an update.
+	updateLookup bool
+
+	// stages are those following $changeStream in the pipeline, which are
+	// applied to each event.
+	stages bson.D
+
+	// resumeAfter is the resume token of the last event not to return.
+	resumeAfter string
+
+	// invalidated is set once the collection watched has been dropped or
+	// renamed, after which no further events are returned.
+	invalidated bool
+
+	lookup func(dbname, cname string, id interface{}) interface{}
+}
+
+// isChangeStream returns whether a pipeline opens a change stream.
+func isChangeStream(stages bson.D) bool {
+	return len(stages) > 0 && stages[0].Name == "$changeStream"
+}
+
+// resumeToken returns the resume token of the nth event produced from the
+// oplog entry at ts. Tokens order as their events do.
+func resumeToken(ts bson.MongoTimestamp, n int) string {
+	return fmt.Sprintf("%016X%02X", uint64(ts), n)
+}
+
+// parseResumeToken returns the timestamp of the oplog entry a resume token
+// was produced from.
+func parseResumeToken(v interface{}) (string, bson.MongoTimestamp, error) {
+	doc, _ := asBsonM(v)
+	data, _ := doc["_data"].(string)
+	if len(data) != 18 {
+		return "", 0, errorf(ErrBadValue, "invalid resume token: %s", formatValue(v))
+	}
+	ts, err := strconv.ParseUint(data[:16], 16, 64)
+	if err != nil {
+		return "", 0, errorf(ErrBadValue, "invalid resume token: %s", formatValue(v))
+	}
+	return data, bson.MongoTimestamp(ts), nil
+}
+
+// newChangeStream returns a change stream on a collection, or on a
+// database if cname is empty, and the filter selecting the oplog entries
+// to read it from.
+func (b *MemoryBackend) newChangeStream(dbname, cname string, stages bson.D) (*changeStream, bson.M, error) {
+	cs := &changeStream{db: dbname, coll: cname, lookup: b.lookupDoc}
+	after := bson.M{"$gt": b.oplog.timestamp()}
+	var resume, startAt interface{}
+	var allChanges bool
+	for _, kv := range asDoc(stages[0].Value) {
+		switch kv.Name {
+		case "fullDocument":
+			switch kv.Value {
+			case "default":
+			case "updateLookup":
+				cs.updateLookup = true
+			default:
+				return nil, nil, errorf(ErrBadValue,
+					"unrecognized value for the 'fullDocument' option to the $changeStream stage. "+
+						"Expected \"default\" or \"updateLookup\", got %s", formatValue(kv.Value))
+			}
+		case "resumeAfter":
+			resume = kv.Value
+		case "startAtOperationTime":
+			startAt = kv.Value
+		case "allChangesForCluster":
+			allChanges = asBool(kv.Value)
+		default:
+			return nil, nil, errorf(ErrBadValue, "unrecognized option to $changeStream: %s", kv.Name)
+		}
+	}
+
+	switch {
+	case allChanges && (dbname != "admin" || cname != ""):
+		return nil, nil, errorf(ErrBadValue,
+			"A $changeStream with 'allChangesForCluster:true' may only be opened on the 'admin' database, "+
+				"and with no collection name")
+	case allChanges:
+		cs.db = ""
+	case dbname == "admin" || dbname == "config" || dbname == "local":
+		return nil, nil, errorf(ErrInvalidNamespace, "$changeStream may not be opened on the internal %s database", dbname)
+	case strings.HasPrefix(cname, "system."):
+		return nil, nil, errorf(ErrInvalidNamespace, "$changeStream may not be opened on the internal %s.%s collection",
+			dbname, cname)
+	}
+
+	for _, stage := range stages[1:] {
+		if stage.Name != "$match" && stage.Name != "$project" {
+			return nil, nil, errorf(ErrIllegalOperation, "%s is not permitted in a $changeStream pipeline", stage.Name)
+		}
+	}
+	cs.stages = stages[1:]
+
+	switch {
+	case resume != nil && startAt != nil:
+		return nil, nil, errorf(ErrMultipleResumeOptions, "Only one type of resume option is allowed, but multiple were found.")
+	case resume != nil:
+		token, ts, err := parseResumeToken(resume)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := b.oplog.check(ts, token); err != nil {
+			return nil, nil, err
+		}
+		cs.resumeAfter = token
+		after = bson.M{"$gte": ts}
+	case startAt != nil:
+		ts, ok := startAt.(bson.MongoTimestamp)
+		if !ok {
+			return nil, nil, errorf(ErrBadValue, "startAtOperationTime must be a timestamp: %s", formatValue(startAt))
+		}
+		after = bson.M{"$gte": ts}
+	}
+	return cs, bson.M{"ts": after}, nil
+}
+
+// timestamp returns the timestamp of the last entry appended to the oplog.
+func (o *oplog) timestamp() bson.MongoTimestamp {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.last
+}
+
+// check checks that the entry a resume token was produced from is still
+// in the oplog.
+func (o *oplog) check(ts bson.MongoTimestamp, token string) error {
+	if first, _, _ := o.coll.Tail(nil, 0, 1); len(first) == 0 || first[0].(bson.M)["ts"].(bson.MongoTimestamp) > ts {
+		return errorf(ErrChangeStreamHistoryLost,
+			"Resume of change stream was not possible, as the resume point may no longer be in the oplog.")
+	}
+	if len(o.coll.Match(bson.M{"ts": ts})) == 0 {
+		return errorf(ErrResumeTokenNotFound,
+			"resume of change stream was not possible, as the resume token was not found. {_data: %q}", token)
+	}
+	return nil
+}
+
+// lookupDoc returns the current version of a document, or nil if it no
+// longer exists.
+func (b *MemoryBackend) lookupDoc(dbname, cname string, id interface{}) interface{} {
+	b.mu.Lock()
+	db, ok := b.dbs[dbname]
+	b.mu.Unlock()
+	if !ok || !hasCollection(db, cname) {
+		return nil
+	}
+	result, err := db.C(cname).Find(&Query{Filter: bson.M{"_id": id}})
+	if err != nil || len(result.Docs) == 0 {
+		return nil
+	}
+	return copyDoc(result.Docs[0].(bson.M))
+}
+
+// watches returns whether the stream returns events for a collection.
+func (cs *changeStream) watches(dbname, cname string) bool {
+	switch {
+	case strings.HasPrefix(cname, "system."):
+		return false
+	case cs.db == "":
+		return dbname != "admin" && dbname != "config" && dbname != "local"
+	case cs.coll == "":
+		return dbname == cs.db
+	}
+	return dbname == cs.db && cname == cs.coll
+}
+
+// events returns the change events for oplog entries, after applying the
+// rest of the pipeline to them.
+func (cs *changeStream) events(entries []interface{}) ([]interface{}, error) {
+	var result []interface{}
+	for _, entry := range entries {
+		for _, event := range cs.entryEvents(entry.(bson.M)) {
+			id := event["_id"]
+			if token := id.(bson.M)["_data"].(string); token <= cs.resumeAfter {
+				continue
+			}
+			docs, err := runStages([]interface{}{event}, cs.stages)
+			if err != nil {
+				return nil, err
+			}
+			for _, doc := range docs {
+				if compareValues(doc.(bson.M)["_id"], id) != 0 {
+					return nil, errorf(ErrChangeStreamFatalError,
+						"Encountered an event whose _id field, which contains the resume token, was modified by the pipeline. "+
+							"Modifying the _id field of an event makes it impossible to resume the stream from that point. "+
+							"Only transformations that retain the unmodified _id field are allowed.")
+				}
+			}
+			result = append(result, docs...)
+		}
+		if cs.invalidated {
+			break
+		}
+	}
+	return result, nil
+}
+
+// entryEvents returns the change events for an oplog entry, if it changes
+// a collection the stream watches. A collection being dropped or renamed
+// invalidates a stream on it.
+func (cs *changeStream) entryEvents(entry bson.M) []bson.M {
+	ts, _ := entry["ts"].(bson.MongoTimestamp)
+	op, _ := entry["op"].(string)
+	ns, _ := entry["ns"].(string)
+	o, _ := entry["o"].(bson.M)
+	o2, _ := entry["o2"].(bson.M)
+	dbname, cname := splitNamespace(ns)
+	event := func(opType, cname string) bson.M {
+		return bson.M{
+			"_id":           bson.M{"_data": resumeToken(ts, 0)},
+			"operationType": opType,
+			"clusterTime":   ts,
+			"ns":            bson.M{"db": dbname, "coll": cname},
+		}
+	}
+
+	var ev bson.M
+	switch op {
+	case "i", "u", "d":
+		if !cs.watches(dbname, cname) {
+			return nil
+		}
+		switch {
+		case op == "i":
+			ev = event("insert", cname)
+			ev["fullDocument"] = copyDoc(o)
+			ev["documentKey"] = bson.M{"_id": o["_id"]}
+		case op == "u" && isOperatorUpdate(o):
+			ev = event("update", cname)
+			ev["documentKey"] = copyDoc(o2)
+			set, _ := o["$set"].(bson.M)
+			unset, _ := o["$unset"].(bson.M)
+			removed := []string{}
+			for k := range unset {
+				removed = append(removed, k)
+			}
+			sort.Strings(removed)
+			if set == nil {
+				set = bson.M{}
+			}
+			ev["updateDescription"] = bson.M{"updatedFields": copyDoc(set), "removedFields": removed}
+			if cs.updateLookup {
+				ev["fullDocument"] = cs.lookup(dbname, cname, o2["_id"])
+			}
+		case op == "u":
+			ev = event("replace", cname)
+			ev["fullDocument"] = copyDoc(o)
+			ev["documentKey"] = copyDoc(o2)
+		default:
+			ev = event("delete", cname)
+			ev["documentKey"] = copyDoc(o)
+		}
+		return []bson.M{ev}
+	case "c":
+		if dropped, ok := o["drop"].(string); ok {
+			if !cs.watches(dbname, dropped) {
+				return nil
+			}
+			ev = event("drop", dropped)
+		} else if from, ok := o["renameCollection"].(string); ok {
+			fromDB, fromColl := splitNamespace(from)
+			if !cs.watches(fromDB, fromColl) {
+				return nil
+			}
+			toDB, toColl := splitNamespace(o["to"].(string))
+			ev = event("rename", fromColl)
+			ev["to"] = bson.M{"db": toDB, "coll": toColl}
+		} else {
+			return nil
+		}
+		if cs.coll == "" {
+			return []bson.M{ev}
+		}
+		cs.invalidated = true
+		return []bson.M{ev, {
+			"_id":           bson.M{"_data": resumeToken(ts, 1)},
+			"operationType": "invalidate",
+			"clusterTime":   ts,
+		}}
+	}
+	return nil
+}
+
+// splitNamespace returns the database and collection names of a
+// namespace.
+func splitNamespace(ns string) (string, string) {
+	fields := strings.SplitN(ns, ".", 2)
+	if len(fields) < 2 {
+		return fields[0], ""
+	}
+	return fields[0], fields[1]
+}
+
+// changeStream opens a change stream, returning the first batch of events
+// and a cursor for OP_GET_MORE to wait for more with.
+func (b *MemoryBackend) changeStream(dbname, cname string, stages bson.D, query *OpQueryMsg) (bson.D, error) {
+	cs, filter, err := b.newChangeStream(dbname, cname, stages)
+	if err != nil {
+		return nil, err
+	}
+	ns := dbname + "." + cname
+	if cname == "" {
+		ns = dbname + ".$cmd.aggregate"
+	}
+	var batchSize int
+	if v, ok := query.Get("cursor"); ok {
+		batchSize = int(asFloat64(asDoc(v).Map()["batchSize"]))
+	}
+	cur := &cursor{
+		ns:        ns,
+		coll:      b.oplog.coll,
+		tailable:  true,
+		awaitData: true,
+		filter:    filter,
+		stream:    cs,
+	}
+	docs, err := b.tail(cur, batchSize, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	var cursorID int64
+	if !cur.exhausted() {
+		cursorID = b.cursors.add(cur)
+	}
+	return cursorReply(ns, cursorID, docs), nil
+}
@@ -0,0 +1,205 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type changeEvent struct {
+	Id                bson.M              `bson:"_id"`
+	OperationType     string              `bson:"operationType"`
+	ClusterTime       bson.MongoTimestamp `bson:"clusterTime"`
+	NS                struct{ DB, Coll string }
+	To                struct{ DB, Coll string }
+	DocumentKey       bson.M `bson:"documentKey"`
+	FullDocument      bson.M `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// nextEvent returns the next event from a change stream, failing if none
+// arrives in time.
+func nextEvent(c *gc.C, iter *mgo.Iter) changeEvent {
+	events := make(chan changeEvent, 1)
+	go func() {
+		var event changeEvent
+		if iter.Next(&event) {
+			events <- event
+		}
+		close(events)
+	}()
+	select {
+	case event, ok := <-events:
+		c.Assert(ok, gc.Equals, true, gc.Commentf("%v", iter.Err()))
+		return event
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for change event")
+	}
+	panic("unreachable")
+}
+
+// watch opens a change stream on a database, or the cluster from admin.
+func (s *gonzoSuite) watch(c *gc.C, dbname string, stage bson.M) *mgo.Iter {
+	var result struct {
+		Cursor struct {
+			Id         int64
+			NS         string
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+		}
+	}
+	err := s.session.DB(dbname).Run(bson.D{
+		{"aggregate", 1},
+		{"pipeline", []bson.M{{"$changeStream": stage}}},
+		{"cursor", bson.M{}},
+	}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Cursor.NS, gc.Equals, dbname+".$cmd.aggregate")
+	return s.session.DB(dbname).C("$cmd.aggregate").NewIter(nil, result.Cursor.FirstBatch, result.Cursor.Id, nil)
+}
+
+func (s *gonzoSuite) TestChangeStream(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 0}), gc.IsNil)
+
+	iter := coll.Pipe([]bson.M{{"$changeStream": bson.M{"fullDocument": "updateLookup"}}}).Iter()
+	defer iter.Close()
+	c.Assert(coll.Insert(bson.M{"_id": 1, "a": 1, "b": 1}), gc.IsNil)
+	c.Assert(s.session.DB("db1").C("c2").Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(coll.Update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"a": 2}}), gc.IsNil)
+
+	event := nextEvent(c, iter)
+	c.Assert(event.OperationType, gc.Equals, "insert")
+	c.Assert(event.NS.DB, gc.Equals, "db1")
+	c.Assert(event.NS.Coll, gc.Equals, "c1")
+	c.Assert(event.DocumentKey, gc.DeepEquals, bson.M{"_id": 1})
+	c.Assert(event.FullDocument, gc.DeepEquals, bson.M{"_id": 1, "a": 1, "b": 1})
+	c.Assert(event.Id["_data"], gc.FitsTypeOf, "")
+
+	event = nextEvent(c, iter)
+	c.Assert(event.OperationType, gc.Equals, "update")
+	c.Assert(event.UpdateDescription.UpdatedFields, gc.DeepEquals, bson.M{"a": 2})
+	c.Assert(event.UpdateDescription.RemovedFields, gc.HasLen, 0)
+	c.Assert(event.FullDocument, gc.DeepEquals, bson.M{"_id": 1, "a": 2, "b": 1})
+	updated := event.Id
+
+	c.Assert(coll.Update(bson.M{"_id": 1}, bson.M{"c": 3}), gc.IsNil)
+	c.Assert(coll.Remove(bson.M{"_id": 1}), gc.IsNil)
+
+	event = nextEvent(c, iter)
+	c.Assert(event.OperationType, gc.Equals, "replace")
+	c.Assert(event.FullDocument, gc.DeepEquals, bson.M{"_id": 1, "c": 3})
+	event = nextEvent(c, iter)
+	c.Assert(event.OperationType, gc.Equals, "delete")
+	c.Assert(event.DocumentKey, gc.DeepEquals, bson.M{"_id": 1})
+	c.Assert(event.FullDocument, gc.IsNil)
+
+	// Events arriving while waiting are returned.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		coll.Insert(bson.M{"_id": 2})
+	}()
+	event = nextEvent(c, iter)
+	c.Assert(event.OperationType, gc.Equals, "insert")
+	c.Assert(event.DocumentKey, gc.DeepEquals, bson.M{"_id": 2})
+
+	// Resuming after the update returns the events which followed it.
+	resumed := coll.Pipe([]bson.M{
+		{"$changeStream": bson.M{"resumeAfter": updated}},
+		{"$match": bson.M{"operationType": bson.M{"$ne": "replace"}}},
+	}).Iter()
+	defer resumed.Close()
+	c.Assert(nextEvent(c, resumed).OperationType, gc.Equals, "delete")
+	c.Assert(nextEvent(c, resumed).OperationType, gc.Equals, "insert")
+}
+
+func (s *gonzoSuite) TestChangeStreamInvalidate(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	renamed := coll.Pipe([]bson.M{{"$changeStream": bson.M{}}}).Iter()
+	defer renamed.Close()
+	dbIter := s.watch(c, "db1", bson.M{})
+	defer dbIter.Close()
+
+	err := s.session.Run(bson.D{{"renameCollection", "db1.c1"}, {"to", "db1.c2"}}, nil)
+	c.Assert(err, gc.IsNil)
+	event := nextEvent(c, renamed)
+	c.Assert(event.OperationType, gc.Equals, "rename")
+	c.Assert(event.NS.Coll, gc.Equals, "c1")
+	c.Assert(event.To.Coll, gc.Equals, "c2")
+	c.Assert(nextEvent(c, renamed).OperationType, gc.Equals, "invalidate")
+	var doc bson.M
+	c.Assert(renamed.Next(&doc), gc.Equals, false)
+	c.Assert(renamed.Err(), gc.IsNil)
+
+	dropped := s.session.DB("db1").C("c2").Pipe([]bson.M{{"$changeStream": bson.M{}}}).Iter()
+	defer dropped.Close()
+	c.Assert(s.session.DB("db1").C("c2").DropCollection(), gc.IsNil)
+	event = nextEvent(c, dropped)
+	c.Assert(event.OperationType, gc.Equals, "drop")
+	c.Assert(event.NS.Coll, gc.Equals, "c2")
+	c.Assert(nextEvent(c, dropped).OperationType, gc.Equals, "invalidate")
+
+	// Database streams see the same events, and carry on.
+	c.Assert(nextEvent(c, dbIter).OperationType, gc.Equals, "rename")
+	c.Assert(nextEvent(c, dbIter).OperationType, gc.Equals, "drop")
+	c.Assert(s.session.DB("db1").C("c3").Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(s.session.DB("db2").C("c3").Insert(bson.M{"_id": 2}), gc.IsNil)
+	event = nextEvent(c, dbIter)
+	c.Assert(event.OperationType, gc.Equals, "insert")
+	c.Assert(event.NS.Coll, gc.Equals, "c3")
+	c.Assert(event.DocumentKey, gc.DeepEquals, bson.M{"_id": 1})
+
+	// Renaming over a collection drops it first.
+	target := s.session.DB("db1").C("c4")
+	c.Assert(target.Insert(bson.M{"_id": 9}), gc.IsNil)
+	replaced := target.Pipe([]bson.M{{"$changeStream": bson.M{}}}).Iter()
+	defer replaced.Close()
+	err = s.session.Run(bson.D{{"renameCollection", "db1.c3"}, {"to", "db1.c4"}, {"dropTarget", true}}, nil)
+	c.Assert(err, gc.IsNil)
+	event = nextEvent(c, replaced)
+	c.Assert(event.OperationType, gc.Equals, "drop")
+	c.Assert(event.NS.Coll, gc.Equals, "c4")
+	c.Assert(nextEvent(c, replaced).OperationType, gc.Equals, "invalidate")
+	var docs []bson.M
+	c.Assert(target.Find(nil).All(&docs), gc.IsNil)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"_id": 1}})
+}
+
+func (s *gonzoSuite) TestChangeStreamCluster(c *gc.C) {
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 0}), gc.IsNil)
+	var first oplogEntry
+	c.Assert(s.session.DB("local").C("oplog.rs").Find(nil).One(&first), gc.IsNil)
+
+	iter := s.watch(c, "admin", bson.M{"allChangesForCluster": true, "startAtOperationTime": first.Timestamp})
+	defer iter.Close()
+	c.Assert(s.session.DB("db2").C("c2").Insert(bson.M{"_id": 2}), gc.IsNil)
+	for _, ns := range []string{"db1.c1", "db2.c2"} {
+		event := nextEvent(c, iter)
+		c.Assert(event.OperationType, gc.Equals, "insert")
+		c.Assert(event.NS.DB+"."+event.NS.Coll, gc.Equals, ns)
+	}
+
+	var result bson.M
+	run := func(dbname string, pipeline ...bson.M) error {
+		return s.session.DB(dbname).Run(bson.D{{"aggregate", 1}, {"pipeline", pipeline}, {"cursor", bson.M{}}}, &result)
+	}
+	c.Assert(run("admin", bson.M{"$changeStream": bson.M{}}), gc.ErrorMatches,
+		"\\$changeStream may not be opened on the internal admin database")
+	c.Assert(run("db1", bson.M{"$changeStream": bson.M{"resumeAfter": bson.M{"_data": "0000000000000001" + "00"}}}),
+		gc.ErrorMatches, "Resume of change stream was not possible, .*")
+	c.Assert(run("db1", bson.M{"$changeStream": bson.M{
+		"resumeAfter": bson.M{"_data": "7FFFFFFF0000000100"}, "startAtOperationTime": first.Timestamp,
+	}}), gc.ErrorMatches, "Only one type of resume option is allowed, but multiple were found.")
+	c.Assert(run("db1", bson.M{"$changeStream": bson.M{}}, bson.M{"$limit": 1}), gc.ErrorMatches,
+		"\\$limit is not permitted in a \\$changeStream pipeline")
+	c.Assert(run("db1", bson.M{"$match": bson.M{}}, bson.M{"$changeStream": bson.M{}}), gc.ErrorMatches,
+		"malformed aggregate command: .*")
+	var docs []bson.M
+	err := s.session.DB("db1").C("c1").Pipe([]bson.M{{"$match": bson.M{}}, {"$changeStream": bson.M{}}}).All(&docs)
+	c.Assert(err, gc.ErrorMatches, "\\$changeStream is only valid as the first stage in a pipeline.")
+}
@@ -0,0 +1,318 @@
+package gonzo
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// typeOrder returns the rank of a value's type in the BSON comparison order
+// used by mongod when comparing values of different types.
+func typeOrder(v interface{}) int {
+	if v == bson.MinKey {
+		return 1
+	}
+	if v == bson.MaxKey {
+		return 100
+	}
+	if v == bson.Undefined {
+		return 5
+	}
+	switch v.(type) {
+	case nil:
+		return 5
+	case int, int32, int64, float64:
+		return 10
+	case string, bson.Symbol:
+		return 15
+	case bson.M, bson.D, map[string]interface{}:
+		return 20
+	case []interface{}:
+		return 25
+	case bson.Binary, []byte:
+		return 30
+	case bson.ObjectId:
+		return 35
+	case bool:
+		return 40
+	case time.Time:
+		return 45
+	case bson.MongoTimestamp:
+		return 47
+	case bson.RegEx:
+		return 50
+	}
+	return 60
+}
+
+// compareValues compares two BSON values, returning -1, 0 or 1 if a sorts
+// before, equal to or after b.
+func compareValues(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return compareInts(int64(ta), int64(tb))
+	}
+	switch ta {
+	case 10:
+		return compareNumbers(a, b)
+	case 15:
+		return strings.Compare(asString(a), asString(b))
+	case 20:
+		return compareDocs(asDoc(a), asDoc(b))
+	case 25:
+		aa, ba := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(aa) && i < len(ba); i++ {
+			if cmp := compareValues(aa[i], ba[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareInts(int64(len(aa)), int64(len(ba)))
+	case 30:
+		ab, bb := asBinary(a), asBinary(b)
+		if len(ab.Data) != len(bb.Data) {
+			return compareInts(int64(len(ab.Data)), int64(len(bb.Data)))
+		}
+		if ab.Kind != bb.Kind {
+			return compareInts(int64(ab.Kind), int64(bb.Kind))
+		}
+		return bytes.Compare(ab.Data, bb.Data)
+	case 35:
+		return strings.Compare(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+	case 40:
+		ab, bb := a.(bool), b.(bool)
+		if ab == bb {
+			return 0
+		} else if !ab {
+			return -1
+		}
+		return 1
+	case 45:
+		at, bt := a.(time.Time), b.(time.Time)
+		if at.Before(bt) {
+			return -1
+		} else if at.After(bt) {
+			return 1
+		}
+		return 0
+	case 47:
+		return compareInts(int64(a.(bson.MongoTimestamp)), int64(b.(bson.MongoTimestamp)))
+	case 50:
+		ar, br := a.(bson.RegEx), b.(bson.RegEx)
+		if cmp := strings.Compare(ar.Pattern, br.Pattern); cmp != 0 {
+			return cmp
+		}
+		return strings.Compare(ar.Options, br.Options)
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareNumbers(a, b interface{}) int {
+	ai, aok := asInt64(a)
+	bi, bok := asInt64(b)
+	if aok && bok {
+		return compareInts(ai, bi)
+	}
+	af, bf := asFloat64(a), asFloat64(b)
+	if af < bf {
+		return -1
+	} else if af > bf {
+		return 1
+	}
+	return 0
+}
+
+// asInt64 interprets a value as an integer, which it is if it is an int or
+// a double with no fractional part, as shells send numbers as doubles.
+func asInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func asFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func asString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bson.Symbol:
+		return string(s)
+	}
+	return ""
+}
+
+func asBinary(v interface{}) bson.Binary {
+	switch b := v.(type) {
+	case bson.Binary:
+		return b
+	case []byte:
+		return bson.Binary{Data: b}
+	}
+	return bson.Binary{}
+}
+
+// asDoc returns an embedded document as a bson.D. Documents decoded into
+// maps have lost their field order, so their fields are sorted by name.
+func asDoc(v interface{}) bson.D {
+	var m map[string]interface{}
+	switch d := v.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		m = d
+	case map[string]interface{}:
+		m = d
+	default:
+		return nil
+	}
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make(bson.D, len(names))
+	for i, name := range names {
+		result[i] = bson.DocElem{name, m[name]}
+	}
+	return result
+}
+
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if cmp := compareInts(int64(typeOrder(a[i].Value)), int64(typeOrder(b[i].Value))); cmp != 0 {
+			return cmp
+		}
+		if cmp := strings.Compare(a[i].Name, b[i].Name); cmp != 0 {
+			return cmp
+		}
+		if cmp := compareValues(a[i].Value, b[i].Value); cmp != 0 {
+			return cmp
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+// lookupPath resolves a dotted field path in a document. Path elements
+// that traverse arrays of documents collect the matching values from each
+// element into an array.
+func lookupPath(doc interface{}, path string) (interface{}, bool) {
+	name, rest := path, ""
+	if i := strings.Index(path, "."); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+	var value interface{}
+	var ok bool
+	switch d := doc.(type) {
+	case bson.M:
+		value, ok = d[name]
+	case map[string]interface{}:
+		value, ok = d[name]
+	case bson.D:
+		for _, kv := range d {
+			if kv.Name == name {
+				value, ok = kv.Value, true
+				break
+			}
+		}
+	case []interface{}:
+		if i, isIndex := parseIndex(name); isIndex {
+			if i < len(d) {
+				value, ok = d[i], true
+			}
+			break
+		}
+		var values []interface{}
+		for _, elem := range d {
+			if v, found := lookupPath(elem, name); found {
+				values = append(values, v)
+			}
+		}
+		value, ok = values, len(values) > 0
+	}
+	if !ok || rest == "" {
+		return value, ok
+	}
+	return lookupPath(value, rest)
+}
+
+// parseIndex parses a path element as a non-negative array index.
+func parseIndex(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	n := 0
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		n = n*10 + int(ch-'0')
+	}
+	return n, true
+}
+
+// copyValue returns a deep copy of a BSON value, so that stored documents
+// do not share mutable state with the documents they were derived from.
+func copyValue(v interface{}) interface{} {
+	switch d := v.(type) {
+	case bson.M:
+		return copyDoc(d)
+	case map[string]interface{}:
+		return copyDoc(bson.M(d))
+	case bson.D:
+		result := make(bson.D, len(d))
+		for i, kv := range d {
+			result[i] = bson.DocElem{kv.Name, copyValue(kv.Value)}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(d))
+		for i := range d {
+			result[i] = copyValue(d[i])
+		}
+		return result
+	}
+	return v
+}
+
+func copyDoc(doc bson.M) bson.M {
+	result := make(bson.M, len(doc))
+	for k, v := range doc {
+		result[k] = copyValue(v)
+	}
+	return result
+}
@@ -0,0 +1,287 @@
+package gonzo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// compressorNames are the compressors clients may negotiate, by the names
+// they give them in isMaster and hello.
+var compressorNames = map[string]Compressor{
+	"noop":   CompressorNoop,
+	"snappy": CompressorSnappy,
+	"zlib":   CompressorZlib,
+}
+
+// compress compresses data with a compressor.
+func compress(id Compressor, data []byte) ([]byte, error) {
+	switch id {
+	case CompressorNoop:
+		return data, nil
+	case CompressorSnappy:
+		return snappyEncode(data), nil
+	case CompressorZlib:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compressor %d", id)
+}
+
+// decompress decompresses data compressed with a compressor, which must
+// decompress to size bytes.
+func decompress(id Compressor, data []byte, size int) ([]byte, error) {
+	var out []byte
+	var err error
+	switch id {
+	case CompressorNoop:
+		out = data
+	case CompressorSnappy:
+		out, err = snappyDecode(data, size)
+	case CompressorZlib:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err == nil {
+			// Read one byte more than expected, to detect messages
+			// larger than they claim.
+			out, err = ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+			r.Close()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compressor %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("compressed message decompressed to %d bytes, not %d", len(out), size)
+	}
+	return out, nil
+}
+
+// negotiateCompression adds the compressors a client offered in isMaster or
+// hello that the server supports to its reply, in the client's order of
+// preference, as mongod does.
+func negotiateCompression(query *OpQueryMsg, reply bson.D) bson.D {
+	v, ok := query.Get("compression")
+	if !ok {
+		return reply
+	}
+	compressors := []string{}
+	for _, name := range asArray(v) {
+		if s, ok := name.(string); ok {
+			if _, ok := compressorNames[s]; ok {
+				compressors = append(compressors, s)
+			}
+		}
+	}
+	// The reply ends with ok, which is kept last.
+	n := len(reply) - 1
+	return append(reply[:n:n], bson.DocElem{"compression", compressors}, reply[n])
+}
+
+// handshakeReply returns the reply to isMaster or hello, given the reply
+// to isMaster. hello reports whether the server is primary as
+// isWritablePrimary.
+func handshakeReply(query *OpQueryMsg, reply bson.D) bson.D {
+	if cmd, _ := query.Command(); cmd == "hello" {
+		for i := range reply {
+			if reply[i].Name == "ismaster" {
+				reply[i].Name = "isWritablePrimary"
+			}
+		}
+	}
+	return negotiateCompression(query, reply)
+}
+
+// readMessage reads a message from the connection, decompressing it if it
+// was compressed. Replies to compressed messages are compressed with the
+// same compressor. When the message is refused after its header is read,
+// it is returned with the error, so that it can be replied to.
+func (ctx *connContext) readMessage() (*Header, error) {
+	h := &Header{}
+	if err := h.Read(ctx.Conn); err != nil {
+		if _, ok := err.(*Error); ok {
+			return h, err
+		}
+		return nil, err
+	}
+	ctx.compressed = false
+	if h.OpCode != OpCompressed {
+		return h, nil
+	}
+	m, err := NewOpCompressedMsg(h)
+	if err != nil {
+		return h, err
+	}
+	inner, err := m.Decompress()
+	if err != nil {
+		return h, err
+	}
+	ctx.compressed, ctx.compressor = true, m.CompressorID
+	return inner, nil
+}
+
+// writeMessage writes a message to the connection, compressed if it replies
+// to a compressed message.
+func (ctx *connContext) writeMessage(h *Header) error {
+	if !ctx.compressed {
+		return h.writeTo(ctx.Conn)
+	}
+	m, err := CompressMessage(h, ctx.compressor)
+	if err != nil {
+		return err
+	}
+	return m.Write(ctx.Conn)
+}
+
+// snappyEncode compresses data in the snappy block format, finding repeated
+// sequences of four bytes or more within the previous 64KiB.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6+1)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	var table [1 << 14]int32
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		key := binary.LittleEndian.Uint32(src[i:])
+		h := key * 0x1e35a7bd >> 18
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 0xffff || binary.LittleEndian.Uint32(src[candidate:]) != key {
+			i++
+			continue
+		}
+		dst = snappyLiteral(dst, src[lit:i])
+		n := 4
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = snappyCopy(dst, i-candidate, n)
+		i += n
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 2|63<<2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 2|59<<2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(2|(length-1)<<2), byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(1|(length-4)<<2|offset>>8<<5), byte(offset))
+}
+
+var errSnappyCorrupt = fmt.Errorf("corrupt snappy data")
+
+// snappyDecode decompresses data in the snappy block format, which must
+// decompress to size bytes.
+func snappyDecode(src []byte, size int) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n != uint64(size) {
+		return nil, errSnappyCorrupt
+	}
+	src = src[k:]
+	// Sizes are only trusted as far as the data could expand to them.
+	capacity := size
+	if limit := len(src) * 32; capacity > limit {
+		capacity = limit
+	}
+	dst := make([]byte, 0, capacity)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				nb := length - 59
+				if len(src) < nb {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for j := nb - 1; j >= 0; j-- {
+					length = length<<8 | int(src[j])
+				}
+				src = src[nb:]
+			}
+			length++
+			if length > len(src) || length > size-len(dst) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || length > size-len(dst) {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap what they copy, repeating it.
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != size {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,107 @@
+package gonzo_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+// opQuery encodes an OP_QUERY message, which mgo cannot compress.
+func opQuery(c *gc.C, requestID int32, ns string, query interface{}) *gonzo.Header {
+	doc, err := bson.Marshal(query)
+	c.Assert(err, gc.IsNil)
+	b := make([]byte, 4, 4+len(ns)+9+len(doc))
+	b = append(b, ns...)
+	b = append(b, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)
+	b = append(b, doc...)
+	return &gonzo.Header{Length: int32(16 + len(b)), RequestID: requestID, OpCode: gonzo.OpQuery, Contents: b}
+}
+
+// readReply reads an OP_REPLY, which may be compressed, returning its
+// first document.
+func readReply(c *gc.C, conn net.Conn) (*gonzo.OpCompressedMsg, bson.M) {
+	h := &gonzo.Header{}
+	c.Assert(h.Read(conn), gc.IsNil)
+	var compressed *gonzo.OpCompressedMsg
+	if h.OpCode == gonzo.OpCompressed {
+		var err error
+		compressed, err = gonzo.NewOpCompressedMsg(h)
+		c.Assert(err, gc.IsNil)
+		h, err = compressed.Decompress()
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(h.OpCode, gc.Equals, gonzo.OpReply)
+	c.Assert(binary.LittleEndian.Uint32(h.Contents[16:]), gc.Equals, uint32(1))
+	var doc bson.M
+	c.Assert(bson.Unmarshal(h.Contents[20:], &doc), gc.IsNil)
+	return compressed, doc
+}
+
+func (s *gonzoSuite) TestCompressionNegotiation(c *gc.C) {
+	var reply struct {
+		IsMaster          bool     `bson:"ismaster"`
+		IsWritablePrimary bool     `bson:"isWritablePrimary"`
+		Compression       []string `bson:"compression"`
+	}
+	c.Assert(s.session.Run(bson.D{{"isMaster", 1}, {"compression", []string{"zstd", "zlib", "snappy"}}}, &reply), gc.IsNil)
+	c.Assert(reply.IsMaster, gc.Equals, true)
+	c.Assert(reply.Compression, gc.DeepEquals, []string{"zlib", "snappy"})
+	reply.Compression = nil
+	c.Assert(s.session.Run("hello", &reply), gc.IsNil)
+	c.Assert(reply.IsWritablePrimary, gc.Equals, true)
+	c.Assert(reply.Compression, gc.IsNil)
+}
+
+func (s *gonzoSuite) TestOpCompressed(c *gc.C) {
+	conn, err := net.Dial("tcp", s.session.LiveServers()[0])
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	text := strings.Repeat("the jesus lizard ", 1000)
+	for i, compressor := range []gonzo.Compressor{gonzo.CompressorNoop, gonzo.CompressorSnappy, gonzo.CompressorZlib} {
+		insert := opQuery(c, int32(2*i+1), "db1.$cmd", bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": i, "text": text}}}})
+		m, err := gonzo.CompressMessage(insert, compressor)
+		c.Assert(err, gc.IsNil)
+		if compressor != gonzo.CompressorNoop {
+			c.Assert(len(m.CompressedMessage) < len(insert.Contents)/10, gc.Equals, true)
+		}
+		c.Assert(m.Write(conn), gc.IsNil)
+		compressed, doc := readReply(c, conn)
+		c.Assert(compressed, gc.NotNil)
+		c.Assert(compressed.CompressorID, gc.Equals, compressor)
+		c.Assert(compressed.ResponseTo, gc.Equals, int32(2*i+1))
+		c.Assert(doc["n"], gc.Equals, 1)
+
+		find := opQuery(c, int32(2*i+2), "db1.$cmd", bson.D{{"find", "c1"}, {"filter", bson.M{"_id": i}}})
+		m, err = gonzo.CompressMessage(find, compressor)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Write(conn), gc.IsNil)
+		compressed, doc = readReply(c, conn)
+		c.Assert(compressed.CompressorID, gc.Equals, compressor)
+		if compressor != gonzo.CompressorNoop {
+			c.Assert(len(compressed.CompressedMessage) < int(compressed.UncompressedSize)/10, gc.Equals, true)
+		}
+		batch := doc["cursor"].(bson.M)["firstBatch"].([]interface{})
+		c.Assert(batch, gc.HasLen, 1)
+		c.Assert(batch[0].(bson.M)["text"], gc.Equals, text)
+	}
+
+	// Replies to messages which were not compressed are not compressed.
+	c.Assert(opQuery(c, 7, "admin.$cmd", bson.M{"ping": 1}).Write(conn), gc.IsNil)
+	compressed, doc := readReply(c, conn)
+	c.Assert(compressed, gc.IsNil)
+	c.Assert(doc["ok"], gc.Equals, 1)
+
+	// Messages which cannot be decompressed are refused.
+	m, err := gonzo.CompressMessage(opQuery(c, 8, "admin.$cmd", bson.M{"ping": 1}), gonzo.CompressorSnappy)
+	c.Assert(err, gc.IsNil)
+	m.UncompressedSize++
+	c.Assert(m.Write(conn), gc.IsNil)
+	_, doc = readReply(c, conn)
+	c.Assert(doc["$err"], gc.Equals, "corrupt snappy data")
+}
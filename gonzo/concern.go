@@ -0,0 +1,275 @@
+package gonzo
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeConcern is the acknowledgement a client asks for a write with,
+// either in the writeConcern of a write command or in getLastError.
+type writeConcern struct {
+	// w is the number of members which must acknowledge the write, or
+	// "majority".
+	w        interface{}
+	j        bool
+	fsync    bool
+	wtimeout time.Duration
+}
+
+// parseWriteConcern parses the fields of a write concern. Fields which are
+// not part of write concerns are ignored, as getLastError has them next to
+// its command name.
+func parseWriteConcern(doc bson.D) (*writeConcern, error) {
+	wc := &writeConcern{w: 1}
+	for _, kv := range doc {
+		switch kv.Name {
+		case "w":
+			switch w := kv.Value.(type) {
+			case string:
+				if w != "majority" {
+					return nil, errorf(ErrUnknownReplWriteConcern, "No write concern mode named '%s' found in replica set configuration", w)
+				}
+				wc.w = w
+			default:
+				n := asFloat64(w)
+				if typeOrder(w) != 10 || n < 0 || n > 50 {
+					return nil, errorf(ErrFailedToParse, "w has to be a non-negative number and not greater than 50; found: %s", formatValue(w))
+				}
+				wc.w = int(n)
+			}
+		case "j":
+			wc.j = asBool(kv.Value)
+		case "fsync":
+			wc.fsync = asBool(kv.Value)
+		case "wtimeout":
+			if typeOrder(kv.Value) != 10 {
+				return nil, errorf(ErrFailedToParse, "wtimeout must be a number: %s", formatValue(kv.Value))
+			}
+			wc.wtimeout = time.Duration(asFloat64(kv.Value)) * time.Millisecond
+		}
+	}
+	if wc.j && wc.fsync {
+		return nil, errorf(ErrFailedToParse, "fsync and j options cannot be used together")
+	}
+	return wc, nil
+}
+
+// errWTimeout is the error for a write concern which was not satisfied
+// within its wtimeout.
+func errWTimeout() error {
+	return &Error{
+		Code:    ErrWriteConcernFailed,
+		Message: "waiting for replication timed out",
+		Info:    bson.D{{"errInfo", bson.D{{"wtimeout", true}}}},
+	}
+}
+
+// SetReplicationLag sets how long it takes members other than the primary
+// to acknowledge writes, so that write concerns with a shorter wtimeout
+// time out.
+func (rs *ReplicaSet) SetReplicationLag(lag time.Duration) {
+	rs.backend.mu.Lock()
+	rs.backend.replicationLag = lag
+	rs.backend.mu.Unlock()
+}
+
+// replicas returns the number of members of the replica set, and how many
+// of them are reachable.
+func (rs *ReplicaSet) replicas() (members, reachable int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, unreachable := range rs.unreachable {
+		if !unreachable {
+			reachable++
+		}
+	}
+	return len(rs.unreachable), reachable
+}
+
+// waitWriteConcern waits until a write has been acknowledged as a write
+// concern asks, and returns how long that took. Members other than the
+// primary acknowledge writes after the replication lag, if they are
+// reachable. If the write concern is not satisfied within its wtimeout,
+// or at all when it has none, it fails with a WriteConcernFailed error.
+func (b *MemoryBackend) waitWriteConcern(wc *writeConcern) (time.Duration, error) {
+	b.mu.Lock()
+	replicas, lag, clock := b.replicas, b.replicationLag, b.clock
+	b.mu.Unlock()
+	members, reachable := 1, 1
+	if replicas != nil {
+		members, reachable = replicas()
+	}
+	w, ok := wc.w.(int)
+	if !ok {
+		w = members/2 + 1
+	}
+	switch {
+	case w > 1 && replicas == nil:
+		return 0, errorf(ErrBadValue, "cannot use 'w' > 1 on a standalone")
+	case w > members:
+		return 0, errorf(ErrUnsatisfiableWriteConcern, "Not enough data-bearing nodes")
+	case w <= 1:
+		return 0, nil
+	}
+
+	var acknowledged, timeout <-chan time.Time
+	if w <= reachable {
+		acknowledged = clock.After(lag)
+	}
+	if wc.wtimeout > 0 {
+		timeout = clock.After(wc.wtimeout)
+	}
+	select {
+	case <-acknowledged:
+		return lag, nil
+	case <-timeout:
+		return wc.wtimeout, errWTimeout()
+	case <-b.t.Dying():
+		return 0, errorf(ErrShutdownInProgress, "Replication is being shut down")
+	}
+}
+
+// getLastError answers a getLastError command with the result of the last
+// write on a connection, once it has been acknowledged as the command asks.
+// Write concerns which time out are reported along with the result, as
+// mongod does.
+func (b *MemoryBackend) getLastError(ctx *connContext, query *OpQueryMsg) (bson.D, error) {
+	ctx.lastError.disable()
+	wc, err := parseWriteConcern(query.Doc)
+	if err != nil {
+		return nil, err
+	}
+	last := ctx.lastError.last()
+	data, err := bson.Marshal(last)
+	if err != nil {
+		return nil, err
+	}
+	var result bson.D
+	if err := bson.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	reply := append(bson.D{{"connectionId", ctx.id}}, result...)
+	if last.Err != nil {
+		return markOk(reply), nil
+	}
+	waited, err := b.waitWriteConcern(wc)
+	if err, ok := err.(*Error); ok && err.Code == ErrWriteConcernFailed {
+		reply = setField(reply, "err", "timeout")
+		reply = append(reply,
+			bson.DocElem{"wtimeout", true},
+			bson.DocElem{"waited", int(waited / time.Millisecond)},
+			bson.DocElem{"errmsg", "timed out waiting for slaves"},
+			bson.DocElem{"code", err.Code},
+			bson.DocElem{"codeName", err.CodeName()},
+		)
+		return markOk(reply), nil
+	} else if err != nil {
+		return nil, err
+	}
+	reply = setField(reply, "err", nil)
+	if wc.w != 1 {
+		reply = append(reply, bson.DocElem{"waited", int(waited / time.Millisecond)})
+	}
+	return markOk(reply), nil
+}
+
+// setField sets a field of a document, appending it if it is not already
+// there.
+func setField(doc bson.D, name string, v interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = v
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{name, v})
+}
+
+// withWriteConcern runs a write command, then waits for the write concern
+// it asks for. Write concerns which are not satisfied are reported in a
+// writeConcernError, as the write has been applied regardless. The
+// failCommand fail point may also report a writeConcernError.
+func (b *MemoryBackend) withWriteConcern(query *OpQueryMsg, run func() (bson.D, error)) (bson.D, error) {
+	var wc *writeConcern
+	if v, ok := query.Get("writeConcern"); ok {
+		var err error
+		if wc, err = parseWriteConcern(asDoc(v)); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := run()
+	if err != nil {
+		return nil, err
+	}
+	var wcErr error
+	if wc != nil {
+		_, wcErr = b.waitWriteConcern(wc)
+	}
+	cmd, _ := query.Command()
+	if data, ok := b.failPoints.failCommand(cmd, true); ok {
+		wcErr = failCommandError(data["writeConcernError"])
+	}
+	if wcErr == nil {
+		return reply, nil
+	}
+	doc := errReply(wcErr)
+	doc = doc[:len(doc)-1]
+	ok := reply[len(reply)-1]
+	reply = append(reply[:len(reply)-1], bson.DocElem{"writeConcernError", doc})
+	return append(reply, ok), nil
+}
+
+// readConcernLevels are the read concern levels mongod accepts.
+var readConcernLevels = map[string]bool{
+	"local":        true,
+	"available":    true,
+	"majority":     true,
+	"linearizable": true,
+	"snapshot":     true,
+}
+
+// readConcernCommands are the commands which accept a read concern outside
+// transactions.
+var readConcernCommands = map[string]bool{
+	"aggregate": true,
+	"count":     true,
+	"distinct":  true,
+	"find":      true,
+	"geoNear":   true,
+}
+
+// checkReadConcern checks the readConcern of a command, if any. All reads
+// see the latest writes, which satisfies every level, but levels are
+// checked as mongod checks them: linearizable reads need a replica set,
+// and snapshot reads a transaction.
+func (b *MemoryBackend) checkReadConcern(query *OpQueryMsg) error {
+	v, ok := query.Get("readConcern")
+	if !ok {
+		return nil
+	}
+	_, inTxn := query.Get("autocommit")
+	cmd, _ := query.Command()
+	if !inTxn && !readConcernCommands[cmd] {
+		return errorf(ErrInvalidOptions, "Command does not support read concern")
+	}
+	rc := asDoc(v).Map()
+	level, ok := rc["level"]
+	if !ok {
+		return nil
+	}
+	s, _ := level.(string)
+	if !readConcernLevels[s] {
+		return errorf(ErrFailedToParse, "readConcern.level must be either 'local', 'majority', 'linearizable', 'available', or 'snapshot'")
+	}
+	b.mu.Lock()
+	replicas := b.replicas
+	b.mu.Unlock()
+	switch {
+	case s == "linearizable" && replicas == nil:
+		return errorf(ErrNotAReplicaSet, "node needs to be a replica set member to use read concern")
+	case s == "snapshot" && !inTxn:
+		return errorf(ErrInvalidOptions, "read concern level snapshot is only valid in a transaction")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type lastError struct {
+	N        int         `bson:"n"`
+	Err      interface{} `bson:"err"`
+	Code     int         `bson:"code"`
+	WTimeout bool        `bson:"wtimeout"`
+	Ok       int         `bson:"ok"`
+}
+
+type writeConcernReply struct {
+	N                 int    `bson:"n"`
+	WriteConcernError bson.M `bson:"writeConcernError"`
+}
+
+func (s *gonzoSuite) TestGetLastError(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	var result lastError
+	c.Assert(s.session.DB("db1").Run(bson.D{{"getLastError", 1}, {"w", 1}, {"j", true}}, &result), gc.IsNil)
+	c.Assert(result, gc.DeepEquals, lastError{Ok: 1})
+
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.NotNil)
+	result = lastError{}
+	c.Assert(s.session.DB("db1").Run("getLastError", &result), gc.IsNil)
+	c.Assert(result.Err, gc.Matches, "E11000 duplicate key error .*")
+	c.Assert(result.Code, gc.Equals, 11000)
+	c.Assert(result.Ok, gc.Equals, 1)
+
+	// Write concerns are checked as mongod checks them.
+	c.Assert(coll.Insert(bson.M{"_id": 2}), gc.IsNil)
+	err := s.session.DB("db1").Run(bson.D{{"getLastError", 1}, {"w", 2}}, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot use 'w' > 1 on a standalone")
+	c.Assert(errorCode(err), gc.Equals, 2)
+	err = s.session.DB("db1").Run(bson.D{{"getLastError", 1}, {"w", "dc"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 79)
+	err = s.session.DB("db1").Run(bson.D{{"getLastError", 1}, {"j", true}, {"fsync", true}}, nil)
+	c.Assert(err, gc.ErrorMatches, "fsync and j options cannot be used together")
+	c.Assert(errorCode(err), gc.Equals, 9)
+
+	// Write commands fail before writing when their write concern is
+	// invalid, and report write concerns they cannot satisfy.
+	err = s.session.DB("db1").Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 3}}}, {"writeConcern", bson.M{"w": -1}}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 9)
+	var reply writeConcernReply
+	c.Assert(s.session.DB("db1").Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 3}}}, {"writeConcern", bson.M{"w": "majority", "wtimeout": 100}}}, &reply), gc.IsNil)
+	c.Assert(reply, gc.DeepEquals, writeConcernReply{N: 1})
+	c.Assert(s.session.DB("db1").Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 4}}}, {"writeConcern", bson.M{"w": 2}}}, &reply), gc.IsNil)
+	c.Assert(reply.N, gc.Equals, 1)
+	c.Assert(reply.WriteConcernError["code"], gc.Equals, 2)
+}
+
+func (s *gonzoSuite) TestReadConcern(c *gc.C) {
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	for _, level := range []string{"local", "available", "majority"} {
+		var result struct {
+			N int
+		}
+		c.Assert(s.session.DB("db1").Run(bson.D{{"count", "c1"}, {"readConcern", bson.M{"level": level}}}, &result), gc.IsNil)
+		c.Assert(result.N, gc.Equals, 1)
+	}
+
+	for _, t := range []struct {
+		cmd  bson.D
+		code int
+	}{
+		{bson.D{{"find", "c1"}, {"readConcern", bson.M{"level": "latest"}}}, 9},
+		{bson.D{{"find", "c1"}, {"readConcern", bson.M{"level": "linearizable"}}}, 123},
+		{bson.D{{"find", "c1"}, {"readConcern", bson.M{"level": "snapshot"}}}, 72},
+		{bson.D{{"create", "c2"}, {"readConcern", bson.M{"level": "local"}}}, 72},
+	} {
+		err := s.session.DB("db1").Run(t.cmd, nil)
+		c.Check(errorCode(err), gc.Equals, t.code, gc.Commentf("%v", t.cmd))
+	}
+
+	// Transactions may read a snapshot, when they start.
+	tc := s.startSession(c)
+	tc.start()
+	docs, err := tc.find()
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.HasLen, 1)
+	err = tc.run("db1", bson.D{{"find", "c1"}, {"readConcern", bson.M{"level": "snapshot"}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Only the first command in a transaction may specify a readConcern")
+	tc.start()
+	c.Assert(tc.run("db1", bson.D{{"find", "c1"}, {"readConcern", bson.M{"level": "snapshot"}}}, nil), gc.IsNil)
+	err = tc.run("db1", bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 2}}}, {"writeConcern", bson.M{"w": 1}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Cannot set write concern after starting a transaction.")
+}
+
+func (s *gonzoSuite) TestFailCommand(c *gc.C) {
+	db := s.session.DB("db1")
+	c.Assert(s.session.Run(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", bson.M{"times": 1}},
+		{"data", bson.M{"failCommands": []string{"insert"}, "errorCode": 91}},
+	}, nil), gc.IsNil)
+	err := db.Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1}}}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 91)
+	var reply writeConcernReply
+	c.Assert(db.Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1}}}}, &reply), gc.IsNil)
+	c.Assert(reply, gc.DeepEquals, writeConcernReply{N: 1})
+
+	// Writes reporting a writeConcernError are applied.
+	c.Assert(s.session.Run(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", "alwaysOn"},
+		{"data", bson.M{
+			"failCommands":      []string{"update"},
+			"writeConcernError": bson.M{"code": 64, "errmsg": "waiting for replication timed out", "errInfo": bson.M{"wtimeout": true}},
+		}},
+	}, nil), gc.IsNil)
+	update := bson.D{{"update", "c1"}, {"updates", []bson.M{{"q": bson.M{"_id": 1}, "u": bson.M{"$set": bson.M{"x": 1}}}}}}
+	c.Assert(db.Run(update, &reply), gc.IsNil)
+	c.Assert(reply.N, gc.Equals, 1)
+	c.Assert(reply.WriteConcernError, gc.DeepEquals, bson.M{
+		"code": 64, "codeName": "WriteConcernFailed", "errmsg": "waiting for replication timed out",
+		"errInfo": bson.M{"wtimeout": true},
+	})
+	n, err := db.C("c1").Find(bson.M{"x": 1}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(s.session.Run(bson.D{{"configureFailPoint", "failCommand"}, {"mode", "off"}}, nil), gc.IsNil)
+
+	err = s.session.Run(bson.D{{"configureFailPoint", "failCommand"}, {"mode", "alwaysOn"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 2)
+}
+
+func (s *replSetSuite) TestWriteConcern(c *gc.C) {
+	db := s.session.DB("db1")
+	insert := func(id int, wc bson.M) writeConcernReply {
+		var reply writeConcernReply
+		c.Assert(db.Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": id}}}, {"writeConcern", wc}}, &reply), gc.IsNil)
+		c.Assert(reply.N, gc.Equals, 1)
+		return reply
+	}
+	c.Assert(insert(1, bson.M{"w": 3}).WriteConcernError, gc.IsNil)
+	c.Assert(insert(2, bson.M{"w": "majority", "j": true}).WriteConcernError, gc.IsNil)
+	c.Assert(insert(3, bson.M{"w": 4}).WriteConcernError["code"], gc.Equals, 100)
+
+	// Write concerns which are not satisfied within their wtimeout time out.
+	s.rs.SetReplicationLag(time.Hour)
+	c.Assert(insert(4, bson.M{"w": 1}).WriteConcernError, gc.IsNil)
+	c.Assert(insert(5, bson.M{"w": 2, "wtimeout": 10}).WriteConcernError, gc.DeepEquals, bson.M{
+		"code": 64, "codeName": "WriteConcernFailed", "errmsg": "waiting for replication timed out",
+		"errInfo": bson.M{"wtimeout": true},
+	})
+	err := db.Run(bson.D{{"getLastError", 1}, {"w", "majority"}, {"wtimeout", 10}}, nil)
+	c.Assert(err, gc.ErrorMatches, "timed out waiting for slaves")
+	c.Assert(errorCode(err), gc.Equals, 64)
+
+	// So do those needing members which are unreachable.
+	s.rs.SetReplicationLag(0)
+	s.rs.SetUnreachable(2, true)
+	c.Assert(insert(6, bson.M{"w": 2}).WriteConcernError, gc.IsNil)
+	c.Assert(insert(7, bson.M{"w": 3, "wtimeout": 10}).WriteConcernError["code"], gc.Equals, 64)
+}
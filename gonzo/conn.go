@@ -0,0 +1,162 @@
+package gonzo
+
+import (
+	"net"
+	"sync/atomic"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// connContext is a client connection, along with the state mongod keeps
+// for each connection. Server.handle creates one for each connection it
+// accepts, and passes it to the backend as the connection requests are
+// read from.
+type connContext struct {
+	net.Conn
+	id        int64
+	lastError lastError
+
+	// server is the server which accepted the connection.
+	server *Server
+
+	// users holds the name of the user the connection is authenticated as
+	// on each database. nonce is the nonce getnonce last returned, for
+	// MONGODB-CR authentication, and conversation the SCRAM conversation
+	// in progress, if any.
+	users        map[string]string
+	nonce        string
+	conversation *scramConversation
+
+	// compressed is set while the request being handled was compressed,
+	// with compressor, which its replies are compressed with.
+	compressed bool
+	compressor Compressor
+
+	// op is the operation the connection is handling, if any.
+	op *operation
+}
+
+// lastConnID is the id of the latest connection accepted by any server.
+var lastConnID int64
+
+func newConnContext(c net.Conn) *connContext {
+	return &connContext{Conn: c, id: atomic.AddInt64(&lastConnID, 1)}
+}
+
+// contextOf returns the context of a connection, or a new context if the
+// connection was not accepted by a Server.
+func contextOf(c net.Conn) *connContext {
+	if ctx, ok := c.(*connContext); ok {
+		return ctx
+	}
+	return &connContext{Conn: c}
+}
+
+// login records that the connection has authenticated as a user of a
+// database, in place of any other user of the database.
+func (ctx *connContext) login(dbname, user string) {
+	if ctx.users == nil {
+		ctx.users = make(map[string]string)
+	}
+	ctx.users[dbname] = user
+}
+
+// logout forgets the user the connection authenticated as on a database.
+func (ctx *connContext) logout(dbname string) {
+	delete(ctx.users, dbname)
+}
+
+// handleConnCommand runs the commands which keep their state for each
+// connection, on whichever database they are run. It returns false for
+// other commands.
+func (b *MemoryBackend) handleConnCommand(c net.Conn, dbname string, query *OpQueryMsg) bool {
+	ctx := contextOf(c)
+	var reply bson.D
+	var err error
+	switch cmd, _ := query.Command(); cmd {
+	case "getLastError", "getlasterror":
+		reply, err = b.getLastError(ctx, query)
+	case "getPrevError", "getpreverror":
+		ctx.lastError.disable()
+		reply = ctx.lastError.prevError()
+	case "resetError", "reseterror":
+		ctx.lastError.disable()
+		ctx.lastError.reset()
+		reply = markOk(nil)
+	case "getnonce":
+		reply, err = getnonce(ctx)
+	case "authenticate":
+		reply, err = b.authenticate(ctx, dbname, query)
+	case "saslStart":
+		reply, err = b.saslStart(ctx, dbname, query)
+	case "saslContinue":
+		reply, err = b.saslContinue(ctx, dbname, query)
+	case "logout":
+		ctx.logout(dbname)
+		reply = markOk(nil)
+	default:
+		return false
+	}
+	if err != nil {
+		respError(c, query.RequestID, err)
+	} else {
+		respDoc(c, query.RequestID, reply)
+	}
+	return true
+}
+
+// lastError is the result of the last legacy write on a connection, which
+// getLastError and getPrevError report. As in mongod, it counts how many
+// requests ago the write was, so that getLastError only reports the
+// request just before it.
+type lastError struct {
+	// result is nil until a write is recorded, and once the error is
+	// reset.
+	result *WriteResult
+	nPrev  int
+}
+
+// startRequest counts a request read from the connection.
+func (le *lastError) startRequest() {
+	le.nPrev++
+}
+
+// disable undoes startRequest for the commands reporting on the last
+// error, which do not count as requests.
+func (le *lastError) disable() {
+	le.nPrev--
+}
+
+// record records the result of a write made by the current request.
+func (le *lastError) record(result *WriteResult) {
+	le.result = result
+	le.nPrev = 1
+}
+
+// reset forgets the last write.
+func (le *lastError) reset() {
+	le.result = nil
+}
+
+// last returns the result of the write made by the request before the
+// current one, if any.
+func (le *lastError) last() *WriteResult {
+	if le.nPrev != 1 || le.result == nil {
+		return &WriteResult{}
+	}
+	return le.result
+}
+
+// prevError answers getPrevError, with the result of the last write and
+// how many requests ago it was made.
+func (le *lastError) prevError() bson.D {
+	if le.result == nil {
+		return markOk(bson.D{{"err", nil}, {"n", 0}, {"nPrev", -1}})
+	}
+	doc := bson.D{{"err", le.result.Err}}
+	if le.result.Code != 0 {
+		doc = append(doc, bson.DocElem{"code", le.result.Code}, bson.DocElem{"codeName", le.result.CodeName})
+	}
+	doc = append(doc, bson.DocElem{"n", le.result.N}, bson.DocElem{"nPrev", le.nPrev})
+	return markOk(doc)
+}
@@ -0,0 +1,59 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type prevError struct {
+	Err   interface{} `bson:"err"`
+	Code  int         `bson:"code"`
+	N     int         `bson:"n"`
+	NPrev int         `bson:"nPrev"`
+}
+
+func (s *gonzoSuite) TestLastErrorPerConnection(c *gc.C) {
+	other := s.session.Copy()
+	defer other.Close()
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.NotNil)
+	c.Assert(other.DB("db1").C("c1").Insert(bson.M{"_id": 2}), gc.IsNil)
+
+	// Each connection reports its own last error.
+	var result lastError
+	c.Assert(s.session.DB("db1").Run("getLastError", &result), gc.IsNil)
+	c.Assert(result.Code, gc.Equals, 11000)
+	result = lastError{}
+	c.Assert(other.DB("db1").Run("getLastError", &result), gc.IsNil)
+	c.Assert(result, gc.DeepEquals, lastError{Ok: 1})
+
+	var connIDs [2]struct {
+		ConnectionId int64 `bson:"connectionId"`
+	}
+	c.Assert(s.session.Run("getLastError", &connIDs[0]), gc.IsNil)
+	c.Assert(other.Run("getLastError", &connIDs[1]), gc.IsNil)
+	c.Assert(connIDs[0].ConnectionId, gc.Not(gc.Equals), connIDs[1].ConnectionId)
+}
+
+func (s *gonzoSuite) TestPrevError(c *gc.C) {
+	db := s.session.DB("db1")
+	c.Assert(db.C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(db.C("c1").Insert(bson.M{"_id": 1}), gc.NotNil)
+
+	// getLastError only reports on the request just before it, while
+	// getPrevError reports how many requests ago the last write was.
+	c.Assert(db.Run(bson.D{{"count", "c1"}}, nil), gc.IsNil)
+	var result lastError
+	c.Assert(db.Run("getLastError", &result), gc.IsNil)
+	c.Assert(result.Err, gc.IsNil)
+	var prev prevError
+	c.Assert(db.Run("getPrevError", &prev), gc.IsNil)
+	c.Assert(prev.Err, gc.Matches, "E11000 duplicate key error .*")
+	c.Assert(prev.Code, gc.Equals, 11000)
+	c.Assert(prev.NPrev, gc.Equals, 2)
+
+	c.Assert(db.Run("resetError", nil), gc.IsNil)
+	prev = prevError{}
+	c.Assert(db.Run("getPrevError", &prev), gc.IsNil)
+	c.Assert(prev, gc.DeepEquals, prevError{NPrev: -1})
+}
@@ -0,0 +1,279 @@
+package gonzo
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultBatchSize is the number of documents returned in the first batch
+// of a query which does not ask for a number, as with mongod.
+var DefaultBatchSize = 101
+
+// AwaitDataTimeout is how long OP_GET_MORE waits on a tailable cursor with
+// the await data flag for new documents to be inserted, before returning
+// an empty batch.
+var AwaitDataTimeout = time.Second
+
+// cursor holds the state of a query with more documents to return, for
+// OP_GET_MORE to continue.
+type cursor struct {
+	id   int64
+	ns   string
+	coll Collection
+
+	// docs holds the remaining results of a query which is not tailable.
+	docs []interface{}
+
+	// returned is the number of documents returned so far.
+	returned int
+
+	// tailable cursors return the documents matching filter as they are
+	// inserted into a capped collection, after the last record examined.
+	// Those which await data block until there are some to return.
+	tailable  bool
+	awaitData bool
+	filter    bson.M
+	proj      *projection
+	last      int64
+
+	// stream is set for cursors returning change events, which are read
+	// from the oplog.
+	stream *changeStream
+}
+
+// nextBatch returns up to n of the remaining results of a cursor which is
+// not tailable, or all of them if n is zero.
+func (cur *cursor) nextBatch(n int) []interface{} {
+	if n <= 0 || n > len(cur.docs) {
+		n = len(cur.docs)
+	}
+	batch := cur.docs[:n]
+	cur.docs = cur.docs[n:]
+	cur.returned += n
+	return batch
+}
+
+// exhausted returns whether the cursor has no more documents to return.
+func (cur *cursor) exhausted() bool {
+	if cur.stream != nil {
+		return cur.stream.invalidated
+	}
+	return !cur.tailable && len(cur.docs) == 0
+}
+
+// cursorSet holds the open cursors of a backend. A cursor is checked out
+// of the set while a batch is read from it, so that it is only used by one
+// client at a time.
+type cursorSet struct {
+	cursors map[int64]*cursor
+
+	mu sync.Mutex
+}
+
+func newCursorSet() *cursorSet {
+	return &cursorSet{cursors: make(map[int64]*cursor)}
+}
+
+// add assigns the cursor a new, random id and adds it to the set.
+func (s *cursorSet) add(cur *cursor) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Reader.Read(b); err != nil {
+			panic(err)
+		}
+		id := int64(binary.LittleEndian.Uint64(b) >> 1)
+		if _, ok := s.cursors[id]; id != 0 && !ok {
+			cur.id = id
+			s.cursors[id] = cur
+			return id
+		}
+	}
+}
+
+// checkout removes a cursor from the set, to be returned with checkin if it
+// has more to return.
+func (s *cursorSet) checkout(id int64) (*cursor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.cursors[id]
+	delete(s.cursors, id)
+	return cur, ok
+}
+
+func (s *cursorSet) checkin(cur *cursor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors[cur.id] = cur
+}
+
+func (s *cursorSet) remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cursors, id)
+}
+
+// firstBatch returns the first batch of a query's results, and the id of
+// a cursor holding the rest, or zero if there are none. A negative
+// number to return, or one, asks for a single batch.
+func (b *MemoryBackend) firstBatch(ns string, coll Collection, docs []interface{}, numberToReturn int32) ([]interface{}, int64) {
+	n := int(numberToReturn)
+	if n < 0 || n == 1 {
+		if n = -n; n == -1 {
+			n = 1
+		}
+		if n < len(docs) {
+			docs = docs[:n]
+		}
+		return docs, 0
+	}
+	if n == 0 {
+		n = DefaultBatchSize
+	}
+	if len(docs) <= n {
+		return docs, 0
+	}
+	cur := &cursor{ns: ns, coll: coll, docs: docs[n:], returned: n}
+	return docs[:n], b.cursors.add(cur)
+}
+
+// tailQuery answers a query with a tailable cursor, which remains open
+// after returning the documents already in a capped collection.
+func (b *MemoryBackend) tailQuery(c net.Conn, query *OpQueryMsg, coll Collection, q *Query) {
+	if !coll.Capped() {
+		respQueryError(c, query.RequestID, errorf(ErrBadValue,
+			"error processing query: ns=%s planner returned error :: caused by :: "+
+				"tailable cursor requested on non capped collection", query.FullCollectionName))
+		return
+	}
+	if len(q.Sort) > 0 && !(len(q.Sort) == 1 && q.Sort[0].Name == "$natural" && asFloat64(q.Sort[0].Value) > 0) {
+		respQueryError(c, query.RequestID, errorf(ErrBadValue,
+			"error processing query: ns=%s planner returned error :: caused by :: "+
+				"cannot tail with a sort other than {$natural: 1}", query.FullCollectionName))
+		return
+	}
+	proj, err := newProjection(q.Projection)
+	if err != nil {
+		respQueryError(c, query.RequestID, err)
+		return
+	}
+	cur := &cursor{
+		ns:        query.FullCollectionName,
+		coll:      coll,
+		tailable:  true,
+		awaitData: query.Flags&QueryFlagAwaitData != 0,
+		filter:    q.Filter,
+		proj:      proj,
+	}
+	docs, err := b.tail(cur, int(query.NumberToReturn), false, nil)
+	if err != nil {
+		respQueryError(c, query.RequestID, err)
+		return
+	}
+	respCursor(c, query.RequestID, b.cursors.add(cur), 0, docs)
+}
+
+// tail returns the next batch of documents from a tailable cursor. If
+// there are none yet, and the cursor awaits data, it waits for more to be
+// inserted until AwaitDataTimeout has passed, or interrupted is closed.
+func (b *MemoryBackend) tail(cur *cursor, n int, wait bool, interrupted <-chan struct{}) ([]interface{}, error) {
+	if n < 0 {
+		n = -n
+	}
+	var timeout <-chan time.Time
+	for {
+		inserted := cur.coll.Notify()
+		docs, last, err := cur.coll.Tail(cur.filter, cur.last, n)
+		if err != nil {
+			return nil, err
+		}
+		cur.last = last
+		if cur.stream != nil {
+			if docs, err = cur.stream.events(docs); err != nil {
+				return nil, err
+			}
+		}
+		if len(docs) > 0 || !wait || !cur.awaitData || cur.exhausted() {
+			if cur.proj != nil {
+				for i, doc := range docs {
+					docs[i] = cur.proj.apply(doc.(bson.M), 0)
+				}
+			}
+			cur.returned += len(docs)
+			return docs, nil
+		}
+		if timeout == nil {
+			timeout = b.Clock().After(AwaitDataTimeout)
+		}
+		select {
+		case <-inserted:
+		case <-timeout:
+			return nil, nil
+		case <-interrupted:
+			return nil, errInterrupted
+		case <-b.t.Dying():
+			return nil, nil
+		}
+	}
+}
+
+// HandleGetMore returns the next batch of documents from a cursor.
+func (b *MemoryBackend) HandleGetMore(c net.Conn, getMore *OpGetMoreMsg) {
+	dbname, cname := splitNamespace(getMore.FullCollectionName)
+	find := []need{{resource{DB: dbname, Collection: cname}, []string{"find"}}}
+	err := b.authorize(c, "getMore", find, func() error {
+		return errorf(ErrUnauthorized, "not authorized for getMore on %s", getMore.FullCollectionName)
+	})
+	if err != nil {
+		respQueryError(c, getMore.RequestID, err)
+		return
+	}
+	cur, ok := b.cursors.checkout(getMore.CursorID)
+	if !ok {
+		respCursorNotFound(c, getMore.RequestID)
+		return
+	}
+	if cur.ns != getMore.FullCollectionName {
+		b.cursors.checkin(cur)
+		respQueryError(c, getMore.RequestID, errorf(ErrBadValue,
+			"Requested getMore on namespace '%s', but cursor belongs to a different namespace %s",
+			getMore.FullCollectionName, cur.ns))
+		return
+	}
+	startingFrom := cur.returned
+	var docs []interface{}
+	if cur.tailable {
+		var err error
+		if docs, err = b.tail(cur, int(getMore.NumberToReturn), true, contextOf(c).interrupted()); err != nil {
+			respQueryError(c, getMore.RequestID, err)
+			return
+		}
+	} else {
+		docs = cur.nextBatch(int(getMore.NumberToReturn))
+	}
+	cursorID := cur.id
+	if cur.exhausted() {
+		cursorID = 0
+	} else {
+		b.cursors.checkin(cur)
+	}
+	respCursor(c, getMore.RequestID, cursorID, startingFrom, docs)
+}
+
+// HandleKillCursors closes cursors which a client has no further use for.
+func (b *MemoryBackend) HandleKillCursors(c net.Conn, killCursors *OpKillCursorsMsg) {
+	// Cursors may be killed by any client which has authenticated, as
+	// their ids are all that clients can name them by.
+	if b.authorize(c, "killCursors", nil, nil) != nil {
+		return
+	}
+	for _, id := range killCursors.CursorIDs {
+		b.cursors.remove(id)
+	}
+}
@@ -0,0 +1,186 @@
+package gonzo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrorCode is a MongoDB server error code.
+type ErrorCode int
+
+const (
+	ErrBadValue                  = ErrorCode(2)
+	ErrFailedToParse             = ErrorCode(9)
+	ErrUserNotFound              = ErrorCode(11)
+	ErrUnauthorized              = ErrorCode(13)
+	ErrProtocolError             = ErrorCode(17)
+	ErrAuthenticationFailed      = ErrorCode(18)
+	ErrIllegalOperation          = ErrorCode(20)
+	ErrInvalidBSON               = ErrorCode(22)
+	ErrNamespaceNotFound         = ErrorCode(26)
+	ErrIndexNotFound             = ErrorCode(27)
+	ErrRoleNotFound              = ErrorCode(31)
+	ErrNamespaceExists           = ErrorCode(48)
+	ErrCommandNotFound           = ErrorCode(59)
+	ErrWriteConcernFailed        = ErrorCode(64)
+	ErrImmutableField            = ErrorCode(66)
+	ErrInvalidOptions            = ErrorCode(72)
+	ErrInvalidNamespace          = ErrorCode(73)
+	ErrNoReplicationEnabled      = ErrorCode(76)
+	ErrUnknownReplWriteConcern   = ErrorCode(79)
+	ErrIndexOptionsConflict      = ErrorCode(85)
+	ErrShutdownInProgress        = ErrorCode(91)
+	ErrUnsatisfiableWriteConcern = ErrorCode(100)
+	ErrWriteConflict             = ErrorCode(112)
+	ErrCommandNotSupported       = ErrorCode(115)
+	ErrConflictingOperation      = ErrorCode(117)
+	ErrNotAReplicaSet            = ErrorCode(123)
+	ErrCappedPositionLost        = ErrorCode(136)
+	ErrCannotIndexParallel       = ErrorCode(171)
+	ErrTransactionTooOld         = ErrorCode(225)
+	ErrNoSuchTransaction         = ErrorCode(251)
+	ErrTransactionCommitted      = ErrorCode(256)
+	ErrExceededTimeLimit         = ErrorCode(262)
+	ErrNotSupportedInTxn         = ErrorCode(263)
+	ErrChangeStreamFatalError    = ErrorCode(280)
+	ErrChangeStreamHistoryLost   = ErrorCode(286)
+	ErrNoQueryExecutionPlans     = ErrorCode(291)
+	ErrMechanismUnavailable      = ErrorCode(334)
+	ErrCannotGrowCappedDocument  = ErrorCode(10003)
+	ErrNotMaster                 = ErrorCode(10107)
+	ErrBSONObjectTooLarge        = ErrorCode(10334)
+	ErrDuplicateKey              = ErrorCode(11000)
+	ErrInterruptedAtShutdown     = ErrorCode(11600)
+	ErrInterrupted               = ErrorCode(11601)
+	ErrBadGeoValue               = ErrorCode(13026)
+	ErrGeoOutOfBounds            = ErrorCode(13027)
+	ErrNotMasterNoSlaveOk        = ErrorCode(13435)
+	ErrCannotExtractGeoKeys      = ErrorCode(16755)
+	ErrUnknownPipelineStage      = ErrorCode(40324)
+	ErrResumeTokenNotFound       = ErrorCode(40585)
+	ErrChangeStreamNotFirst      = ErrorCode(40602)
+	ErrGeoNearNotFirst           = ErrorCode(40603)
+	ErrMultipleResumeOptions     = ErrorCode(40674)
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrBadValue:                  "BadValue",
+	ErrFailedToParse:             "FailedToParse",
+	ErrUserNotFound:              "UserNotFound",
+	ErrUnauthorized:              "Unauthorized",
+	ErrProtocolError:             "ProtocolError",
+	ErrAuthenticationFailed:      "AuthenticationFailed",
+	ErrIllegalOperation:          "IllegalOperation",
+	ErrInvalidBSON:               "InvalidBSON",
+	ErrNamespaceNotFound:         "NamespaceNotFound",
+	ErrIndexNotFound:             "IndexNotFound",
+	ErrRoleNotFound:              "RoleNotFound",
+	ErrNamespaceExists:           "NamespaceExists",
+	ErrCommandNotFound:           "CommandNotFound",
+	ErrWriteConcernFailed:        "WriteConcernFailed",
+	ErrImmutableField:            "ImmutableField",
+	ErrInvalidOptions:            "InvalidOptions",
+	ErrInvalidNamespace:          "InvalidNamespace",
+	ErrNoReplicationEnabled:      "NoReplicationEnabled",
+	ErrUnknownReplWriteConcern:   "UnknownReplWriteConcern",
+	ErrIndexOptionsConflict:      "IndexOptionsConflict",
+	ErrShutdownInProgress:        "ShutdownInProgress",
+	ErrUnsatisfiableWriteConcern: "UnsatisfiableWriteConcern",
+	ErrWriteConflict:             "WriteConflict",
+	ErrCommandNotSupported:       "CommandNotSupported",
+	ErrConflictingOperation:      "ConflictingOperationInProgress",
+	ErrNotAReplicaSet:            "NotAReplicaSet",
+	ErrCappedPositionLost:        "CappedPositionLost",
+	ErrCannotIndexParallel:       "CannotIndexParallelArrays",
+	ErrTransactionTooOld:         "TransactionTooOld",
+	ErrNoSuchTransaction:         "NoSuchTransaction",
+	ErrTransactionCommitted:      "TransactionCommitted",
+	ErrExceededTimeLimit:         "ExceededTimeLimit",
+	ErrNotSupportedInTxn:         "OperationNotSupportedInTransaction",
+	ErrChangeStreamFatalError:    "ChangeStreamFatalError",
+	ErrChangeStreamHistoryLost:   "ChangeStreamHistoryLost",
+	ErrNoQueryExecutionPlans:     "NoQueryExecutionPlans",
+	ErrMechanismUnavailable:      "MechanismUnavailable",
+	ErrCannotGrowCappedDocument:  "CannotGrowDocumentInCappedNamespace",
+	ErrNotMaster:                 "NotMaster",
+	ErrBSONObjectTooLarge:        "BSONObjectTooLarge",
+	ErrDuplicateKey:              "DuplicateKey",
+	ErrInterruptedAtShutdown:     "InterruptedAtShutdown",
+	ErrInterrupted:               "Interrupted",
+	ErrBadGeoValue:               "Location13026",
+	ErrGeoOutOfBounds:            "Location13027",
+	ErrNotMasterNoSlaveOk:        "NotMasterNoSlaveOk",
+	ErrCannotExtractGeoKeys:      "Location16755",
+	ErrUnknownPipelineStage:      "Location40324",
+	ErrResumeTokenNotFound:       "Location40585",
+	ErrChangeStreamNotFirst:      "Location40602",
+	ErrGeoNearNotFirst:           "Location40603",
+	ErrMultipleResumeOptions:     "Location40674",
+}
+
+// Error is an error reported to clients along with a MongoDB error code.
+// Info holds any additional fields mongod reports with the error.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Info    bson.D
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// CodeName returns the symbolic name mongod reports for the error code.
+func (e *Error) CodeName() string {
+	return errorCodeNames[e.Code]
+}
+
+func errorf(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// formatValue formats a BSON value the way mongod quotes values in error
+// messages, such as { email: "x@example.com" }.
+func formatValue(v interface{}) string {
+	switch typeOrder(v) {
+	case 20:
+		doc := asDoc(v)
+		if len(doc) == 0 {
+			return "{}"
+		}
+		var fields []string
+		for _, kv := range doc {
+			fields = append(fields, kv.Name+": "+formatValue(kv.Value))
+		}
+		return "{ " + strings.Join(fields, ", ") + " }"
+	case 25:
+		var elems []string
+		for _, elem := range v.([]interface{}) {
+			elems = append(elems, formatValue(elem))
+		}
+		return "[ " + strings.Join(elems, ", ") + " ]"
+	}
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(value)
+	case float64:
+		if value == float64(int64(value)) {
+			return strconv.FormatFloat(value, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case bson.ObjectId:
+		return "ObjectId('" + value.Hex() + "')"
+	case time.Time:
+		return "new Date(" + strconv.FormatInt(value.UnixNano()/int64(time.Millisecond), 10) + ")"
+	}
+	if v == bson.Undefined {
+		return "undefined"
+	}
+	return fmt.Sprint(v)
+}
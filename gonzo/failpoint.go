@@ -0,0 +1,131 @@
+package gonzo
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failPointNames are the fail points which configureFailPoint can set.
+// While onPrimaryTransactionalWrite is set, the connection a retryable
+// write was sent on is closed once the write is applied, instead of the
+// write being answered. The failCommand fail point makes the commands
+// named in its failCommands data fail: they close the connection if
+// closeConnection is set, fail with errorCode, or are run and then report
+// the writeConcernError given. With blockConnection, they first wait for
+// blockTimeMS, unless killOp interrupts them.
+var failPointNames = map[string]bool{
+	"failCommand":                 true,
+	"onPrimaryTransactionalWrite": true,
+}
+
+// failPoint is a fail point set with configureFailPoint.
+type failPoint struct {
+	// times is the number of times the fail point is still to trigger, or
+	// -1 if it triggers until it is turned off.
+	times int
+	data  bson.M
+}
+
+// failPointSet holds the fail points set on a backend, which make it fail
+// in ways chosen by tests.
+type failPointSet struct {
+	points map[string]*failPoint
+
+	mu sync.Mutex
+}
+
+func newFailPointSet() *failPointSet {
+	return &failPointSet{points: make(map[string]*failPoint)}
+}
+
+// configure runs a configureFailPoint command, setting a fail point to
+// trigger always, a number of times, or not at all.
+func (s *failPointSet) configure(query *OpQueryMsg) error {
+	_, arg := query.Command()
+	name, _ := arg.(string)
+	if !failPointNames[name] {
+		return errorf(ErrBadValue, "Cannot find failPoint named %s", formatValue(arg))
+	}
+	fp := &failPoint{}
+	mode, _ := query.Get("mode")
+	switch mode {
+	case "alwaysOn":
+		fp.times = -1
+	case "off":
+	default:
+		times, ok := asInt64(asDoc(mode).Map()["times"])
+		if !ok || times < 0 {
+			return errorf(ErrBadValue, "mode must be 'alwaysOn', 'off' or { times: <n> }: %s", formatValue(mode))
+		}
+		fp.times = int(times)
+	}
+	if v, ok := query.Get("data"); ok {
+		fp.data, _ = asBsonM(v)
+	}
+	if name == "failCommand" && fp.times != 0 {
+		_, closeConn := fp.data["closeConnection"]
+		_, code := fp.data["errorCode"]
+		_, wcErr := fp.data["writeConcernError"]
+		_, block := fp.data["blockConnection"]
+		if _, ok := fp.data["failCommands"].([]interface{}); !ok || !closeConn && !code && !wcErr && !block {
+			return errorf(ErrBadValue, "failCommand needs failCommands, and closeConnection, errorCode, writeConcernError or blockConnection in its data")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.points[name] = fp
+	return nil
+}
+
+// trigger returns the data of a fail point, and whether it triggered.
+func (s *failPointSet) trigger(name string) (bson.M, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, ok := s.points[name]
+	if !ok || fp.times == 0 {
+		return nil, false
+	}
+	if fp.times > 0 {
+		fp.times--
+	}
+	return fp.data, true
+}
+
+// failCommand returns the data of the failCommand fail point, and whether
+// it triggered for a command. The fail point is triggered either before
+// commands run, or once write commands have run when wcErr is set, as
+// decided by whether it has a writeConcernError.
+func (s *failPointSet) failCommand(cmd string, wcErr bool) (bson.M, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, ok := s.points["failCommand"]
+	if !ok || fp.times == 0 {
+		return nil, false
+	}
+	if _, ok := fp.data["writeConcernError"]; ok != wcErr {
+		return nil, false
+	}
+	for _, name := range asArray(fp.data["failCommands"]) {
+		if name == cmd {
+			if fp.times > 0 {
+				fp.times--
+			}
+			return fp.data, true
+		}
+	}
+	return nil, false
+}
+
+// failCommandError returns the error described by the writeConcernError
+// data of the failCommand fail point.
+func failCommandError(v interface{}) error {
+	doc, _ := asBsonM(v)
+	code, _ := asInt64(doc["code"])
+	msg, _ := doc["errmsg"].(string)
+	err := &Error{Code: ErrorCode(code), Message: msg}
+	if info, ok := doc["errInfo"]; ok {
+		err.Info = bson.D{{"errInfo", info}}
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+//go:build go1.18
+// +build go1.18
+
+package gonzo_test
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+// The fuzz tests check that no message, however malformed, crashes the
+// parsers. Each is seeded with well-formed messages, and with those
+// messages truncated, and with the inputs in testdata/fuzz which earlier
+// runs found to be of interest. Run them with go test -fuzz, one at a
+// time. Fuzzing needs Go 1.18, so older toolchains skip this file.
+
+// addSeeds seeds a fuzz test with messages and their truncations.
+func addSeeds(f *testing.F, msgs ...[]byte) {
+	for _, msg := range msgs {
+		f.Add(msg)
+		for n := len(msg) - 1; n > 0; n /= 2 {
+			f.Add(msg[:n])
+		}
+	}
+}
+
+// seedDoc holds each kind of value a document may hold.
+var seedDoc = bson.D{
+	{"double", 1.5},
+	{"string", "gonzo"},
+	{"doc", bson.M{"a": 1}},
+	{"array", []interface{}{1, "two", nil}},
+	{"binary", []byte("binary")},
+	{"oldBinary", bson.Binary{Kind: 2, Data: []byte("\x03\x00\x00\x00old")}},
+	{"undefined", bson.Undefined},
+	{"objectId", bson.ObjectIdHex("5a934e000102030405000000")},
+	{"bool", true},
+	{"date", int64(1)},
+	{"null", nil},
+	{"regex", bson.RegEx{Pattern: "^g", Options: "i"}},
+	{"dbPointer", bson.DBPointer{Namespace: "db1.c1", Id: bson.ObjectIdHex("5a934e000102030405000000")}},
+	{"code", bson.JavaScript{Code: "x"}},
+	{"symbol", bson.Symbol("s")},
+	{"codeWithScope", bson.JavaScript{Code: "x", Scope: bson.M{"x": 1}}},
+	{"int32", 1},
+	{"timestamp", bson.MongoTimestamp(1)},
+	{"int64", int64(1) << 40},
+	{"minKey", bson.MinKey},
+	{"maxKey", bson.MaxKey},
+}
+
+func fuzzParser(f *testing.F, op gonzo.OpCode, parse func(h *gonzo.Header) error) {
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		parse(&gonzo.Header{Length: int32(16 + len(contents)), RequestID: 1, OpCode: op, Contents: contents})
+	})
+}
+
+func FuzzOpQueryMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(0), cstring("db1.$cmd"), int32le(0), int32le(-1), bsonDoc(bson.D{{"find", "c1"}, {"filter", seedDoc}})),
+		concat(int32le(4), cstring("db1.c1"), int32le(10), int32le(5), bsonDoc(seedDoc), bsonDoc(bson.M{"a": 1})),
+	)
+	fuzzParser(f, gonzo.OpQuery, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpQueryMsg(h)
+		return err
+	})
+}
+
+func FuzzOpInsertMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(1), cstring("db1.c1"), bsonDoc(seedDoc), bsonDoc(bson.M{"_id": 2})),
+	)
+	fuzzParser(f, gonzo.OpInsert, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpInsertMsg(h)
+		return err
+	})
+}
+
+func FuzzOpUpdateMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(0), cstring("db1.c1"), int32le(3), bsonDoc(bson.M{"_id": 1}), bsonDoc(bson.M{"$set": seedDoc})),
+	)
+	fuzzParser(f, gonzo.OpUpdate, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpUpdateMsg(h)
+		return err
+	})
+}
+
+func FuzzOpDeleteMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(0), cstring("db1.c1"), int32le(1), bsonDoc(seedDoc)),
+	)
+	fuzzParser(f, gonzo.OpDelete, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpDeleteMsg(h)
+		return err
+	})
+}
+
+func FuzzOpGetMoreMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(0), cstring("db1.c1"), int32le(100), int64le(1<<40)),
+	)
+	fuzzParser(f, gonzo.OpGetMore, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpGetMoreMsg(h)
+		return err
+	})
+}
+
+func FuzzOpKillCursorsMsg(f *testing.F) {
+	addSeeds(f,
+		concat(int32le(0), int32le(2), int64le(1), int64le(2)),
+		concat(int32le(0), int32le(1<<30), int64le(1)),
+	)
+	fuzzParser(f, gonzo.OpKillCursors, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpKillCursorsMsg(h)
+		return err
+	})
+}
+
+func FuzzOpMsgMsg(f *testing.F) {
+	addSeeds(f, cstring("hello, gonzo"))
+	fuzzParser(f, gonzo.OpMsg, func(h *gonzo.Header) error {
+		_, err := gonzo.NewOpMsgMsg(h)
+		return err
+	})
+}
+
+func FuzzOpCompressedMsg(f *testing.F) {
+	query := &gonzo.Header{
+		OpCode:   gonzo.OpQuery,
+		Contents: concat(int32le(0), cstring("db1.$cmd"), int32le(0), int32le(-1), bsonDoc(seedDoc)),
+	}
+	for _, id := range []gonzo.Compressor{gonzo.CompressorNoop, gonzo.CompressorSnappy, gonzo.CompressorZlib} {
+		m, err := gonzo.CompressMessage(query, id)
+		if err != nil {
+			f.Fatal(err)
+		}
+		addSeeds(f, concat(int32le(int32(m.OriginalOpCode)), int32le(m.UncompressedSize), []byte{byte(id)}, m.CompressedMessage))
+	}
+	fuzzParser(f, gonzo.OpCompressed, func(h *gonzo.Header) error {
+		m, err := gonzo.NewOpCompressedMsg(h)
+		if err != nil {
+			return err
+		}
+		_, err = m.Decompress()
+		return err
+	})
+}
+
+// FuzzCompress checks that messages decompress to what was compressed.
+func FuzzCompress(f *testing.F) {
+	f.Add(byte(gonzo.CompressorSnappy), []byte("gonzo gonzo gonzo gonzo"))
+	f.Add(byte(gonzo.CompressorZlib), bsonDoc(seedDoc))
+	f.Fuzz(func(t *testing.T, id byte, contents []byte) {
+		id %= 3
+		h := &gonzo.Header{RequestID: 1, OpCode: gonzo.OpQuery, Contents: contents}
+		m, err := gonzo.CompressMessage(h, gonzo.Compressor(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.Decompress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Contents, contents) {
+			t.Fatalf("decompressed %x, not %x", got.Contents, contents)
+		}
+	})
+}
+
+// FuzzHeaderRead checks that the framing of messages is read as written.
+func FuzzHeaderRead(f *testing.F) {
+	f.Add(concat(int32le(21), int32le(1), int32le(0), int32le(int32(gonzo.OpQuery)), []byte("gonzo")))
+	f.Add(concat(int32le(48000001), int32le(1), int32le(0), int32le(int32(gonzo.OpQuery))))
+	f.Add(concat(int32le(-1), int32le(1), int32le(0), int32le(int32(gonzo.OpQuery))))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		h := &gonzo.Header{}
+		if err := h.Read(bytes.NewReader(msg)); err != nil {
+			return
+		}
+		if int(h.Length) != 16+len(h.Contents) || !bytes.Equal(h.Contents, msg[16:h.Length]) {
+			t.Fatalf("read %d bytes of contents from a message of length %d", len(h.Contents), h.Length)
+		}
+	})
+}
@@ -0,0 +1,812 @@
+package gonzo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// earthRadius is the radius of the earth in meters, which mongod uses to
+// convert between angles and distances on its surface.
+const earthRadius = 6378100.0
+
+// geoEpsilon is how close, in radians or in flat coordinates, points must
+// be to be considered to touch.
+const geoEpsilon = 1e-9
+
+// geoPoint is a location, given either as a longitude and latitude in
+// degrees, or as x and y coordinates on a flat plane.
+type geoPoint struct {
+	x, y float64
+}
+
+// geometry is a GeoJSON geometry or a legacy coordinate pair. Geometries
+// are held as the points, lines and polygons they are made of, so that
+// multi-part geometries need no special treatment.
+type geometry struct {
+	points []geoPoint
+	lines  [][]geoPoint
+
+	// polygons holds the rings of each polygon. The first ring is the
+	// outer boundary, and any others are holes.
+	polygons [][][]geoPoint
+
+	// legacy is set for a legacy coordinate pair.
+	legacy bool
+}
+
+// geoIndex describes the location field of a 2d or 2dsphere index.
+type geoIndex struct {
+	field string
+	kind  string
+
+	// min and max bound the coordinates of locations in a 2d index.
+	min, max float64
+}
+
+func newGeoIndex(field, kind string, spec bson.D) (*geoIndex, error) {
+	if kind != "2d" && kind != "2dsphere" {
+		return nil, errorf(ErrBadValue, "unsupported index type for field %q: %v", field, kind)
+	}
+	geo := &geoIndex{field: field, kind: kind, min: -180, max: 180}
+	for _, kv := range spec {
+		switch kv.Name {
+		case "min":
+			geo.min = asFloat64(kv.Value)
+		case "max":
+			geo.max = asFloat64(kv.Value)
+		}
+	}
+	if geo.min >= geo.max {
+		return nil, errorf(ErrBadValue, "region for hash must be valid and have positive area: [%v, %v]", geo.min, geo.max)
+	}
+	return geo, nil
+}
+
+// check returns an error if value is not a location the index can hold.
+func (g *geoIndex) check(doc bson.M, value interface{}) error {
+	if g.kind == "2dsphere" {
+		if _, err := parseGeometry(value); err != nil {
+			return errorf(ErrCannotExtractGeoKeys, "Can't extract geo keys: %s  %v", formatValue(doc), err)
+		}
+		return nil
+	}
+	p, ok := parseLegacyPoint(value)
+	if !ok {
+		return errorf(ErrBadGeoValue, "location object expected, location array not in correct format")
+	}
+	if p.x < g.min || p.x >= g.max || p.y < g.min || p.y >= g.max {
+		return errorf(ErrGeoOutOfBounds, "point not in interval of [ %v, %v ) :: caused by :: %s",
+			g.min, g.max, formatValue(value))
+	}
+	return nil
+}
+
+// parseLegacyPoint parses a legacy coordinate pair, given as an array or
+// an embedded document. Documents which have lost their field order must
+// name their coordinates x and y, or lng and lat.
+func parseLegacyPoint(v interface{}) (geoPoint, bool) {
+	var coords []interface{}
+	switch d := v.(type) {
+	case []interface{}:
+		coords = d
+	case bson.D:
+		for _, kv := range d {
+			coords = append(coords, kv.Value)
+		}
+	case bson.M, map[string]interface{}:
+		m, _ := asBsonM(d)
+		for _, names := range [][2]string{{"x", "y"}, {"lng", "lat"}, {"lon", "lat"}, {"long", "lat"}} {
+			x, hasX := m[names[0]]
+			y, hasY := m[names[1]]
+			if hasX && hasY {
+				coords = []interface{}{x, y}
+				break
+			}
+		}
+	}
+	if len(coords) < 2 || typeOrder(coords[0]) != 10 || typeOrder(coords[1]) != 10 {
+		return geoPoint{}, false
+	}
+	return geoPoint{asFloat64(coords[0]), asFloat64(coords[1])}, true
+}
+
+// parseGeometry parses a legacy coordinate pair or a GeoJSON geometry.
+func parseGeometry(v interface{}) (*geometry, error) {
+	if p, ok := parseLegacyPoint(v); ok {
+		return &geometry{points: []geoPoint{p}, legacy: true}, nil
+	}
+	return parseGeoJSON(v)
+}
+
+// parseGeoJSON parses a GeoJSON geometry object.
+func parseGeoJSON(v interface{}) (*geometry, error) {
+	if typeOrder(v) != 20 {
+		return nil, fmt.Errorf("geo element must be an array or object: %s", formatValue(v))
+	}
+	doc := asDoc(v)
+	var kind string
+	var coords, geometries interface{}
+	for _, kv := range doc {
+		switch kv.Name {
+		case "type":
+			kind, _ = kv.Value.(string)
+		case "coordinates":
+			coords = kv.Value
+		case "geometries":
+			geometries = kv.Value
+		}
+	}
+	g := &geometry{}
+	switch kind {
+	case "Point":
+		p, err := parseCoordinates(coords)
+		if err != nil {
+			return nil, err
+		}
+		g.points = append(g.points, p)
+	case "MultiPoint":
+		for _, elem := range asArray(coords) {
+			p, err := parseCoordinates(elem)
+			if err != nil {
+				return nil, err
+			}
+			g.points = append(g.points, p)
+		}
+	case "LineString":
+		line, err := parseLine(coords)
+		if err != nil {
+			return nil, err
+		}
+		g.lines = append(g.lines, line)
+	case "MultiLineString":
+		for _, elem := range asArray(coords) {
+			line, err := parseLine(elem)
+			if err != nil {
+				return nil, err
+			}
+			g.lines = append(g.lines, line)
+		}
+	case "Polygon":
+		rings, err := parsePolygon(coords)
+		if err != nil {
+			return nil, err
+		}
+		g.polygons = append(g.polygons, rings)
+	case "MultiPolygon":
+		for _, elem := range asArray(coords) {
+			rings, err := parsePolygon(elem)
+			if err != nil {
+				return nil, err
+			}
+			g.polygons = append(g.polygons, rings)
+		}
+	case "GeometryCollection":
+		for _, elem := range asArray(geometries) {
+			part, err := parseGeoJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			g.points = append(g.points, part.points...)
+			g.lines = append(g.lines, part.lines...)
+			g.polygons = append(g.polygons, part.polygons...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown GeoJSON type: %s", formatValue(v))
+	}
+	return g, nil
+}
+
+// parseCoordinates parses the longitude and latitude of a GeoJSON
+// position.
+func parseCoordinates(v interface{}) (geoPoint, error) {
+	coords, ok := v.([]interface{})
+	if !ok || len(coords) < 2 {
+		return geoPoint{}, fmt.Errorf("Point must be an array of coordinates: %s", formatValue(v))
+	}
+	for _, c := range coords {
+		if typeOrder(c) != 10 {
+			return geoPoint{}, fmt.Errorf("Point must only contain numeric elements")
+		}
+	}
+	p := geoPoint{asFloat64(coords[0]), asFloat64(coords[1])}
+	if p.x < -180 || p.x > 180 || p.y < -90 || p.y > 90 {
+		return geoPoint{}, fmt.Errorf("longitude/latitude is out of bounds, lng: %v lat: %v", p.x, p.y)
+	}
+	return p, nil
+}
+
+func parseLine(v interface{}) ([]geoPoint, error) {
+	var line []geoPoint
+	for _, elem := range asArray(v) {
+		p, err := parseCoordinates(elem)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, p)
+	}
+	if len(line) < 2 {
+		return nil, fmt.Errorf("GeoJSON LineString must have at least 2 vertices: %s", formatValue(v))
+	}
+	return line, nil
+}
+
+func parsePolygon(v interface{}) ([][]geoPoint, error) {
+	var rings [][]geoPoint
+	for _, elem := range asArray(v) {
+		ring, err := parseLine(elem)
+		if err != nil {
+			return nil, err
+		}
+		if len(ring) < 4 {
+			return nil, fmt.Errorf("Loop must have at least 3 different vertices: %s", formatValue(elem))
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return nil, fmt.Errorf("Loop is not closed: %s", formatValue(elem))
+		}
+		rings = append(rings, ring)
+	}
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("Polygon has no loops.")
+	}
+	return rings, nil
+}
+
+// geometryValues returns the geometries a document holds in a field,
+// which may be an array of them when the field path traverses an array.
+func geometryValues(value interface{}) []*geometry {
+	if g, err := parseGeometry(value); err == nil {
+		return []*geometry{g}
+	}
+	var result []*geometry
+	for _, elem := range asArray(value) {
+		if g, err := parseGeometry(elem); err == nil {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// vertices returns every point of the geometry.
+func (g *geometry) vertices() []geoPoint {
+	result := append([]geoPoint(nil), g.points...)
+	for _, line := range g.lines {
+		result = append(result, line...)
+	}
+	for _, rings := range g.polygons {
+		for _, ring := range rings {
+			result = append(result, ring...)
+		}
+	}
+	return result
+}
+
+// edges returns the segments of the geometry's lines and polygon rings.
+func (g *geometry) edges() [][2]geoPoint {
+	var result [][2]geoPoint
+	add := func(line []geoPoint) {
+		for i := 1; i < len(line); i++ {
+			result = append(result, [2]geoPoint{line[i-1], line[i]})
+		}
+	}
+	for _, line := range g.lines {
+		add(line)
+	}
+	for _, rings := range g.polygons {
+		for _, ring := range rings {
+			add(ring)
+		}
+	}
+	return result
+}
+
+// distance returns the shortest distance from p to the geometry, in
+// radians on the sphere or in coordinate units on a flat plane. Points
+// inside a polygon are no distance from it.
+func (g *geometry) distance(p geoPoint, spherical bool) float64 {
+	for _, rings := range g.polygons {
+		if inPolygon(p, rings, spherical) {
+			return 0
+		}
+	}
+	best := math.Inf(1)
+	for _, q := range g.points {
+		best = math.Min(best, pointDistance(p, q, spherical))
+	}
+	for _, e := range g.edges() {
+		best = math.Min(best, edgeDistance(p, e[0], e[1], spherical))
+	}
+	return best
+}
+
+// intersects returns whether two geometries share any point on the
+// sphere.
+func (g *geometry) intersects(other *geometry) bool {
+	for _, v := range g.vertices() {
+		if other.distance(v, true) < geoEpsilon {
+			return true
+		}
+	}
+	for _, v := range other.vertices() {
+		if g.distance(v, true) < geoEpsilon {
+			return true
+		}
+	}
+	for _, a := range g.edges() {
+		for _, b := range other.edges() {
+			if arcsIntersect(a[0].vector(), a[1].vector(), b[0].vector(), b[1].vector()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// within returns whether the geometry lies entirely inside the polygons
+// of region on the sphere. Geometries may touch the region's boundary,
+// but not cross it.
+func (g *geometry) within(region *geometry) bool {
+	for _, v := range g.vertices() {
+		if region.distance(v, true) >= geoEpsilon {
+			return false
+		}
+	}
+	for _, a := range g.edges() {
+		for _, b := range region.edges() {
+			if arcsCross(a[0].vector(), a[1].vector(), b[0].vector(), b[1].vector()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inPolygon returns whether p is inside or on the boundary of a polygon,
+// and not inside one of its holes.
+func inPolygon(p geoPoint, rings [][]geoPoint, spherical bool) bool {
+	onRing := func(ring []geoPoint) bool {
+		for i := 1; i < len(ring); i++ {
+			if edgeDistance(p, ring[i-1], ring[i], spherical) < geoEpsilon {
+				return true
+			}
+		}
+		return false
+	}
+	if !onRing(rings[0]) && !inRing(p, rings[0], spherical) {
+		return false
+	}
+	for _, hole := range rings[1:] {
+		if inRing(p, hole, spherical) && !onRing(hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRing returns whether p is inside a closed ring. On the sphere, the
+// angles the ring's edges subtend at p sum to a full turn if p is inside,
+// and to nothing if it is outside. On a plane, a ray from p crosses the
+// ring an odd number of times if p is inside.
+func inRing(p geoPoint, ring []geoPoint, spherical bool) bool {
+	if spherical {
+		pv := p.vector()
+		var sum float64
+		for i := 1; i < len(ring); i++ {
+			a, b := ring[i-1].vector(), ring[i].vector()
+			sum += math.Atan2(dot(pv, cross(a, b)), dot(a, b)-dot(pv, a)*dot(pv, b))
+		}
+		return math.Abs(sum) > math.Pi
+	}
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// pointDistance returns the distance between two points.
+func pointDistance(a, b geoPoint, spherical bool) float64 {
+	if !spherical {
+		return math.Hypot(a.x-b.x, a.y-b.y)
+	}
+	lat1, lat2 := radians(a.y), radians(b.y)
+	dlat, dlng := lat2-lat1, radians(b.x-a.x)
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlng/2), 2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// edgeDistance returns the distance from p to the nearest point of the
+// segment from a to b, which is an arc of a great circle on the sphere.
+func edgeDistance(p, a, b geoPoint, spherical bool) float64 {
+	if spherical {
+		return arcDistance(p.vector(), a.vector(), b.vector())
+	}
+	dx, dy := b.x-a.x, b.y-a.y
+	if dx == 0 && dy == 0 {
+		return pointDistance(p, a, false)
+	}
+	t := ((p.x-a.x)*dx + (p.y-a.y)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p.x-(a.x+t*dx), p.y-(a.y+t*dy))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// vec3 is a point on the unit sphere, as a vector from its center.
+type vec3 [3]float64
+
+func (p geoPoint) vector() vec3 {
+	lng, lat := radians(p.x), radians(p.y)
+	return vec3{math.Cos(lat) * math.Cos(lng), math.Cos(lat) * math.Sin(lng), math.Sin(lat)}
+}
+
+func dot(a, b vec3) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func cross(a, b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vec3) norm() float64 {
+	return math.Sqrt(dot(a, a))
+}
+
+func (a vec3) unit() vec3 {
+	n := a.norm()
+	return vec3{a[0] / n, a[1] / n, a[2] / n}
+}
+
+// angle returns the angle between two points on the unit sphere.
+func angle(a, b vec3) float64 {
+	return math.Atan2(cross(a, b).norm(), dot(a, b))
+}
+
+// arcDistance returns the angle from p to the nearest point of the arc
+// from a to b.
+func arcDistance(p, a, b vec3) float64 {
+	n := cross(a, b)
+	if n.norm() < geoEpsilon {
+		return math.Min(angle(p, a), angle(p, b))
+	}
+	n = n.unit()
+	// If p lies between a and b, its nearest point is on the great circle
+	// through them.
+	if dot(cross(a, p), n) >= 0 && dot(cross(p, b), n) >= 0 {
+		return math.Abs(math.Asin(math.Max(-1, math.Min(1, dot(p, n)))))
+	}
+	return math.Min(angle(p, a), angle(p, b))
+}
+
+// arcsIntersect returns whether two arcs of great circles meet. Their
+// great circles meet at two opposite points, which must lie on both arcs.
+func arcsIntersect(a1, a2, b1, b2 vec3) bool {
+	t := cross(cross(a1, a2), cross(b1, b2))
+	if t.norm() < geoEpsilon {
+		// The arcs lie on the same great circle.
+		return arcDistance(a1, b1, b2) < geoEpsilon || arcDistance(a2, b1, b2) < geoEpsilon ||
+			arcDistance(b1, a1, a2) < geoEpsilon || arcDistance(b2, a1, a2) < geoEpsilon
+	}
+	t = t.unit()
+	for _, x := range []vec3{t, {-t[0], -t[1], -t[2]}} {
+		if arcDistance(x, a1, a2) < geoEpsilon && arcDistance(x, b1, b2) < geoEpsilon {
+			return true
+		}
+	}
+	return false
+}
+
+// arcsCross returns whether two arcs meet at a point which is not the
+// end of either.
+func arcsCross(a1, a2, b1, b2 vec3) bool {
+	return arcsIntersect(a1, a2, b1, b2) &&
+		arcDistance(a1, b1, b2) >= geoEpsilon && arcDistance(a2, b1, b2) >= geoEpsilon &&
+		arcDistance(b1, a1, a2) >= geoEpsilon && arcDistance(b2, a1, a2) >= geoEpsilon
+}
+
+// isGeoQuery returns whether a query value uses a geospatial operator.
+func isGeoQuery(matchValue interface{}) bool {
+	ops, _ := operatorDoc(matchValue)
+	for _, op := range ops {
+		switch op.Name {
+		case "$geoWithin", "$within", "$geoIntersects", "$near", "$nearSphere":
+			return true
+		}
+	}
+	return false
+}
+
+// isGeoWithinMatch evaluates $geoWithin. Legacy shapes are on a flat
+// plane, apart from $centerSphere, and GeoJSON polygons are on the
+// sphere.
+func isGeoWithinMatch(value, arg interface{}) bool {
+	shape := asDoc(arg)
+	if len(shape) != 1 {
+		return false
+	}
+	var within func(g *geometry) bool
+	allVertices := func(pred func(geoPoint) bool) func(g *geometry) bool {
+		return func(g *geometry) bool {
+			for _, v := range g.vertices() {
+				if !pred(v) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	switch shape[0].Name {
+	case "$box":
+		corners := asArray(shape[0].Value)
+		if len(corners) != 2 {
+			return false
+		}
+		a, okA := parseLegacyPoint(corners[0])
+		b, okB := parseLegacyPoint(corners[1])
+		if !okA || !okB {
+			return false
+		}
+		within = allVertices(func(p geoPoint) bool {
+			return p.x >= math.Min(a.x, b.x) && p.x <= math.Max(a.x, b.x) &&
+				p.y >= math.Min(a.y, b.y) && p.y <= math.Max(a.y, b.y)
+		})
+	case "$polygon":
+		var ring []geoPoint
+		for _, elem := range asArray(shape[0].Value) {
+			p, ok := parseLegacyPoint(elem)
+			if !ok {
+				return false
+			}
+			ring = append(ring, p)
+		}
+		if len(ring) < 3 {
+			return false
+		}
+		ring = append(ring, ring[0])
+		within = allVertices(func(p geoPoint) bool {
+			return inPolygon(p, [][]geoPoint{ring}, false)
+		})
+	case "$center", "$centerSphere":
+		args := asArray(shape[0].Value)
+		if len(args) != 2 || typeOrder(args[1]) != 10 {
+			return false
+		}
+		center, ok := parseLegacyPoint(args[0])
+		if !ok {
+			return false
+		}
+		radius, spherical := asFloat64(args[1]), shape[0].Name == "$centerSphere"
+		within = allVertices(func(p geoPoint) bool {
+			return pointDistance(p, center, spherical) <= radius
+		})
+	case "$geometry":
+		region, err := parseGeoJSON(shape[0].Value)
+		if err != nil || len(region.polygons) == 0 || len(region.points) > 0 || len(region.lines) > 0 {
+			return false
+		}
+		within = func(g *geometry) bool {
+			return g.within(region)
+		}
+	default:
+		return false
+	}
+	for _, g := range geometryValues(value) {
+		if within(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGeoIntersectsMatch evaluates $geoIntersects, on the sphere.
+func isGeoIntersectsMatch(value, arg interface{}) bool {
+	shape := asDoc(arg)
+	if len(shape) != 1 || shape[0].Name != "$geometry" {
+		return false
+	}
+	other, err := parseGeoJSON(shape[0].Value)
+	if err != nil {
+		return false
+	}
+	for _, g := range geometryValues(value) {
+		if g.intersects(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// nearQuery is a $near or $nearSphere query, which finds the documents
+// nearest a point in order of distance.
+type nearQuery struct {
+	path  string
+	point geoPoint
+
+	// geoJSON is set if the point is given as GeoJSON, in which case
+	// distances are in meters. Otherwise they are in radians on the
+	// sphere, or coordinate units on a flat plane.
+	geoJSON   bool
+	spherical bool
+
+	minDistance, maxDistance float64
+}
+
+// nearPath returns the field of a query filter which has a $near or
+// $nearSphere operator.
+func nearPath(filter bson.M) (string, bool) {
+	for path, matchValue := range filter {
+		ops, _ := operatorDoc(matchValue)
+		for _, op := range ops {
+			if op.Name == "$near" || op.Name == "$nearSphere" {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseNear parses the $near or $nearSphere operator on a field, along
+// with its $minDistance and $maxDistance, which may also be given inside
+// the operator alongside a GeoJSON $geometry.
+func parseNear(path string, matchValue interface{}) (*nearQuery, error) {
+	n := &nearQuery{path: path, maxDistance: math.Inf(1)}
+	ops, _ := operatorDoc(matchValue)
+	var hasPoint bool
+	var parseOps func(ops bson.D) error
+	parseOps = func(ops bson.D) error {
+		for _, op := range ops {
+			switch op.Name {
+			case "$near", "$nearSphere":
+				n.spherical = op.Name == "$nearSphere"
+				if p, ok := parseLegacyPoint(op.Value); ok {
+					n.point, hasPoint = p, true
+					continue
+				}
+				inner := asDoc(op.Value)
+				if _, ok := operatorDoc(inner); ok {
+					if err := parseOps(inner); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := n.parseGeometry(inner); err != nil {
+					return err
+				}
+				hasPoint = true
+			case "$geometry":
+				if err := n.parseGeometry(op.Value); err != nil {
+					return err
+				}
+				hasPoint = true
+			case "$maxDistance", "$minDistance":
+				d := asFloat64(op.Value)
+				if typeOrder(op.Value) != 10 || d < 0 {
+					return errorf(ErrBadValue, "%s must be a non-negative number: %s", op.Name, formatValue(op.Value))
+				}
+				if op.Name == "$maxDistance" {
+					n.maxDistance = d
+				} else {
+					n.minDistance = d
+				}
+			}
+		}
+		return nil
+	}
+	if err := parseOps(ops); err != nil {
+		return nil, err
+	}
+	if !hasPoint {
+		return nil, errorf(ErrBadValue, "invalid argument in geo near query: %s", formatValue(matchValue))
+	}
+	return n, nil
+}
+
+func (n *nearQuery) parseGeometry(v interface{}) error {
+	g, err := parseGeoJSON(v)
+	if err != nil {
+		return errorf(ErrBadValue, "invalid point in geo near query $geometry argument: %v", err)
+	}
+	if len(g.points) != 1 || len(g.lines) > 0 || len(g.polygons) > 0 {
+		return errorf(ErrBadValue, "$near requires a point, given %s", formatValue(v))
+	}
+	n.point, n.geoJSON, n.spherical = g.points[0], true, true
+	return nil
+}
+
+// canUse returns whether an index of the given kind can answer the query.
+// GeoJSON points need a 2dsphere index, and flat distances a 2d index.
+func (n *nearQuery) canUse(kind string) bool {
+	switch {
+	case n.geoJSON:
+		return kind == "2dsphere"
+	case !n.spherical:
+		return kind == "2d"
+	}
+	return true
+}
+
+// distance returns the distance from the query point to the nearest
+// location in a document.
+func (n *nearQuery) distance(doc bson.M) (float64, bool) {
+	value, _ := lookupPath(doc, n.path)
+	geometries := geometryValues(value)
+	if len(geometries) == 0 {
+		return 0, false
+	}
+	best := math.Inf(1)
+	for _, g := range geometries {
+		best = math.Min(best, g.distance(n.point, n.spherical))
+	}
+	if n.geoJSON {
+		best *= earthRadius
+	}
+	return best, true
+}
+
+// nearSearch returns the records with locations in a geo index within the
+// query's distance limits, nearest first.
+func (c *MemoryCollection) nearSearch(idx *memoryIndex, n *nearQuery) (ids []int64, keysExamined, docsExamined int) {
+	seen := make(map[int64]bool)
+	var found nearResults
+	for _, entry := range idx.entries {
+		keysExamined++
+		if seen[entry.id] {
+			continue
+		}
+		seen[entry.id] = true
+		docsExamined++
+		d, ok := n.distance(c.docs[entry.id])
+		if ok && d >= n.minDistance && d <= n.maxDistance {
+			found = append(found, nearResult{id: entry.id, distance: d})
+		}
+	}
+	sort.Sort(found)
+	for _, r := range found {
+		ids = append(ids, r.id)
+	}
+	return ids, keysExamined, docsExamined
+}
+
+type nearResult struct {
+	id       int64
+	distance float64
+}
+
+type nearResults []nearResult
+
+func (s nearResults) Len() int      { return len(s) }
+func (s nearResults) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s nearResults) Less(i, j int) bool {
+	if s[i].distance != s[j].distance {
+		return s[i].distance < s[j].distance
+	}
+	return s[i].id < s[j].id
+}
+
+// stage returns the description of the geo near stage which explain
+// reports.
+func (n *nearQuery) stage(idx *memoryIndex, stats *QueryResult) bson.D {
+	name := "GEO_NEAR_2D"
+	if idx.geo.kind == "2dsphere" {
+		name = "GEO_NEAR_2DSPHERE"
+	}
+	stage := bson.D{{"stage", name}}
+	if stats != nil {
+		stage = append(stage,
+			bson.DocElem{"nReturned", stats.nMatched},
+			bson.DocElem{"keysExamined", stats.KeysExamined},
+			bson.DocElem{"docsExamined", stats.DocsExamined})
+	}
+	return append(stage, bson.D{
+		{"keyPattern", idx.key},
+		{"indexName", idx.name},
+		{"indexVersion", 2},
+	}...)
+}
@@ -0,0 +1,186 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func geoPoint(lng, lat float64) bson.M {
+	return bson.M{"type": "Point", "coordinates": []float64{lng, lat}}
+}
+
+func geoPolygon(coords ...[]float64) bson.M {
+	return bson.M{"type": "Polygon", "coordinates": [][][]float64{coords}}
+}
+
+// insertStores inserts stores around Manhattan, indexed by location.
+func (s *gonzoSuite) insertStores(c *gc.C) *mgo.Collection {
+	coll := s.session.DB("db1").C("stores")
+	c.Assert(coll.EnsureIndexKey("$2dsphere:loc"), gc.IsNil)
+	for _, doc := range []bson.M{
+		{"_id": 1, "name": "Times Square", "loc": geoPoint(-73.9855, 40.7580)},
+		{"_id": 2, "name": "Empire State", "loc": geoPoint(-73.9857, 40.7484)},
+		{"_id": 3, "name": "Central Park", "loc": geoPoint(-73.9712, 40.7740)},
+		{"_id": 4, "name": "Liberty Island", "loc": geoPoint(-74.0445, 40.6892)},
+		{"_id": 5, "name": "Brooklyn Bridge", "loc": geoPoint(-73.9969, 40.7061)},
+		{"_id": 6, "name": "Online"},
+	} {
+		c.Assert(coll.Insert(doc), gc.IsNil)
+	}
+	return coll
+}
+
+func findIds(c *gc.C, query *mgo.Query) []int {
+	var docs []struct {
+		Id int `bson:"_id"`
+	}
+	c.Assert(query.All(&docs), gc.IsNil)
+	ids := []int{}
+	for _, doc := range docs {
+		ids = append(ids, doc.Id)
+	}
+	return ids
+}
+
+func (s *gonzoSuite) TestNear(c *gc.C) {
+	coll := s.insertStores(c)
+
+	timesSquare := geoPoint(-73.9855, 40.7580)
+	c.Assert(findIds(c, coll.Find(bson.M{"loc": bson.M{"$near": bson.M{
+		"$geometry":    timesSquare,
+		"$maxDistance": 3000,
+	}}})), gc.DeepEquals, []int{1, 2, 3})
+	c.Assert(findIds(c, coll.Find(bson.M{"loc": bson.M{"$nearSphere": bson.M{
+		"$geometry":    timesSquare,
+		"$minDistance": 1500,
+	}}})), gc.DeepEquals, []int{3, 5, 4})
+	c.Assert(findIds(c, coll.Find(bson.M{
+		"loc":  bson.M{"$near": bson.M{"$geometry": timesSquare}},
+		"name": bson.M{"$ne": "Times Square"},
+	}).Limit(2)), gc.DeepEquals, []int{2, 3})
+
+	var result explainResult
+	err := coll.Find(bson.M{"loc": bson.M{"$near": bson.M{"$geometry": timesSquare}}}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.QueryPlanner.WinningPlan["stage"], gc.Equals, "GEO_NEAR_2DSPHERE")
+	c.Assert(result.QueryPlanner.WinningPlan["indexName"], gc.Equals, "loc_2dsphere")
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 5)
+
+	var doc bson.M
+	err = s.session.DB("db1").C("other").Find(bson.M{"loc": bson.M{"$near": []int{0, 0}}}).One(&doc)
+	c.Assert(err, gc.ErrorMatches, ".*unable to find index for \\$geoNear query")
+	// Flat distances need a 2d index.
+	err = coll.Find(bson.M{"loc": bson.M{"$near": []int{0, 0}}}).One(&doc)
+	c.Assert(err, gc.ErrorMatches, ".*unable to find index for \\$geoNear query")
+}
+
+func (s *gonzoSuite) TestGeoWithin(c *gc.C) {
+	coll := s.session.DB("db1").C("grid")
+	c.Assert(coll.EnsureIndexKey("$2d:pos"), gc.IsNil)
+	for i := 0; i < 25; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i, "pos": []int{i % 5, i / 5}}), gc.IsNil)
+	}
+
+	within := func(shape bson.M) []int {
+		return findIds(c, coll.Find(bson.M{"pos": bson.M{"$geoWithin": shape}}).Sort("_id"))
+	}
+	c.Assert(within(bson.M{"$box": [][]int{{1, 1}, {2, 3}}}), gc.DeepEquals, []int{6, 7, 11, 12, 16, 17})
+	c.Assert(within(bson.M{"$center": []interface{}{[]int{2, 2}, 1}}), gc.DeepEquals, []int{7, 11, 12, 13, 17})
+	c.Assert(within(bson.M{"$polygon": [][]int{{0, 0}, {2, 0}, {0, 2}}}), gc.DeepEquals, []int{0, 1, 2, 5, 6, 10})
+	c.Assert(within(bson.M{"$centerSphere": []interface{}{[]int{0, 0}, 0.025}}), gc.DeepEquals, []int{0, 1, 5, 6})
+
+	var result explainResult
+	err := coll.Find(bson.M{"pos": bson.M{"$geoWithin": bson.M{"$box": [][]int{{1, 1}, {2, 3}}}}}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inputStage(result.QueryPlanner.WinningPlan, "IXSCAN")["indexName"], gc.Equals, "pos_2d")
+
+	c.Assert(findIds(c, coll.Find(bson.M{"pos": bson.M{"$near": []int{4, 4}, "$maxDistance": 1.5}})),
+		gc.DeepEquals, []int{24, 19, 23, 18})
+
+	err = coll.Insert(bson.M{"pos": []int{200, 0}})
+	c.Assert(err, gc.ErrorMatches, "point not in interval of \\[ -180, 180 \\).*")
+	err = coll.Insert(bson.M{"pos": "here"})
+	c.Assert(err, gc.ErrorMatches, "location object expected.*")
+
+	// GeoJSON polygons contain points on the sphere.
+	stores := s.insertStores(c)
+	midtown := geoPolygon([]float64{-74.0, 40.74}, []float64{-73.96, 40.74},
+		[]float64{-73.96, 40.78}, []float64{-74.0, 40.78}, []float64{-74.0, 40.74})
+	c.Assert(findIds(c, stores.Find(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$geometry": midtown}}}).Sort("_id")),
+		gc.DeepEquals, []int{1, 2, 3})
+}
+
+func (s *gonzoSuite) TestGeoIntersects(c *gc.C) {
+	coll := s.session.DB("db1").C("shapes")
+	c.Assert(coll.EnsureIndexKey("$2dsphere:geo"), gc.IsNil)
+	for _, doc := range []bson.M{
+		{"_id": 1, "geo": bson.M{"type": "LineString", "coordinates": [][]float64{{0, 0}, {10, 10}}}},
+		{"_id": 2, "geo": geoPolygon([]float64{20, 20}, []float64{30, 20}, []float64{30, 30}, []float64{20, 20})},
+		{"_id": 3, "geo": geoPoint(5, 1)},
+		{"_id": 4, "geo": []float64{25, 22}},
+	} {
+		c.Assert(coll.Insert(doc), gc.IsNil)
+	}
+
+	intersects := func(geometry bson.M) []int {
+		return findIds(c, coll.Find(bson.M{"geo": bson.M{"$geoIntersects": bson.M{"$geometry": geometry}}}).Sort("_id"))
+	}
+	// A line crossing the first line, and entering the triangle.
+	c.Assert(intersects(bson.M{"type": "LineString", "coordinates": [][]float64{{0, 10}, {10, 0}}}),
+		gc.DeepEquals, []int{1})
+	c.Assert(intersects(bson.M{"type": "LineString", "coordinates": [][]float64{{25, 10}, {25, 21}}}),
+		gc.DeepEquals, []int{2})
+	// A box around the point and part of the line.
+	c.Assert(intersects(geoPolygon([]float64{4, 0}, []float64{6, 0}, []float64{6, 2}, []float64{4, 2}, []float64{4, 0})),
+		gc.DeepEquals, []int{3})
+	// A point inside the triangle, which is also where the legacy point is.
+	c.Assert(intersects(geoPoint(25, 22)), gc.DeepEquals, []int{2, 4})
+
+	err := coll.Insert(bson.M{"geo": bson.M{"type": "Point", "coordinates": []float64{0, 100}}})
+	c.Assert(err, gc.ErrorMatches, "Can't extract geo keys: .* longitude/latitude is out of bounds.*")
+	err = coll.Insert(bson.M{"geo": geoPolygon([]float64{0, 0}, []float64{1, 0}, []float64{1, 1}, []float64{0, 1})})
+	c.Assert(err, gc.ErrorMatches, "Can't extract geo keys: .* Loop is not closed.*")
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes[1].Key, gc.DeepEquals, []string{"$2dsphere:geo"})
+}
+
+func (s *gonzoSuite) TestGeoNearStage(c *gc.C) {
+	coll := s.insertStores(c)
+
+	var docs []struct {
+		Id   int     `bson:"_id"`
+		Dist float64 `bson:"dist"`
+	}
+	err := coll.Pipe([]bson.M{
+		{"$geoNear": bson.M{
+			"near":               geoPoint(-73.9855, 40.7580),
+			"distanceField":      "dist",
+			"distanceMultiplier": 0.001,
+			"maxDistance":        6000,
+			"query":              bson.M{"_id": bson.M{"$ne": 2}},
+		}},
+		{"$skip": 1},
+	}).All(&docs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.HasLen, 2)
+	c.Assert(docs[0].Id, gc.Equals, 3)
+	c.Assert(docs[1].Id, gc.Equals, 5)
+	// Distances are great-circle distances, in kilometers here.
+	c.Assert(docs[0].Dist > 2.0 && docs[0].Dist < 2.2, gc.Equals, true, gc.Commentf("%v", docs[0].Dist))
+	c.Assert(docs[1].Dist > 5.7 && docs[1].Dist < 6.0, gc.Equals, true, gc.Commentf("%v", docs[1].Dist))
+
+	var counts []bson.M
+	err = coll.Pipe([]bson.M{{"$match": bson.M{"loc": bson.M{"$exists": true}}}, {"$count": "n"}}).All(&counts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(counts, gc.DeepEquals, []bson.M{{"n": 5}})
+
+	err = coll.Pipe([]bson.M{{"$match": bson.M{}}, {"$geoNear": bson.M{}}}).All(&counts)
+	c.Assert(err, gc.ErrorMatches, "\\$geoNear is only valid as the first stage in a pipeline.")
+	err = s.session.DB("db1").C("other").Pipe([]bson.M{{"$geoNear": bson.M{
+		"near": []int{0, 0}, "distanceField": "d",
+	}}}).All(&counts)
+	c.Assert(err, gc.ErrorMatches, "\\$geoNear requires a 2d or 2dsphere index, but none were found")
+}
@@ -0,0 +1,380 @@
+package gonzo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// indexField is one field of an index key pattern.
+type indexField struct {
+	path string
+	desc bool
+}
+
+// indexEntry maps an index key to the record holding a document.
+type indexEntry struct {
+	key []interface{}
+	id  int64
+}
+
+// memoryIndex is an ordered index over the documents in a
+// MemoryCollection. Entries are kept sorted by key, then record id.
+type memoryIndex struct {
+	name   string
+	key    bson.D
+	spec   bson.D
+	fields []indexField
+
+	unique  bool
+	sparse  bool
+	partial bson.M
+
+	// multikey is set once any document has had an array value in an
+	// indexed field.
+	multikey bool
+
+	// text is set for text indexes, which index the terms in documents
+	// rather than field values.
+	text *textIndex
+
+	// geo is set for 2d and 2dsphere indexes, which hold the locations
+	// in a field as they are, to be matched by geospatial queries.
+	geo *geoIndex
+
+	entries []indexEntry
+}
+
+// idIndex returns the collection's index on _id, which every collection
+// but the oplog has, or nil if it has none.
+func (c *MemoryCollection) idIndex() *memoryIndex {
+	if len(c.indexes) > 0 && c.indexes[0].name == "_id_" {
+		return c.indexes[0]
+	}
+	return nil
+}
+
+// idIndexSpec is the specification of the index every collection has on
+// _id.
+var idIndexSpec = bson.D{
+	{"v", 2},
+	{"key", bson.D{{"_id", 1}}},
+	{"name", "_id_"},
+}
+
+// indexName returns the default name mongod gives an index with the given
+// key pattern.
+func indexName(key bson.D) string {
+	var parts []string
+	for _, kv := range key {
+		parts = append(parts, fmt.Sprintf("%s_%v", kv.Name, kv.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// newMemoryIndex creates an empty index from an index specification, as
+// given to createIndexes or inserted into system.indexes.
+func newMemoryIndex(spec bson.D) (*memoryIndex, error) {
+	idx := &memoryIndex{}
+	var options bson.D
+	for _, kv := range spec {
+		switch kv.Name {
+		case "key":
+			idx.key = asDoc(kv.Value)
+			continue
+		case "name":
+			name, ok := kv.Value.(string)
+			if !ok {
+				return nil, errorf(ErrBadValue, "index name must be a string: %v", kv.Value)
+			}
+			idx.name = name
+			continue
+		case "v", "ns", "weights", "default_language", "language_override", "textIndexVersion":
+			continue
+		case "unique":
+			idx.unique = asBool(kv.Value)
+		case "sparse":
+			idx.sparse = asBool(kv.Value)
+		case "partialFilterExpression":
+			partial, err := asBsonM(kv.Value)
+			if err != nil || partial == nil {
+				return nil, errorf(ErrBadValue, "partialFilterExpression must be an object: %v", kv.Value)
+			}
+			idx.partial = partial
+		}
+		options = append(options, kv)
+	}
+	if len(idx.key) == 0 {
+		return nil, errorf(ErrBadValue, "index key pattern must be a non-empty object: %v", spec)
+	}
+	if isTextKey(idx.key) {
+		return newTextMemoryIndex(idx, spec, options)
+	}
+	for _, kv := range idx.key {
+		if kind, ok := kv.Value.(string); ok {
+			if idx.geo != nil {
+				return nil, errorf(ErrBadValue, "can't have more than one geo field in an index: %v", idx.key)
+			}
+			geo, err := newGeoIndex(kv.Name, kind, spec)
+			if err != nil {
+				return nil, err
+			}
+			idx.geo = geo
+			idx.fields = append(idx.fields, indexField{path: kv.Name})
+			continue
+		}
+		var desc bool
+		switch n := asFloat64(kv.Value); {
+		case typeOrder(kv.Value) != 10:
+			return nil, errorf(ErrBadValue, "unsupported index type for field %q: %v", kv.Name, kv.Value)
+		case n < 0:
+			desc = true
+		case n == 0:
+			return nil, errorf(ErrBadValue, "index key values cannot be 0: %v", idx.key)
+		}
+		idx.fields = append(idx.fields, indexField{path: kv.Name, desc: desc})
+	}
+	if idx.name == "" {
+		idx.name = indexName(idx.key)
+	}
+	idx.spec = append(bson.D{
+		{"v", 2},
+		{"key", idx.key},
+		{"name", idx.name},
+	}, options...)
+	if _, ok := idx.option("2dsphereIndexVersion"); idx.geo != nil && idx.geo.kind == "2dsphere" && !ok {
+		idx.spec = append(idx.spec, bson.DocElem{"2dsphereIndexVersion", 3})
+	}
+	return idx, nil
+}
+
+// isGeoField returns whether path is the location field of a geo index.
+func (idx *memoryIndex) isGeoField(path string) bool {
+	return idx.geo != nil && idx.geo.field == path
+}
+
+// isTextKey returns whether an index key pattern is that of a text index.
+func isTextKey(key bson.D) bool {
+	for _, kv := range key {
+		if kv.Value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+// newTextMemoryIndex completes a text index. Its entries are keyed by the
+// terms in each document, and its key pattern is stored the way mongod
+// does, with the indexed fields given by the weights option.
+func newTextMemoryIndex(idx *memoryIndex, spec, options bson.D) (*memoryIndex, error) {
+	text, err := newTextIndex(idx.key, spec)
+	if err != nil {
+		return nil, err
+	}
+	if idx.name == "" {
+		idx.name = indexName(idx.key)
+	}
+	idx.text = text
+	idx.key = bson.D{{"_fts", "text"}, {"_ftsx", 1}}
+	idx.fields = []indexField{{path: "_fts"}}
+	idx.spec = append(append(bson.D{
+		{"v", 2},
+		{"key", idx.key},
+		{"name", idx.name},
+	}, options...), text.options()...)
+	return idx, nil
+}
+
+// option returns the value of an index option, such as "unique".
+func (idx *memoryIndex) option(name string) (interface{}, bool) {
+	for _, kv := range idx.spec {
+		if kv.Name == name {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// sameKey returns whether two indexes have the same key pattern.
+func (idx *memoryIndex) sameKey(other *memoryIndex) bool {
+	if len(idx.key) != len(other.key) {
+		return false
+	}
+	for i := range idx.key {
+		if idx.key[i].Name != other.key[i].Name || compareValues(idx.key[i].Value, other.key[i].Value) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sameSpec returns whether two indexes are identical, apart from their
+// entries.
+func (idx *memoryIndex) sameSpec(other *memoryIndex) bool {
+	return idx.name == other.name && compareDocs(idx.spec, other.spec) == 0
+}
+
+// keys returns the index keys for a document. Documents with an array
+// value in an indexed field have a key for each element of the array.
+// Documents excluded from a sparse or partial index have no keys.
+func (idx *memoryIndex) keys(doc bson.M) ([][]interface{}, error) {
+	if idx.partial != nil && !isPatternMatch(doc, idx.partial) {
+		return nil, nil
+	}
+	if idx.text != nil {
+		return idx.text.keys(doc)
+	}
+	keys := [][]interface{}{nil}
+	var arrayField string
+	var anyFound bool
+	for _, field := range idx.fields {
+		var values []interface{}
+		value, found := lookupPath(doc, field.path)
+		anyFound = anyFound || found
+		if idx.isGeoField(field.path) {
+			if value == nil {
+				// Documents without a location are not in geo indexes.
+				return nil, nil
+			}
+			if err := idx.geo.check(doc, value); err != nil {
+				return nil, err
+			}
+			values = []interface{}{value}
+		} else if array, ok := value.([]interface{}); ok {
+			if arrayField != "" {
+				return nil, errorf(ErrCannotIndexParallel,
+					"cannot index parallel arrays [%s] [%s]", field.path, arrayField)
+			}
+			arrayField = field.path
+			idx.multikey = true
+			values = array
+			if len(values) == 0 {
+				values = []interface{}{bson.Undefined}
+			}
+		} else {
+			values = []interface{}{value}
+		}
+
+		var next [][]interface{}
+		for _, key := range keys {
+			for _, value := range values {
+				next = append(next, append(append([]interface{}(nil), key...), value))
+			}
+		}
+		keys = next
+	}
+	if idx.sparse && !anyFound {
+		return nil, nil
+	}
+
+	// Remove duplicate keys from repeated array elements.
+	var result [][]interface{}
+	for _, key := range keys {
+		dup := false
+		for _, prev := range result {
+			if idx.compareKeys(key, prev) == 0 {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// compareKeys compares the leading fields of two index keys, in index
+// order.
+func (idx *memoryIndex) compareKeys(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		cmp := compareValues(a[i], b[i])
+		if idx.fields[i].desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// search returns the position of the first entry not before (key, id).
+func (idx *memoryIndex) search(key []interface{}, id int64) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		cmp := idx.compareKeys(idx.entries[i].key, key)
+		return cmp > 0 || cmp == 0 && idx.entries[i].id >= id
+	})
+}
+
+func (idx *memoryIndex) insert(keys [][]interface{}, id int64) {
+	for _, key := range keys {
+		i := idx.search(key, id)
+		idx.entries = append(idx.entries, indexEntry{})
+		copy(idx.entries[i+1:], idx.entries[i:])
+		idx.entries[i] = indexEntry{key: key, id: id}
+	}
+}
+
+// duplicate returns the first key which another record already has in a
+// unique index.
+func (idx *memoryIndex) duplicate(keys [][]interface{}, id int64) ([]interface{}, bool) {
+	if !idx.unique {
+		return nil, false
+	}
+	for _, key := range keys {
+		for _, other := range idx.lookup(key) {
+			if other != id {
+				return key, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// dupKeyError returns the error mongod reports when a write would add a
+// duplicate key to a unique index.
+func (idx *memoryIndex) dupKeyError(ns string, key []interface{}) error {
+	var keyValue bson.D
+	for i, field := range idx.fields {
+		keyValue = append(keyValue, bson.DocElem{field.path, key[i]})
+	}
+	return &Error{
+		Code: ErrDuplicateKey,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %s",
+			ns, idx.name, formatValue(keyValue)),
+		Info: bson.D{
+			{"keyPattern", idx.key},
+			{"keyValue", keyValue},
+		},
+	}
+}
+
+func (idx *memoryIndex) remove(keys [][]interface{}, id int64) {
+	for _, key := range keys {
+		i := idx.search(key, id)
+		if i < len(idx.entries) && idx.entries[i].id == id && idx.compareKeys(idx.entries[i].key, key) == 0 {
+			idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+		}
+	}
+}
+
+// lookup returns the records whose keys begin with the given values, in
+// index order.
+func (idx *memoryIndex) lookup(prefix []interface{}) []int64 {
+	lo := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.compareKeys(idx.entries[i].key, prefix) >= 0
+	})
+	var result []int64
+	seen := make(map[int64]bool)
+	for i := lo; i < len(idx.entries) && idx.compareKeys(idx.entries[i].key, prefix) == 0; i++ {
+		id := idx.entries[i].id
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
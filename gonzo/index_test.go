@@ -0,0 +1,214 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *gonzoSuite) TestEnsureIndex(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"artist", "-venue"}})
+	c.Assert(err, gc.IsNil)
+	err = coll.EnsureIndexKey("label")
+	c.Assert(err, gc.IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes, gc.HasLen, 3)
+	c.Assert(indexes[0].Name, gc.Equals, "_id_")
+	c.Assert(indexes[1].Name, gc.Equals, "artist_1_venue_-1")
+	c.Assert(indexes[1].Key, gc.DeepEquals, []string{"artist", "-venue"})
+	c.Assert(indexes[2].Name, gc.Equals, "label_1")
+
+	var specs []bson.M
+	err = s.session.DB("db1").C("system.indexes").Find(bson.M{"name": "label_1"}).All(&specs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(specs, gc.HasLen, 1)
+	c.Assert(specs[0]["ns"], gc.Equals, "db1.c1")
+
+	err = coll.DropIndex("label")
+	c.Assert(err, gc.IsNil)
+	indexes, err = coll.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes, gc.HasLen, 2)
+
+	err = coll.DropIndexName("label_1")
+	c.Assert(err, gc.ErrorMatches, `index not found with name \[label_1\]`)
+	err = coll.DropIndexName("_id_")
+	c.Assert(err, gc.ErrorMatches, "cannot drop _id index")
+}
+
+func (s *gonzoSuite) TestIndexMaintained(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := coll.EnsureIndexKey("label", "artist")
+	c.Assert(err, gc.IsNil)
+	for _, testCase := range queryMatchTestCases {
+		err := coll.Insert(testCase)
+		c.Assert(err, gc.IsNil)
+	}
+
+	var result []bson.M
+	err = coll.Find(bson.M{"label": "trance syndicate"}).All(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 2)
+	c.Assert(result[0]["artist"], gc.Equals, "cherubs")
+	c.Assert(result[1]["artist"], gc.Equals, "ed hall")
+
+	err = coll.Update(bson.M{"artist": "cherubs"}, bson.M{"$set": bson.M{"label": "touch & go"}})
+	c.Assert(err, gc.IsNil)
+	err = coll.Find(bson.M{"label": "trance syndicate"}).All(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0]["artist"], gc.Equals, "ed hall")
+	err = coll.Find(bson.M{"label": "touch & go", "artist": "cherubs"}).All(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+
+	err = coll.Remove(bson.M{"artist": "cherubs"})
+	c.Assert(err, gc.IsNil)
+	err = coll.Find(bson.M{"label": "touch & go"}).All(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0]["artist"], gc.Equals, "the jesus lizard")
+}
+
+func (s *gonzoSuite) TestIndexMultikey(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := coll.Insert(bson.M{"tags": []string{"noise", "rock"}}, bson.M{"tags": []string{"rock"}})
+	c.Assert(err, gc.IsNil)
+	err = coll.EnsureIndexKey("tags")
+	c.Assert(err, gc.IsNil)
+
+	n, err := coll.Find(bson.M{"tags": "rock"}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	n, err = coll.Find(bson.M{"tags": "noise"}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	err = coll.EnsureIndexKey("tags", "other")
+	c.Assert(err, gc.IsNil)
+	err = coll.Insert(bson.M{"tags": []string{"a"}, "other": []string{"b"}})
+	c.Assert(err, gc.ErrorMatches, `cannot index parallel arrays \[other\] \[tags\]`)
+}
+
+func (s *gonzoSuite) TestUniqueIndex(c *gc.C) {
+	coll := s.session.DB("db1").C("users")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true})
+	c.Assert(err, gc.IsNil)
+
+	err = coll.Insert(bson.M{"email": "a@example.com"})
+	c.Assert(err, gc.IsNil)
+	err = coll.Insert(bson.M{"email": "a@example.com"})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+	c.Assert(err, gc.ErrorMatches,
+		`E11000 duplicate key error collection: db1.users index: email_1 dup key: { email: "a@example.com" }`)
+
+	err = coll.Insert(bson.M{"email": "b@example.com"})
+	c.Assert(err, gc.IsNil)
+	err = coll.Update(bson.M{"email": "b@example.com"}, bson.M{"$set": bson.M{"email": "a@example.com"}})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+	n, err := coll.Find(bson.M{"email": "b@example.com"}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// Documents missing the field all have a null key.
+	err = coll.Insert(bson.M{"name": "x"})
+	c.Assert(err, gc.IsNil)
+	err = coll.Insert(bson.M{"name": "y"})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+
+	// A unique index can't be built over duplicate data.
+	err = s.session.DB("db1").C("other").Insert(bson.M{"v": 1}, bson.M{"v": 1})
+	c.Assert(err, gc.IsNil)
+	err = s.session.DB("db1").C("other").EnsureIndex(mgo.Index{Key: []string{"v"}, Unique: true})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+}
+
+func (s *gonzoSuite) TestUniqueId(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := coll.Insert(bson.M{"_id": "foo", "n": 1})
+	c.Assert(err, gc.IsNil)
+	err = coll.Insert(bson.M{"_id": "foo", "n": 2})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+	c.Assert(err, gc.ErrorMatches,
+		`E11000 duplicate key error collection: db1.c1 index: _id_ dup key: { _id: "foo" }`)
+
+	var result bson.M
+	err = coll.FindId("foo").One(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result["n"], gc.Equals, 1)
+}
+
+func (s *gonzoSuite) TestUniqueCompoundSparsePartial(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"a", "b"}, Unique: true})
+	c.Assert(err, gc.IsNil)
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"s"}, Unique: true, Sparse: true})
+	c.Assert(err, gc.IsNil)
+	err = s.session.DB("db1").Run(bson.D{
+		{"createIndexes", "c1"},
+		{"indexes", []bson.D{{
+			{"key", bson.D{{"p", 1}}},
+			{"name", "p_1"},
+			{"unique", true},
+			{"partialFilterExpression", bson.D{{"active", bson.D{{"$eq", true}}}}},
+		}}},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(coll.Insert(bson.M{"a": 1, "b": 1, "p": "x", "active": true}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"a": 1, "b": 2, "p": "x", "active": false}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"a": 2, "b": 1}), gc.IsNil)
+
+	err = coll.Insert(bson.M{"a": 1, "b": 2})
+	c.Assert(err, gc.ErrorMatches,
+		`E11000 duplicate key error collection: db1.c1 index: a_1_b_1 dup key: { a: 1, b: 2 }`)
+	err = coll.Insert(bson.M{"a": 3, "p": "x", "active": true})
+	c.Assert(err, gc.ErrorMatches, `.* index: p_1 dup key: { p: "x" }`)
+
+	c.Assert(coll.Insert(bson.M{"a": 4, "s": 1}), gc.IsNil)
+	err = coll.Insert(bson.M{"a": 5, "s": 1})
+	c.Assert(mgo.IsDup(err), gc.Equals, true)
+}
+
+func (s *gonzoSuite) TestWriteCommandDuplicateKey(c *gc.C) {
+	var result struct {
+		N           int
+		WriteErrors []bson.M `bson:"writeErrors"`
+	}
+	err := s.session.DB("db1").Run(bson.D{
+		{"insert", "c1"},
+		{"documents", []bson.M{{"_id": 1}, {"_id": 1}, {"_id": 2}}},
+		{"ordered", false},
+	}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.N, gc.Equals, 2)
+	c.Assert(result.WriteErrors, gc.DeepEquals, []bson.M{{
+		"index":      1,
+		"code":       11000,
+		"codeName":   "DuplicateKey",
+		"keyPattern": bson.M{"_id": 1},
+		"keyValue":   bson.M{"_id": 1},
+		"errmsg":     "E11000 duplicate key error collection: db1.c1 index: _id_ dup key: { _id: 1 }",
+	}})
+
+	err = s.session.DB("db1").Run(bson.D{
+		{"update", "c1"},
+		{"updates", []bson.M{
+			{"q": bson.M{"_id": 3}, "u": bson.M{"$set": bson.M{"x": 1}}, "upsert": true},
+			{"q": bson.M{"_id": 2}, "u": bson.M{"_id": 1}},
+		}},
+	}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.N, gc.Equals, 1)
+	c.Assert(result.WriteErrors, gc.HasLen, 1)
+	c.Assert(result.WriteErrors[0]["code"], gc.Equals, 66)
+	c.Assert(result.WriteErrors[0]["codeName"], gc.Equals, "ImmutableField")
+
+	var doc bson.M
+	err = s.session.DB("db1").C("c1").FindId(3).One(&doc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(doc, gc.DeepEquals, bson.M{"_id": 3, "x": 1})
+}
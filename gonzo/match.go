@@ -0,0 +1,358 @@
+package gonzo
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// isPatternMatch returns whether a document matches a query pattern.
+func isPatternMatch(doc, pattern bson.M) bool {
+	for matchKey, matchValue := range pattern {
+		switch matchKey {
+		case "$and", "$or", "$nor":
+			clauses, _ := matchValue.([]interface{})
+			if !isLogicalMatch(doc, matchKey, clauses) {
+				return false
+			}
+			continue
+		case "$comment":
+			continue
+		case "$text":
+			// Text queries are answered by the text index.
+			continue
+		}
+		value, found := lookupPath(doc, matchKey)
+		if !isFieldMatch(value, found, matchValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLogicalMatch(doc bson.M, op string, clauses []interface{}) bool {
+	for _, clause := range clauses {
+		pattern, err := asBsonM(clause)
+		if err != nil {
+			return false
+		}
+		match := isPatternMatch(doc, pattern)
+		switch {
+		case op == "$and" && !match:
+			return false
+		case op == "$or" && match:
+			return true
+		case op == "$nor" && match:
+			return false
+		}
+	}
+	return op != "$or"
+}
+
+// operatorDoc returns the operators in a query value, if it is a document
+// of query operators such as {$gt: 1}.
+func operatorDoc(matchValue interface{}) (bson.D, bool) {
+	switch matchValue.(type) {
+	case bson.M, bson.D, map[string]interface{}:
+	default:
+		return nil, false
+	}
+	ops := asDoc(matchValue)
+	if len(ops) == 0 || !strings.HasPrefix(ops[0].Name, "$") {
+		return nil, false
+	}
+	return ops, true
+}
+
+// isFieldMatch returns whether the value found for a field matches the
+// value given for it in a query, which may be a literal or a document of
+// query operators.
+func isFieldMatch(value interface{}, found bool, matchValue interface{}) bool {
+	ops, ok := operatorDoc(matchValue)
+	if !ok {
+		return isValueMatch(value, matchValue)
+	}
+	var options string
+	for _, op := range ops {
+		if op.Name == "$options" {
+			options, _ = op.Value.(string)
+		}
+	}
+	for _, op := range ops {
+		if !isOperatorMatch(value, found, op.Name, op.Value, options) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValueMatch returns whether a document value is equal to the value
+// given for it in a query. Arrays match if any of their elements match,
+// and regular expressions match the strings they describe.
+func isValueMatch(value, matchValue interface{}) bool {
+	if re, ok := matchValue.(bson.RegEx); ok {
+		return isRegexMatch(value, re)
+	}
+	if compareValues(value, matchValue) == 0 {
+		return true
+	}
+	if array, ok := value.([]interface{}); ok {
+		for _, elem := range array {
+			if compareValues(elem, matchValue) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isOperatorMatch(value interface{}, found bool, op string, arg interface{}, options string) bool {
+	switch op {
+	case "$eq":
+		return isValueMatch(value, arg)
+	case "$ne":
+		return !isValueMatch(value, arg)
+	case "$gt", "$gte", "$lt", "$lte":
+		return isAnyElement(value, func(v interface{}) bool {
+			return isComparisonMatch(v, op, arg)
+		})
+	case "$in":
+		values, _ := arg.([]interface{})
+		for _, v := range values {
+			if isValueMatch(value, v) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		return !isOperatorMatch(value, found, "$in", arg, options)
+	case "$exists":
+		return found == asBool(arg)
+	case "$type":
+		return isAnyElement(value, func(v interface{}) bool {
+			return isTypeMatch(v, arg)
+		})
+	case "$size":
+		array, ok := value.([]interface{})
+		n, isInt := asInt64(arg)
+		return ok && isInt && int64(len(array)) == n
+	case "$all":
+		values, _ := arg.([]interface{})
+		for _, v := range values {
+			if !isFieldMatch(value, found, v) {
+				return false
+			}
+		}
+		return len(values) > 0
+	case "$elemMatch":
+		array, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, elem := range array {
+			if isElemMatch(elem, arg) {
+				return true
+			}
+		}
+		return false
+	case "$not":
+		if re, ok := arg.(bson.RegEx); ok {
+			return !isRegexMatch(value, re)
+		}
+		return !isFieldMatch(value, found, arg)
+	case "$regex":
+		var re bson.RegEx
+		switch pattern := arg.(type) {
+		case string:
+			re = bson.RegEx{Pattern: pattern, Options: options}
+		case bson.RegEx:
+			re = pattern
+			if options != "" {
+				re.Options = options
+			}
+		default:
+			return false
+		}
+		return isRegexMatch(value, re)
+	case "$options":
+		return true
+	case "$near", "$nearSphere", "$minDistance", "$maxDistance":
+		// Near queries are answered by a geo index.
+		return true
+	case "$geoWithin", "$within":
+		return isGeoWithinMatch(value, arg)
+	case "$geoIntersects":
+		return isGeoIntersectsMatch(value, arg)
+	case "$mod":
+		args, _ := arg.([]interface{})
+		if len(args) != 2 {
+			return false
+		}
+		divisor, remainder := int64(asFloat64(args[0])), int64(asFloat64(args[1]))
+		if divisor == 0 {
+			return false
+		}
+		return isAnyElement(value, func(v interface{}) bool {
+			return typeOrder(v) == 10 && int64(asFloat64(v))%divisor == remainder
+		})
+	}
+	return false
+}
+
+// isAnyElement returns whether a value, or any element of an array value,
+// satisfies a predicate.
+func isAnyElement(value interface{}, pred func(interface{}) bool) bool {
+	if array, ok := value.([]interface{}); ok {
+		for _, elem := range array {
+			if pred(elem) {
+				return true
+			}
+		}
+	}
+	return pred(value)
+}
+
+// isComparisonMatch evaluates a comparison operator. Values only compare
+// with values of the same type, so that {$gt: 1} does not match strings.
+func isComparisonMatch(value interface{}, op string, arg interface{}) bool {
+	if typeOrder(value) != typeOrder(arg) && arg != bson.MinKey && arg != bson.MaxKey {
+		return false
+	}
+	cmp := compareValues(value, arg)
+	switch op {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+func isElemMatch(elem, arg interface{}) bool {
+	if _, ok := operatorDoc(arg); ok {
+		return isFieldMatch(elem, true, arg)
+	}
+	pattern, err := asBsonM(arg)
+	if err != nil {
+		return false
+	}
+	doc, err := asBsonM(elem)
+	if err != nil || doc == nil {
+		return false
+	}
+	return isPatternMatch(doc, pattern)
+}
+
+func isRegexMatch(value interface{}, re bson.RegEx) bool {
+	if v, ok := value.(bson.RegEx); ok {
+		return v == re
+	}
+	compiled, err := compileRegex(re)
+	if err != nil {
+		return false
+	}
+	return isAnyElement(value, func(v interface{}) bool {
+		s, ok := v.(string)
+		return ok && compiled.MatchString(s)
+	})
+}
+
+func compileRegex(re bson.RegEx) (*regexp.Regexp, error) {
+	var flags string
+	for _, opt := range re.Options {
+		switch opt {
+		case 'i', 'm', 's':
+			flags += string(opt)
+		}
+	}
+	if flags != "" {
+		return regexp.Compile("(?" + flags + ")" + re.Pattern)
+	}
+	return regexp.Compile(re.Pattern)
+}
+
+var typeAliases = map[string]int{
+	"double":     1,
+	"string":     2,
+	"object":     3,
+	"array":      4,
+	"binData":    5,
+	"undefined":  6,
+	"objectId":   7,
+	"bool":       8,
+	"date":       9,
+	"null":       10,
+	"regex":      11,
+	"javascript": 13,
+	"symbol":     14,
+	"int":        16,
+	"timestamp":  17,
+	"long":       18,
+	"minKey":     -1,
+	"maxKey":     127,
+}
+
+// bsonType returns the BSON type number of a value.
+func bsonType(v interface{}) int {
+	switch {
+	case v == bson.MinKey:
+		return -1
+	case v == bson.MaxKey:
+		return 127
+	case v == bson.Undefined:
+		return 6
+	}
+	switch v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.M, bson.D, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.Binary, []byte:
+		return 5
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case nil:
+		return 10
+	case bson.RegEx:
+		return 11
+	case bson.JavaScript:
+		return 13
+	case bson.Symbol:
+		return 14
+	case int, int32:
+		return 16
+	case bson.MongoTimestamp:
+		return 17
+	case int64:
+		return 18
+	}
+	return 0
+}
+
+func isTypeMatch(value, arg interface{}) bool {
+	if alias, ok := arg.(string); ok {
+		if alias == "number" {
+			return typeOrder(value) == 10
+		}
+		code, ok := typeAliases[alias]
+		return ok && bsonType(value) == code
+	}
+	if typeOrder(arg) != 10 {
+		return false
+	}
+	return bsonType(value) == int(asFloat64(arg))
+}
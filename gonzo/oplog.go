@@ -0,0 +1,171 @@
+package gonzo
+
+import (
+	"log"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OplogSize is the size of the capped collection local.oplog.rs, in bytes.
+var OplogSize int64 = 64 << 20
+
+// oplog appends an entry to local.oplog.rs for each change made to the
+// documents in other databases, as a replica set primary would.
+type oplog struct {
+	coll  *MemoryCollection
+	clock func() Clock
+	last  bson.MongoTimestamp
+
+	// snapshots are the snapshots of the transactions in progress, which
+	// changes recorded in the oplog must be kept from. It is nil for the
+	// logs of transactions' own writes.
+	snapshots *snapshotSet
+
+	mu sync.Mutex
+}
+
+func newOplog(clock func() Clock, options bson.D) *oplog {
+	coll := NewMemoryCollection("local.oplog.rs", options)
+	// As with mongod's, the oplog has no _id index, and its entries have
+	// no _id, so that appending an entry is not slowed by indexing it.
+	coll.indexes = nil
+	return &oplog{
+		coll:  coll,
+		clock: clock,
+	}
+}
+
+// nextTimestamp returns a timestamp for the next entry. Timestamps are
+// the time in seconds, and an increment ordering entries within a second.
+func (o *oplog) nextTimestamp() bson.MongoTimestamp {
+	secs := o.clock().Now().Unix()
+	lastSecs, inc := int64(o.last)>>32, int64(o.last)&0xffffffff
+	if secs <= lastSecs {
+		secs, inc = lastSecs, inc+1
+	} else {
+		inc = 1
+	}
+	o.last = bson.MongoTimestamp(secs<<32 | inc)
+	return o.last
+}
+
+// log appends an entry for an operation on a namespace: "i" for an
+// insert, "u" for an update, "d" for a delete and "c" for a command. The
+// entry holds the inserted document, the update applied, the _id of the
+// document deleted, or the command in o, and the _id of the document
+// updated in o2. ui is the UUID of the collection changed.
+func (o *oplog) log(op, ns string, ui bson.Binary, obj, obj2 bson.M) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ts := o.nextTimestamp()
+	entry := bson.M{
+		"ts":   ts,
+		"t":    int64(1),
+		"v":    2,
+		"op":   op,
+		"ns":   ns,
+		"ui":   ui,
+		"wall": o.clock().Now(),
+		"o":    obj,
+	}
+	if obj2 != nil {
+		entry["o2"] = obj2
+	}
+	if w, ok := entryWrite(entry); ok && o.snapshots != nil {
+		o.snapshots.record(w, ts)
+	}
+	o.coll.mu.Lock()
+	err := o.coll.insertDoc(entry)
+	o.coll.mu.Unlock()
+	if err != nil {
+		log.Printf("failed to record %q operation on %s in the oplog: %v", op, ns, err)
+	}
+}
+
+// preserve keeps the collection with a namespace, or its absence if c is
+// nil, in the snapshots of transactions in progress, before it is changed.
+func (o *oplog) preserve(ns string, c *MemoryCollection) {
+	if o != nil && o.snapshots != nil {
+		o.snapshots.preserve(ns, c)
+	}
+}
+
+// preserveLocked keeps the locked collection in the snapshots of
+// transactions in progress, before it is changed.
+func (c *MemoryCollection) preserveLocked() {
+	c.oplog.preserve(c.ns, c)
+}
+
+// logInsert records a document inserted into a collection.
+func (c *MemoryCollection) logInsert(doc bson.M) {
+	if c.oplog != nil {
+		c.oplog.log("i", c.ns, c.uuid, copyDoc(doc), nil)
+	}
+}
+
+// logUpdate records a document changed by an update. Replacements are
+// recorded as the new document; updates with operators as the fields set
+// and unset.
+func (c *MemoryCollection) logUpdate(update, oldDoc, newDoc bson.M) {
+	if c.oplog == nil {
+		return
+	}
+	obj := copyDoc(newDoc)
+	if isOperatorUpdate(update) {
+		obj = oplogUpdate(oldDoc, newDoc)
+	}
+	c.oplog.log("u", c.ns, c.uuid, obj, bson.M{"_id": newDoc["_id"]})
+}
+
+// logDelete records a document removed from a collection.
+func (c *MemoryCollection) logDelete(doc bson.M) {
+	if c.oplog != nil {
+		c.oplog.log("d", c.ns, c.uuid, bson.M{"_id": doc["_id"]}, nil)
+	}
+}
+
+// logCommand records a command which changed a collection in a database.
+func (db *MemoryDB) logCommand(coll *MemoryCollection, cmd bson.M) {
+	if db.oplog != nil {
+		db.oplog.log("c", db.name+".$cmd", coll.uuid, cmd, nil)
+	}
+}
+
+// oplogUpdate returns the $set and $unset of the fields which differ
+// between two versions of a document.
+func oplogUpdate(oldDoc, newDoc bson.M) bson.M {
+	set, unset := bson.M{}, bson.M{}
+	for k, v := range newDoc {
+		if old, ok := oldDoc[k]; !ok || compareValues(old, v) != 0 {
+			set[k] = copyValue(v)
+		}
+	}
+	for k := range oldDoc {
+		if _, ok := newDoc[k]; !ok {
+			unset[k] = true
+		}
+	}
+	result := bson.M{}
+	if len(set) > 0 {
+		result["$set"] = set
+	}
+	if len(unset) > 0 {
+		result["$unset"] = unset
+	}
+	return result
+}
+
+// checkOplogReplay checks that a query with the oplog replay flag selects
+// the entries after a timestamp.
+func checkOplogReplay(filter bson.M) error {
+	ts, _ := asBsonM(filter["ts"])
+	if _, ok := ts["$gt"]; ok {
+		return nil
+	}
+	if _, ok := ts["$gte"]; ok {
+		return nil
+	}
+	return errorf(ErrBadValue,
+		"OplogReplay query does not contain top-level $gt or $gte over the 'ts' field.")
+}
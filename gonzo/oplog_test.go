@@ -0,0 +1,91 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Op        string              `bson:"op"`
+	NS        string              `bson:"ns"`
+	Object    bson.M              `bson:"o"`
+	Object2   bson.M              `bson:"o2"`
+}
+
+func (s *gonzoSuite) TestOplog(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1, "a": 1, "b": 1}), gc.IsNil)
+	c.Assert(coll.Update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"a": 2}}), gc.IsNil)
+	c.Assert(coll.Update(bson.M{"_id": 1}, bson.M{"c": 3}), gc.IsNil)
+	c.Assert(coll.Remove(bson.M{"_id": 1}), gc.IsNil)
+	// Failed and unchanging writes are not recorded.
+	c.Assert(coll.Insert(bson.M{"_id": 2}), gc.IsNil)
+	c.Assert(coll.Insert(bson.M{"_id": 2}), gc.NotNil)
+	c.Assert(coll.Update(bson.M{"_id": 2}, bson.M{"$set": bson.M{}}), gc.IsNil)
+
+	var entries []oplogEntry
+	oplog := s.session.DB("local").C("oplog.rs")
+	c.Assert(oplog.Find(nil).All(&entries), gc.IsNil)
+	c.Assert(entries, gc.HasLen, 5)
+	for i, entry := range entries {
+		c.Assert(entry.NS, gc.Equals, "db1.c1")
+		if i > 0 {
+			c.Assert(entry.Timestamp > entries[i-1].Timestamp, gc.Equals, true)
+		}
+	}
+	c.Assert(entries[0].Op, gc.Equals, "i")
+	c.Assert(entries[0].Object, gc.DeepEquals, bson.M{"_id": 1, "a": 1, "b": 1})
+	c.Assert(entries[1].Op, gc.Equals, "u")
+	c.Assert(entries[1].Object, gc.DeepEquals, bson.M{"$set": bson.M{"a": 2}})
+	c.Assert(entries[1].Object2, gc.DeepEquals, bson.M{"_id": 1})
+	c.Assert(entries[2].Op, gc.Equals, "u")
+	c.Assert(entries[2].Object, gc.DeepEquals, bson.M{"_id": 1, "c": 3})
+	c.Assert(entries[3].Op, gc.Equals, "d")
+	c.Assert(entries[3].Object, gc.DeepEquals, bson.M{"_id": 1})
+	c.Assert(entries[4].Op, gc.Equals, "i")
+
+	// Entries have no _id, and the oplog no _id index.
+	var raw bson.M
+	c.Assert(oplog.Find(nil).One(&raw), gc.IsNil)
+	_, hasID := raw["_id"]
+	c.Assert(hasID, gc.Equals, false)
+	indexes, err := oplog.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes, gc.HasLen, 0)
+
+	names, err := s.session.DB("local").CollectionNames()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"oplog.rs"})
+}
+
+func (s *gonzoSuite) TestOplogReplay(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	for i := 0; i < 3; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i}), gc.IsNil)
+	}
+	oplog := s.session.DB("local").C("oplog.rs")
+	var first oplogEntry
+	c.Assert(oplog.Find(nil).One(&first), gc.IsNil)
+
+	iter := oplog.Find(bson.M{"ts": bson.M{"$gt": first.Timestamp}}).LogReplay().Tail(5 * time.Second)
+	defer iter.Close()
+	var entry oplogEntry
+	for _, id := range []int{1, 2} {
+		c.Assert(iter.Next(&entry), gc.Equals, true)
+		c.Assert(entry.Object["_id"], gc.Equals, id)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		coll.Remove(bson.M{"_id": 0})
+	}()
+	c.Assert(iter.Next(&entry), gc.Equals, true)
+	c.Assert(entry.Op, gc.Equals, "d")
+	c.Assert(entry.Object["_id"], gc.Equals, 0)
+
+	var entries []oplogEntry
+	err := oplog.Find(bson.M{"op": "i"}).LogReplay().All(&entries)
+	c.Assert(err, gc.ErrorMatches, "OplogReplay query does not contain top-level \\$gt or \\$gte over the 'ts' field.")
+}
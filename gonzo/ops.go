@@ -0,0 +1,184 @@
+package gonzo
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errInterrupted           = errorf(ErrInterrupted, "operation was interrupted")
+	errInterruptedAtShutdown = errorf(ErrInterruptedAtShutdown, "interrupted at shutdown")
+)
+
+// operation is a request a connection is handling, as currentOp lists it.
+// killed is closed once killOp has asked for it to be interrupted, which
+// requests waiting on a tailable cursor or a fail point heed.
+type operation struct {
+	id      int32
+	conn    *connContext
+	op      string
+	ns      string
+	command bson.D
+	started time.Time
+
+	killed chan struct{}
+	once   sync.Once
+}
+
+func (op *operation) kill() {
+	op.once.Do(func() { close(op.killed) })
+}
+
+func (op *operation) killPending() bool {
+	select {
+	case <-op.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+// doc describes the operation as currentOp reports it.
+func (op *operation) doc(now time.Time) bson.M {
+	running := now.Sub(op.started)
+	doc := bson.M{
+		"desc":              fmt.Sprintf("conn%d", op.conn.id),
+		"connectionId":      op.conn.id,
+		"client":            remoteAddr(op.conn.Conn),
+		"active":            true,
+		"opid":              op.id,
+		"secs_running":      int64(running / time.Second),
+		"microsecs_running": int64(running / time.Microsecond),
+		"op":                op.op,
+		"ns":                op.ns,
+	}
+	if op.command != nil {
+		doc["command"] = op.command
+	}
+	if op.killPending() {
+		doc["killPending"] = true
+	}
+	return doc
+}
+
+// runOp registers a request as an operation in progress on its connection
+// while handle handles it.
+func (s *Server) runOp(c *connContext, kind, ns string, command bson.D, handle func()) {
+	op := &operation{
+		conn:    c,
+		op:      kind,
+		ns:      ns,
+		command: command,
+		started: time.Now(),
+		killed:  make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.lastOpID++
+	op.id = s.lastOpID
+	s.ops[op.id] = op
+	s.mu.Unlock()
+	c.op = op
+	defer func() {
+		c.op = nil
+		s.mu.Lock()
+		delete(s.ops, op.id)
+		s.mu.Unlock()
+	}()
+	handle()
+}
+
+// currentOp describes the operations in progress which match a filter, in
+// the order they started.
+func (s *Server) currentOp(filter bson.M) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int
+	for id := range s.ops {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	now := time.Now()
+	inprog := []interface{}{}
+	for _, id := range ids {
+		if doc := s.ops[int32(id)].doc(now); isPatternMatch(doc, filter) {
+			inprog = append(inprog, doc)
+		}
+	}
+	return inprog
+}
+
+// killOp interrupts an operation in progress, if there is one with the id
+// given. As with mongod, the operation stops when it next checks whether
+// it has been interrupted, if it ever does.
+func (s *Server) killOp(id int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if op, ok := s.ops[id]; ok {
+		op.kill()
+	}
+}
+
+// interrupted returns a channel closed once the operation the connection
+// is handling is killed, or nil if it is handling none.
+func (ctx *connContext) interrupted() <-chan struct{} {
+	if ctx.op == nil {
+		return nil
+	}
+	return ctx.op.killed
+}
+
+// currentOp runs a currentOp command. Fields other than currentOp, $all and
+// $ownOps filter the operations listed, as a query does. As only requests
+// in progress are registered, $all lists no idle connections.
+func (b *MemoryBackend) currentOp(c net.Conn, query *OpQueryMsg) (bson.D, error) {
+	s := contextOf(c).server
+	if s == nil {
+		return nil, errorf(ErrCommandNotSupported, "currentOp is not supported without a server")
+	}
+	filter := bson.M{}
+	for _, kv := range query.Doc[1:] {
+		if kv.Name != "$all" && kv.Name != "$ownOps" {
+			filter[kv.Name] = kv.Value
+		}
+	}
+	return markOk(bson.D{{"inprog", s.currentOp(filter)}}), nil
+}
+
+// killOp runs a killOp command, interrupting the operation given by op.
+func (b *MemoryBackend) killOp(c net.Conn, query *OpQueryMsg) (bson.D, error) {
+	s := contextOf(c).server
+	if s == nil {
+		return nil, errorf(ErrCommandNotSupported, "killOp is not supported without a server")
+	}
+	v, ok := query.Get("op")
+	if !ok {
+		return nil, errorf(ErrBadValue, "Did not provide \"op\" field")
+	}
+	id, ok := asInt64(v)
+	if !ok || id != int64(int32(id)) {
+		return nil, errorf(ErrBadValue, "\"op\" field must be a 32 bit integer, not %s", formatValue(v))
+	}
+	if s.Verbose {
+		log.Printf("going to kill op: op: %d", id)
+	}
+	s.killOp(int32(id))
+	return markOk(bson.D{{"info", "attempting to kill op"}}), nil
+}
+
+// sleep waits for d to pass, unless the request is interrupted first.
+func (b *MemoryBackend) sleep(c net.Conn, d time.Duration) error {
+	select {
+	case <-b.Clock().After(d):
+		return nil
+	case <-contextOf(c).interrupted():
+		return errInterrupted
+	case <-b.t.Dying():
+		return errInterruptedAtShutdown
+	}
+}
@@ -0,0 +1,126 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+type currentOpResult struct {
+	Inprog []bson.M
+}
+
+// awaitOp waits for an operation matching a filter to be in progress,
+// returning its description.
+func (s *gonzoSuite) awaitOp(c *gc.C, filter bson.D) bson.M {
+	for i := 0; ; i++ {
+		var result currentOpResult
+		c.Assert(s.session.Run(append(bson.D{{"currentOp", 1}}, filter...), &result), gc.IsNil)
+		if len(result.Inprog) > 0 {
+			c.Assert(result.Inprog, gc.HasLen, 1)
+			return result.Inprog[0]
+		}
+		c.Assert(i < 100, gc.Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *gonzoSuite) TestCurrentOp(c *gc.C) {
+	// currentOp lists itself, among the operations in progress.
+	var result currentOpResult
+	c.Assert(s.session.Run(bson.D{{"currentOp", 1}, {"$all", true}}, &result), gc.IsNil)
+	c.Assert(result.Inprog, gc.HasLen, 1)
+	op := result.Inprog[0]
+	c.Assert(op["active"], gc.Equals, true)
+	c.Assert(op["op"], gc.Equals, "command")
+	c.Assert(op["ns"], gc.Equals, "admin.$cmd")
+	c.Assert(op["command"], gc.DeepEquals, bson.M{"currentOp": 1, "$all": true})
+	c.Assert(op["desc"], gc.Matches, "conn[0-9]+")
+	c.Assert(op["opid"], gc.FitsTypeOf, 0)
+
+	err := s.session.DB("db1").Run("currentOp", nil)
+	c.Assert(err, gc.ErrorMatches, "currentOp may only be run against the admin database.")
+	c.Assert(errorCode(err), gc.Equals, 13)
+	err = s.session.DB("db1").Run(bson.D{{"killOp", 1}, {"op", 1}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 13)
+	err = s.session.Run(bson.D{{"killOp", 1}, {"op", "one"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 2)
+	err = s.session.Run(bson.D{{"killOp", 1}, {"op", 1.5}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 2)
+}
+
+func (s *gonzoSuite) TestKillOpBlockedCommand(c *gc.C) {
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(s.session.Run(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", bson.M{"times": 1}},
+		{"data", bson.M{"failCommands": []string{"count"}, "blockConnection": true, "blockTimeMS": 60000}},
+	}, nil), gc.IsNil)
+	blocked := s.session.Copy()
+	defer blocked.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := blocked.DB("db1").C("c1").Count()
+		errs <- err
+	}()
+
+	op := s.awaitOp(c, bson.D{{"command.count", "c1"}})
+	c.Assert(op["ns"], gc.Equals, "db1.$cmd")
+	c.Assert(op["secs_running"], gc.FitsTypeOf, int64(0))
+	var reply struct {
+		Info string
+	}
+	// Shells send op ids as doubles.
+	c.Assert(s.session.Run(bson.D{{"killOp", 1}, {"op", float64(op["opid"].(int))}}, &reply), gc.IsNil)
+	c.Assert(reply.Info, gc.Equals, "attempting to kill op")
+	select {
+	case err := <-errs:
+		c.Assert(err, gc.ErrorMatches, "operation was interrupted")
+		c.Assert(errorCode(err), gc.Equals, 11601)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("blocked command was not interrupted")
+	}
+
+	// The fail point blocks commands for blockTimeMS before they run.
+	c.Assert(s.session.Run(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", bson.M{"times": 1}},
+		{"data", bson.M{"failCommands": []string{"count"}, "blockConnection": true, "blockTimeMS": 100}},
+	}, nil), gc.IsNil)
+	start := time.Now()
+	n, err := s.session.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, gc.Equals, true)
+}
+
+func (s *gonzoSuite) TestKillOpGetMore(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 10 * time.Second
+	coll := s.createCapped(c, "events", 4096, 0)
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	tailing := s.session.Copy()
+	defer tailing.Close()
+	iter := tailing.DB("db1").C("events").Find(nil).Tail(-1)
+	var doc bson.M
+	c.Assert(iter.Next(&doc), gc.Equals, true)
+	done := make(chan bool, 1)
+	go func() {
+		done <- iter.Next(&doc)
+	}()
+
+	op := s.awaitOp(c, bson.D{{"op", "getmore"}, {"ns", "db1.events"}})
+	c.Assert(s.session.Run(bson.D{{"killOp", 1}, {"op", op["opid"]}}, nil), gc.IsNil)
+	select {
+	case ok := <-done:
+		c.Assert(ok, gc.Equals, false)
+		c.Assert(iter.Err(), gc.FitsTypeOf, &mgo.QueryError{})
+		c.Assert(errorCode(iter.Err()), gc.Equals, 11601)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("getMore was not interrupted")
+	}
+}
@@ -0,0 +1,702 @@
+package gonzo
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// interval is a range of values of one indexed field.
+type interval struct {
+	low, high         interface{}
+	lowIncl, highIncl bool
+}
+
+// fullInterval contains every value.
+var fullInterval = interval{bson.MinKey, bson.MaxKey, true, true}
+
+func pointInterval(v interface{}) interval {
+	return interval{v, v, true, true}
+}
+
+// typeBracket returns the interval of all values of the same BSON type as
+// v, which is as far as a comparison with v can match.
+func typeBracket(v interface{}) interval {
+	switch typeOrder(v) {
+	case 5:
+		return pointInterval(nil)
+	case 10:
+		return interval{math.Inf(-1), math.Inf(1), true, true}
+	case 15:
+		return interval{"", bson.D{}, true, false}
+	case 20:
+		return interval{bson.D{}, []interface{}{}, true, false}
+	case 25:
+		return interval{[]interface{}{}, bson.Binary{}, true, false}
+	case 30:
+		return interval{bson.Binary{}, bson.ObjectId(""), true, false}
+	case 35:
+		return interval{bson.ObjectId(""), false, true, false}
+	case 40:
+		return interval{false, true, true, true}
+	case 45:
+		return interval{true, bson.MongoTimestamp(math.MinInt64), false, false}
+	case 47:
+		return interval{bson.MongoTimestamp(math.MinInt64), bson.RegEx{}, true, false}
+	case 50:
+		return interval{bson.RegEx{}, bson.MaxKey, true, false}
+	}
+	return fullInterval
+}
+
+func (iv interval) isPoint() bool {
+	return iv.lowIncl && iv.highIncl && compareValues(iv.low, iv.high) == 0
+}
+
+func (iv interval) isEmpty() bool {
+	cmp := compareValues(iv.low, iv.high)
+	return cmp > 0 || cmp == 0 && !(iv.lowIncl && iv.highIncl)
+}
+
+func (iv interval) contains(v interface{}) bool {
+	lo, hi := compareValues(v, iv.low), compareValues(v, iv.high)
+	return (lo > 0 || lo == 0 && iv.lowIncl) && (hi < 0 || hi == 0 && iv.highIncl)
+}
+
+// restrict narrows the interval by a comparison operator such as $gt.
+func (iv interval) restrict(op string, v interface{}) interval {
+	switch op {
+	case "$gt", "$gte":
+		incl := op == "$gte"
+		if cmp := compareValues(v, iv.low); cmp > 0 || cmp == 0 && !incl {
+			iv.low, iv.lowIncl = v, incl
+		}
+	case "$lt", "$lte":
+		incl := op == "$lte"
+		if cmp := compareValues(v, iv.high); cmp < 0 || cmp == 0 && !incl {
+			iv.high, iv.highIncl = v, incl
+		}
+	}
+	return iv
+}
+
+// format formats the interval the way mongod reports index bounds, in
+// the given direction.
+func (iv interval) format(desc bool) string {
+	low, high, lowIncl, highIncl := iv.low, iv.high, iv.lowIncl, iv.highIncl
+	if desc {
+		low, high, lowIncl, highIncl = high, low, highIncl, lowIncl
+	}
+	open, close := "(", ")"
+	if lowIncl {
+		open = "["
+	}
+	if highIncl {
+		close = "]"
+	}
+	return open + formatBound(low) + ", " + formatBound(high) + close
+}
+
+func formatBound(v interface{}) string {
+	switch {
+	case v == bson.MinKey:
+		return "MinKey"
+	case v == bson.MaxKey:
+		return "MaxKey"
+	}
+	if f, ok := v.(float64); ok && math.IsInf(f, 0) {
+		if f < 0 {
+			return "-inf.0"
+		}
+		return "inf.0"
+	}
+	return formatValue(v)
+}
+
+// fieldBounds returns the intervals of values which a query pattern allows
+// a field to have, in ascending order. It returns false if the pattern
+// does not constrain the field, and sets exact if the intervals match
+// precisely the values the pattern does, so that the field need not be
+// matched again. Multikey indexes hold a key for each element of an array,
+// and any of them may satisfy each comparison, so only one side of a range
+// can be used to bound them.
+func fieldBounds(pattern bson.M, path string, multikey bool) (bounds []interval, exact, ok bool) {
+	value, found := pattern[path]
+	if !found {
+		return nil, false, false
+	}
+	ops, isOps := operatorDoc(value)
+	if !isOps {
+		if !isIndexableValue(value) {
+			return nil, false, false
+		}
+		return []interval{pointInterval(value)}, true, true
+	}
+
+	exact = true
+	var points []interval
+	var hasPoints, hasRange bool
+	var rng interval
+	for _, op := range ops {
+		switch op.Name {
+		case "$eq":
+			if !isIndexableValue(op.Value) {
+				exact = false
+				continue
+			}
+			points, hasPoints = []interval{pointInterval(op.Value)}, true
+		case "$in":
+			values, _ := op.Value.([]interface{})
+			var inPoints []interval
+			indexable := true
+			for _, v := range values {
+				if !isIndexableValue(v) {
+					indexable = false
+					break
+				}
+				inPoints = append(inPoints, pointInterval(v))
+			}
+			if !indexable {
+				exact = false
+				continue
+			}
+			sort.Sort(intervalSlice(inPoints))
+			points, hasPoints = dedupPoints(inPoints), true
+		case "$gt", "$gte", "$lt", "$lte":
+			if _, isArray := op.Value.([]interface{}); isArray || multikey && hasRange {
+				exact = false
+				continue
+			}
+			if !hasRange {
+				rng, hasRange = typeBracket(op.Value), true
+			}
+			rng = rng.restrict(op.Name, op.Value)
+		default:
+			exact = false
+		}
+	}
+	switch {
+	case hasPoints && hasRange && !multikey:
+		var inRange []interval
+		for _, p := range points {
+			if rng.contains(p.low) {
+				inRange = append(inRange, p)
+			}
+		}
+		return inRange, exact, true
+	case hasPoints:
+		return points, exact && !hasRange, true
+	case hasRange:
+		if rng.isEmpty() {
+			return []interval{}, exact, true
+		}
+		return []interval{rng}, exact, true
+	}
+	return nil, false, false
+}
+
+type intervalSlice []interval
+
+func (s intervalSlice) Len() int           { return len(s) }
+func (s intervalSlice) Less(i, j int) bool { return compareValues(s[i].low, s[j].low) < 0 }
+func (s intervalSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func dedupPoints(points []interval) []interval {
+	var result []interval
+	for _, p := range points {
+		if len(result) > 0 && compareValues(result[len(result)-1].low, p.low) == 0 {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// maxIndexScans limits how many separate ranges of an index a plan may
+// scan, when $in is used on several fields.
+const maxIndexScans = 200
+
+// queryPlan is a way of finding the documents a query may match: a scan
+// of the whole collection, or of ranges of an index.
+type queryPlan struct {
+	// index is the index scanned, or nil for a collection scan.
+	index *memoryIndex
+
+	// bounds are the intervals scanned in the leading fields of the index.
+	bounds [][]interval
+
+	// exact holds the query fields fully answered by the index bounds.
+	exact map[string]bool
+
+	// backward is set if the scan runs in reverse order.
+	backward bool
+
+	// sorted is set if the scan returns documents in the order the query
+	// sorts them.
+	sorted bool
+
+	// text is the $text query answered by a text index.
+	text *textQuery
+
+	// near is the $near query answered by a geo index.
+	near *nearQuery
+}
+
+// planIndex returns a plan which scans idx for the documents matching
+// filter, or nil if the index is of no use to the query. A hinted index is
+// used even if it constrains nothing.
+func planIndex(idx *memoryIndex, filter bson.M, sortSpec bson.D, hinted bool) *queryPlan {
+	if idx.text != nil {
+		// Text indexes only answer $text queries.
+		return nil
+	}
+	if idx.geo != nil && !hinted && !isGeoQuery(filter[idx.geo.field]) {
+		// Documents without a location are missing from geo indexes.
+		return nil
+	}
+	if !hinted && idx.partial != nil && !impliesPattern(filter, idx.partial) {
+		// The index is missing documents the query may match.
+		return nil
+	}
+	plan := &queryPlan{index: idx, exact: make(map[string]bool)}
+	scans := 1
+	for _, field := range idx.fields {
+		if idx.isGeoField(field.path) {
+			// Geospatial queries scan every location in the index, and
+			// match each against the query.
+			if len(plan.bounds) == 0 {
+				plan.bounds = append(plan.bounds, []interval{fullInterval})
+			}
+			break
+		}
+		bounds, exact, ok := fieldBounds(filter, field.path, idx.multikey)
+		if !ok {
+			break
+		}
+		if idx.sparse && !hinted {
+			for _, iv := range bounds {
+				if iv.contains(nil) {
+					// Documents missing the field are not in the index.
+					return nil
+				}
+			}
+		}
+		if len(bounds) > 0 && scans*len(bounds) > maxIndexScans {
+			break
+		}
+		scans *= len(bounds)
+		plan.bounds = append(plan.bounds, bounds)
+		if exact {
+			plan.exact[field.path] = true
+		}
+		if len(bounds) != 0 && !bounds[0].isPoint() {
+			break
+		}
+	}
+	plan.backward, plan.sorted = idx.sortOrder(plan.bounds, sortSpec)
+	if len(plan.bounds) == 0 && !hinted && (!plan.sorted || idx.sparse) {
+		return nil
+	}
+	return plan
+}
+
+// impliesPattern returns whether every document matching filter must also
+// match pattern, as far as can be simply told.
+func impliesPattern(filter, pattern bson.M) bool {
+	for k, v := range pattern {
+		fv, ok := filter[k]
+		if !ok {
+			return false
+		}
+		if compareValues(fv, v) == 0 {
+			continue
+		}
+		if ops, isOps := operatorDoc(v); isOps && len(ops) == 1 && ops[0].Name == "$eq" &&
+			compareValues(fv, ops[0].Value) == 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// sortOrder returns whether scanning the index within the given bounds
+// returns documents in the order of sortSpec, and if so, in which
+// direction. Fields constrained to a single value do not affect the order.
+func (idx *memoryIndex) sortOrder(bounds [][]interval, sortSpec bson.D) (backward, sorted bool) {
+	if len(sortSpec) == 0 || idx.multikey {
+		return false, false
+	}
+	i := 0
+	for fi, field := range idx.fields {
+		if i == len(sortSpec) || idx.isGeoField(field.path) {
+			break
+		}
+		if sortSpec[i].Name == field.path && typeOrder(sortSpec[i].Value) == 10 {
+			reverse := (asFloat64(sortSpec[i].Value) < 0) != field.desc
+			if i > 0 && reverse != backward {
+				return false, false
+			}
+			backward = reverse
+			i++
+			continue
+		}
+		if fi < len(bounds) && len(bounds[fi]) == 1 && bounds[fi][0].isPoint() {
+			continue
+		}
+		break
+	}
+	if i < len(sortSpec) {
+		return false, false
+	}
+	return backward, true
+}
+
+// boxes returns the combinations of the intervals given for each field,
+// in index order.
+func (idx *memoryIndex) boxes(bounds [][]interval) [][]interval {
+	boxes := [][]interval{nil}
+	for fi, field := range bounds {
+		ordered := field
+		if idx.fields[fi].desc {
+			ordered = make([]interval, len(field))
+			for i, iv := range field {
+				ordered[len(field)-1-i] = iv
+			}
+		}
+		var next [][]interval
+		for _, box := range boxes {
+			for _, iv := range ordered {
+				next = append(next, append(append([]interval(nil), box...), iv))
+			}
+		}
+		boxes = next
+	}
+	return boxes
+}
+
+// boxRange returns the range of index entries with keys within a box.
+func (idx *memoryIndex) boxRange(box []interval) (lo, hi int) {
+	start := make([]interface{}, len(box))
+	end := make([]interface{}, len(box))
+	startIncl, endIncl := true, true
+	for i, iv := range box {
+		start[i], end[i] = iv.low, iv.high
+		startIncl, endIncl = iv.lowIncl, iv.highIncl
+		if idx.fields[i].desc {
+			start[i], end[i] = iv.high, iv.low
+			startIncl, endIncl = iv.highIncl, iv.lowIncl
+		}
+	}
+	lo = sort.Search(len(idx.entries), func(i int) bool {
+		cmp := idx.compareKeys(idx.entries[i].key, start)
+		return cmp > 0 || cmp == 0 && startIncl
+	})
+	hi = lo + sort.Search(len(idx.entries)-lo, func(i int) bool {
+		cmp := idx.compareKeys(idx.entries[lo+i].key, end)
+		return cmp > 0 || cmp == 0 && !endIncl
+	})
+	return lo, hi
+}
+
+// countKeys returns the number of index keys within the given bounds,
+// which is how many a scan of them examines.
+func (idx *memoryIndex) countKeys(bounds [][]interval) int {
+	var n int
+	for _, box := range idx.boxes(bounds) {
+		lo, hi := idx.boxRange(box)
+		n += hi - lo
+	}
+	return n
+}
+
+// scan returns the records with index keys within the given bounds, in
+// index order, along with the number of keys examined.
+func (idx *memoryIndex) scan(bounds [][]interval) ([]int64, int) {
+	var result []int64
+	var keysExamined int
+	seen := make(map[int64]bool)
+	for _, box := range idx.boxes(bounds) {
+		lo, hi := idx.boxRange(box)
+		keysExamined += hi - lo
+		for _, entry := range idx.entries[lo:hi] {
+			if !seen[entry.id] {
+				seen[entry.id] = true
+				result = append(result, entry.id)
+			}
+		}
+	}
+	return result, keysExamined
+}
+
+// planRun is the outcome of running a query plan: the records it found,
+// and the work it took.
+type planRun struct {
+	plan         *queryPlan
+	ids          []int64
+	keysExamined int
+	docsExamined int
+
+	// scores holds the text score of each record found by a text search.
+	scores map[int64]float64
+}
+
+// works estimates how much work running the plan would take, as mongod's
+// planner counts it: each index key or document scanned is a unit of work,
+// and fetching the document for an index key is part of the same unit.
+// Sorting the results is extra work for plans which do not return them in
+// order, and every record scanned is taken to be a result. Index keys are
+// counted by searching for the ends of the plan's bounds, rather than by
+// scanning them.
+func (c *MemoryCollection) works(plan *queryPlan, sortSpec bson.D) int {
+	n := len(c.docs)
+	if plan.index != nil {
+		n = plan.index.countKeys(plan.bounds)
+	}
+	if len(sortSpec) > 0 && !plan.sorted {
+		n *= 2
+	}
+	return n
+}
+
+// runPlan finds the records which may match a query using plan.
+func (c *MemoryCollection) runPlan(plan *queryPlan) *planRun {
+	run := &planRun{plan: plan}
+	switch {
+	case plan.text != nil:
+		run.ids, run.scores, run.keysExamined, run.docsExamined = c.textSearch(plan.index, plan.text)
+		return run
+	case plan.near != nil:
+		run.ids, run.keysExamined, run.docsExamined = c.nearSearch(plan.index, plan.near)
+		return run
+	case plan.index == nil:
+		run.ids = c.recordIDs()
+	default:
+		run.ids, run.keysExamined = plan.index.scan(plan.bounds)
+	}
+	run.docsExamined = len(run.ids)
+	if plan.backward {
+		for i, j := 0, len(run.ids)-1; i < j; i, j = i+1, j-1 {
+			run.ids[i], run.ids[j] = run.ids[j], run.ids[i]
+		}
+	}
+	return run
+}
+
+// plans returns the candidate plans for a query. A collection scan is only
+// a candidate if no index is of use, or if it is hinted.
+func (c *MemoryCollection) plans(q *Query) ([]*queryPlan, error) {
+	filter := q.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+	natural := func(v interface{}) []*queryPlan {
+		return []*queryPlan{{backward: asFloat64(v) < 0, sorted: true}}
+	}
+	if len(q.Sort) == 1 && q.Sort[0].Name == "$natural" {
+		return natural(q.Sort[0].Value), nil
+	}
+	if arg, ok := filter["$text"]; ok {
+		// A $text query can only be answered by the text index.
+		for _, idx := range c.indexes {
+			if idx.text == nil {
+				continue
+			}
+			text, err := parseTextQuery(arg, idx.text.defaultLanguage)
+			if err != nil {
+				return nil, err
+			}
+			return []*queryPlan{{index: idx, text: text, exact: map[string]bool{"$text": true}}}, nil
+		}
+		return nil, errorf(ErrIndexNotFound, "text index required for $text query")
+	}
+	if path, ok := nearPath(filter); ok {
+		// A $near query can only be answered by a geo index on its field.
+		near, err := parseNear(path, filter[path])
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range c.indexes {
+			if idx.isGeoField(path) && near.canUse(idx.geo.kind) {
+				return []*queryPlan{{index: idx, near: near, exact: map[string]bool{path: true}}}, nil
+			}
+		}
+		return nil, errorf(ErrNoQueryExecutionPlans,
+			"error processing query: ns=%s planner returned error :: caused by :: "+
+				"unable to find index for $geoNear query", c.ns)
+	}
+
+	if q.Hint != nil {
+		var hinted *memoryIndex
+		switch hint := q.Hint.(type) {
+		case string:
+			for _, idx := range c.indexes {
+				if idx.name == hint {
+					hinted = idx
+				}
+			}
+		default:
+			key := asDoc(hint)
+			if len(key) == 1 && key[0].Name == "$natural" {
+				return natural(key[0].Value), nil
+			}
+			for _, idx := range c.indexes {
+				if len(key) > 0 && compareDocs(idx.key, key) == 0 {
+					hinted = idx
+				}
+			}
+		}
+		if hinted == nil {
+			return nil, errorf(ErrBadValue,
+				"error processing query: ns=%s planner returned error :: caused by :: "+
+					"hint provided does not correspond to an existing index", c.ns)
+		}
+		return []*queryPlan{planIndex(hinted, filter, q.Sort, true)}, nil
+	}
+
+	var result []*queryPlan
+	for _, idx := range c.indexes {
+		if plan := planIndex(idx, filter, q.Sort, false); plan != nil {
+			result = append(result, plan)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, &queryPlan{})
+	}
+	return result, nil
+}
+
+// choosePlan runs the candidate plan for a query estimated to do the least
+// work, and returns its run along with the plans rejected, which are
+// costed but not run.
+func (c *MemoryCollection) choosePlan(q *Query) (*planRun, []*queryPlan, error) {
+	plans, err := c.plans(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	best, bestWorks := plans[0], 0
+	if len(plans) > 1 {
+		bestWorks = c.works(best, q.Sort)
+	}
+	var rejected []*queryPlan
+	for _, plan := range plans[1:] {
+		if works := c.works(plan, q.Sort); works < bestWorks {
+			rejected = append(rejected, best)
+			best, bestWorks = plan, works
+		} else {
+			rejected = append(rejected, plan)
+		}
+	}
+	return c.runPlan(best), rejected, nil
+}
+
+// residualFilter returns the part of a query filter which documents found
+// by the plan must still be matched against.
+func (p *queryPlan) residualFilter(filter bson.M) bson.M {
+	result := bson.M{}
+	for k, v := range filter {
+		if !p.exact[k] {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// stage returns the description of the plan's stages which explain
+// reports. If stats is not nil, each stage includes the statistics of
+// its execution.
+func (p *queryPlan) stage(filter bson.M, stats *QueryResult) bson.D {
+	direction := "forward"
+	if p.backward {
+		direction = "backward"
+	}
+	if p.text != nil || p.near != nil {
+		var stage bson.D
+		if p.text != nil {
+			stage = p.text.stage(p.index, stats)
+		} else {
+			stage = p.near.stage(p.index, stats)
+		}
+		if residual := p.residualFilter(filter); len(residual) > 0 {
+			stage = append(stage, bson.DocElem{"filter", residual})
+		}
+		return stage
+	}
+	if p.index == nil {
+		stage := bson.D{{"stage", "COLLSCAN"}}
+		if stats != nil {
+			stage = append(stage,
+				bson.DocElem{"nReturned", stats.nMatched},
+				bson.DocElem{"docsExamined", stats.DocsExamined})
+		}
+		if len(filter) > 0 {
+			stage = append(stage, bson.DocElem{"filter", filter})
+		}
+		return append(stage, bson.DocElem{"direction", direction})
+	}
+
+	idx := p.index
+	var indexBounds bson.D
+	for i, field := range idx.fields {
+		intervals := []string{}
+		if i < len(p.bounds) {
+			ordered := p.bounds[i]
+			for j := range ordered {
+				if field.desc {
+					intervals = append(intervals, ordered[len(ordered)-1-j].format(true))
+				} else {
+					intervals = append(intervals, ordered[j].format(false))
+				}
+			}
+		} else {
+			intervals = append(intervals, fullInterval.format(field.desc))
+		}
+		indexBounds = append(indexBounds, bson.DocElem{field.path, intervals})
+	}
+	ixscan := bson.D{{"stage", "IXSCAN"}}
+	if stats != nil {
+		ixscan = append(ixscan,
+			bson.DocElem{"nReturned", stats.DocsExamined},
+			bson.DocElem{"keysExamined", stats.KeysExamined})
+	}
+	ixscan = append(ixscan, bson.D{
+		{"keyPattern", idx.key},
+		{"indexName", idx.name},
+		{"isMultiKey", idx.multikey},
+		{"isUnique", idx.unique},
+		{"isSparse", idx.sparse},
+		{"isPartial", idx.partial != nil},
+		{"indexVersion", 2},
+		{"direction", direction},
+		{"indexBounds", indexBounds},
+	}...)
+
+	fetch := bson.D{{"stage", "FETCH"}}
+	if stats != nil {
+		fetch = append(fetch,
+			bson.DocElem{"nReturned", stats.nMatched},
+			bson.DocElem{"docsExamined", stats.DocsExamined})
+	}
+	if residual := p.residualFilter(filter); len(residual) > 0 {
+		fetch = append(fetch, bson.DocElem{"filter", residual})
+	}
+	return append(fetch, bson.DocElem{"inputStage", ixscan})
+}
+
+// isIndexableValue returns whether matching a field against value is a
+// simple equality, which can be answered from an index.
+func isIndexableValue(value interface{}) bool {
+	switch v := value.(type) {
+	case []interface{}, bson.RegEx:
+		return false
+	case bson.M, bson.D, map[string]interface{}:
+		for _, kv := range asDoc(v) {
+			if strings.HasPrefix(kv.Name, "$") {
+				return false
+			}
+		}
+	}
+	return true
+}
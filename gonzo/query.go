@@ -0,0 +1,503 @@
+package gonzo
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Query describes a find operation on a collection.
+type Query struct {
+	Filter     bson.M
+	Sort       bson.D
+	Projection bson.D
+
+	// Hint names the index to use, or gives its key pattern.
+	Hint interface{}
+
+	Skip  int
+	Limit int
+}
+
+// QueryResult holds the documents a query returned, and describes how the
+// query was executed.
+type QueryResult struct {
+	Docs []interface{}
+
+	// Plan and RejectedPlans describe the plan chosen for the query and
+	// those considered, the way explain reports them.
+	Plan          bson.D
+	RejectedPlans []bson.D
+
+	// ExecutionStages describes the chosen plan along with the statistics
+	// of its execution.
+	ExecutionStages bson.D
+
+	KeysExamined  int
+	DocsExamined  int
+	ExecutionTime time.Duration
+
+	nMatched int
+}
+
+// Find runs a query using the index which answers it with the least work,
+// or a collection scan if no index is of use.
+func (c *MemoryCollection) Find(q *Query) (*QueryResult, error) {
+	proj, err := newProjection(q.Projection)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	run, rejected, err := c.choosePlan(q)
+	if err != nil {
+		return nil, err
+	}
+	filter := q.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+	residual := filter
+	if run.plan.index != nil {
+		residual = run.plan.residualFilter(filter)
+	}
+
+	if run.scores == nil && (proj.needsScore() || sortNeedsScore(q.Sort)) {
+		return nil, errorf(ErrBadValue, "query requires text score metadata, but it is not available")
+	}
+
+	result := &QueryResult{
+		KeysExamined: run.keysExamined,
+		DocsExamined: run.docsExamined,
+	}
+	var docs []interface{}
+	var scores []float64
+	for _, id := range run.ids {
+		doc := c.docs[id]
+		if isPatternMatch(doc, residual) {
+			docs = append(docs, doc)
+			scores = append(scores, run.scores[id])
+		}
+	}
+	result.nMatched = len(docs)
+	blockingSort := len(q.Sort) > 0 && !run.plan.sorted
+	if blockingSort {
+		sortDocs(docs, scores, q.Sort)
+	}
+	if q.Skip > 0 {
+		skip := q.Skip
+		if skip > len(docs) {
+			skip = len(docs)
+		}
+		docs, scores = docs[skip:], scores[skip:]
+	}
+	if q.Limit > 0 && q.Limit < len(docs) {
+		docs, scores = docs[:q.Limit], scores[:q.Limit]
+	}
+	for i, doc := range docs {
+		result.Docs = append(result.Docs, proj.apply(doc.(bson.M), scores[i]))
+	}
+	result.ExecutionTime = time.Since(start)
+
+	result.Plan = q.stages(run.plan, filter, proj, blockingSort, nil)
+	result.ExecutionStages = q.stages(run.plan, filter, proj, blockingSort, result)
+	for _, plan := range rejected {
+		result.RejectedPlans = append(result.RejectedPlans,
+			q.stages(plan, filter, proj, len(q.Sort) > 0 && !plan.sorted, nil))
+	}
+	return result, nil
+}
+
+// stages describes how a query is executed by a plan, from the index or
+// collection scan up through sorting, skipping, limiting and projecting
+// its results. If stats is not nil, each stage includes the statistics of
+// its execution.
+func (q *Query) stages(plan *queryPlan, filter bson.M, proj *projection, blockingSort bool, stats *QueryResult) bson.D {
+	stage := plan.stage(filter, stats)
+	n := 0
+	if stats != nil {
+		n = stats.nMatched
+	}
+	wrap := func(name string, nReturned int, fields ...bson.DocElem) {
+		outer := bson.D{{"stage", name}}
+		if stats != nil {
+			outer = append(outer, bson.DocElem{"nReturned", nReturned})
+		}
+		outer = append(outer, fields...)
+		stage = append(outer, bson.DocElem{"inputStage", stage})
+	}
+	if blockingSort {
+		wrap("SORT", n, bson.DocElem{"sortPattern", q.Sort})
+	}
+	if q.Skip > 0 {
+		if n -= q.Skip; n < 0 {
+			n = 0
+		}
+		wrap("SKIP", n, bson.DocElem{"skipAmount", q.Skip})
+	}
+	if q.Limit > 0 {
+		if n > q.Limit {
+			n = q.Limit
+		}
+		wrap("LIMIT", n, bson.DocElem{"limitAmount", q.Limit})
+	}
+	if proj != nil {
+		wrap("PROJECTION", n, bson.DocElem{"transformBy", q.Projection})
+	}
+	return stage
+}
+
+// explainReply returns the explain output for a query on the namespace
+// ns. The "queryPlanner" verbosity omits the executionStats.
+func explainReply(ns string, q *Query, result *QueryResult, verbosity string) bson.D {
+	parsedQuery := interface{}(q.Filter)
+	if q.Filter == nil {
+		parsedQuery = bson.D{}
+	}
+	rejected := result.RejectedPlans
+	if rejected == nil {
+		rejected = []bson.D{}
+	}
+	reply := bson.D{{"queryPlanner", bson.D{
+		{"plannerVersion", 1},
+		{"namespace", ns},
+		{"indexFilterSet", false},
+		{"parsedQuery", parsedQuery},
+		{"winningPlan", result.Plan},
+		{"rejectedPlans", rejected},
+	}}}
+	if verbosity == "queryPlanner" {
+		return reply
+	}
+	return append(reply, bson.DocElem{"executionStats", bson.D{
+		{"executionSuccess", true},
+		{"nReturned", len(result.Docs)},
+		{"executionTimeMillis", int64(result.ExecutionTime / time.Millisecond)},
+		{"totalKeysExamined", result.KeysExamined},
+		{"totalDocsExamined", result.DocsExamined},
+		{"executionStages", result.ExecutionStages},
+	}})
+}
+
+// legacyQuery returns the query an OP_QUERY message makes, and whether it
+// asks for the query to be explained. Query modifiers such as $orderby
+// wrap the filter in $query. A negative number to return, or one, limits
+// the results to a single batch; otherwise it is the size of the first
+// batch, and the rest are returned from a cursor.
+func legacyQuery(query *OpQueryMsg) (*Query, bool, error) {
+	q := &Query{
+		Projection: query.ReturnFieldsSelector,
+		Skip:       int(query.NumberToSkip),
+	}
+	if n := int(query.NumberToReturn); n < 0 {
+		q.Limit = -n
+	} else if n == 1 {
+		q.Limit = 1
+	}
+	if _, ok := query.Get("$query"); !ok {
+		q.Filter = query.Doc.Map()
+		return q, false, nil
+	}
+	var explain bool
+	for _, kv := range query.Doc {
+		switch kv.Name {
+		case "$query":
+			filter, err := asBsonM(kv.Value)
+			if err != nil {
+				return nil, false, errorf(ErrBadValue, "$query must be an object: %v", kv.Value)
+			}
+			q.Filter = filter
+		case "$orderby":
+			q.Sort = asDoc(kv.Value)
+		case "$hint":
+			q.Hint = kv.Value
+		case "$explain":
+			explain = asBool(kv.Value)
+		}
+	}
+	return q, explain, nil
+}
+
+// findQuery returns the query a find command makes.
+func findQuery(cmd bson.D) (*Query, error) {
+	q := &Query{}
+	for _, kv := range cmd[1:] {
+		switch kv.Name {
+		case "filter":
+			filter, err := asBsonM(kv.Value)
+			if err != nil {
+				return nil, errorf(ErrBadValue, "filter must be an object: %v", kv.Value)
+			}
+			q.Filter = filter
+		case "sort":
+			q.Sort = asDoc(kv.Value)
+		case "projection":
+			q.Projection = asDoc(kv.Value)
+		case "hint":
+			q.Hint = kv.Value
+		case "skip":
+			if q.Skip = int(asFloat64(kv.Value)); q.Skip < 0 {
+				return nil, errorf(ErrBadValue, "skip value must be non-negative, but received: %v", kv.Value)
+			}
+		case "limit":
+			if q.Limit = int(asFloat64(kv.Value)); q.Limit < 0 {
+				q.Limit = -q.Limit
+			}
+		}
+	}
+	return q, nil
+}
+
+// countQuery returns the query a count command makes.
+func countQuery(cmd bson.D) (*Query, error) {
+	q := &Query{}
+	for _, kv := range cmd[1:] {
+		switch kv.Name {
+		case "query":
+			filter, err := asBsonM(kv.Value)
+			if err != nil {
+				return nil, errorf(ErrBadValue, "query must be an object: %v", kv.Value)
+			}
+			q.Filter = filter
+		case "hint":
+			q.Hint = kv.Value
+		case "skip":
+			q.Skip = int(asFloat64(kv.Value))
+		case "limit":
+			if q.Limit = int(asFloat64(kv.Value)); q.Limit < 0 {
+				q.Limit = -q.Limit
+			}
+		}
+	}
+	return q, nil
+}
+
+// sortDocs sorts documents by a sort specification, along with their text
+// scores. Arrays sort by their least element in ascending order, and
+// their greatest in descending order. Text scores sort in descending
+// order.
+func sortDocs(docs []interface{}, scores []float64, sortSpec bson.D) {
+	sort.Stable(&docSorter{docs: docs, scores: scores, spec: sortSpec})
+}
+
+// sortNeedsScore returns whether a sort specification sorts by text score.
+func sortNeedsScore(sortSpec bson.D) bool {
+	for _, kv := range sortSpec {
+		if isTextScore(kv.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+type docSorter struct {
+	docs   []interface{}
+	scores []float64
+	spec   bson.D
+}
+
+func (s *docSorter) Len() int { return len(s.docs) }
+
+func (s *docSorter) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+func (s *docSorter) Less(i, j int) bool {
+	for _, kv := range s.spec {
+		var cmp int
+		if isTextScore(kv.Value) {
+			cmp = -compareValues(s.scores[i], s.scores[j])
+		} else {
+			desc := asFloat64(kv.Value) < 0
+			cmp = compareValues(sortKey(s.docs[i], kv.Name, desc), sortKey(s.docs[j], kv.Name, desc))
+			if desc {
+				cmp = -cmp
+			}
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+// sortKey returns the value a document is sorted by for a field.
+func sortKey(doc interface{}, path string, desc bool) interface{} {
+	value, _ := lookupPath(doc, path)
+	array, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	if len(array) == 0 {
+		return bson.Undefined
+	}
+	key := array[0]
+	for _, elem := range array[1:] {
+		cmp := compareValues(elem, key)
+		if desc && cmp > 0 || !desc && cmp < 0 {
+			key = elem
+		}
+	}
+	return key
+}
+
+// projection selects the fields of the documents a query returns. Fields
+// are either all included or all excluded, apart from _id, which is
+// included unless excluded explicitly, and fields set to the text score.
+type projection struct {
+	include bool
+	fields  projectionTree
+	noID    bool
+	scores  []string
+}
+
+// projectionTree holds the projected paths, with a nested tree for each
+// path into an embedded document, and a nil tree at each projected field.
+type projectionTree map[string]projectionTree
+
+// newProjection parses a projection specification. It returns nil if the
+// specification selects all fields.
+func newProjection(spec bson.D) (*projection, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	p := &projection{fields: projectionTree{}}
+	var hasInclude, hasExclude bool
+	for _, kv := range spec {
+		include := asBool(kv.Value)
+		if isTextScore(kv.Value) {
+			p.scores = append(p.scores, kv.Name)
+			continue
+		}
+		if _, isOps := operatorDoc(kv.Value); isOps {
+			return nil, errorf(ErrBadValue, "Unsupported projection option: %s: %s", kv.Name, formatValue(kv.Value))
+		}
+		if kv.Name == "_id" {
+			p.noID = !include
+			continue
+		}
+		if include {
+			hasInclude = true
+		} else {
+			hasExclude = true
+		}
+		tree := p.fields
+		parts := strings.Split(kv.Name, ".")
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				tree[part] = nil
+				break
+			}
+			if tree[part] == nil {
+				tree[part] = projectionTree{}
+			}
+			tree = tree[part]
+		}
+	}
+	if hasInclude && hasExclude {
+		return nil, errorf(ErrBadValue, "Projection cannot have a mix of inclusion and exclusion.")
+	}
+	p.include = hasInclude
+	if !p.include && !p.noID && len(p.fields) == 0 && len(p.scores) == 0 {
+		return nil, nil
+	}
+	if !p.include && p.noID {
+		p.fields["_id"] = nil
+	}
+	return p, nil
+}
+
+// needsScore returns whether the projection includes the text score.
+func (p *projection) needsScore() bool {
+	return p != nil && len(p.scores) > 0
+}
+
+// apply returns the projected fields of a document with the given text
+// score.
+func (p *projection) apply(doc bson.M, score float64) bson.M {
+	if p == nil {
+		return doc
+	}
+	var result bson.M
+	if p.include {
+		result = includeFields(doc, p.fields)
+		if id, ok := doc["_id"]; ok && !p.noID {
+			result["_id"] = id
+		}
+	} else {
+		result = excludeFields(doc, p.fields)
+	}
+	for _, name := range p.scores {
+		result[name] = score
+	}
+	return result
+}
+
+func includeFields(doc bson.M, tree projectionTree) bson.M {
+	result := bson.M{}
+	for name, sub := range tree {
+		value, ok := doc[name]
+		if !ok {
+			continue
+		}
+		if sub == nil {
+			result[name] = value
+			continue
+		}
+		if projected, ok := projectValue(value, sub, true); ok {
+			result[name] = projected
+		}
+	}
+	return result
+}
+
+func excludeFields(doc bson.M, tree projectionTree) bson.M {
+	result := bson.M{}
+	for name, value := range doc {
+		sub, ok := tree[name]
+		switch {
+		case !ok:
+			result[name] = value
+		case sub != nil:
+			if projected, ok := projectValue(value, sub, false); ok {
+				result[name] = projected
+			} else {
+				result[name] = value
+			}
+		}
+	}
+	return result
+}
+
+// projectValue projects the fields of an embedded document, or of each
+// document in an array. Other array elements are kept only when fields
+// are excluded.
+func projectValue(value interface{}, tree projectionTree, include bool) (interface{}, bool) {
+	switch v := value.(type) {
+	case bson.M, bson.D, map[string]interface{}:
+		doc, err := asBsonM(asDoc(v))
+		if err != nil {
+			return nil, false
+		}
+		if include {
+			return includeFields(doc, tree), true
+		}
+		return excludeFields(doc, tree), true
+	case []interface{}:
+		result := []interface{}{}
+		for _, elem := range v {
+			if projected, ok := projectValue(elem, tree, include); ok {
+				result = append(result, projected)
+			} else if !include {
+				result = append(result, elem)
+			}
+		}
+		return result, true
+	}
+	return nil, false
+}
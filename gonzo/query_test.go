@@ -0,0 +1,190 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func insertNumbers(c *gc.C, coll *mgo.Collection, n int) {
+	for i := 0; i < n; i++ {
+		err := coll.Insert(bson.M{"a": i, "b": i % 10})
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+type explainResult struct {
+	QueryPlanner struct {
+		WinningPlan   bson.M   `bson:"winningPlan"`
+		RejectedPlans []bson.M `bson:"rejectedPlans"`
+	} `bson:"queryPlanner"`
+	ExecutionStats struct {
+		NReturned         int `bson:"nReturned"`
+		TotalKeysExamined int `bson:"totalKeysExamined"`
+		TotalDocsExamined int `bson:"totalDocsExamined"`
+	} `bson:"executionStats"`
+}
+
+// inputStage returns the named stage of a plan, searching down through its
+// input stages.
+func inputStage(plan bson.M, name string) bson.M {
+	for plan != nil {
+		if plan["stage"] == name {
+			return plan
+		}
+		plan, _ = plan["inputStage"].(bson.M)
+	}
+	return nil
+}
+
+func (s *gonzoSuite) TestExplainIndexRange(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	insertNumbers(c, coll, 100)
+	c.Assert(coll.EnsureIndexKey("a"), gc.IsNil)
+
+	var result explainResult
+	err := coll.Find(bson.M{"a": bson.M{"$gte": 10, "$lt": 20}}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 10)
+	c.Assert(result.ExecutionStats.TotalKeysExamined, gc.Equals, 10)
+	c.Assert(result.ExecutionStats.TotalDocsExamined, gc.Equals, 10)
+	plan := result.QueryPlanner.WinningPlan
+	c.Assert(plan["stage"], gc.Equals, "FETCH")
+	ixscan := inputStage(plan, "IXSCAN")
+	c.Assert(ixscan, gc.NotNil)
+	c.Assert(ixscan["indexName"], gc.Equals, "a_1")
+	c.Assert(ixscan["indexBounds"], gc.DeepEquals, bson.M{"a": []interface{}{"[10, 20)"}})
+	// A collection scan is not considered when an index is of use.
+	c.Assert(result.QueryPlanner.RejectedPlans, gc.HasLen, 0)
+
+	var docs []bson.M
+	err = coll.Find(bson.M{"a": bson.M{"$in": []int{42, 7, 99}}}).All(&docs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.HasLen, 3)
+	c.Assert(docs[0]["a"], gc.Equals, 7)
+
+	err = coll.Find(bson.M{"b": 3}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.QueryPlanner.WinningPlan["stage"], gc.Equals, "COLLSCAN")
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 10)
+	c.Assert(result.ExecutionStats.TotalKeysExamined, gc.Equals, 0)
+	c.Assert(result.ExecutionStats.TotalDocsExamined, gc.Equals, 100)
+}
+
+func (s *gonzoSuite) TestExplainCompoundIndex(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	insertNumbers(c, coll, 100)
+	c.Assert(coll.EnsureIndexKey("b", "-a"), gc.IsNil)
+	c.Assert(coll.EnsureIndexKey("a"), gc.IsNil)
+
+	var result explainResult
+	err := coll.Find(bson.M{"b": 3, "a": bson.M{"$gt": 50}}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	ixscan := inputStage(result.QueryPlanner.WinningPlan, "IXSCAN")
+	c.Assert(ixscan["indexName"], gc.Equals, "b_1_a_-1")
+	c.Assert(ixscan["indexBounds"], gc.DeepEquals, bson.M{
+		"b": []interface{}{"[3, 3]"},
+		"a": []interface{}{"[inf.0, 50)"},
+	})
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 5)
+	c.Assert(result.ExecutionStats.TotalKeysExamined, gc.Equals, 5)
+	c.Assert(result.QueryPlanner.RejectedPlans, gc.HasLen, 1)
+	ixscan = inputStage(result.QueryPlanner.RejectedPlans[0], "IXSCAN")
+	c.Assert(ixscan["indexName"], gc.Equals, "a_1")
+
+	// The index returns documents in the order sorted, so that no sort
+	// stage is needed.
+	var docs []bson.M
+	query := coll.Find(bson.M{"b": 3}).Sort("a")
+	c.Assert(query.All(&docs), gc.IsNil)
+	c.Assert(docs, gc.HasLen, 10)
+	for i, doc := range docs {
+		c.Assert(doc["a"], gc.Equals, i*10+3)
+	}
+	err = query.Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inputStage(result.QueryPlanner.WinningPlan, "SORT"), gc.IsNil)
+	ixscan = inputStage(result.QueryPlanner.WinningPlan, "IXSCAN")
+	c.Assert(ixscan["indexName"], gc.Equals, "b_1_a_-1")
+	c.Assert(ixscan["direction"], gc.Equals, "backward")
+}
+
+func (s *gonzoSuite) TestHint(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	insertNumbers(c, coll, 100)
+	c.Assert(coll.EnsureIndexKey("a"), gc.IsNil)
+	c.Assert(coll.EnsureIndexKey("b"), gc.IsNil)
+
+	var result explainResult
+	err := coll.Find(bson.M{"a": 5}).Hint("b").Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inputStage(result.QueryPlanner.WinningPlan, "IXSCAN")["indexName"], gc.Equals, "b_1")
+	c.Assert(result.QueryPlanner.RejectedPlans, gc.HasLen, 0)
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 1)
+	c.Assert(result.ExecutionStats.TotalKeysExamined, gc.Equals, 100)
+
+	err = s.session.DB("db1").Run(bson.D{
+		{"explain", bson.D{{"find", "c1"}, {"filter", bson.M{"a": 5}}, {"hint", bson.M{"$natural": 1}}}},
+	}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.QueryPlanner.WinningPlan["stage"], gc.Equals, "COLLSCAN")
+	c.Assert(result.ExecutionStats.TotalDocsExamined, gc.Equals, 100)
+
+	var doc bson.M
+	err = coll.Find(bson.M{"a": 5}).Hint("c").One(&doc)
+	c.Assert(err, gc.ErrorMatches, ".*hint provided does not correspond to an existing index")
+}
+
+func (s *gonzoSuite) TestSortSkipLimitSelect(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	insertNumbers(c, coll, 30)
+
+	var docs []bson.M
+	err := coll.Find(bson.M{"a": bson.M{"$lt": 20}}).Sort("b", "-a").Skip(1).Limit(3).
+		Select(bson.M{"_id": 0, "a": 1}).All(&docs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"a": 0}, {"a": 11}, {"a": 1}})
+
+	var result explainResult
+	err = coll.Find(nil).Sort("-a").Limit(3).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inputStage(result.QueryPlanner.WinningPlan, "SORT")["sortPattern"], gc.DeepEquals, bson.M{"a": -1})
+
+	var doc bson.M
+	err = coll.Find(nil).Select(bson.M{"a": 1, "b": 0}).One(&doc)
+	c.Assert(err, gc.ErrorMatches, "Projection cannot have a mix of inclusion and exclusion.")
+}
+
+func (s *gonzoSuite) TestFindCommand(c *gc.C) {
+	db := s.session.DB("db1")
+	insertNumbers(c, db.C("c1"), 20)
+	c.Assert(db.C("c1").EnsureIndexKey("a"), gc.IsNil)
+
+	var reply struct {
+		Cursor struct {
+			Id         int64
+			NS         string
+			FirstBatch []bson.M `bson:"firstBatch"`
+		}
+	}
+	err := db.Run(bson.D{
+		{"find", "c1"},
+		{"filter", bson.M{"a": bson.M{"$in": []int{1, 2, 3}}}},
+		{"sort", bson.M{"a": -1}},
+		{"projection", bson.M{"a": 1, "_id": 0}},
+	}, &reply)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply.Cursor.NS, gc.Equals, "db1.c1")
+	c.Assert(reply.Cursor.FirstBatch, gc.DeepEquals, []bson.M{{"a": 3}, {"a": 2}, {"a": 1}})
+
+	var result explainResult
+	err = db.Run(bson.D{
+		{"explain", bson.D{{"find", "c1"}, {"filter", bson.M{"a": 5}}}},
+		{"verbosity", "executionStats"},
+	}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inputStage(result.QueryPlanner.WinningPlan, "IXSCAN")["indexName"], gc.Equals, "a_1")
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 1)
+	c.Assert(result.ExecutionStats.TotalKeysExamined, gc.Equals, 1)
+	c.Assert(result.ExecutionStats.TotalDocsExamined, gc.Equals, 1)
+}
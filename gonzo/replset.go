@@ -0,0 +1,450 @@
+package gonzo
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/tomb.v2"
+)
+
+// ReplicaSet is a set of servers which present themselves to clients as
+// the members of a replica set. The members share a backend, so there is
+// no replication lag: only the roles of the members differ. The first
+// member starts as the primary.
+//
+// Secondaries refuse writes with NotMaster errors, and reads by clients
+// which have not set slaveOk. Tests can force failovers by stepping the
+// primary down, electing a member, or making members unreachable.
+type ReplicaSet struct {
+	Name string
+
+	backend *MemoryBackend
+	servers []*Server
+	hosts   []string
+	started time.Time
+	t       tomb.Tomb
+
+	// primary is the index of the primary member, or -1 while there is
+	// none. Each election starts a new term with a new election id.
+	primary      int
+	lastPrimary  int
+	term         int64
+	electionID   bson.ObjectId
+	electionTime time.Time
+
+	// stepDownUntil holds the time until which each member which stepped
+	// down may not be elected.
+	stepDownUntil []time.Time
+
+	// unreachable is set for members which clients and the other members
+	// cannot reach.
+	unreachable []bool
+
+	mu sync.Mutex
+}
+
+// NewReplicaSet returns a replica set with a member listening on each of
+// the given listeners.
+func NewReplicaSet(name string, lns ...net.Listener) *ReplicaSet {
+	rs := &ReplicaSet{
+		Name:          name,
+		primary:       -1,
+		lastPrimary:   -1,
+		stepDownUntil: make([]time.Time, len(lns)),
+		unreachable:   make([]bool, len(lns)),
+	}
+	rs.backend = NewMemoryBackend(&rs.t)
+	rs.backend.replicas = rs.replicas
+	rs.started = rs.backend.Clock().Now()
+	for i, ln := range lns {
+		rs.hosts = append(rs.hosts, ln.Addr().String())
+		s := newServer(ln)
+		s.Backend = &replSetMember{Backend: rs.backend, set: rs, id: i}
+		rs.servers = append(rs.servers, s)
+	}
+	rs.mu.Lock()
+	rs.electLocked(rs.started)
+	rs.mu.Unlock()
+	return rs
+}
+
+// replSetMember is the backend of a replica set member. It answers the
+// commands describing the replica set from the member's point of view, and
+// passes everything else to the backend the members share.
+type replSetMember struct {
+	Backend
+	set *ReplicaSet
+	id  int
+}
+
+// anyMemberCommands are the commands which secondaries run for clients
+// which have not set slaveOk.
+var anyMemberCommands = map[string]bool{
+	"authenticate":       true,
+	"buildinfo":          true,
+	"buildInfo":          true,
+	"configureFailPoint": true,
+	"currentOp":          true,
+	"getLastError":       true,
+	"getlasterror":       true,
+	"getLog":             true,
+	"getPrevError":       true,
+	"getpreverror":       true,
+	"getnonce":           true,
+	"ismaster":           true,
+	"isMaster":           true,
+	"killOp":             true,
+	"hello":              true,
+	"endSessions":        true,
+	"ping":               true,
+	"refreshSessions":    true,
+	"replSetGetStatus":   true,
+	"replSetStepDown":    true,
+	"resetError":         true,
+	"reseterror":         true,
+	"shutdown":           true,
+	"startSession":       true,
+	"whatsmyuri":         true,
+}
+
+// writeCommands are the commands which only the primary runs.
+var writeCommands = map[string]bool{
+	"abortTransaction":  true,
+	"commitTransaction": true,
+	"create":            true,
+	"createIndexes":     true,
+	"delete":            true,
+	"deleteIndexes":     true,
+	"drop":              true,
+	"dropIndexes":       true,
+	"insert":            true,
+	"renameCollection":  true,
+	"update":            true,
+}
+
+// isPrimary returns whether the member is the primary.
+func (m *replSetMember) isPrimary() bool {
+	return m.set.Primary() == m.id
+}
+
+func (m *replSetMember) HandleQuery(c net.Conn, query *OpQueryMsg) {
+	if !strings.HasSuffix(query.FullCollectionName, ".$cmd") {
+		if query.Flags&QueryFlagSlaveOk == 0 && !m.isPrimary() {
+			respQueryError(c, query.RequestID, errorf(ErrNotMasterNoSlaveOk, "not master and slaveOk=false"))
+			return
+		}
+		m.Backend.HandleQuery(c, query)
+		return
+	}
+	cmd, _ := query.Command()
+	dbname, _ := splitNamespace(query.FullCollectionName)
+	if err := m.set.backend.authorizeCommand(c, dbname, query); err != nil {
+		respError(c, query.RequestID, err)
+		return
+	}
+	if query.FullCollectionName == "admin.$cmd" {
+		switch cmd {
+		case "ismaster", "isMaster", "hello":
+			respDoc(c, query.RequestID, handshakeReply(query, m.set.isMaster(m.id)))
+			return
+		case "replSetGetStatus":
+			respDoc(c, query.RequestID, m.set.status(m.id))
+			return
+		case "replSetStepDown":
+			// As with mongod before 4.2, the member closes its connections
+			// once it has stepped down.
+			err := m.set.stepDownCommand(m.id, query)
+			respDoc(c, query.RequestID, errReply(err))
+			if err == nil {
+				m.set.servers[m.id].CloseConnections()
+			}
+			return
+		}
+	}
+	switch {
+	case anyMemberCommands[cmd] || m.isPrimary():
+	case writeCommands[cmd]:
+		respDoc(c, query.RequestID, errReply(errorf(ErrNotMaster, "not master")))
+		return
+	case query.Flags&QueryFlagSlaveOk == 0:
+		respDoc(c, query.RequestID, errReply(errorf(ErrNotMasterNoSlaveOk, "not master and slaveOk=false")))
+		return
+	}
+	m.Backend.HandleQuery(c, query)
+}
+
+// notMaster records a NotMaster error for a write on a secondary, for
+// getLastError to report.
+func (m *replSetMember) notMaster(c net.Conn) bool {
+	if m.isPrimary() {
+		return false
+	}
+	contextOf(c).lastError.record(writeErrorResult(0, errorf(ErrNotMaster, "not master")))
+	return true
+}
+
+func (m *replSetMember) HandleInsert(c net.Conn, insert *OpInsertMsg) {
+	if !m.notMaster(c) {
+		m.Backend.HandleInsert(c, insert)
+	}
+}
+
+func (m *replSetMember) HandleUpdate(c net.Conn, update *OpUpdateMsg) {
+	if !m.notMaster(c) {
+		m.Backend.HandleUpdate(c, update)
+	}
+}
+
+func (m *replSetMember) HandleDelete(c net.Conn, deleteMsg *OpDeleteMsg) {
+	if !m.notMaster(c) {
+		m.Backend.HandleDelete(c, deleteMsg)
+	}
+}
+
+// AddUser adds a user to a database of the replica set, or sets the
+// password and roles of the user if it already exists.
+func (rs *ReplicaSet) AddUser(dbname, user, password string, roles ...string) error {
+	return rs.backend.AddUser(dbname, user, password, roles...)
+}
+
+// SetAuth sets whether clients of the members must authenticate.
+func (rs *ReplicaSet) SetAuth(enabled bool) {
+	rs.backend.SetAuth(enabled)
+}
+
+// Start starts all of the members.
+func (rs *ReplicaSet) Start() {
+	for _, s := range rs.servers {
+		s.Start()
+	}
+}
+
+// Stop stops all of the members, and the backend they share.
+func (rs *ReplicaSet) Stop() {
+	for _, s := range rs.servers {
+		s.Stop()
+	}
+	rs.t.Kill(nil)
+	rs.t.Wait()
+}
+
+// Addrs returns the addresses of the members, by which they know each
+// other.
+func (rs *ReplicaSet) Addrs() []string {
+	return append([]string(nil), rs.hosts...)
+}
+
+// Member returns the server of the ith member.
+func (rs *ReplicaSet) Member(i int) *Server {
+	return rs.servers[i]
+}
+
+// Primary returns the index of the primary member, or -1 if there is
+// none.
+func (rs *ReplicaSet) Primary() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.electLocked(rs.backend.Clock().Now())
+	return rs.primary
+}
+
+// SetClock sets the clock of the backend the members share, which also
+// decides when members which stepped down may be elected again.
+func (rs *ReplicaSet) SetClock(clock Clock) {
+	rs.backend.SetClock(clock)
+}
+
+// electable returns whether a member may be elected primary.
+func (rs *ReplicaSet) electable(id int, now time.Time) bool {
+	return !rs.unreachable[id] && !now.Before(rs.stepDownUntil[id])
+}
+
+// electLocked elects a primary if there is none, choosing the first
+// member which may be elected, after the one which was last primary.
+func (rs *ReplicaSet) electLocked(now time.Time) {
+	if rs.primary >= 0 {
+		return
+	}
+	for i := range rs.servers {
+		id := (rs.lastPrimary + 1 + i) % len(rs.servers)
+		if rs.electable(id, now) {
+			rs.setPrimaryLocked(id, now)
+			return
+		}
+	}
+}
+
+// setPrimaryLocked makes a member primary, starting a new term.
+func (rs *ReplicaSet) setPrimaryLocked(id int, now time.Time) {
+	rs.primary, rs.lastPrimary = id, id
+	rs.term++
+	rs.electionID = bson.NewObjectId()
+	rs.electionTime = now
+}
+
+// Elect makes a member primary, stepping down the current primary. The
+// stepped down primary keeps its connections open, so clients using it
+// get NotMaster errors until they rediscover the set.
+func (rs *ReplicaSet) Elect(id int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.unreachable[id] {
+		return fmt.Errorf("member %d is unreachable", id)
+	}
+	if rs.primary != id {
+		rs.stepDownUntil[id] = time.Time{}
+		rs.setPrimaryLocked(id, rs.backend.Clock().Now())
+	}
+	return nil
+}
+
+// StepDown makes the primary step down for d, during which it may not be
+// elected again. Another member is elected in its place, if there is one
+// which may be. Unless force is set, the primary only steps down if there
+// is. The stepped down primary keeps its connections open; use
+// CloseConnections on its server to close them.
+func (rs *ReplicaSet) StepDown(d time.Duration, force bool) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := rs.backend.Clock().Now()
+	rs.electLocked(now)
+	if rs.primary < 0 {
+		return errorf(ErrNotMaster, "not primary so can't step down")
+	}
+	if !force {
+		electable := false
+		for id := range rs.servers {
+			if id != rs.primary && rs.electable(id, now) {
+				electable = true
+			}
+		}
+		if !electable {
+			return errorf(ErrExceededTimeLimit, "No electable secondaries caught up as of %s. "+
+				"Please use the replSetStepDown command with the argument {force: true} to force node to step down.",
+				now.Format(time.RFC3339))
+		}
+	}
+	rs.stepDownUntil[rs.primary] = now.Add(d)
+	rs.primary = -1
+	rs.electLocked(now)
+	return nil
+}
+
+// SetUnreachable sets whether a member can be reached by clients and the
+// other members. An unreachable member closes its connections, and refuses
+// new ones. If it was primary, another member is elected.
+func (rs *ReplicaSet) SetUnreachable(id int, unreachable bool) {
+	rs.mu.Lock()
+	rs.unreachable[id] = unreachable
+	if unreachable && rs.primary == id {
+		rs.primary = -1
+		rs.electLocked(rs.backend.Clock().Now())
+	}
+	rs.mu.Unlock()
+	rs.servers[id].setUnreachable(unreachable)
+}
+
+// stepDownCommand runs a replSetStepDown command received by a member.
+func (rs *ReplicaSet) stepDownCommand(id int, query *OpQueryMsg) error {
+	_, arg := query.Command()
+	secs := 60.0
+	if typeOrder(arg) == 10 {
+		secs = asFloat64(arg)
+	}
+	catchUp := 10.0
+	if v, ok := query.Get("secondaryCatchUpPeriodSecs"); ok {
+		catchUp = asFloat64(v)
+	}
+	if secs < catchUp {
+		return errorf(ErrBadValue, "stepdown period must be longer than secondaryCatchUpPeriodSecs")
+	}
+	if rs.Primary() != id {
+		return errorf(ErrNotMaster, "not primary so can't step down")
+	}
+	force, _ := query.Get("force")
+	return rs.StepDown(time.Duration(secs*float64(time.Second)), asBool(force))
+}
+
+// isMaster returns the isMaster reply of a member.
+func (rs *ReplicaSet) isMaster(id int) bson.D {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := rs.backend.Clock().Now()
+	rs.electLocked(now)
+	reply := bson.D{
+		{"hosts", rs.hosts},
+		{"setName", rs.Name},
+		{"setVersion", 1},
+		{"ismaster", id == rs.primary},
+		{"secondary", id != rs.primary},
+	}
+	if rs.primary >= 0 {
+		reply = append(reply, bson.DocElem{"primary", rs.hosts[rs.primary]})
+	}
+	reply = append(reply, bson.DocElem{"me", rs.hosts[id]})
+	if id == rs.primary {
+		reply = append(reply, bson.DocElem{"electionId", rs.electionID})
+	}
+	return markOk(append(reply,
+		bson.DocElem{"maxBsonObjectSize", maxBsonObjectSize},
+		bson.DocElem{"maxMessageSizeBytes", maxMessageSizeBytes},
+		bson.DocElem{"maxWriteBatchSize", 1000},
+		bson.DocElem{"localTime", now},
+		bson.DocElem{"logicalSessionTimeoutMinutes", int(SessionTimeout / time.Minute)},
+		bson.DocElem{"readOnly", false},
+	))
+}
+
+// status returns the replSetGetStatus reply of a member.
+func (rs *ReplicaSet) status(id int) bson.D {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := rs.backend.Clock().Now()
+	rs.electLocked(now)
+	optime := bson.D{{"ts", rs.backend.oplog.timestamp()}, {"t", rs.term}}
+	var members []bson.D
+	for i, host := range rs.hosts {
+		health, state, stateStr := 1, 2, "SECONDARY"
+		switch {
+		case rs.unreachable[i]:
+			health, state, stateStr = 0, 8, "(not reachable/healthy)"
+		case i == rs.primary:
+			state, stateStr = 1, "PRIMARY"
+		}
+		member := bson.D{
+			{"_id", i},
+			{"name", host},
+			{"health", health},
+			{"state", state},
+			{"stateStr", stateStr},
+			{"uptime", int64(now.Sub(rs.started) / time.Second)},
+			{"optime", optime},
+			{"optimeDate", now},
+		}
+		if i == rs.primary {
+			member = append(member,
+				bson.DocElem{"electionTime", bson.MongoTimestamp(rs.electionTime.Unix() << 32)},
+				bson.DocElem{"electionDate", rs.electionTime})
+		}
+		if i == id {
+			member = append(member, bson.DocElem{"self", true})
+		}
+		members = append(members, member)
+	}
+	myState := 2
+	if id == rs.primary {
+		myState = 1
+	}
+	return markOk(bson.D{
+		{"set", rs.Name},
+		{"date", now},
+		{"myState", myState},
+		{"term", rs.term},
+		{"heartbeatIntervalMillis", int64(2000)},
+		{"members", members},
+	})
+}
@@ -0,0 +1,250 @@
+package gonzo_test
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+type replSetSuite struct {
+	rs      *gonzo.ReplicaSet
+	session *mgo.Session
+}
+
+var _ = gc.Suite(&replSetSuite{})
+
+func newReplicaSet(c *gc.C, n int) *gonzo.ReplicaSet {
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, gc.IsNil)
+		lns = append(lns, l)
+	}
+	rs := gonzo.NewReplicaSet("rs0", lns...)
+	rs.Start()
+	return rs
+}
+
+func (s *replSetSuite) SetUpTest(c *gc.C) {
+	s.rs = newReplicaSet(c, 3)
+	var err error
+	s.session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:          s.rs.Addrs()[:1],
+		ReplicaSetName: "rs0",
+		Timeout:        5 * time.Second,
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *replSetSuite) TearDownTest(c *gc.C) {
+	s.session.Close()
+	s.rs.Stop()
+}
+
+// dialMember connects directly to a member, whatever its role.
+func (s *replSetSuite) dialMember(c *gc.C, i int) *mgo.Session {
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   s.rs.Addrs()[i : i+1],
+		Direct:  true,
+		Timeout: 5 * time.Second,
+	})
+	c.Assert(err, gc.IsNil)
+	session.SetMode(mgo.Monotonic, true)
+	return session
+}
+
+type isMasterResult struct {
+	IsMaster  bool `bson:"ismaster"`
+	Secondary bool
+	SetName   string `bson:"setName"`
+	Hosts     []string
+	Primary   string
+	Me        string
+}
+
+func (s *replSetSuite) TestIsMaster(c *gc.C) {
+	addrs := s.rs.Addrs()
+	var result isMasterResult
+	c.Assert(s.session.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result, gc.DeepEquals, isMasterResult{
+		IsMaster: true, SetName: "rs0", Hosts: addrs, Primary: addrs[0], Me: addrs[0],
+	})
+
+	member := s.dialMember(c, 2)
+	defer member.Close()
+	c.Assert(member.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result, gc.DeepEquals, isMasterResult{
+		Secondary: true, SetName: "rs0", Hosts: addrs, Primary: addrs[0], Me: addrs[2],
+	})
+
+	// The driver discovers the whole set from the seed it dialed.
+	c.Assert(s.session.LiveServers(), gc.HasLen, 3)
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	n, err := member.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *replSetSuite) TestReplSetGetStatus(c *gc.C) {
+	member := s.dialMember(c, 1)
+	defer member.Close()
+	var status struct {
+		Set     string
+		MyState int `bson:"myState"`
+		Members []struct {
+			Id       int `bson:"_id"`
+			Name     string
+			StateStr string `bson:"stateStr"`
+			Self     bool
+		}
+	}
+	c.Assert(member.Run("replSetGetStatus", &status), gc.IsNil)
+	c.Assert(status.Set, gc.Equals, "rs0")
+	c.Assert(status.MyState, gc.Equals, 2)
+	c.Assert(status.Members, gc.HasLen, 3)
+	for i, m := range status.Members {
+		c.Assert(m.Id, gc.Equals, i)
+		c.Assert(m.Name, gc.Equals, s.rs.Addrs()[i])
+		c.Assert(m.Self, gc.Equals, i == 1)
+	}
+	c.Assert(status.Members[0].StateStr, gc.Equals, "PRIMARY")
+	c.Assert(status.Members[2].StateStr, gc.Equals, "SECONDARY")
+}
+
+func (s *replSetSuite) TestReplSetStepDown(c *gc.C) {
+	member := s.dialMember(c, 1)
+	defer member.Close()
+	err := member.Run(bson.D{{"replSetStepDown", 60}}, nil)
+	c.Assert(err, gc.ErrorMatches, "not primary so can't step down")
+
+	c.Assert(s.session.Run(bson.D{{"replSetStepDown", 60}}, nil), gc.IsNil)
+	c.Assert(s.rs.Primary(), gc.Equals, 1)
+	var result isMasterResult
+	c.Assert(member.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result.IsMaster, gc.Equals, true)
+	c.Assert(result.Primary, gc.Equals, s.rs.Addrs()[1])
+
+	// Drivers discovering the set find the new primary.
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:          s.rs.Addrs()[:1],
+		ReplicaSetName: "rs0",
+		Timeout:        5 * time.Second,
+	})
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result.Me, gc.Equals, s.rs.Addrs()[1])
+}
+
+func (s *replSetSuite) TestStepDownSingleMember(c *gc.C) {
+	rs := newReplicaSet(c, 1)
+	defer rs.Stop()
+	clock := gonzo.NewManualClock(time.Now())
+	rs.SetClock(clock)
+
+	err := rs.StepDown(time.Minute, false)
+	c.Assert(err, gc.ErrorMatches, "No electable secondaries caught up .*")
+	c.Assert(rs.Primary(), gc.Equals, 0)
+
+	c.Assert(rs.StepDown(time.Minute, true), gc.IsNil)
+	c.Assert(rs.Primary(), gc.Equals, -1)
+	clock.Advance(time.Minute)
+	c.Assert(rs.Primary(), gc.Equals, 0)
+}
+
+func (s *replSetSuite) TestFailover(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(s.rs.StepDown(time.Minute, false), gc.IsNil)
+	c.Assert(s.rs.Primary(), gc.Equals, 1)
+
+	// The old primary keeps its connections, refusing writes and reads by
+	// clients which have not set slaveOk.
+	err := coll.Insert(bson.M{"_id": 2})
+	c.Assert(err, gc.ErrorMatches, "not master")
+	c.Assert(mgo.IsDup(err), gc.Equals, false)
+	var doc bson.M
+	c.Assert(coll.Find(nil).One(&doc), gc.ErrorMatches, "not master and slaveOk=false")
+
+	// Once its connections are closed, the driver finds the new primary.
+	s.rs.Member(0).CloseConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.session.Refresh()
+		if err = coll.Insert(bson.M{"_id": 2}); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, gc.IsNil)
+	var result isMasterResult
+	c.Assert(s.session.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result.Me, gc.Equals, s.rs.Addrs()[1])
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+}
+
+func (s *replSetSuite) TestSecondaryWrites(c *gc.C) {
+	member := s.dialMember(c, 1)
+	defer member.Close()
+	err := member.DB("db1").Run(bson.D{{"create", "c1"}}, nil)
+	c.Assert(err, gc.ErrorMatches, "not master")
+	err = member.DB("db1").Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1}}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "not master")
+
+	// Reads by clients which set slaveOk are answered.
+	c.Assert(s.session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	n, err := member.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *replSetSuite) TestUnreachable(c *gc.C) {
+	s.rs.SetUnreachable(0, true)
+	c.Assert(s.rs.Primary(), gc.Equals, 1)
+	_, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   s.rs.Addrs()[:1],
+		Direct:  true,
+		Timeout: 500 * time.Millisecond,
+	})
+	c.Assert(err, gc.NotNil)
+
+	member := s.dialMember(c, 1)
+	defer member.Close()
+	var status struct {
+		Members []struct {
+			Health   int
+			StateStr string `bson:"stateStr"`
+		}
+	}
+	c.Assert(member.Run("replSetGetStatus", &status), gc.IsNil)
+	c.Assert(status.Members[0].Health, gc.Equals, 0)
+	c.Assert(status.Members[0].StateStr, gc.Equals, "(not reachable/healthy)")
+	c.Assert(status.Members[1].StateStr, gc.Equals, "PRIMARY")
+
+	// An unreachable member may not be elected until it is reachable again.
+	c.Assert(s.rs.Elect(0), gc.ErrorMatches, "member 0 is unreachable")
+	s.rs.SetUnreachable(0, false)
+	c.Assert(s.rs.Elect(0), gc.IsNil)
+	c.Assert(s.rs.Primary(), gc.Equals, 0)
+	session := s.dialMember(c, 0)
+	defer session.Close()
+	c.Assert(session.Ping(), gc.IsNil)
+}
+
+func (s *replSetSuite) TestElect(c *gc.C) {
+	c.Assert(s.rs.Elect(2), gc.IsNil)
+	c.Assert(s.rs.Primary(), gc.Equals, 2)
+	member := s.dialMember(c, 0)
+	defer member.Close()
+	var result isMasterResult
+	c.Assert(member.Run("ismaster", &result), gc.IsNil)
+	c.Assert(result.Secondary, gc.Equals, true)
+	c.Assert(result.Primary, gc.Equals, s.rs.Addrs()[2])
+}
@@ -0,0 +1,96 @@
+package gonzo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// retryableCommands are the commands which are retryable writes when sent
+// with a transaction number outside of a transaction.
+var retryableCommands = map[string]bool{
+	"delete": true,
+	"insert": true,
+	"update": true,
+}
+
+// stmtFields are the fields holding the statements of each retryable
+// write command.
+var stmtFields = map[string]string{
+	"delete": "deletes",
+	"insert": "documents",
+	"update": "updates",
+}
+
+// stmtIDs returns the statement ids of a write command's statements: those
+// in stmtIds, which must give one for each statement, or numbered from
+// stmtId, or else from zero.
+func stmtIDs(query *OpQueryMsg) (func(i int) int32, error) {
+	if v, ok := query.Get("stmtIds"); ok {
+		cmd, _ := query.Command()
+		stmts, _ := query.Get(stmtFields[cmd])
+		ids := make([]int32, len(asArray(v)))
+		if len(ids) != len(asArray(stmts)) {
+			return nil, errorf(ErrBadValue, "The size of 'stmtIds' (%d) must match the number of statements (%d)",
+				len(ids), len(asArray(stmts)))
+		}
+		for i, idv := range asArray(v) {
+			id, ok := asInt64(idv)
+			if !ok || id != int64(int32(id)) {
+				return nil, errorf(ErrBadValue, "stmtIds must be 32 bit integers, not %s", formatValue(idv))
+			}
+			ids[i] = int32(id)
+		}
+		return func(i int) int32 {
+			return ids[i]
+		}, nil
+	}
+	var first int64
+	if v, ok := query.Get("stmtId"); ok {
+		if first, ok = asInt64(v); !ok || first != int64(int32(first)) {
+			return nil, errorf(ErrBadValue, "stmtId must be a 32 bit integer, not %s", formatValue(v))
+		}
+	}
+	return func(i int) int32 {
+		return int32(first) + int32(i)
+	}, nil
+}
+
+// retryableWrite runs a write command in a session which may be retried
+// with the same transaction number. Statements which have already been
+// applied are not applied again; the results they had are returned.
+func (b *MemoryBackend) retryableWrite(sess *session, dbname string, v interface{}, query *OpQueryMsg) (bson.D, error) {
+	number, ok := asInt64(v)
+	if !ok {
+		return nil, errorf(ErrBadValue, "txnNumber must be a number: %s", formatValue(v))
+	}
+	switch {
+	case number < sess.txnNumber:
+		return nil, errorf(ErrTransactionTooOld,
+			"Retryable write with txnNumber %d is prohibited on session %s because a newer retryable write "+
+				"with txnNumber %d has already started on this session.", number, formatUUID(sess.id), sess.txnNumber)
+	case number == sess.txnNumber && sess.txn != nil:
+		return nil, errorf(ErrConflictingOperation,
+			"Retryable write with txnNumber %d is prohibited on session %s because a transaction "+
+				"with the same txnNumber has already started on this session.", number, formatUUID(sess.id))
+	case number > sess.txnNumber || sess.stmts == nil:
+		if sess.txn != nil {
+			sess.txn.abort()
+		}
+		sess.txnNumber, sess.txn = number, nil
+		sess.stmts = make(map[int32]*stmtResult)
+	}
+	stmtID, err := stmtIDs(query)
+	if err != nil {
+		return nil, err
+	}
+	return b.runWriteCommand(b.DB(dbname), query, func(i int, stmt func() *stmtResult) *stmtResult {
+		id := stmtID(i)
+		if result, ok := sess.stmts[id]; ok {
+			return result
+		}
+		result := stmt()
+		if result.err == nil {
+			sess.stmts[id] = result
+		}
+		return result
+	})
+}
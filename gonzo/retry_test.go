@@ -0,0 +1,137 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type writeReply struct {
+	N           int      `bson:"n"`
+	NModified   int      `bson:"nModified"`
+	WriteErrors []bson.M `bson:"writeErrors"`
+}
+
+// retryableWrite runs a write command as a retryable write.
+func (t *txnClient) retryableWrite(cmd bson.D) (writeReply, error) {
+	var reply writeReply
+	cmd = append(cmd, bson.DocElem{"lsid", t.lsid}, bson.DocElem{"txnNumber", t.txnNumber})
+	err := t.session.DB("db1").Run(cmd, &reply)
+	return reply, err
+}
+
+func (s *gonzoSuite) TestRetryableWrites(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	t := s.startSession(c)
+	t.txnNumber = 1
+	insert := bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1, "x": 1}, {"_id": 2, "x": 1}}}}
+	for i := 0; i < 2; i++ {
+		reply, err := t.retryableWrite(insert)
+		c.Assert(err, gc.IsNil)
+		c.Assert(reply, gc.DeepEquals, writeReply{N: 2})
+	}
+
+	// Retries return the results the statements had the first time.
+	t.txnNumber++
+	update := bson.D{{"update", "c1"}, {"updates", []bson.M{{"q": bson.M{"_id": 1}, "u": bson.M{"$set": bson.M{"y": 1}}}}}}
+	for i := 0; i < 2; i++ {
+		reply, err := t.retryableWrite(update)
+		c.Assert(err, gc.IsNil)
+		c.Assert(reply, gc.DeepEquals, writeReply{N: 1, NModified: 1})
+	}
+	t.txnNumber++
+	remove := bson.D{{"delete", "c1"}, {"deletes", []bson.M{{"q": bson.M{"x": 1}, "limit": 1}}}}
+	for i := 0; i < 2; i++ {
+		reply, err := t.retryableWrite(remove)
+		c.Assert(err, gc.IsNil)
+		c.Assert(reply.N, gc.Equals, 1)
+	}
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// A new transaction number runs the statements again.
+	t.txnNumber++
+	reply, err := t.retryableWrite(remove)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply.N, gc.Equals, 1)
+
+	t.txnNumber = 1
+	_, err = t.retryableWrite(insert)
+	c.Assert(err, gc.ErrorMatches, "Retryable write with txnNumber 1 is prohibited on session .*")
+	c.Assert(errorCode(err), gc.Equals, 225)
+}
+
+func (s *gonzoSuite) TestRetryableWriteFailedStatement(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 2}), gc.IsNil)
+	t := s.startSession(c)
+	t.txnNumber = 1
+	insert := bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}}}}
+	reply, err := t.retryableWrite(insert)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply.N, gc.Equals, 1)
+	c.Assert(reply.WriteErrors, gc.HasLen, 1)
+
+	// Statements which failed are run again when retried.
+	c.Assert(coll.Remove(bson.M{"_id": 2}), gc.IsNil)
+	reply, err = t.retryableWrite(insert)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply, gc.DeepEquals, writeReply{N: 3})
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 3)
+}
+
+func (s *gonzoSuite) TestRetryableWriteDroppedConnection(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	err := s.session.Run(bson.D{
+		{"configureFailPoint", "onPrimaryTransactionalWrite"},
+		{"mode", bson.M{"times": 1}},
+		{"data", bson.M{"closeConnection": true}},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	// The write is applied, but its connection closed before it is
+	// answered.
+	t := s.startSession(c)
+	t.txnNumber = 1
+	insert := bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 1}}}}
+	_, err = t.retryableWrite(insert)
+	c.Assert(err, gc.NotNil)
+	s.session.Refresh()
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// Retrying it does not insert the document again.
+	reply, err := t.retryableWrite(insert)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply, gc.DeepEquals, writeReply{N: 1})
+	n, err = coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	err = s.session.Run(bson.D{{"configureFailPoint", "noSuchFailPoint"}, {"mode", "alwaysOn"}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Cannot find failPoint named .*")
+}
+
+func (s *gonzoSuite) TestRetryableWriteStmtIds(c *gc.C) {
+	t := s.startSession(c)
+	t.txnNumber = 1
+	docs := []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}}
+
+	// Statement ids must be given for every statement, as integers.
+	_, err := t.retryableWrite(bson.D{{"insert", "c1"}, {"documents", docs}, {"stmtIds", []int{0}}})
+	c.Assert(err, gc.ErrorMatches, `The size of 'stmtIds' \(1\) must match the number of statements \(3\)`)
+	c.Assert(errorCode(err), gc.Equals, 2)
+	_, err = t.retryableWrite(bson.D{{"insert", "c1"}, {"documents", docs}, {"stmtIds", []interface{}{0, "one", 2}}})
+	c.Assert(err, gc.ErrorMatches, `stmtIds must be 32 bit integers, not "one"`)
+	c.Assert(errorCode(err), gc.Equals, 2)
+	n, err := s.session.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	reply, err := t.retryableWrite(bson.D{{"insert", "c1"}, {"documents", docs}, {"stmtIds", []int{5, 6, 7}}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(reply, gc.DeepEquals, writeReply{N: 3})
+}
@@ -0,0 +1,439 @@
+package gonzo
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Actions the built-in database roles grant, as mongod grants them.
+var (
+	readActions = []string{
+		"changeStream", "collStats", "dbHash", "dbStats", "find",
+		"killCursors", "listCollections", "listIndexes",
+	}
+	readWriteActions = append([]string{
+		"convertToCapped", "createCollection", "createIndex", "dropCollection",
+		"dropIndex", "emptycapped", "insert", "remove", "renameCollectionSameDB",
+		"update",
+	}, readActions...)
+	dbAdminActions = []string{
+		"collMod", "collStats", "compact", "convertToCapped", "createCollection",
+		"createIndex", "dbStats", "dropCollection", "dropDatabase", "dropIndex",
+		"enableProfiler", "listCollections", "listIndexes", "reIndex",
+		"renameCollectionSameDB", "validate",
+	}
+	userAdminActions = []string{
+		"changeCustomData", "changePassword", "createRole", "createUser",
+		"dropRole", "dropUser", "grantRole", "revokeRole", "viewRole", "viewUser",
+	}
+)
+
+// builtinRoles are the actions granted by the built-in roles which every
+// database has. Those but dbOwner are also defined on admin for every
+// database, as readAnyDatabase and so on. root is defined on admin only.
+var builtinRoles = map[string][]string{
+	"read":      readActions,
+	"readWrite": readWriteActions,
+	"dbAdmin":   dbAdminActions,
+	"userAdmin": userAdminActions,
+	"dbOwner":   append(append(append([]string(nil), readWriteActions...), dbAdminActions...), userAdminActions...),
+}
+
+// systemCollectionsReadable are the system collections which privileges on
+// every collection of a database include.
+var systemCollectionsReadable = map[string]bool{
+	"system.indexes":    true,
+	"system.js":         true,
+	"system.namespaces": true,
+}
+
+// resource is what a privilege grants actions on: a collection, a
+// database and its collections when Collection is empty, every database
+// when DB is also empty, the cluster, or anything at all.
+type resource struct {
+	DB          string
+	Collection  string
+	Cluster     bool
+	AnyResource bool
+}
+
+// covers returns whether privileges on the resource extend to another.
+func (r resource) covers(other resource) bool {
+	switch {
+	case r.AnyResource:
+		return true
+	case r.Cluster || other.Cluster:
+		return r.Cluster && other.Cluster
+	case r.DB != "" && r.DB != other.DB:
+		return false
+	case r.Collection == "":
+		return !strings.HasPrefix(other.Collection, "system.") || systemCollectionsReadable[other.Collection]
+	}
+	return r.Collection == other.Collection
+}
+
+// doc returns the resource as it is given in privilege documents.
+func (r resource) doc() bson.D {
+	switch {
+	case r.AnyResource:
+		return bson.D{{"anyResource", true}}
+	case r.Cluster:
+		return bson.D{{"cluster", true}}
+	}
+	return bson.D{{"db", r.DB}, {"collection", r.Collection}}
+}
+
+// parseResource parses a resource document.
+func parseResource(doc bson.D) (resource, error) {
+	m := doc.Map()
+	switch {
+	case len(m) == 1 && m["anyResource"] == true:
+		return resource{AnyResource: true}, nil
+	case len(m) == 1 && m["cluster"] == true:
+		return resource{Cluster: true}, nil
+	}
+	dbname, ok1 := m["db"].(string)
+	cname, ok2 := m["collection"].(string)
+	if len(m) != 2 || !ok1 || !ok2 {
+		return resource{}, errorf(ErrBadValue, "resource must have either db and collection, cluster, or anyResource: %s", formatValue(doc))
+	}
+	return resource{DB: dbname, Collection: cname}, nil
+}
+
+// privilege grants actions on a resource. The action anyAction stands for
+// every action.
+type privilege struct {
+	resource resource
+	actions  []string
+}
+
+// allows returns whether the privilege allows an action on a resource.
+func (p privilege) allows(res resource, action string) bool {
+	if !p.resource.covers(res) {
+		return false
+	}
+	for _, a := range p.actions {
+		if a == action || a == "anyAction" {
+			return true
+		}
+	}
+	return false
+}
+
+// privilegeDoc is a privilege as stored in admin.system.roles.
+type privilegeDoc struct {
+	Resource bson.D   `bson:"resource"`
+	Actions  []string `bson:"actions"`
+}
+
+// parsePrivileges parses the privileges granted to a role on a database,
+// which may only be on the database unless it is admin.
+func parsePrivileges(v interface{}, dbname string) ([]privilegeDoc, error) {
+	docs := []privilegeDoc{}
+	for _, elem := range asArray(v) {
+		var doc privilegeDoc
+		m := asDoc(elem).Map()
+		res, err := parseResource(asDoc(m["resource"]))
+		if err != nil {
+			return nil, err
+		}
+		if dbname != "admin" && (res.Cluster || res.AnyResource || res.DB != dbname) {
+			return nil, errorf(ErrBadValue, "Roles on the '%s' database cannot be granted privileges that target other databases or the cluster", dbname)
+		}
+		doc.Resource = res.doc()
+		for _, action := range asArray(m["actions"]) {
+			s, ok := action.(string)
+			if !ok {
+				return nil, errorf(ErrBadValue, "Privilege actions must be strings")
+			}
+			doc.Actions = append(doc.Actions, s)
+		}
+		if len(doc.Actions) == 0 {
+			return nil, errorf(ErrBadValue, "Privileges must have at least one action")
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// roleDoc is a user-defined role, as stored in admin.system.roles.
+type roleDoc struct {
+	Id         string         `bson:"_id"`
+	Role       string         `bson:"role"`
+	DB         string         `bson:"db"`
+	Privileges []privilegeDoc `bson:"privileges"`
+	Roles      []roleName     `bson:"roles"`
+}
+
+// less orders roles by database, then name.
+func (r roleName) less(other roleName) bool {
+	if r.DB != other.DB {
+		return r.DB < other.DB
+	}
+	return r.Role < other.Role
+}
+
+// builtinPrivileges returns the privileges of a built-in role, or false if
+// the role is not built in.
+func builtinPrivileges(r roleName) ([]privilege, bool) {
+	if r.Role == "root" {
+		if r.DB != "admin" {
+			return nil, false
+		}
+		return []privilege{{resource{AnyResource: true}, []string{"anyAction"}}}, true
+	}
+	if name := strings.TrimSuffix(r.Role, "AnyDatabase"); name != r.Role {
+		actions, ok := builtinRoles[name]
+		if !ok || name == "dbOwner" || r.DB != "admin" {
+			return nil, false
+		}
+		return []privilege{{resource{}, actions}}, true
+	}
+	actions, ok := builtinRoles[r.Role]
+	if !ok {
+		return nil, false
+	}
+	return []privilege{{resource{DB: r.DB}, actions}}, true
+}
+
+// parseRoleNames parses the roles given to a command run on a database,
+// each of which may be a name of a role on the database or a document
+// naming a role on any database.
+func parseRoleNames(v interface{}, dbname string) ([]roleName, error) {
+	roles := []roleName{}
+	for _, elem := range asArray(v) {
+		if name, ok := elem.(string); ok {
+			roles = append(roles, roleName{Role: name, DB: dbname})
+			continue
+		}
+		m := asDoc(elem).Map()
+		name, ok1 := m["role"].(string)
+		db, ok2 := m["db"].(string)
+		if !ok1 || !ok2 {
+			return nil, errorf(ErrBadValue, "Role names must be either strings or objects with role and db fields: %s", formatValue(elem))
+		}
+		roles = append(roles, roleName{Role: name, DB: db})
+	}
+	return roles, nil
+}
+
+// role returns a user-defined role.
+func (b *MemoryBackend) role(r roleName) (*roleDoc, bool) {
+	docs := b.DB("admin").C("system.roles").Match(bson.M{"_id": r.DB + "." + r.Role})
+	if len(docs) == 0 {
+		return nil, false
+	}
+	var doc roleDoc
+	if err := convertDoc(docs[0], &doc); err != nil {
+		return nil, false
+	}
+	return &doc, true
+}
+
+// checkRoles returns a RoleNotFound error unless roles exist.
+func (b *MemoryBackend) checkRoles(roles []roleName) error {
+	for _, r := range roles {
+		if _, ok := builtinPrivileges(r); ok {
+			continue
+		}
+		if _, ok := b.role(r); !ok {
+			return errorf(ErrRoleNotFound, "Could not find role: %s@%s", r.Role, r.DB)
+		}
+	}
+	return nil
+}
+
+// expandRoles calls fn with each role in roles and each role they inherit,
+// once each, along with the role's document if it is user-defined.
+func (b *MemoryBackend) expandRoles(roles []roleName, fn func(r roleName, doc *roleDoc)) {
+	seen := make(map[roleName]bool)
+	for len(roles) > 0 {
+		r := roles[0]
+		roles = roles[1:]
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		if _, ok := builtinPrivileges(r); ok {
+			fn(r, nil)
+			continue
+		}
+		doc, ok := b.role(r)
+		if !ok {
+			continue
+		}
+		fn(r, doc)
+		roles = append(roles, doc.Roles...)
+	}
+}
+
+// rolePrivileges returns the privileges roles grant, including those of
+// the roles they inherit.
+func (b *MemoryBackend) rolePrivileges(roles []roleName) []privilege {
+	var privs []privilege
+	b.expandRoles(roles, func(r roleName, doc *roleDoc) {
+		if doc == nil {
+			builtin, _ := builtinPrivileges(r)
+			privs = append(privs, builtin...)
+			return
+		}
+		for _, p := range doc.Privileges {
+			if res, err := parseResource(p.Resource); err == nil {
+				privs = append(privs, privilege{res, p.Actions})
+			}
+		}
+	})
+	return privs
+}
+
+// inheritedRoles returns the roles which roles inherit, sorted, not
+// including roles themselves unless they are inherited.
+func (b *MemoryBackend) inheritedRoles(roles []roleName) []roleName {
+	inherited := []roleName{}
+	b.expandRoles(roles, func(r roleName, doc *roleDoc) {
+		if doc != nil {
+			inherited = append(inherited, doc.Roles...)
+		}
+	})
+	sort.Slice(inherited, func(i, j int) bool { return inherited[i].less(inherited[j]) })
+	unique := []roleName{}
+	for i, r := range inherited {
+		if i == 0 || r != inherited[i-1] {
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
+
+// userPrivileges returns the privileges of the users a connection has
+// authenticated as. Users dropped since they authenticated have none.
+func (b *MemoryBackend) userPrivileges(ctx *connContext) []privilege {
+	var roles []roleName
+	for dbname, name := range ctx.users {
+		if u, ok := b.user(dbname, name); ok {
+			roles = append(roles, u.Roles...)
+		}
+	}
+	return b.rolePrivileges(roles)
+}
+
+// need is the actions an operation needs on a resource.
+type need struct {
+	resource resource
+	actions  []string
+}
+
+// commandNeeds returns the actions a command run on a database needs.
+// Commands which are not listed need the action of the same name on the
+// cluster, which root grants. Commands needing no actions may be run by
+// any user who has authenticated.
+func commandNeeds(dbname string, query *OpQueryMsg) []need {
+	cmd, arg := query.Command()
+	onDB := func(actions ...string) need {
+		return need{resource{DB: dbname}, actions}
+	}
+	onColl := func(cname interface{}, actions ...string) need {
+		s, _ := cname.(string)
+		return need{resource{DB: dbname, Collection: s}, actions}
+	}
+	// grants returns what granting or revoking the roles given to the
+	// command needs on each of their databases.
+	grants := func(action string) []need {
+		v, _ := query.Get("roles")
+		roles, _ := parseRoleNames(v, dbname)
+		var needs []need
+		for _, r := range roles {
+			needs = append(needs, need{resource{DB: r.DB}, []string{action}})
+		}
+		return needs
+	}
+	switch cmd {
+	case "find", "count", "distinct", "geoNear":
+		return []need{onColl(arg, "find")}
+	case "aggregate":
+		v, _ := query.Get("pipeline")
+		if stages := asArray(v); len(stages) > 0 {
+			if _, ok := asDoc(stages[0]).Map()["$changeStream"]; ok {
+				return []need{onColl(arg, "changeStream")}
+			}
+		}
+		return []need{onColl(arg, "find")}
+	case "explain":
+		if explained := asDoc(arg); len(explained) > 0 {
+			return []need{onColl(explained[0].Value, "find")}
+		}
+		return []need{onDB("find")}
+	case "listIndexes":
+		return []need{onColl(arg, "listIndexes")}
+	case "collStats":
+		return []need{onColl(arg, "collStats")}
+	case "insert":
+		return []need{onColl(arg, "insert")}
+	case "update":
+		return []need{onColl(arg, "update")}
+	case "delete":
+		return []need{onColl(arg, "remove")}
+	case "create":
+		return []need{onColl(arg, "createCollection")}
+	case "createIndexes":
+		return []need{onColl(arg, "createIndex")}
+	case "drop":
+		return []need{onColl(arg, "dropCollection")}
+	case "dropIndexes", "deleteIndexes":
+		return []need{onColl(arg, "dropIndex")}
+	case "listCollections", "dbStats", "dropDatabase":
+		return []need{onDB(cmd)}
+	case "renameCollection":
+		fromDB, fromColl := splitNamespace(asString(arg))
+		v, _ := query.Get("to")
+		toDB, toColl := splitNamespace(asString(v))
+		from := resource{DB: fromDB, Collection: fromColl}
+		to := resource{DB: toDB, Collection: toColl}
+		if fromDB == toDB {
+			return []need{{from, []string{"renameCollectionSameDB"}}, {to, []string{"renameCollectionSameDB"}}}
+		}
+		return []need{{from, []string{"find", "dropCollection"}}, {to, []string{"insert", "createIndex"}}}
+	case "createUser", "createRole":
+		return append(grants("grantRole"), onDB(cmd))
+	case "updateUser":
+		needs := []need{onDB()}
+		if _, ok := query.Get("pwd"); ok {
+			needs[0].actions = append(needs[0].actions, "changePassword")
+		}
+		if _, ok := query.Get("customData"); ok {
+			needs[0].actions = append(needs[0].actions, "changeCustomData")
+		}
+		if _, ok := query.Get("roles"); ok {
+			needs[0].actions = append(needs[0].actions, "revokeRole")
+			needs = append(needs, grants("grantRole")...)
+		}
+		return needs
+	case "updateRole":
+		return append(grants("grantRole"), onDB("grantRole", "revokeRole"))
+	case "grantRolesToUser", "grantRolesToRole":
+		return grants("grantRole")
+	case "revokeRolesFromUser", "revokeRolesFromRole":
+		return grants("revokeRole")
+	case "grantPrivilegesToRole":
+		return []need{onDB("grantRole")}
+	case "revokePrivilegesFromRole":
+		return []need{onDB("revokeRole")}
+	case "dropUser", "dropAllUsersFromDatabase":
+		return []need{onDB("dropUser")}
+	case "dropRole", "dropAllRolesFromDatabase":
+		return []need{onDB("dropRole")}
+	case "usersInfo":
+		return []need{onDB("viewUser")}
+	case "rolesInfo":
+		return []need{onDB("viewRole")}
+	case "currentOp":
+		return []need{{resource{Cluster: true}, []string{"inprog"}}}
+	case "killOp":
+		return []need{{resource{Cluster: true}, []string{"killop"}}}
+	case "startSession", "endSessions", "refreshSessions", "commitTransaction", "abortTransaction":
+		return nil
+	}
+	return []need{{resource{Cluster: true}, []string{cmd}}}
+}
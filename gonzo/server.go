@@ -1,11 +1,14 @@
 package gonzo
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/tomb.v2"
@@ -14,8 +17,42 @@ import (
 type Server struct {
 	Backend Backend
 
-	ln net.Listener
-	t  tomb.Tomb
+	// Verbose logs each connection as it is accepted and closed, as mongod
+	// does.
+	Verbose bool
+
+	// MaxConns is how many connections the server keeps open at once, as
+	// with mongod --maxConns. Connections beyond it are closed as soon as
+	// they are accepted. Zero means no limit.
+	MaxConns int
+
+	// IdleTimeout closes connections which send no request for so long.
+	// Zero means they are never closed for being idle.
+	IdleTimeout time.Duration
+
+	lns []net.Listener
+	t   tomb.Tomb
+
+	// ca is the ephemeral CA which issued the server's TLS certificate,
+	// if any.
+	ca *CA
+
+	// conns holds the open client connections, and whether each is
+	// handling a request. While the server is unreachable, new connections
+	// are closed as soon as they are accepted. While it is draining, it
+	// accepts no connections, and closes each as soon as it is idle;
+	// drained is closed once they all are.
+	conns       map[net.Conn]bool
+	unreachable bool
+	draining    bool
+	drained     chan struct{}
+
+	// ops holds the operations in progress by their id, as listed by
+	// currentOp, and lastOpID is the id of the latest.
+	ops      map[int32]*operation
+	lastOpID int32
+
+	mu sync.Mutex
 }
 
 func NewServerAddr(netname, addr string) (*Server, error) {
@@ -26,15 +63,75 @@ func NewServerAddr(netname, addr string) (*Server, error) {
 	return NewServer(ln), nil
 }
 
-func NewServer(ln net.Listener) *Server {
-	s := &Server{ln: ln}
+// NewServer serves connections accepted from any of the given listeners,
+// such as a TCP listener and a Unix domain socket.
+func NewServer(lns ...net.Listener) *Server {
+	s := newServer(lns...)
 	s.Backend = NewMemoryBackend(&s.t)
 	return s
 }
 
+func newServer(lns ...net.Listener) *Server {
+	return &Server{
+		lns:     lns,
+		conns:   make(map[net.Conn]bool),
+		drained: make(chan struct{}),
+		ops:     make(map[int32]*operation),
+	}
+}
+
+// SetClock sets the clock used by the server's backend, for example to
+// expire documents from TTL indexes at times controlled by a test.
+func (s *Server) SetClock(clock Clock) {
+	if b, ok := s.Backend.(interface {
+		SetClock(Clock)
+	}); ok {
+		b.SetClock(clock)
+	}
+}
+
+// AddUser adds a user to a database, granting it roles on the database,
+// or sets the password and roles of the user if it already exists.
+func (s *Server) AddUser(dbname, user, password string, roles ...string) error {
+	b, ok := s.Backend.(interface {
+		AddUser(dbname, user, password string, roles ...string) error
+	})
+	if !ok {
+		return fmt.Errorf("backend does not support users")
+	}
+	return b.AddUser(dbname, user, password, roles...)
+}
+
+// SetAuth sets whether clients must authenticate before running anything
+// but the commands which log in, as with mongod --auth.
+func (s *Server) SetAuth(enabled bool) {
+	if b, ok := s.Backend.(interface {
+		SetAuth(bool)
+	}); ok {
+		b.SetAuth(enabled)
+	}
+}
+
+// Addr returns the address the server listens on, or the first of them if
+// it listens on several.
+func (s *Server) Addr() net.Addr {
+	return s.lns[0].Addr()
+}
+
+// Addrs returns the addresses the server listens on.
+func (s *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, ln := range s.lns {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
 func (s *Server) Start() {
 	s.t.Go(s.run)
-	log.Printf("gonzodb running pid=%d addr=%q", os.Getpid(), s.ln.Addr())
+	for _, ln := range s.lns {
+		log.Printf("gonzodb running pid=%d addr=%q", os.Getpid(), ln.Addr())
+	}
 }
 
 func (s *Server) Wait() error {
@@ -42,28 +139,211 @@ func (s *Server) Wait() error {
 }
 
 func (s *Server) run() error {
-	s.t.Go(func() (err error) {
-		var conn net.Conn
-		defer s.t.Kill(err)
-		for {
-			conn, err = s.ln.Accept()
-			if err != nil {
-				return
-			}
-			s.t.Go(func() error { s.handle(conn); return nil })
-		}
-	})
+	for _, ln := range s.lns {
+		ln := ln
+		s.t.Go(func() error {
+			s.accept(ln)
+			return nil
+		})
+	}
 	<-s.t.Dying()
-	s.ln.Close()
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+	s.CloseConnections()
 	return nil
 }
 
+// accept serves the connections accepted from a listener, until it is
+// closed. The server stops if any of its listeners fails, unless it is
+// draining.
+func (s *Server) accept(ln net.Listener) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.draining {
+			s.t.Kill(nil)
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		n, ok := s.addConn(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		if s.Verbose {
+			log.Printf("connection accepted from %s (%d connections now open)", remoteAddr(conn), n)
+		}
+		s.t.Go(func() error {
+			defer func() {
+				n := s.removeConn(conn)
+				if s.Verbose {
+					log.Printf("end connection %s (%d connections now open)", remoteAddr(conn), n)
+				}
+			}()
+			s.handle(conn)
+			return nil
+		})
+	}
+}
+
+// remoteAddr describes the client of a connection, which has no address
+// if it connected to a Unix domain socket.
+func remoteAddr(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		return addr.String()
+	}
+	return "anonymous unix socket"
+}
+
+// addConn adds a connection, returning how many are open, or false if it
+// is refused.
+func (s *Server) addConn(c net.Conn) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unreachable || s.draining {
+		return 0, false
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		if s.Verbose {
+			log.Printf("connection refused because too many open connections: %d", len(s.conns))
+		}
+		return 0, false
+	}
+	s.conns[c] = false
+	return len(s.conns), true
+}
+
+// removeConn removes a connection, returning how many remain open.
+func (s *Server) removeConn(c net.Conn) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.checkDrainedLocked()
+	return len(s.conns)
+}
+
+// startRequest marks a connection as handling a request, returning false
+// if the server is draining and the request should not be handled.
+func (s *Server) startRequest(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+// endRequest marks a connection as idle, returning false if the server is
+// draining and the connection should be closed.
+func (s *Server) endRequest(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = false
+	return !s.draining
+}
+
+func (s *Server) checkDrainedLocked() {
+	if s.draining && len(s.conns) == 0 {
+		select {
+		case <-s.drained:
+		default:
+			close(s.drained)
+		}
+	}
+}
+
+// CloseConnections closes all open client connections, as mongod does when
+// a primary steps down, so that drivers discover the new topology.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// setUnreachable sets whether the server refuses clients, closing the
+// connections already open if so.
+func (s *Server) setUnreachable(unreachable bool) {
+	s.mu.Lock()
+	s.unreachable = unreachable
+	s.mu.Unlock()
+	if unreachable {
+		s.CloseConnections()
+	}
+}
+
+// Stop stops the server at once, closing its connections whether or not
+// they are handling requests.
 func (s *Server) Stop() {
 	s.t.Kill(nil)
 	s.t.Wait()
 }
 
+// Shutdown stops the server gracefully. It stops accepting connections and
+// closes those which are idle, then waits for the others to finish the
+// requests they are handling, closing each as it does. If ctx is done
+// first, the connections which remain are closed regardless, and its error
+// returned. Either way, the server has stopped when Shutdown returns.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+	for c, busy := range s.conns {
+		if !busy {
+			c.Close()
+		}
+	}
+	s.checkDrainedLocked()
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.t.Dying():
+	}
+	s.Stop()
+	return err
+}
+
+// shutdown shuts the server down at the request of a client, at once if
+// forced, and otherwise giving requests in progress up to timeout to
+// finish. The server is shut down in the background, as the client's own
+// request is among those it waits for.
+func (s *Server) shutdown(force bool, timeout time.Duration) {
+	if force {
+		go s.Stop()
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v; closed connections still in use", err)
+		}
+	}()
+}
+
 func errReply(err error) bson.D {
+	if err, ok := err.(*Error); ok {
+		reply := bson.D{
+			{"errmsg", err.Error()},
+			{"code", err.Code},
+			{"codeName", err.CodeName()},
+		}
+		reply = append(reply, err.Info...)
+		return append(reply, bson.DocElem{"ok", 0})
+	}
 	if err != nil {
 		return bson.D{
 			{"errmsg", err.Error()},
@@ -90,8 +370,41 @@ func respError(w io.Writer, requestID int32, err error) error {
 	return resp.Write(w)
 }
 
-func (s *Server) handle(c net.Conn) {
-	defer c.Close()
+// respCursor replies with a batch of documents from a cursor. The cursor
+// has more documents to return unless cursorID is zero.
+func respCursor(w io.Writer, requestID int32, cursorID int64, startingFrom int, docs []interface{}) error {
+	resp := NewOpReplyMsg(requestID, docs...)
+	resp.CursorID = cursorID
+	resp.StartingFrom = int32(startingFrom)
+	return resp.Write(w)
+}
+
+// respQueryError replies to a query on a collection which failed. Unlike
+// command errors, these are reported in an $err field, and flagged as
+// failures.
+func respQueryError(w io.Writer, requestID int32, err error) error {
+	log.Println(err)
+	doc := bson.D{{"$err", err.Error()}}
+	if err, ok := err.(*Error); ok {
+		doc = append(doc, bson.DocElem{"code", err.Code})
+	}
+	resp := NewOpReplyMsg(requestID, doc)
+	resp.ResponseFlags = ReplyFlagQueryFailure
+	return resp.Write(w)
+}
+
+// respCursorNotFound replies to a getMore of a cursor which does not exist,
+// or no longer does.
+func respCursorNotFound(w io.Writer, requestID int32) error {
+	resp := NewOpReplyMsg(requestID)
+	resp.ResponseFlags = ReplyFlagCursorNotFound
+	return resp.Write(w)
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	c := newConnContext(conn)
+	c.server = s
 	for {
 		select {
 		case <-s.t.Dying():
@@ -99,49 +412,119 @@ func (s *Server) handle(c net.Conn) {
 		default:
 		}
 
-		h := &Header{}
-		err := h.Read(c)
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		h, err := c.readMessage()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			if s.Verbose {
+				log.Printf("conn%d: closing connection idle for %v", c.id, s.IdleTimeout)
+			}
+			return
+		}
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
 		if err != nil {
 			log.Printf("header read: %v", err)
+			if h != nil {
+				respQueryError(c, h.RequestID, err)
+			}
 			return
 		}
-		switch h.OpCode {
-		//case OpReply:
-		//case OpMsg:
-		case OpUpdate:
-			update, err := NewOpUpdateMsg(h)
-			if err != nil {
-				respError(c, h.RequestID, err)
-				return
-			}
-			s.Backend.HandleUpdate(c, update)
-		case OpInsert:
-			insert, err := NewOpInsertMsg(h)
-			if err != nil {
-				respError(c, h.RequestID, err)
-				return
-			}
-			s.Backend.HandleInsert(c, insert)
-		case OpQuery:
-			query, err := NewOpQueryMsg(h)
-			if err != nil {
-				respError(c, h.RequestID, err)
-				return
-			}
-			s.Backend.HandleQuery(c, query)
-		//case OpGetMore:
-		case OpDelete:
-			deleteMsg, err := NewOpDeleteMsg(h)
-			if err != nil {
-				respError(c, h.RequestID, err)
-				return
-			}
-			s.Backend.HandleDelete(c, deleteMsg)
-		//case OpKillCursors:
-		default:
-			err := fmt.Errorf("unsupported op code %d", h.OpCode)
-			respError(c, h.RequestID, err)
+		if !s.startRequest(conn) {
+			return
+		}
+		c.lastError.startRequest()
+		if ok := s.dispatch(c, h); !s.endRequest(conn) || !ok {
 			return
 		}
 	}
 }
+
+// dispatch parses a message and passes it to the backend. Messages which
+// cannot be parsed are failed as mongod fails them: queries with an $err
+// reply, and writes, which have no reply, with the error getLastError
+// reports. As the message was read in full, the connection remains usable.
+// While the backend handles a message, it is registered as an operation in
+// progress on the connection. dispatch returns false if the connection
+// should be closed.
+func (s *Server) dispatch(c *connContext, h *Header) bool {
+	var err error
+	switch h.OpCode {
+	//case OpReply:
+	case OpMsg:
+		var msg *OpMsgMsg
+		if msg, err = NewOpMsgMsg(h); err == nil {
+			// As mongod did, log the message and reply that it is
+			// deprecated.
+			log.Printf("conn%d: dbMsg: %q", c.id, msg.Message)
+			respDoc(c, h.RequestID, bson.D{{"msg", "i am fine - dbMsg deprecated"}})
+		}
+	case OpUpdate:
+		var update *OpUpdateMsg
+		if update, err = NewOpUpdateMsg(h); err == nil {
+			s.runOp(c, "update", update.FullCollectionName, nil, func() {
+				s.Backend.HandleUpdate(c, update)
+			})
+		}
+	case OpInsert:
+		var insert *OpInsertMsg
+		if insert, err = NewOpInsertMsg(h); err == nil {
+			s.runOp(c, "insert", insert.FullCollectionName, nil, func() {
+				s.Backend.HandleInsert(c, insert)
+			})
+		}
+	case OpQuery:
+		var query *OpQueryMsg
+		if query, err = NewOpQueryMsg(h); err == nil {
+			kind := "query"
+			if _, cname := splitNamespace(query.FullCollectionName); cname == "$cmd" {
+				kind = "command"
+			}
+			s.runOp(c, kind, query.FullCollectionName, query.Doc, func() {
+				s.Backend.HandleQuery(c, query)
+			})
+		}
+	case OpGetMore:
+		var getMore *OpGetMoreMsg
+		if getMore, err = NewOpGetMoreMsg(h); err == nil {
+			_, cname := splitNamespace(getMore.FullCollectionName)
+			command := bson.D{{"getMore", getMore.CursorID}, {"collection", cname}}
+			s.runOp(c, "getmore", getMore.FullCollectionName, command, func() {
+				s.Backend.HandleGetMore(c, getMore)
+			})
+		}
+	case OpDelete:
+		var deleteMsg *OpDeleteMsg
+		if deleteMsg, err = NewOpDeleteMsg(h); err == nil {
+			s.runOp(c, "remove", deleteMsg.FullCollectionName, nil, func() {
+				s.Backend.HandleDelete(c, deleteMsg)
+			})
+		}
+	case OpKillCursors:
+		var killCursors *OpKillCursorsMsg
+		if killCursors, err = NewOpKillCursorsMsg(h); err == nil {
+			s.runOp(c, "killcursors", "", nil, func() {
+				s.Backend.HandleKillCursors(c, killCursors)
+			})
+		}
+	default:
+		err := fmt.Errorf("unsupported op code %d", h.OpCode)
+		respError(c, h.RequestID, err)
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	switch h.OpCode {
+	case OpQuery, OpGetMore:
+		respQueryError(c, h.RequestID, err)
+	case OpKillCursors, OpMsg:
+		log.Println(err)
+	default:
+		log.Println(err)
+		c.lastError.record(writeErrorResult(0, err))
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package gonzo_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+func (s *gonzoSuite) TestListeners(c *gc.C) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	path := filepath.Join(c.MkDir(), "gonzo.sock")
+	unix, err := net.Listen("unix", path)
+	c.Assert(err, gc.IsNil)
+	server := gonzo.NewServer(tcp, unix)
+	server.Verbose = true
+	server.Start()
+	defer server.Stop()
+	c.Assert(server.Addrs(), gc.DeepEquals, []net.Addr{tcp.Addr(), unix.Addr()})
+
+	// Clients of each listener share the server's databases.
+	session, err := mgo.Dial(server.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	// mgo resolves the addresses it is given as TCP addresses, even if it
+	// is told how to dial them.
+	local, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   []string{"127.0.0.1:1"},
+		Direct:  true,
+		Timeout: 5 * time.Second,
+		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	defer local.Close()
+	n, err := local.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+// awaitData starts tailing a capped collection with a session, leaving a
+// getMore waiting for data for AwaitDataTimeout. The channel returned is
+// closed once the session stops tailing.
+func (s *gonzoSuite) awaitData(c *gc.C, session *mgo.Session) <-chan struct{} {
+	coll := s.createCapped(c, "events", 4096, 0)
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	iter := session.DB("db1").C("events").Find(nil).Tail(-1)
+	var doc bson.M
+	c.Assert(iter.Next(&doc), gc.Equals, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for iter.Next(&doc) {
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	return done
+}
+
+func (s *gonzoSuite) TestShutdown(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 300 * time.Millisecond
+	tailing := s.session.Copy()
+	defer tailing.Close()
+	idle := s.session.Copy()
+	defer idle.Close()
+	c.Assert(idle.Ping(), gc.IsNil)
+	done := s.awaitData(c, tailing)
+
+	// Requests in progress are finished, while no new connections are
+	// accepted.
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(s.server.Shutdown(ctx), gc.IsNil)
+	c.Assert(time.Since(start) > 200*time.Millisecond, gc.Equals, true)
+	<-done
+	idle.SetSyncTimeout(200 * time.Millisecond)
+	c.Assert(idle.Ping(), gc.NotNil)
+	_, err := mgo.DialWithTimeout(s.server.Addr().String(), 200*time.Millisecond)
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *gonzoSuite) TestShutdownDeadline(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 10 * time.Second
+	tailing := s.session.Copy()
+	defer tailing.Close()
+	done := s.awaitData(c, tailing)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Assert(s.server.Shutdown(ctx), gc.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < 5*time.Second, gc.Equals, true)
+	<-done
+}
+
+func (s *gonzoSuite) TestShutdownCommand(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 300 * time.Millisecond
+	err := s.session.DB("db1").Run("shutdown", nil)
+	c.Assert(err, gc.ErrorMatches, "shutdown may only be run against the admin database.")
+	c.Assert(errorCode(err), gc.Equals, 13)
+	err = s.session.Run(bson.D{{"shutdown", 1}, {"timeoutSecs", "soon"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 2)
+
+	tailing := s.session.Copy()
+	defer tailing.Close()
+	done := s.awaitData(c, tailing)
+
+	// The client which shuts the server down gets no reply.
+	start := time.Now()
+	c.Assert(s.session.Run(bson.D{{"shutdown", 1}, {"timeoutSecs", 5.0}}, nil), gc.NotNil)
+	c.Assert(s.server.Wait(), gc.IsNil)
+	c.Assert(time.Since(start) > 200*time.Millisecond, gc.Equals, true)
+	<-done
+}
+
+func (s *gonzoSuite) TestShutdownForce(c *gc.C) {
+	defer func(d time.Duration) { gonzo.AwaitDataTimeout = d }(gonzo.AwaitDataTimeout)
+	gonzo.AwaitDataTimeout = 10 * time.Second
+	tailing := s.session.Copy()
+	defer tailing.Close()
+	done := s.awaitData(c, tailing)
+
+	start := time.Now()
+	c.Assert(s.session.Run(bson.D{{"shutdown", 1}, {"force", true}}, nil), gc.NotNil)
+	c.Assert(s.server.Wait(), gc.IsNil)
+	c.Assert(time.Since(start) < 5*time.Second, gc.Equals, true)
+	<-done
+}
+
+// newServer starts a server of its own for a test to configure.
+func newServer(c *gc.C, configure func(server *gonzo.Server)) *gonzo.Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	server := gonzo.NewServer(ln)
+	configure(server)
+	server.Start()
+	return server
+}
+
+// ping pings a server over a raw connection, returning the error reading
+// the reply, if any.
+func ping(c *gc.C, conn net.Conn) error {
+	_, err := conn.Write(rawMessage(opQuery(c, 1, "admin.$cmd", bson.M{"ping": 1})))
+	if err != nil {
+		return err
+	}
+	return (&gonzo.Header{}).Read(conn)
+}
+
+func (s *gonzoSuite) TestMaxConns(c *gc.C) {
+	server := newServer(c, func(server *gonzo.Server) { server.MaxConns = 2 })
+	defer server.Stop()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		c.Assert(err, gc.IsNil)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	c.Assert(ping(c, conns[0]), gc.IsNil)
+	c.Assert(ping(c, conns[1]), gc.IsNil)
+
+	// Connections beyond the limit are closed at once, until others are.
+	c.Assert(ping(c, conns[2]), gc.NotNil)
+	conns[0].Close()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		c.Assert(err, gc.IsNil)
+		defer conn.Close()
+		if ping(c, conn) == nil {
+			break
+		}
+		c.Assert(i < 50, gc.Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *gonzoSuite) TestIdleTimeout(c *gc.C) {
+	server := newServer(c, func(server *gonzo.Server) { server.IdleTimeout = 200 * time.Millisecond })
+	defer server.Stop()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	// Connections in use are kept open, while idle ones are closed.
+	for i := 0; i < 5; i++ {
+		c.Assert(ping(c, conn), gc.IsNil)
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(ping(c, conn), gc.NotNil)
+}
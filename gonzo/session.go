@@ -0,0 +1,121 @@
+package gonzo
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SessionTimeout is how long a logical session may go unused before it
+// expires, as with mongod's default localLogicalSessionTimeoutMinutes.
+var SessionTimeout = 30 * time.Minute
+
+// session is a logical session, identified by the lsid clients send with
+// their commands.
+type session struct {
+	id      bson.Binary
+	lastUse time.Time
+
+	// txnNumber is the highest transaction number used in the session,
+	// and txn the transaction started with it, if any. Otherwise stmts
+	// holds the results of the retryable write statements run with it, by
+	// statement id.
+	txnNumber int64
+	txn       *transaction
+	stmts     map[int32]*stmtResult
+}
+
+// sessionSet holds the logical sessions of a backend. Commands in
+// transactions are run one at a time, holding its lock.
+type sessionSet struct {
+	sessions map[string]*session
+
+	mu sync.Mutex
+}
+
+func newSessionSet() *sessionSet {
+	return &sessionSet{sessions: make(map[string]*session)}
+}
+
+// parseSessionID returns the UUID in an lsid document.
+func parseSessionID(v interface{}) (bson.Binary, error) {
+	doc, _ := asBsonM(v)
+	id, ok := doc["id"].(bson.Binary)
+	if !ok || id.Kind != 0x04 || len(id.Data) != 16 {
+		return bson.Binary{}, errorf(ErrBadValue, "invalid session id: %s", formatValue(v))
+	}
+	return id, nil
+}
+
+// expireLocked removes the sessions which have not been used within
+// SessionTimeout, aborting their transactions.
+func (s *sessionSet) expireLocked(now time.Time) {
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastUse) >= SessionTimeout {
+			if sess.txn != nil {
+				sess.txn.abort()
+			}
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// getLocked returns the session with an id, starting it if it is not
+// already, and marks it as used.
+func (s *sessionSet) getLocked(id bson.Binary, now time.Time) *session {
+	s.expireLocked(now)
+	sess, ok := s.sessions[string(id.Data)]
+	if !ok {
+		sess = &session{id: id}
+		s.sessions[string(id.Data)] = sess
+	}
+	sess.lastUse = now
+	return sess
+}
+
+// end ends the sessions with the given lsids, aborting their transactions.
+func (s *sessionSet) end(lsids []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lsid := range lsids {
+		id, err := parseSessionID(lsid)
+		if err != nil {
+			return err
+		}
+		if sess, ok := s.sessions[string(id.Data)]; ok {
+			if sess.txn != nil {
+				sess.txn.abort()
+			}
+			delete(s.sessions, string(id.Data))
+		}
+	}
+	return nil
+}
+
+// refresh marks the sessions with the given lsids as used, so that they do
+// not expire.
+func (s *sessionSet) refresh(lsids []interface{}, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lsid := range lsids {
+		id, err := parseSessionID(lsid)
+		if err != nil {
+			return err
+		}
+		s.getLocked(id, now)
+	}
+	return nil
+}
+
+// startSession starts a new session, with an id chosen by the server.
+func (b *MemoryBackend) startSession() bson.D {
+	id := newUUID()
+	b.sessions.mu.Lock()
+	b.sessions.getLocked(id, b.Clock().Now())
+	b.sessions.mu.Unlock()
+	return markOk(bson.D{
+		{"id", bson.D{{"id", id}}},
+		{"timeoutMinutes", int(SessionTimeout / time.Minute)},
+	})
+}
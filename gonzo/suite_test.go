@@ -238,3 +238,113 @@ func (s *gonzoSuite) TestDelete(c *gc.C) {
 	err = s.session.DB("db1").C("c1").Find(bson.M{"artist": "cherubs"}).One(&result)
 	c.Assert(err, gc.ErrorMatches, "not found")
 }
+
+func (s *gonzoSuite) TestCollectionNames(c *gc.C) {
+	for _, cname := range []string{"c2", "c1"} {
+		err := s.session.DB("db1").C(cname).Insert(bson.M{"foo": 1})
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.session.DB("db1").Run(bson.D{
+		{"create", "c3"}, {"capped", true}, {"size", 4096},
+		{"writeConcern", bson.M{"w": 1}}, {"$readPreference", bson.M{"mode": "primary"}}}, nil)
+	c.Assert(err, gc.IsNil)
+
+	names, err := s.session.DB("db1").CollectionNames()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"c1", "c2", "c3"})
+
+	var result struct {
+		Cursor struct {
+			Id         int64
+			NS         string
+			FirstBatch []bson.M `bson:"firstBatch"`
+		}
+	}
+	err = s.session.DB("db1").Run(bson.D{
+		{"listCollections", 1}, {"filter", bson.D{{"name", "c3"}}}}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Cursor.Id, gc.Equals, int64(0))
+	c.Assert(result.Cursor.NS, gc.Equals, "db1.$cmd.listCollections")
+	c.Assert(result.Cursor.FirstBatch, gc.HasLen, 1)
+	info := result.Cursor.FirstBatch[0]
+	c.Assert(info["name"], gc.Equals, "c3")
+	c.Assert(info["type"], gc.Equals, "collection")
+	c.Assert(info["options"], gc.DeepEquals, bson.M{"capped": true, "size": 4096})
+	uuid, ok := info["info"].(bson.M)["uuid"].(bson.Binary)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(uuid.Kind, gc.Equals, byte(0x04))
+	c.Assert(uuid.Data, gc.HasLen, 16)
+
+	err = s.session.DB("db1").Run(bson.D{
+		{"listCollections", 1}, {"nameOnly", true}}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Cursor.FirstBatch, gc.HasLen, 3)
+	c.Assert(result.Cursor.FirstBatch[0], gc.DeepEquals, bson.M{"name": "c1", "type": "collection"})
+
+	err = s.session.DB("db1").Run(bson.D{{"create", "c3"}}, nil)
+	c.Assert(err, gc.ErrorMatches, `collection already exists: "c3"`)
+}
+
+func (s *gonzoSuite) TestListDatabases(c *gc.C) {
+	for _, dbname := range []string{"db2", "db1"} {
+		err := s.session.DB(dbname).C("c1").Insert(bson.M{"foo": 1})
+		c.Assert(err, gc.IsNil)
+	}
+
+	names, err := s.session.DatabaseNames()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"db1", "db2"})
+
+	var result struct {
+		Databases []bson.M
+		TotalSize int64 `bson:"totalSize"`
+	}
+	err = s.session.Run(bson.D{{"listDatabases", 1}}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Databases, gc.HasLen, 2)
+	var sum int64
+	for _, dbinfo := range result.Databases {
+		size, ok := dbinfo["sizeOnDisk"].(int64)
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(size > 0, gc.Equals, true)
+		sum += size
+	}
+	c.Assert(result.TotalSize, gc.Equals, sum)
+
+	result.Databases = nil
+	err = s.session.Run(bson.D{
+		{"listDatabases", 1}, {"nameOnly", true}, {"filter", bson.D{{"name", "db2"}}}}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Databases, gc.DeepEquals, []bson.M{{"name": "db2"}})
+}
+
+func (s *gonzoSuite) TestQueryOperators(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	for i := 0; i < 10; i++ {
+		err := coll.Insert(bson.M{"i": i, "tags": []string{"t" + string('0'+rune(i%3))}})
+		c.Assert(err, gc.IsNil)
+	}
+
+	for _, test := range []struct {
+		query bson.M
+		n     int
+	}{
+		{bson.M{"i": bson.M{"$gt": 6}}, 3},
+		{bson.M{"i": bson.M{"$gte": 2, "$lt": 5}}, 3},
+		{bson.M{"i": bson.M{"$in": []int{1, 3, 99}}}, 2},
+		{bson.M{"i": bson.M{"$nin": []int{1, 3}}}, 8},
+		{bson.M{"i": bson.M{"$ne": 1}}, 9},
+		{bson.M{"i": bson.M{"$gt": "a"}}, 0},
+		{bson.M{"tags": "t0"}, 4},
+		{bson.M{"tags": bson.M{"$size": 1}}, 10},
+		{bson.M{"tags": bson.RegEx{Pattern: "^T[12]$", Options: "i"}}, 6},
+		{bson.M{"missing": bson.M{"$exists": false}}, 10},
+		{bson.M{"missing": nil}, 10},
+		{bson.M{"$or": []bson.M{{"i": 1}, {"i": 2}}}, 2},
+		{bson.M{"i": bson.M{"$not": bson.M{"$lt": 8}}}, 2},
+	} {
+		n, err := coll.Find(test.query).Count()
+		c.Assert(err, gc.IsNil)
+		c.Check(n, gc.Equals, test.n, gc.Commentf("query %v", test.query))
+	}
+}
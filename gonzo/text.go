@@ -0,0 +1,765 @@
+package gonzo
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// textIndexVersion is the version of text index mongod 3.2 and later build.
+const textIndexVersion = 3
+
+// textIndex holds the options of a text index, which indexes the terms in
+// the string fields of documents.
+type textIndex struct {
+	// fields are the paths of the fields indexed, with their weights,
+	// unless wildcard is set, in which case all string fields are indexed.
+	fields   bson.D
+	weights  map[string]float64
+	wildcard bool
+
+	defaultLanguage  string
+	languageOverride string
+}
+
+// textLanguages are the languages text search supports, with whether they
+// stem words and drop stop words.
+var textLanguages = map[string]bool{
+	"english": true,
+	"en":      true,
+	"none":    false,
+}
+
+func checkTextLanguage(language string) error {
+	if _, ok := textLanguages[language]; !ok {
+		return errorf(ErrBadValue, "unsupported language: %q for text search", language)
+	}
+	return nil
+}
+
+// newTextIndex parses the text fields and options of a text index
+// specification. The key pattern of a text index is either given with a
+// "text" value for each field, or in the form mongod stores it, with the
+// fields given by the weights option.
+func newTextIndex(key bson.D, spec bson.D) (*textIndex, error) {
+	t := &textIndex{
+		weights:          make(map[string]float64),
+		defaultLanguage:  "english",
+		languageOverride: "language",
+	}
+	for _, kv := range key {
+		switch {
+		case kv.Name == "_fts" || kv.Name == "_ftsx":
+		case kv.Value == "text":
+			t.fields = append(t.fields, bson.DocElem{kv.Name, 1})
+		default:
+			return nil, errorf(ErrBadValue, "compound text indexes are not supported: %s", formatValue(key))
+		}
+	}
+	for _, kv := range spec {
+		switch kv.Name {
+		case "weights":
+			for _, w := range asDoc(kv.Value) {
+				if typeOrder(w.Value) != 10 || asFloat64(w.Value) <= 0 {
+					return nil, errorf(ErrBadValue, "text index weight must be a positive number: %s", formatValue(w.Value))
+				}
+				found := false
+				for i := range t.fields {
+					if t.fields[i].Name == w.Name {
+						t.fields[i].Value, found = w.Value, true
+					}
+				}
+				if !found {
+					t.fields = append(t.fields, w)
+				}
+			}
+		case "default_language":
+			t.defaultLanguage, _ = kv.Value.(string)
+			if err := checkTextLanguage(t.defaultLanguage); err != nil {
+				return nil, err
+			}
+		case "language_override":
+			t.languageOverride, _ = kv.Value.(string)
+		}
+	}
+	if len(t.fields) == 0 {
+		return nil, errorf(ErrBadValue, "text index requires at least one field: %s", formatValue(key))
+	}
+	for _, kv := range t.fields {
+		if kv.Name == "$**" {
+			t.wildcard = true
+		}
+		t.weights[kv.Name] = asFloat64(kv.Value)
+	}
+	return t, nil
+}
+
+// options returns the index options mongod reports for a text index.
+func (t *textIndex) options() bson.D {
+	return bson.D{
+		{"weights", t.fields},
+		{"default_language", t.defaultLanguage},
+		{"language_override", t.languageOverride},
+		{"textIndexVersion", textIndexVersion},
+	}
+}
+
+// textValue is a string in a document, along with the weight of the field
+// it was found in.
+type textValue struct {
+	text   string
+	weight float64
+}
+
+// values returns the strings a text index indexes in a document.
+func (t *textIndex) values(doc bson.M) []textValue {
+	var result []textValue
+	if t.wildcard {
+		weight := t.weights["$**"]
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch typeOrder(v) {
+			case 15:
+				result = append(result, textValue{asString(v), weight})
+			case 20:
+				for _, kv := range asDoc(v) {
+					w, ok := t.weights[kv.Name]
+					if ok {
+						result = append(result, stringValues(kv.Value, w)...)
+						continue
+					}
+					walk(kv.Value)
+				}
+			case 25:
+				for _, elem := range v.([]interface{}) {
+					walk(elem)
+				}
+			}
+		}
+		walk(doc)
+		return result
+	}
+	for _, kv := range t.fields {
+		value, _ := lookupPath(doc, kv.Name)
+		result = append(result, stringValues(value, t.weights[kv.Name])...)
+	}
+	return result
+}
+
+// stringValues returns the strings in a field value, which may be a
+// string or an array of them.
+func stringValues(v interface{}, weight float64) []textValue {
+	switch typeOrder(v) {
+	case 15:
+		return []textValue{{asString(v), weight}}
+	case 25:
+		var result []textValue
+		for _, elem := range v.([]interface{}) {
+			result = append(result, stringValues(elem, weight)...)
+		}
+		return result
+	}
+	return nil
+}
+
+// language returns the language a document's text is in.
+func (t *textIndex) language(doc bson.M) (string, error) {
+	if v, ok := doc[t.languageOverride]; ok {
+		language, ok := v.(string)
+		if !ok {
+			return "", errorf(ErrBadValue, "language override must be a string: %s", formatValue(v))
+		}
+		return language, checkTextLanguage(language)
+	}
+	return t.defaultLanguage, nil
+}
+
+// keys returns the index keys for a document, which are its distinct
+// terms.
+func (t *textIndex) keys(doc bson.M) ([][]interface{}, error) {
+	language, err := t.language(doc)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var result [][]interface{}
+	for _, v := range t.values(doc) {
+		for _, term := range textTerms(v.text, language, false) {
+			if !seen[term] {
+				seen[term] = true
+				result = append(result, []interface{}{term})
+			}
+		}
+	}
+	return result, nil
+}
+
+// score returns the relevance of each term in a document, computed the way
+// mongod does: terms score more the more often they occur, especially
+// early on, in shorter strings and in fields with greater weight.
+func (t *textIndex) score(doc bson.M, language string, caseSensitive bool) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, v := range t.values(doc) {
+		terms := textTerms(v.text, language, caseSensitive)
+		type termStats struct {
+			freq, exp float64
+			count     int
+		}
+		stats := make(map[string]*termStats)
+		var order []string
+		for _, term := range terms {
+			s, ok := stats[term]
+			if !ok {
+				s = &termStats{}
+				stats[term] = s
+				order = append(order, term)
+			}
+			if s.exp == 0 {
+				s.exp = 1
+			} else {
+				s.exp *= 2
+			}
+			s.freq += 1 / s.exp
+			s.count++
+		}
+		for _, term := range order {
+			s := stats[term]
+			coeff := 0.5*float64(s.count)/float64(len(terms)) + 0.5
+			adjustment := 1.0
+			if strings.EqualFold(v.text, term) {
+				adjustment += 0.1
+			}
+			scores[term] += v.weight * s.freq * coeff * adjustment
+		}
+	}
+	return scores
+}
+
+// textTerms splits text into words, and returns the terms which are
+// indexed for them: words other than stop words, stemmed, and folded to
+// lower case unless the search is case sensitive.
+func textTerms(text, language string, caseSensitive bool) []string {
+	stems := textLanguages[language]
+	var result []string
+	for _, word := range strings.FieldsFunc(text, isWordDelimiter) {
+		lower := strings.ToLower(word)
+		if stems && englishStopWords[lower] {
+			continue
+		}
+		if !caseSensitive {
+			word = lower
+		}
+		if stems {
+			word = stem(word)
+		}
+		result = append(result, word)
+	}
+	return result
+}
+
+func isWordDelimiter(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// textQuery is a parsed $text query.
+type textQuery struct {
+	search        string
+	language      string
+	caseSensitive bool
+
+	terms          []string
+	negatedTerms   []string
+	phrases        []string
+	negatedPhrases []string
+}
+
+// parseTextQuery parses the argument of a $text query operator. Words
+// prefixed with - are negated, and "quoted phrases" must appear in full.
+func parseTextQuery(arg interface{}, defaultLanguage string) (*textQuery, error) {
+	q := &textQuery{language: defaultLanguage}
+	var hasSearch bool
+	for _, kv := range asDoc(arg) {
+		switch kv.Name {
+		case "$search":
+			q.search, hasSearch = kv.Value.(string)
+			if !hasSearch {
+				return nil, errorf(ErrBadValue, "$search requires a string value")
+			}
+		case "$language":
+			language, ok := kv.Value.(string)
+			if !ok {
+				return nil, errorf(ErrBadValue, "$language requires a string value")
+			}
+			if err := checkTextLanguage(language); err != nil {
+				return nil, err
+			}
+			q.language = language
+		case "$caseSensitive":
+			q.caseSensitive = asBool(kv.Value)
+		case "$diacriticSensitive":
+		default:
+			return nil, errorf(ErrBadValue, "extra fields in $text")
+		}
+	}
+	if !hasSearch {
+		return nil, errorf(ErrBadValue, "$search required in $text")
+	}
+
+	addTerms := func(text string, negated bool) {
+		for _, term := range textTerms(text, q.language, q.caseSensitive) {
+			if negated {
+				q.negatedTerms = appendUnique(q.negatedTerms, term)
+			} else {
+				q.terms = appendUnique(q.terms, term)
+			}
+		}
+	}
+	s := q.search
+	for len(s) > 0 {
+		negated := false
+		switch {
+		case strings.HasPrefix(s, `-"`) || strings.HasPrefix(s, `"`):
+			if s[0] == '-' {
+				negated = true
+				s = s[1:]
+			}
+			end := strings.Index(s[1:], `"`)
+			var phrase string
+			if end < 0 {
+				phrase, s = s[1:], ""
+			} else {
+				phrase, s = s[1:end+1], s[end+2:]
+			}
+			if strings.TrimSpace(phrase) == "" {
+				continue
+			}
+			if negated {
+				q.negatedPhrases = append(q.negatedPhrases, phrase)
+			} else {
+				q.phrases = append(q.phrases, phrase)
+				addTerms(phrase, false)
+			}
+		case unicode.IsSpace(rune(s[0])):
+			s = s[1:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+			if end < 0 {
+				end = len(s)
+			}
+			word := s[:end]
+			s = s[end:]
+			if strings.HasPrefix(word, "-") {
+				addTerms(word[1:], true)
+			} else {
+				addTerms(word, false)
+			}
+		}
+	}
+	return q, nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// matchScore returns whether a document matches a text query, and its
+// score if so. Documents match if they contain any of the terms and all
+// of the phrases, and none of the negated terms or phrases.
+func (q *textQuery) matchScore(t *textIndex, doc bson.M) (float64, bool) {
+	language, err := t.language(doc)
+	if err != nil {
+		return 0, false
+	}
+	scores := t.score(doc, language, q.caseSensitive)
+	for _, term := range q.negatedTerms {
+		if _, ok := scores[term]; ok {
+			return 0, false
+		}
+	}
+	var score float64
+	var found bool
+	for _, term := range q.terms {
+		if s, ok := scores[term]; ok {
+			score += s
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	values := t.values(doc)
+	for _, phrase := range q.phrases {
+		if !containsPhrase(values, phrase, q.caseSensitive) {
+			return 0, false
+		}
+	}
+	for _, phrase := range q.negatedPhrases {
+		if containsPhrase(values, phrase, q.caseSensitive) {
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+func containsPhrase(values []textValue, phrase string, caseSensitive bool) bool {
+	if !caseSensitive {
+		phrase = strings.ToLower(phrase)
+	}
+	for _, v := range values {
+		text := v.text
+		if !caseSensitive {
+			text = strings.ToLower(text)
+		}
+		if strings.Contains(text, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// textSearch finds the documents matching a text query using a text
+// index. It returns the ids of the matching records, in insertion order,
+// with their scores, the number of index keys examined and the number of
+// documents examined.
+func (c *MemoryCollection) textSearch(idx *memoryIndex, q *textQuery) ([]int64, map[int64]float64, int, int) {
+	candidates := make(map[int64]bool)
+	var keysExamined int
+	for _, term := range q.terms {
+		if q.caseSensitive {
+			term = strings.ToLower(term)
+		}
+		bounds := [][]interval{{pointInterval(term)}}
+		ids, keys := idx.scan(bounds)
+		keysExamined += keys
+		for _, id := range ids {
+			candidates[id] = true
+		}
+	}
+	var ids []int64
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Sort(int64Slice(ids))
+
+	var result []int64
+	scores := make(map[int64]float64)
+	for _, id := range ids {
+		if score, ok := q.matchScore(idx.text, c.docs[id]); ok {
+			result = append(result, id)
+			scores[id] = score
+		}
+	}
+	return result, scores, keysExamined, len(ids)
+}
+
+// stage returns the description of a text search which explain reports.
+func (q *textQuery) stage(idx *memoryIndex, stats *QueryResult) bson.D {
+	nonNil := func(list []string) []string {
+		if list == nil {
+			return []string{}
+		}
+		return list
+	}
+	stage := bson.D{{"stage", "TEXT"}}
+	if stats != nil {
+		stage = append(stage,
+			bson.DocElem{"nReturned", stats.nMatched},
+			bson.DocElem{"keysExamined", stats.KeysExamined},
+			bson.DocElem{"docsExamined", stats.DocsExamined})
+	}
+	return append(stage, bson.D{
+		{"indexPrefix", bson.D{}},
+		{"indexName", idx.name},
+		{"parsedTextQuery", bson.D{
+			{"terms", nonNil(q.terms)},
+			{"negatedTerms", nonNil(q.negatedTerms)},
+			{"phrases", nonNil(q.phrases)},
+			{"negatedPhrases", nonNil(q.negatedPhrases)},
+		}},
+		{"textIndexVersion", textIndexVersion},
+	}...)
+}
+
+// isTextScore returns whether a projection or sort value asks for the
+// text score of documents, as {$meta: "textScore"}.
+func isTextScore(v interface{}) bool {
+	ops, ok := operatorDoc(v)
+	return ok && len(ops) == 1 && ops[0].Name == "$meta" && ops[0].Value == "textScore"
+}
+
+// englishStopWords are the words too common in English text to be worth
+// indexing.
+var englishStopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+		a about above after again against all am an and any are as at be
+		because been before being below between both but by can cannot could
+		did do does doing down during each few for from further had has have
+		having he her here hers herself him himself his how i if in into is
+		it its itself me more most my myself no nor not of off on once only
+		or other ought our ours ourselves out over own same she should so
+		some such than that the their theirs them themselves then there these
+		they this those through to too under until up very was we were what
+		when where which while who whom why with would you your yours
+		yourself yourselves`) {
+		englishStopWords[word] = true
+	}
+}
+
+// stem reduces an English word to its stem, using the Porter stemming
+// algorithm, so that words such as "run" and "running" are the same term.
+// Words which are not plain ASCII are left as they are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for _, r := range word {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			return word
+		}
+	}
+	z := &stemmer{b: []byte(word)}
+	z.step1ab()
+	if len(z.b) > 1 {
+		z.step1c()
+		z.step2()
+		z.step3()
+		z.step4()
+		z.step5()
+	}
+	return string(z.b)
+}
+
+// stemmer holds a word being stemmed, and the end j of the stem found by
+// the last suffix matched.
+type stemmer struct {
+	b []byte
+	j int
+}
+
+func (z *stemmer) k() int {
+	return len(z.b) - 1
+}
+
+// cons returns whether b[i] is a consonant.
+func (z *stemmer) cons(i int) bool {
+	switch z.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !z.cons(i-1)
+	}
+	return true
+}
+
+// m measures the number of consonant sequences between the start of the
+// word and j.
+func (z *stemmer) m() int {
+	n, i := 0, 0
+	for {
+		if i > z.j {
+			return n
+		}
+		if !z.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > z.j {
+				return n
+			}
+			if z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > z.j {
+				return n
+			}
+			if !z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+func (z *stemmer) vowelInStem() bool {
+	for i := 0; i <= z.j; i++ {
+		if !z.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *stemmer) doubleC(i int) bool {
+	return i >= 1 && z.b[i] == z.b[i-1] && z.cons(i)
+}
+
+// cvc returns whether b[i-2..i] is consonant-vowel-consonant, where the
+// last consonant is not w, x or y.
+func (z *stemmer) cvc(i int) bool {
+	if i < 2 || !z.cons(i) || z.cons(i-1) || !z.cons(i-2) {
+		return false
+	}
+	switch z.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+func (z *stemmer) ends(s string) bool {
+	if !bytes.HasSuffix(z.b, []byte(s)) {
+		return false
+	}
+	z.j = len(z.b) - len(s) - 1
+	return true
+}
+
+func (z *stemmer) setTo(s string) {
+	z.b = append(z.b[:z.j+1], s...)
+}
+
+func (z *stemmer) replace(s string) {
+	if z.m() > 0 {
+		z.setTo(s)
+	}
+}
+
+// step1ab removes plurals, -ed and -ing.
+func (z *stemmer) step1ab() {
+	if z.b[z.k()] == 's' {
+		switch {
+		case z.ends("sses"):
+			z.setTo("ss")
+		case z.ends("ies"):
+			z.setTo("i")
+		case z.b[z.k()-1] != 's':
+			z.b = z.b[:z.k()]
+		}
+	}
+	if z.ends("eed") {
+		if z.m() > 0 {
+			z.b = z.b[:z.k()]
+		}
+		return
+	}
+	if (z.ends("ed") || z.ends("ing")) && z.vowelInStem() {
+		z.b = z.b[:z.j+1]
+		z.j = z.k()
+		switch {
+		case z.ends("at"):
+			z.setTo("ate")
+		case z.ends("bl"):
+			z.setTo("ble")
+		case z.ends("iz"):
+			z.setTo("ize")
+		case z.doubleC(z.k()):
+			switch z.b[z.k()] {
+			case 'l', 's', 'z':
+			default:
+				z.b = z.b[:z.k()]
+			}
+		default:
+			z.j = z.k()
+			if z.m() == 1 && z.cvc(z.k()) {
+				z.b = append(z.b, 'e')
+			}
+		}
+	}
+}
+
+// step1c turns a final y into i when there is another vowel in the stem.
+func (z *stemmer) step1c() {
+	if z.ends("y") && z.vowelInStem() {
+		z.b[z.k()] = 'i'
+	}
+}
+
+// applySuffixes replaces the first of the suffixes the word ends with,
+// when the stem before it is long enough.
+func (z *stemmer) applySuffixes(suffixes [][2]string) {
+	for _, s := range suffixes {
+		if z.ends(s[0]) {
+			z.replace(s[1])
+			return
+		}
+	}
+}
+
+var step2Suffixes = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+// step2 maps double suffixes to single ones, such as -ization to -ize.
+func (z *stemmer) step2() {
+	z.applySuffixes(step2Suffixes)
+}
+
+var step3Suffixes = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+// step3 handles -ic-, -full, -ness and similar suffixes.
+func (z *stemmer) step3() {
+	z.applySuffixes(step3Suffixes)
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+// step4 removes -ant, -ence and similar suffixes from longer stems.
+func (z *stemmer) step4() {
+	for _, s := range step4Suffixes {
+		if !z.ends(s) {
+			continue
+		}
+		if s == "ion" && (z.j < 0 || z.b[z.j] != 's' && z.b[z.j] != 't') {
+			continue
+		}
+		if z.m() > 1 {
+			z.b = z.b[:z.j+1]
+		}
+		return
+	}
+}
+
+// step5 removes a final -e, and -ll becomes -l, in longer stems.
+func (z *stemmer) step5() {
+	z.j = z.k()
+	if z.b[z.k()] == 'e' {
+		if a := z.m(); a > 1 || a == 1 && !z.cvc(z.k()-1) {
+			z.b = z.b[:z.k()]
+		}
+	}
+	z.j = z.k()
+	if z.b[z.k()] == 'l' && z.doubleC(z.k()) && z.m() > 1 {
+		z.b = z.b[:z.k()]
+	}
+}
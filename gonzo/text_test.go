@@ -0,0 +1,125 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *gonzoSuite) insertProducts(c *gc.C) *mgo.Collection {
+	coll := s.session.DB("db1").C("products")
+	err := coll.EnsureIndex(mgo.Index{
+		Key:     []string{"$text:name", "$text:description"},
+		Weights: map[string]int{"name": 10},
+	})
+	c.Assert(err, gc.IsNil)
+	for _, doc := range []bson.M{
+		{"_id": 1, "name": "Dark roast coffee", "description": "A bold, smoky Java blend"},
+		{"_id": 2, "name": "Decaf coffee", "description": "Dark roast without the caffeine"},
+		{"_id": 3, "name": "Running shoes", "description": "For runners who run every day"},
+		{"_id": 4, "name": "Green tea", "description": "Pairs well with coffee cake"},
+		{"_id": 5, "name": "Coffee mug", "description": "Holds coffee", "language": "none"},
+	} {
+		c.Assert(coll.Insert(doc), gc.IsNil)
+	}
+	return coll
+}
+
+func textSearchIds(c *gc.C, coll *mgo.Collection, text bson.M) []int {
+	var docs []struct {
+		Id    int     `bson:"_id"`
+		Score float64 `bson:"score"`
+	}
+	err := coll.Find(bson.M{"$text": text}).
+		Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		Sort("$textScore:score", "_id").All(&docs)
+	c.Assert(err, gc.IsNil)
+	ids := []int{}
+	for i, doc := range docs {
+		c.Assert(doc.Score > 0, gc.Equals, true)
+		if i > 0 {
+			c.Assert(doc.Score <= docs[i-1].Score, gc.Equals, true)
+		}
+		ids = append(ids, doc.Id)
+	}
+	return ids
+}
+
+func (s *gonzoSuite) TestTextSearch(c *gc.C) {
+	coll := s.insertProducts(c)
+
+	// Matches in the heavily weighted name score higher, and in shorter
+	// names higher still. The mug is indexed without stemming, so its
+	// terms differ from those of an English search.
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "coffee"}), gc.DeepEquals, []int{2, 1, 4})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "coffee -decaf"}), gc.DeepEquals, []int{1, 4})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": `"dark roast"`}), gc.DeepEquals, []int{1, 2})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": `coffee -"dark roast"`}), gc.DeepEquals, []int{4})
+
+	// Words are stemmed, and stop words are not indexed.
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "running"}), gc.DeepEquals, []int{3})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "blends"}), gc.DeepEquals, []int{1})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "the"}), gc.DeepEquals, []int{})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "holds"}), gc.DeepEquals, []int{})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "holds", "$language": "none"}), gc.DeepEquals, []int{5})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "runs", "$language": "none"}), gc.DeepEquals, []int{})
+
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "java"}), gc.DeepEquals, []int{1})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "java", "$caseSensitive": true}), gc.DeepEquals, []int{})
+	c.Assert(textSearchIds(c, coll, bson.M{"$search": "Java", "$caseSensitive": true}), gc.DeepEquals, []int{1})
+
+	n, err := coll.Find(bson.M{"$text": bson.M{"$search": "coffee"}, "_id": bson.M{"$gt": 2}}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	var result explainResult
+	err = coll.Find(bson.M{"$text": bson.M{"$search": "coffee -decaf"}}).Explain(&result)
+	c.Assert(err, gc.IsNil)
+	text := inputStage(result.QueryPlanner.WinningPlan, "TEXT")
+	c.Assert(text["indexName"], gc.Equals, "name_text_description_text")
+	c.Assert(text["parsedTextQuery"], gc.DeepEquals, bson.M{
+		"terms":          []interface{}{"coffe"},
+		"negatedTerms":   []interface{}{"decaf"},
+		"phrases":        []interface{}{},
+		"negatedPhrases": []interface{}{},
+	})
+	c.Assert(result.ExecutionStats.NReturned, gc.Equals, 2)
+}
+
+func (s *gonzoSuite) TestTextIndex(c *gc.C) {
+	coll := s.insertProducts(c)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes, gc.HasLen, 2)
+	c.Assert(indexes[1].Key, gc.DeepEquals, []string{"$text:name", "$text:description"})
+	c.Assert(indexes[1].Weights, gc.DeepEquals, map[string]int{"name": 10, "description": 1})
+	c.Assert(indexes[1].DefaultLanguage, gc.Equals, "english")
+
+	err = coll.EnsureIndexKey("$text:other")
+	c.Assert(err, gc.ErrorMatches, ".*already exists.*")
+	err = coll.Insert(bson.M{"name": "x", "language": "klingon"})
+	c.Assert(err, gc.ErrorMatches, `unsupported language: "klingon" for text search`)
+
+	var doc bson.M
+	err = s.session.DB("db1").C("other").Find(bson.M{"$text": bson.M{"$search": "x"}}).One(&doc)
+	c.Assert(err, gc.ErrorMatches, "text index required for \\$text query")
+	// Deletes fail the same way, rather than matching nothing.
+	other := s.session.DB("db1").C("other")
+	c.Assert(other.Insert(bson.M{"name": "x"}), gc.IsNil)
+	_, err = other.RemoveAll(bson.M{"$text": bson.M{"$search": "x"}})
+	c.Assert(err, gc.ErrorMatches, "text index required for \\$text query")
+	var result struct {
+		N           int
+		WriteErrors []struct{ Code int } `bson:"writeErrors"`
+	}
+	err = s.session.DB("db1").Run(bson.D{{"delete", "other"}, {"deletes", []bson.M{{"q": bson.M{"$text": bson.M{"$search": "x"}}, "limit": 0}}}}, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.WriteErrors, gc.HasLen, 1)
+	c.Assert(result.WriteErrors[0].Code, gc.Equals, 27)
+	n, err := other.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	err = coll.Find(nil).Sort("$textScore:score").One(&doc)
+	c.Assert(err, gc.ErrorMatches, "query requires text score metadata, but it is not available")
+}
@@ -0,0 +1,199 @@
+package gonzo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CA is a certificate authority, which issues the certificates of servers
+// and clients that trust it.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// certValidity is how long certificates generated by a CA are valid for.
+const certValidity = 365 * 24 * time.Hour
+
+// newSerial returns a random certificate serial number.
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// NewCA generates an ephemeral, self-signed certificate authority.
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gonzodb ephemeral CA", Organization: []string{"gonzodb"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+// Pool returns a pool holding the CA's certificate, with which clients
+// verify servers and servers verify clients.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue issues a certificate for a subject, which may authenticate clients,
+// and servers with the given host names or IP addresses.
+func (ca *CA) Issue(subject pkix.Name, hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// NewTLSServerAddr listens for TLS connections on a network address. See
+// NewTLSServer.
+func NewTLSServerAddr(netname, addr string, config *tls.Config) (*Server, error) {
+	ln, err := net.Listen(netname, addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewTLSServer(ln, config)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewTLSServer serves TLS connections accepted from a listener. config may
+// be nil. If it has no certificates, the server presents one for localhost
+// issued by an ephemeral CA, which the server's CA method returns, and
+// which also verifies the certificates clients present unless config has
+// ClientCAs of its own. Clients presenting verified certificates may
+// authenticate as the users of $external named by their subjects, with
+// MONGODB-X509.
+func NewTLSServer(ln net.Listener, config *tls.Config) (*Server, error) {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	var ca *CA
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		var err error
+		if ca, err = NewCA(); err != nil {
+			return nil, err
+		}
+		cert, err := ca.Issue(pkix.Name{CommonName: "localhost", Organization: []string{"gonzodb"}}, "localhost", "127.0.0.1", "::1")
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		if config.ClientCAs == nil {
+			config.ClientCAs = ca.Pool()
+		}
+	}
+	if config.ClientCAs != nil && config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	s := NewServer(tls.NewListener(ln, config))
+	s.ca = ca
+	return s, nil
+}
+
+// CA returns the ephemeral CA which issued the server's certificate, or
+// nil if the server does not use TLS or was given its certificate.
+func (s *Server) CA() *CA {
+	return s.ca
+}
+
+// clientSubject returns the subject of the verified certificate the client
+// presented, if any, as mongod names x.509 users.
+func (ctx *connContext) clientSubject() (string, bool) {
+	conn, ok := ctx.Conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.String(), true
+}
+
+// authenticateX509 authenticates a connection as the user of $external
+// named by the subject of the client's certificate. As with mongod 3.4
+// and later, clients need not name the user.
+func (b *MemoryBackend) authenticateX509(ctx *connContext, dbname string, query *OpQueryMsg) (bson.D, error) {
+	if dbname != "$external" {
+		return nil, errorf(ErrProtocolError, "X.509 authentication must always use the $external database.")
+	}
+	subject, ok := ctx.clientSubject()
+	if !ok {
+		return nil, errorf(ErrAuthenticationFailed, "No verified subject name available from client")
+	}
+	if v, ok := query.Get("user"); ok && v != "" && v != subject {
+		return nil, errorf(ErrAuthenticationFailed, "There is no x.509 client certificate matching the user.")
+	}
+	if _, ok := b.user(dbname, subject); !ok {
+		return nil, errAuthenticationFailed()
+	}
+	ctx.login(dbname, subject)
+	return markOk(bson.D{{"dbname", dbname}, {"user", subject}}), nil
+}
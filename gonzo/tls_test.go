@@ -0,0 +1,105 @@
+package gonzo_test
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+type tlsSuite struct {
+	server *gonzo.Server
+}
+
+var _ = gc.Suite(&tlsSuite{})
+
+func (s *tlsSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.server, err = gonzo.NewTLSServerAddr("tcp", "127.0.0.1:0", nil)
+	c.Assert(err, gc.IsNil)
+	s.server.Start()
+}
+
+func (s *tlsSuite) TearDownTest(c *gc.C) {
+	s.server.Stop()
+}
+
+// dial connects to the server over TLS, trusting its CA and presenting
+// client certificates, if any.
+func (s *tlsSuite) dial(info mgo.DialInfo, certs ...tls.Certificate) (*mgo.Session, error) {
+	info.Addrs = []string{s.server.Addr().String()}
+	info.Direct = true
+	if info.Timeout == 0 {
+		info.Timeout = 5 * time.Second
+	}
+	config := &tls.Config{RootCAs: s.server.CA().Pool(), Certificates: certs}
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.Dial("tcp", addr.String(), config)
+	}
+	return mgo.DialWithInfo(&info)
+}
+
+func (s *tlsSuite) TestTLS(c *gc.C) {
+	session, err := s.dial(mgo.DialInfo{})
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	n, err := session.DB("db1").C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// Clients which do not use TLS, or do not trust the CA, cannot connect.
+	_, err = mgo.DialWithTimeout(s.server.Addr().String(), 200*time.Millisecond)
+	c.Assert(err, gc.NotNil)
+	_, err = tls.Dial("tcp", s.server.Addr().String(), &tls.Config{})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *tlsSuite) TestX509(c *gc.C) {
+	c.Assert(s.server.AddUser("admin", "root", "secret", "root"), gc.IsNil)
+	s.server.SetAuth(true)
+	root, err := s.dial(mgo.DialInfo{Source: "admin", Username: "root", Password: "secret"})
+	c.Assert(err, gc.IsNil)
+	defer root.Close()
+	subject := pkix.Name{CommonName: "client", OrganizationalUnit: []string{"gonzo"}, Organization: []string{"test"}}
+	c.Assert(root.DB("$external").Run(bson.D{
+		{"createUser", "CN=client,OU=gonzo,O=test"},
+		{"roles", []bson.M{{"role": "readWrite", "db": "db1"}}},
+	}, nil), gc.IsNil)
+	err = root.DB("$external").Run(bson.D{{"createUser", "CN=other"}, {"pwd", "secret"}, {"roles", []string{}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Cannot set the password for users defined on the '\\$external' database")
+
+	cert, err := s.server.CA().Issue(subject)
+	c.Assert(err, gc.IsNil)
+	session, err := s.dial(mgo.DialInfo{Username: "CN=client,OU=gonzo,O=test", Mechanism: "MONGODB-X509"}, cert)
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	c.Assert(session.DB("db1").C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	err = session.DB("db2").C("c1").Insert(bson.M{"_id": 1})
+	c.Assert(err, gc.ErrorMatches, "not authorized for insert on db2.c1")
+
+	// Clients may only authenticate as the subjects of their certificates,
+	// when they are users.
+	_, err = s.dial(mgo.DialInfo{Username: "CN=root", Mechanism: "MONGODB-X509"}, cert)
+	c.Assert(err, gc.ErrorMatches, "There is no x.509 client certificate matching the user.")
+	_, err = s.dial(mgo.DialInfo{Username: "CN=client,OU=gonzo,O=test", Mechanism: "MONGODB-X509"})
+	c.Assert(err, gc.ErrorMatches, "No verified subject name available from client")
+	stranger, err := s.server.CA().Issue(pkix.Name{CommonName: "stranger"})
+	c.Assert(err, gc.IsNil)
+	_, err = s.dial(mgo.DialInfo{Username: "CN=stranger", Mechanism: "MONGODB-X509"}, stranger)
+	c.Assert(err, gc.ErrorMatches, "Authentication failed.")
+
+	// Certificates from other CAs are not accepted.
+	ca, err := gonzo.NewCA()
+	c.Assert(err, gc.IsNil)
+	forged, err := ca.Issue(subject)
+	c.Assert(err, gc.IsNil)
+	_, err = s.dial(mgo.DialInfo{Username: "CN=client,OU=gonzo,O=test", Mechanism: "MONGODB-X509", Timeout: 200 * time.Millisecond}, forged)
+	c.Assert(err, gc.NotNil)
+}
@@ -0,0 +1,99 @@
+package gonzo
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TTLMonitorInterval is how often expired documents are removed from
+// collections with TTL indexes, as with mongod's default ttlMonitorSleepSecs.
+var TTLMonitorInterval = 60 * time.Second
+
+// ttlIndex describes a TTL index: documents expire once the time in field
+// is more than expireAfter in the past.
+type ttlIndex struct {
+	field       string
+	expireAfter time.Duration
+}
+
+// ttlIndexes returns the TTL indexes on a collection. Only single-field
+// indexes with an expireAfterSeconds option expire documents.
+func ttlIndexes(coll Collection) []ttlIndex {
+	var result []ttlIndex
+	for _, spec := range coll.Indexes() {
+		m := spec.Map()
+		secs, ok := m["expireAfterSeconds"]
+		if !ok || typeOrder(secs) != 10 {
+			continue
+		}
+		key := asDoc(m["key"])
+		if len(key) != 1 || typeOrder(key[0].Value) != 10 {
+			continue
+		}
+		result = append(result, ttlIndex{
+			field:       key[0].Name,
+			expireAfter: time.Duration(asFloat64(secs) * float64(time.Second)),
+		})
+	}
+	return result
+}
+
+// Clock returns the clock the backend expires documents by.
+func (b *MemoryBackend) Clock() Clock {
+	b.clockMu.Lock()
+	defer b.clockMu.Unlock()
+	return b.clock
+}
+
+// SetClock sets the clock the backend expires documents by.
+func (b *MemoryBackend) SetClock(clock Clock) {
+	b.clockMu.Lock()
+	b.clock = clock
+	b.clockMu.Unlock()
+	select {
+	case b.clockChanged <- struct{}{}:
+	default:
+	}
+}
+
+// ExpireTTL removes all documents which have expired according to the TTL
+// indexes on their collections, returning the number removed.
+func (b *MemoryBackend) ExpireTTL() int {
+	now := b.Clock().Now()
+	var n int
+	for _, dbname := range b.DBNames() {
+		db := b.DB(dbname)
+		for _, cname := range db.CNames() {
+			coll := db.C(cname)
+			for _, ttl := range ttlIndexes(coll) {
+				cutoff := now.Add(-ttl.expireAfter)
+				removed, _ := coll.Delete(bson.M{ttl.field: bson.M{"$lt": cutoff}}, 0)
+				n += removed
+			}
+		}
+	}
+	return n
+}
+
+// ttlMonitor periodically removes expired documents until the backend's
+// tomb is killed. The timer for each pass is stopped if the clock changes
+// first, so that the old clock does not keep waiting on it.
+func (b *MemoryBackend) ttlMonitor() error {
+	for {
+		timer := b.Clock().NewTimer(TTLMonitorInterval)
+		select {
+		case <-b.t.Dying():
+			timer.Stop()
+			return nil
+		case <-b.clockChanged:
+			// Wait on the new clock instead.
+			timer.Stop()
+		case <-timer.C():
+			if n := b.ExpireTTL(); n > 0 {
+				log.Printf("TTL monitor removed %d expired documents", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gonzo_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+func (s *gonzoSuite) TestTTLIndex(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := gonzo.NewManualClock(now)
+	s.server.SetClock(clock)
+
+	coll := s.session.DB("db1").C("sessions")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"lastSeen"}, ExpireAfter: time.Hour})
+	c.Assert(err, gc.IsNil)
+	indexes, err := coll.Indexes()
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexes[1].ExpireAfter, gc.Equals, time.Hour)
+
+	err = coll.Insert(
+		bson.M{"_id": "old", "lastSeen": now.Add(-30 * time.Minute)},
+		bson.M{"_id": "new", "lastSeen": now},
+		bson.M{"_id": "multi", "lastSeen": []time.Time{now, now.Add(-25 * time.Minute)}},
+		bson.M{"_id": "notdate", "lastSeen": 1},
+		bson.M{"_id": "missing"})
+	c.Assert(err, gc.IsNil)
+
+	backend := s.server.Backend.(*gonzo.MemoryBackend)
+	clock.Advance(20 * time.Minute)
+	c.Assert(backend.ExpireTTL(), gc.Equals, 0)
+
+	clock.Advance(20 * time.Minute)
+	c.Assert(backend.ExpireTTL(), gc.Equals, 2)
+	var ids []string
+	var docs []bson.M
+	err = coll.Find(nil).All(&docs)
+	c.Assert(err, gc.IsNil)
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"].(string))
+	}
+	c.Assert(ids, gc.DeepEquals, []string{"new", "notdate", "missing"})
+}
+
+func (s *gonzoSuite) TestTTLMonitor(c *gc.C) {
+	now := time.Now()
+	clock := gonzo.NewManualClock(now)
+	s.server.SetClock(clock)
+
+	coll := s.session.DB("db1").C("sessions")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"lastSeen"}, ExpireAfter: time.Second})
+	c.Assert(err, gc.IsNil)
+	err = coll.Insert(bson.M{"lastSeen": now})
+	c.Assert(err, gc.IsNil)
+
+	// The monitor runs once the clock passes its next scheduled pass.
+	for i := 0; i < 100; i++ {
+		clock.Advance(gonzo.TTLMonitorInterval)
+		n, err := coll.Count()
+		c.Assert(err, gc.IsNil)
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("expired document was not removed by the TTL monitor")
+}
+
+func (s *gonzoSuite) TestManualClockTimer(c *gc.C) {
+	clock := gonzo.NewManualClock(time.Now())
+	stopped := clock.NewTimer(time.Minute)
+	fired := clock.NewTimer(time.Minute)
+	c.Assert(stopped.Stop(), gc.Equals, true)
+	clock.Advance(time.Minute)
+	select {
+	case <-stopped.C():
+		c.Fatalf("stopped timer fired")
+	default:
+	}
+	select {
+	case <-fired.C():
+	default:
+		c.Fatalf("timer did not fire")
+	}
+	c.Assert(fired.Stop(), gc.Equals, false)
+	c.Assert(stopped.Stop(), gc.Equals, false)
+}
@@ -0,0 +1,721 @@
+package gonzo
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TransactionLifetimeLimit is how long a transaction may run before it is
+// aborted, as with mongod's default transactionLifetimeLimitSeconds.
+var TransactionLifetimeLimit = 60 * time.Second
+
+type txnState int
+
+const (
+	txnInProgress txnState = iota
+	txnCommitted
+	txnAborted
+)
+
+func (st txnState) String() string {
+	switch st {
+	case txnInProgress:
+		return "TxnInProgress"
+	case txnCommitted:
+		return "TxnCommitted"
+	}
+	return "TxnAborted"
+}
+
+// txnWrite identifies a document written in a transaction.
+type txnWrite struct {
+	ns string
+	id interface{}
+}
+
+func (w txnWrite) same(other txnWrite) bool {
+	return w.ns == other.ns && compareValues(w.id, other.id) == 0
+}
+
+// transaction is a multi-document transaction. It reads and writes a
+// snapshot of the databases taken as it started, and its writes are only
+// applied to the backend when it commits.
+type transaction struct {
+	number  int64
+	state   txnState
+	started time.Time
+
+	// dbs are the transaction's copies of the databases, whose
+	// collections come from its snapshot.
+	snapshot *txnSnapshot
+	dbs      map[string]*MemoryDB
+
+	// log records the writes made in the transaction. writes holds the
+	// documents written, from its entries up to the record checked.
+	log     *oplog
+	writes  []txnWrite
+	checked int64
+}
+
+// transientError returns an error labelled as one after which the whole
+// transaction may be retried.
+func transientError(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Info:    bson.D{{"errorLabels", []string{"TransientTransactionError"}}},
+	}
+}
+
+// beginTxn starts a transaction on a snapshot of the backend.
+func (b *MemoryBackend) beginTxn(number int64, now time.Time) *transaction {
+	log := newOplog(b.Clock, nil)
+	return &transaction{
+		number:   number,
+		started:  now,
+		snapshot: b.snapshot(log, now),
+		dbs:      make(map[string]*MemoryDB),
+		log:      log,
+	}
+}
+
+// txnSnapshot is the state of the backend's collections as of an oplog
+// timestamp. No data is copied as it is taken: each collection is copied
+// as the transaction first uses it, or before it is next changed, if that
+// comes first.
+type txnSnapshot struct {
+	ts      bson.MongoTimestamp
+	started time.Time
+	backend *MemoryBackend
+
+	// colls holds the copies of the collections taken so far, which
+	// record their changes in log, by namespace. It holds nil for those
+	// which did not exist when the snapshot was taken.
+	colls map[string]*MemoryCollection
+	log   *oplog
+}
+
+// snapshotSet tracks the snapshots of the transactions in progress, and
+// the documents written since the oldest of them was taken, which their
+// writes may conflict with.
+type snapshotSet struct {
+	clock  func() Clock
+	active map[*txnSnapshot]bool
+
+	// written holds the timestamp of the last write to each document,
+	// by namespace and idKey.
+	written map[string]map[string]bson.MongoTimestamp
+
+	mu sync.Mutex
+}
+
+func newSnapshotSet(clock func() Clock) *snapshotSet {
+	return &snapshotSet{
+		clock:  clock,
+		active: make(map[*txnSnapshot]bool),
+	}
+}
+
+// snapshot takes a snapshot of the backend, whose copies of collections
+// record their changes in log. Every collection is locked while it is
+// taken, so that no write is part done: each is either included in the
+// snapshot, or preserves its collection for the snapshot before it is
+// made.
+func (b *MemoryBackend) snapshot(log *oplog, now time.Time) *txnSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	colls := make(map[string]*MemoryCollection)
+	for name, db := range b.dbs {
+		if name == "local" {
+			continue
+		}
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for cname, coll := range db.collections {
+			colls[name+"."+cname] = coll
+		}
+	}
+	// Collections are locked in the order of their names, as by commits.
+	var names []string
+	for ns := range colls {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	for _, ns := range names {
+		colls[ns].mu.RLock()
+		defer colls[ns].mu.RUnlock()
+	}
+
+	snap := &txnSnapshot{
+		started: now,
+		backend: b,
+		colls:   make(map[string]*MemoryCollection),
+		log:     log,
+	}
+	b.oplog.mu.Lock()
+	defer b.oplog.mu.Unlock()
+	snap.ts = b.oplog.last
+	set := b.oplog.snapshots
+	set.mu.Lock()
+	set.active[snap] = true
+	set.mu.Unlock()
+	return snap
+}
+
+// coll returns the snapshot's copy of a collection, or nil if it did not
+// exist when the snapshot was taken.
+func (snap *txnSnapshot) coll(dbname, cname string) *MemoryCollection {
+	b := snap.backend
+	var coll *MemoryCollection
+	b.mu.Lock()
+	db := b.dbs[dbname]
+	b.mu.Unlock()
+	if db != nil && dbname != "local" {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if coll = db.collections[cname]; coll != nil {
+			coll.mu.RLock()
+			defer coll.mu.RUnlock()
+		}
+	}
+	set := b.oplog.snapshots
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	ns := dbname + "." + cname
+	clone, ok := snap.colls[ns]
+	if !ok {
+		if coll != nil {
+			clone = coll.cloneLocked(snap.log)
+		}
+		snap.colls[ns] = clone
+	}
+	return clone
+}
+
+// preserve copies a collection, or records its absence if c is nil, into
+// each snapshot which has yet to copy it, before it is changed. Snapshots
+// of transactions which have run for longer than TransactionLifetimeLimit
+// are dropped, as the transactions can no longer use them.
+func (set *snapshotSet) preserve(ns string, c *MemoryCollection) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if len(set.active) == 0 {
+		return
+	}
+	now := set.clock().Now()
+	for snap := range set.active {
+		if now.Sub(snap.started) >= TransactionLifetimeLimit {
+			delete(set.active, snap)
+			continue
+		}
+		if _, ok := snap.colls[ns]; ok {
+			continue
+		}
+		if c == nil {
+			snap.colls[ns] = nil
+		} else {
+			snap.colls[ns] = c.cloneLocked(snap.log)
+		}
+	}
+}
+
+// record records a write made at a timestamp, if there are snapshots it
+// may conflict with.
+func (set *snapshotSet) record(w txnWrite, ts bson.MongoTimestamp) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if len(set.active) == 0 {
+		return
+	}
+	if set.written == nil {
+		set.written = make(map[string]map[string]bson.MongoTimestamp)
+	}
+	ids, ok := set.written[w.ns]
+	if !ok {
+		ids = make(map[string]bson.MongoTimestamp)
+		set.written[w.ns] = ids
+	}
+	ids[idKey(w.id)] = ts
+}
+
+// writtenSince returns whether a document has been written since a
+// snapshot was taken.
+func (set *snapshotSet) writtenSince(w txnWrite, snap *txnSnapshot) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.written[w.ns][idKey(w.id)] > snap.ts
+}
+
+// release drops a snapshot, and forgets the writes made before the oldest
+// of those remaining.
+func (set *snapshotSet) release(snap *txnSnapshot) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.active, snap)
+	if len(set.active) == 0 {
+		set.written = nil
+		return
+	}
+	oldest := snap.ts
+	for other := range set.active {
+		if other.ts < oldest {
+			oldest = other.ts
+		}
+	}
+	if oldest == snap.ts {
+		return
+	}
+	for ns, ids := range set.written {
+		for id, ts := range ids {
+			if ts <= oldest {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(set.written, ns)
+		}
+	}
+}
+
+// idKey returns a key identifying an _id value, which is the same for all
+// values which compare equal, such as numbers of different types.
+func idKey(id interface{}) string {
+	if typeOrder(id) == 10 {
+		return fmt.Sprint(asFloat64(id))
+	}
+	data, err := bson.Marshal(bson.D{{"", id}})
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return string(data)
+}
+
+// cloneLocked returns a copy of the collection which records its changes in
+// log. The copy shares the documents, as they are replaced rather than
+// changed in place when updated.
+func (c *MemoryCollection) cloneLocked(log *oplog) *MemoryCollection {
+	clone := &MemoryCollection{
+		ns:       c.ns,
+		docs:     make(map[int64]bson.M, len(c.docs)),
+		lastID:   c.lastID,
+		order:    append([]int64(nil), c.order...),
+		options:  c.options,
+		uuid:     c.uuid,
+		dataSize: c.dataSize,
+		capped:   c.capped,
+		oplog:    log,
+	}
+	for id, doc := range c.docs {
+		clone.docs[id] = doc
+	}
+	for _, idx := range c.indexes {
+		idxClone := *idx
+		idxClone.entries = append([]indexEntry(nil), idx.entries...)
+		clone.indexes = append(clone.indexes, &idxClone)
+	}
+	return clone
+}
+
+// db returns the transaction's copy of a database.
+func (t *transaction) db(name string) *MemoryDB {
+	db, ok := t.dbs[name]
+	if !ok {
+		db = NewMemoryDB(name)
+		db.oplog = t.log
+		db.snapshot = t.snapshot
+		t.dbs[name] = db
+	}
+	return db
+}
+
+// abort aborts the transaction if it is in progress, discarding its writes.
+func (t *transaction) abort() {
+	if t.state == txnInProgress {
+		t.state = txnAborted
+		t.release()
+	}
+}
+
+// release releases the transaction's snapshot and copies of databases.
+func (t *transaction) release() {
+	t.snapshot.backend.oplog.snapshots.release(t.snapshot)
+	t.dbs = nil
+}
+
+// active returns whether the transaction is in progress, aborting it if it
+// has run for longer than TransactionLifetimeLimit.
+func (t *transaction) active(now time.Time) bool {
+	if t.state == txnInProgress && now.Sub(t.started) >= TransactionLifetimeLimit {
+		t.abort()
+	}
+	return t.state == txnInProgress
+}
+
+// entryWrite returns the document an oplog entry records a write to, if
+// any.
+func entryWrite(entry bson.M) (txnWrite, bool) {
+	ns, _ := entry["ns"].(string)
+	o, _ := entry["o"].(bson.M)
+	switch entry["op"] {
+	case "i", "d":
+		return txnWrite{ns: ns, id: o["_id"]}, true
+	case "u":
+		o2, _ := entry["o2"].(bson.M)
+		return txnWrite{ns: ns, id: o2["_id"]}, true
+	}
+	return txnWrite{}, false
+}
+
+// newWrites adds the documents written since the transaction was last
+// checked to its writes, and returns them.
+func (t *transaction) newWrites() []txnWrite {
+	entries, last, _ := t.log.coll.Tail(nil, t.checked, 0)
+	t.checked = last
+	var result []txnWrite
+	for _, entry := range entries {
+		if w, ok := entryWrite(entry.(bson.M)); ok {
+			result = append(result, w)
+		}
+	}
+	t.writes = append(t.writes, result...)
+	return result
+}
+
+// conflictLocked returns a WriteConflict error if any of the given writes
+// in a transaction are to documents written since it started, outside of
+// it or by another transaction in progress.
+func (b *MemoryBackend) conflictLocked(t *transaction, writes []txnWrite, now time.Time) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	conflict := transientError(ErrWriteConflict,
+		"WriteConflict error: this operation conflicted with another operation. "+
+			"Please retry your operation or multi-document transaction.")
+	for _, w := range writes {
+		if b.oplog.snapshots.writtenSince(w, t.snapshot) {
+			return conflict
+		}
+	}
+	var others []txnWrite
+	for _, sess := range b.sessions.sessions {
+		if other := sess.txn; other != nil && other != t && other.active(now) {
+			others = append(others, other.writes...)
+		}
+	}
+	for _, w := range writes {
+		for _, other := range others {
+			if w.same(other) {
+				return conflict
+			}
+		}
+	}
+	return nil
+}
+
+// handleSessionCommand runs a command sent with a session id, if it is part
+// of a transaction or is a retryable write. Otherwise it marks the session
+// as used, and returns false for the command to be run as usual.
+func (b *MemoryBackend) handleSessionCommand(c net.Conn, dbname string, query *OpQueryMsg) bool {
+	lsid, ok := query.Get("lsid")
+	if !ok {
+		return false
+	}
+	id, err := parseSessionID(lsid)
+	if err != nil {
+		respError(c, query.RequestID, err)
+		return true
+	}
+	autocommit, inTxn := query.Get("autocommit")
+	txnNumber, ok := query.Get("txnNumber")
+	cmd, _ := query.Command()
+	retryable := ok && !inTxn && retryableCommands[cmd]
+	if !inTxn && !retryable {
+		b.sessions.mu.Lock()
+		b.sessions.getLocked(id, b.Clock().Now())
+		b.sessions.mu.Unlock()
+		return false
+	}
+	// Write concerns are waited for once the session is unlocked, so that
+	// other sessions are not held up meanwhile.
+	reply, err := b.withWriteConcern(query, func() (bson.D, error) {
+		b.sessions.mu.Lock()
+		defer b.sessions.mu.Unlock()
+		sess := b.sessions.getLocked(id, b.Clock().Now())
+		if inTxn {
+			return b.txnCommand(sess, dbname, autocommit, query)
+		}
+		return b.retryableWrite(sess, dbname, txnNumber, query)
+	})
+	if data, ok := b.failPoints.trigger("onPrimaryTransactionalWrite"); ok && retryable && err == nil {
+		if closeConn, ok := data["closeConnection"]; !ok || asBool(closeConn) {
+			c.Close()
+			return true
+		}
+	}
+	if err != nil {
+		respError(c, query.RequestID, err)
+	} else {
+		respDoc(c, query.RequestID, reply)
+	}
+	return true
+}
+
+// txnCommand runs a command in a session's transaction, starting the
+// transaction if the command asks to, or commits or aborts it. Any error
+// aborts the transaction.
+func (b *MemoryBackend) txnCommand(sess *session, dbname string, autocommit interface{}, query *OpQueryMsg) (bson.D, error) {
+	if asBool(autocommit) {
+		return nil, errorf(ErrInvalidOptions, "Specifying autocommit=true is not allowed.")
+	}
+	v, ok := query.Get("txnNumber")
+	if !ok {
+		return nil, errorf(ErrInvalidOptions, "'autocommit' field requires a transaction number to also be specified")
+	}
+	number, ok := asInt64(v)
+	if !ok {
+		return nil, errorf(ErrBadValue, "txnNumber must be a number: %s", formatValue(v))
+	}
+	now := b.Clock().Now()
+	cmd, _ := query.Command()
+	switch cmd {
+	case "commitTransaction", "abortTransaction":
+		if dbname != "admin" {
+			return nil, errorf(ErrUnauthorized, "%s may only be run against the admin database.", cmd)
+		}
+		var err error
+		if cmd == "commitTransaction" {
+			err = b.commitTxn(sess, number, now)
+		} else {
+			err = abortTxn(sess, number, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return markOk(nil), nil
+	}
+
+	if _, ok := query.Get("writeConcern"); ok {
+		return nil, errorf(ErrInvalidOptions, "Cannot set write concern after starting a transaction.")
+	}
+	start, _ := query.Get("startTransaction")
+	if _, ok := query.Get("readConcern"); ok && !asBool(start) {
+		return nil, errorf(ErrInvalidOptions, "Only the first command in a transaction may specify a readConcern")
+	}
+	t, err := b.txnLocked(sess, number, asBool(start), now)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := b.runTxnCommand(t, dbname, query)
+	if err == nil {
+		err = b.conflictLocked(t, t.newWrites(), now)
+	}
+	if err != nil {
+		t.abort()
+		return nil, err
+	}
+	if _, ok := reply.Map()["writeErrors"]; ok {
+		t.abort()
+	}
+	return reply, nil
+}
+
+// runTxnCommand runs one of the commands allowed in a transaction on its
+// snapshot.
+func (b *MemoryBackend) runTxnCommand(t *transaction, dbname string, query *OpQueryMsg) (bson.D, error) {
+	db := t.db(dbname)
+	switch cmd, _ := query.Command(); cmd {
+	case "find":
+		return b.find(dbname, db, query)
+	case "aggregate":
+		pipeline, _ := query.Get("pipeline")
+		if stages, _ := pipelineStages(asArray(pipeline)); isChangeStream(stages) {
+			return nil, errorf(ErrNotSupportedInTxn, "Cannot run '$changeStream' in a multi-document transaction.")
+		}
+		return b.aggregate(dbname, db, query)
+	case "insert", "update", "delete":
+		return b.writeCommand(db, query)
+	default:
+		return nil, errorf(ErrNotSupportedInTxn, "Cannot run '%s' in a multi-document transaction.", cmd)
+	}
+}
+
+// txnLocked returns a session's transaction with the given number,
+// starting it if start is set.
+func (b *MemoryBackend) txnLocked(sess *session, number int64, start bool, now time.Time) (*transaction, error) {
+	switch {
+	case number < sess.txnNumber:
+		return nil, errorf(ErrTransactionTooOld,
+			"Cannot start transaction %d on session %s because a newer transaction %d has already started.",
+			number, formatUUID(sess.id), sess.txnNumber)
+	case start && number == sess.txnNumber && sess.txn != nil:
+		return nil, errorf(ErrConflictingOperation,
+			"Cannot start a transaction at given transaction number %d a transaction with the same number is in state %s",
+			number, sess.txn.state)
+	case start && number == sess.txnNumber && sess.stmts != nil:
+		return nil, errorf(ErrConflictingOperation,
+			"Cannot start a transaction at given transaction number %d a retryable write with the same number has already run",
+			number)
+	case start:
+		if sess.txn != nil {
+			sess.txn.abort()
+		}
+		sess.txnNumber = number
+		sess.txn = b.beginTxn(number, now)
+		sess.stmts = nil
+		return sess.txn, nil
+	case number > sess.txnNumber || sess.txn == nil:
+		return nil, transientError(ErrNoSuchTransaction,
+			"Given transaction number %d does not match any in-progress transactions. "+
+				"The active transaction number is %d", number, sess.txnNumber)
+	case sess.txn.state == txnCommitted:
+		return nil, errorf(ErrTransactionCommitted, "Transaction %d has been committed.", number)
+	case !sess.txn.active(now):
+		return nil, transientError(ErrNoSuchTransaction, "Transaction %d has been aborted.", number)
+	}
+	return sess.txn, nil
+}
+
+// commitTxn commits a session's transaction. Committing a transaction
+// again succeeds, so that clients may retry commits.
+func (b *MemoryBackend) commitTxn(sess *session, number int64, now time.Time) error {
+	t := sess.txn
+	switch {
+	case t == nil || number != t.number:
+		return transientError(ErrNoSuchTransaction,
+			"Given transaction number %d does not match any in-progress transactions. "+
+				"The active transaction number is %d", number, sess.txnNumber)
+	case t.state == txnCommitted:
+		return nil
+	case !t.active(now):
+		return transientError(ErrNoSuchTransaction, "Transaction %d has been aborted.", number)
+	}
+	if err := b.applyTxn(t, now); err != nil {
+		t.abort()
+		return err
+	}
+	t.state = txnCommitted
+	t.release()
+	return nil
+}
+
+// abortTxn aborts a session's transaction.
+func abortTxn(sess *session, number int64, now time.Time) error {
+	t := sess.txn
+	switch {
+	case t == nil || number != t.number:
+		return transientError(ErrNoSuchTransaction,
+			"Given transaction number %d does not match any in-progress transactions. "+
+				"The active transaction number is %d", number, sess.txnNumber)
+	case t.state == txnCommitted:
+		return errorf(ErrTransactionCommitted, "Transaction %d has been committed.", number)
+	case !t.active(now):
+		return transientError(ErrNoSuchTransaction, "Transaction %d has been aborted.", number)
+	}
+	t.abort()
+	return nil
+}
+
+// applyTxn applies the writes made in a transaction to the backend, unless
+// any conflict with those made since it started. If a write cannot be
+// applied, those already applied are undone. The collections written stay
+// locked from the conflict check until all the writes are applied, so that
+// no other write comes between them, and no reader sees the transaction
+// partly applied.
+func (b *MemoryBackend) applyTxn(t *transaction, now time.Time) error {
+	var writes []txnWrite
+	colls := make(map[string]*MemoryCollection)
+	for i, w := range t.writes {
+		written := false
+		for _, prev := range t.writes[:i] {
+			written = written || w.same(prev)
+		}
+		if written {
+			continue
+		}
+		writes = append(writes, w)
+		if _, ok := colls[w.ns]; !ok {
+			dbname, cname := splitNamespace(w.ns)
+			colls[w.ns] = b.DB(dbname).C(cname).(*MemoryCollection)
+		}
+	}
+	// Collections are locked in the order of their names, so that commits
+	// cannot deadlock each other.
+	var names []string
+	for ns := range colls {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	for _, ns := range names {
+		colls[ns].mu.Lock()
+		defer colls[ns].mu.Unlock()
+	}
+
+	if err := b.conflictLocked(t, t.writes, now); err != nil {
+		return err
+	}
+	var undo []func()
+	for _, w := range writes {
+		id, coll := w.id, colls[w.ns]
+		dbname, cname := splitNamespace(w.ns)
+		filter := bson.M{"_id": id}
+		from := firstDoc(coll.matchLocked(filter))
+		to := firstDoc(t.db(dbname).C(cname).Match(filter))
+		if err := writeDocLocked(coll, id, from, to); err != nil {
+			for j := len(undo) - 1; j >= 0; j-- {
+				undo[j]()
+			}
+			return err
+		}
+		undo = append(undo, func() { writeDocLocked(coll, id, to, from) })
+	}
+	return nil
+}
+
+// firstDoc returns the first of a list of documents, or nil if there are
+// none.
+func firstDoc(docs []interface{}) bson.M {
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[0].(bson.M)
+}
+
+// writeDocLocked changes the document with an _id in a locked collection
+// from one version to another. Either may be nil, for a document which
+// does not exist.
+func writeDocLocked(coll *MemoryCollection, id interface{}, from, to bson.M) error {
+	filter := bson.M{"_id": id}
+	switch {
+	case from == nil && to == nil:
+		return nil
+	case to == nil:
+		_, err := coll.deleteLocked(filter, 1)
+		return err
+	case from == nil:
+		return coll.insertLocked(copyDoc(to))
+	}
+	update := oplogUpdate(from, to)
+	if len(update) == 0 {
+		return nil
+	}
+	if _, ok := update["$unset"]; ok {
+		// Fields can only be removed by replacing the document.
+		update = copyDoc(to)
+	}
+	_, _, err := coll.updateLocked(filter, update, false)
+	return err
+}
+
+// formatUUID formats a UUID in its canonical, hyphenated form.
+func formatUUID(id bson.Binary) string {
+	d := id.Data
+	if len(d) != 16 {
+		return fmt.Sprintf("%x", d)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", d[0:4], d[4:6], d[6:8], d[8:10], d[10:])
+}
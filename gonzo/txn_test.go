@@ -0,0 +1,283 @@
+package gonzo_test
+
+import (
+	"fmt"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// txnClient runs commands in a logical session, the way drivers supporting
+// transactions send them.
+type txnClient struct {
+	session   *mgo.Session
+	lsid      bson.M
+	txnNumber int64
+	started   bool
+}
+
+func (s *gonzoSuite) startSession(c *gc.C) *txnClient {
+	var result struct {
+		Id             bson.M
+		TimeoutMinutes int `bson:"timeoutMinutes"`
+	}
+	c.Assert(s.session.Run("startSession", &result), gc.IsNil)
+	c.Assert(result.TimeoutMinutes, gc.Equals, 30)
+	c.Assert(result.Id["id"], gc.FitsTypeOf, bson.Binary{})
+	return &txnClient{session: s.session, lsid: result.Id}
+}
+
+// start starts the next transaction, with its first command.
+func (t *txnClient) start() {
+	t.txnNumber++
+	t.started = false
+}
+
+// run runs a command in the current transaction.
+func (t *txnClient) run(dbname string, cmd bson.D, result interface{}) error {
+	cmd = append(cmd, bson.DocElem{"lsid", t.lsid}, bson.DocElem{"txnNumber", t.txnNumber})
+	if !t.started {
+		cmd = append(cmd, bson.DocElem{"startTransaction", true})
+		t.started = true
+	}
+	cmd = append(cmd, bson.DocElem{"autocommit", false})
+	return t.session.DB(dbname).Run(cmd, result)
+}
+
+func (t *txnClient) insert(docs ...interface{}) error {
+	return t.run("db1", bson.D{{"insert", "c1"}, {"documents", docs}}, nil)
+}
+
+func (t *txnClient) update(selector, update bson.M) error {
+	return t.run("db1", bson.D{{"update", "c1"}, {"updates", []bson.M{{"q": selector, "u": update}}}}, nil)
+}
+
+func (t *txnClient) find() ([]bson.M, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.M `bson:"firstBatch"`
+		}
+	}
+	err := t.run("db1", bson.D{{"find", "c1"}, {"sort", bson.M{"_id": 1}}}, &result)
+	return result.Cursor.FirstBatch, err
+}
+
+func (t *txnClient) commit() error {
+	return t.run("admin", bson.D{{"commitTransaction", 1}}, nil)
+}
+
+func (t *txnClient) abort() error {
+	return t.run("admin", bson.D{{"abortTransaction", 1}}, nil)
+}
+
+func errorCode(err error) int {
+	switch err := err.(type) {
+	case *mgo.QueryError:
+		return err.Code
+	case *mgo.LastError:
+		return err.Code
+	}
+	return 0
+}
+
+func (s *gonzoSuite) TestSessions(c *gc.C) {
+	var ismaster struct {
+		LogicalSessionTimeoutMinutes int `bson:"logicalSessionTimeoutMinutes"`
+	}
+	c.Assert(s.session.Run("ismaster", &ismaster), gc.IsNil)
+	c.Assert(ismaster.LogicalSessionTimeoutMinutes, gc.Equals, 30)
+
+	t := s.startSession(c)
+	other := s.startSession(c)
+	c.Assert(t.lsid, gc.Not(gc.DeepEquals), other.lsid)
+	c.Assert(s.session.Run(bson.D{{"refreshSessions", []bson.M{t.lsid}}}, nil), gc.IsNil)
+	c.Assert(s.session.Run(bson.D{{"endSessions", []bson.M{t.lsid, other.lsid}}}, nil), gc.IsNil)
+
+	err := s.session.Run(bson.D{{"refreshSessions", []bson.M{{"id": 1}}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "invalid session id: .*")
+}
+
+func (s *gonzoSuite) TestTransactionCommit(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 0, "n": 0}), gc.IsNil)
+
+	t := s.startSession(c)
+	t.start()
+	c.Assert(t.insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(t.update(bson.M{"_id": 0}, bson.M{"$set": bson.M{"n": 1}}), gc.IsNil)
+	docs, err := t.find()
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"_id": 0, "n": 1}, {"_id": 1}})
+
+	// Writes in the transaction are not seen outside it until it commits.
+	var outside []bson.M
+	c.Assert(coll.Find(nil).Sort("_id").All(&outside), gc.IsNil)
+	c.Assert(outside, gc.DeepEquals, []bson.M{{"_id": 0, "n": 0}})
+
+	c.Assert(t.commit(), gc.IsNil)
+	c.Assert(coll.Find(nil).Sort("_id").All(&outside), gc.IsNil)
+	c.Assert(outside, gc.DeepEquals, []bson.M{{"_id": 0, "n": 1}, {"_id": 1}})
+
+	// Commits may be retried.
+	c.Assert(t.commit(), gc.IsNil)
+	err = t.abort()
+	c.Assert(err, gc.ErrorMatches, "Transaction 1 has been committed.")
+	c.Assert(errorCode(err), gc.Equals, 256)
+}
+
+func (s *gonzoSuite) TestTransactionAbort(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	t := s.startSession(c)
+	t.start()
+	c.Assert(t.insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(t.abort(), gc.IsNil)
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	err = t.insert(bson.M{"_id": 2})
+	c.Assert(err, gc.ErrorMatches, "Transaction 1 has been aborted.")
+	c.Assert(errorCode(err), gc.Equals, 251)
+	c.Assert(t.commit(), gc.ErrorMatches, "Transaction 1 has been aborted.")
+
+	// Errors abort transactions.
+	t.start()
+	c.Assert(t.insert(bson.M{"_id": 1}), gc.IsNil)
+	err = t.run("db1", bson.D{{"count", "c1"}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Cannot run 'count' in a multi-document transaction.")
+	c.Assert(errorCode(err), gc.Equals, 263)
+	c.Assert(t.commit(), gc.ErrorMatches, "Transaction 2 has been aborted.")
+
+	// Transaction numbers only go forward.
+	t.txnNumber = 1
+	t.started = false
+	err = t.insert(bson.M{"_id": 1})
+	c.Assert(err, gc.ErrorMatches, "Cannot start transaction 1 on session .* because a newer transaction 2 has already started.")
+	c.Assert(errorCode(err), gc.Equals, 225)
+	t.txnNumber = 3
+	t.started = true
+	err = t.insert(bson.M{"_id": 1})
+	c.Assert(err, gc.ErrorMatches, "Given transaction number 3 does not match any in-progress transactions. .*")
+	c.Assert(errorCode(err), gc.Equals, 251)
+}
+
+func (s *gonzoSuite) TestTransactionSnapshot(c *gc.C) {
+	db := s.session.DB("db1")
+	coll := db.C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), gc.IsNil)
+	c.Assert(db.C("c2").Insert(bson.M{"_id": 3}), gc.IsNil)
+	t := s.startSession(c)
+	t.start()
+	docs, err := t.find()
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.HasLen, 1)
+
+	// Transactions read the snapshot taken when they started.
+	c.Assert(coll.Insert(bson.M{"_id": 2}), gc.IsNil)
+	c.Assert(coll.Remove(bson.M{"_id": 1}), gc.IsNil)
+	docs, err = t.find()
+	c.Assert(err, gc.IsNil)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"_id": 1}})
+
+	// Collections first read after they have changed are read as they
+	// were, and those created since are empty.
+	c.Assert(db.C("c3").Insert(bson.M{"_id": 4}), gc.IsNil)
+	c.Assert(db.C("c2").Update(bson.M{"_id": 3}, bson.M{"n": 1}), gc.IsNil)
+	c.Assert(db.C("c2").Insert(bson.M{"_id": 5}), gc.IsNil)
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.M `bson:"firstBatch"`
+		}
+	}
+	c.Assert(t.run("db1", bson.D{{"find", "c2"}}, &result), gc.IsNil)
+	c.Assert(result.Cursor.FirstBatch, gc.DeepEquals, []bson.M{{"_id": 3}})
+	c.Assert(t.run("db1", bson.D{{"find", "c3"}}, &result), gc.IsNil)
+	c.Assert(result.Cursor.FirstBatch, gc.HasLen, 0)
+	c.Assert(t.commit(), gc.IsNil)
+}
+
+func (s *gonzoSuite) TestTransactionsConcurrentWrites(c *gc.C) {
+	db := s.session.DB("db1")
+	for _, cname := range []string{"c1", "c2", "c3"} {
+		c.Assert(db.C(cname).Insert(bson.M{"_id": 0}), gc.IsNil)
+	}
+
+	// Transactions start and read while other clients write, without
+	// either waiting on the other forever.
+	done := make(chan error, 4)
+	for i, cname := range []string{"c1", "c2", "c3"} {
+		session := s.session.Copy()
+		defer session.Close()
+		go func(i int, coll *mgo.Collection) {
+			for j := 1; j <= 500; j++ {
+				if err := coll.Insert(bson.M{"_id": j, "i": i}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(i, session.DB("db1").C(cname))
+	}
+	t := s.startSession(c)
+	t.session = s.session.Copy()
+	defer t.session.Close()
+	go func() {
+		for j := 0; j < 200; j++ {
+			t.start()
+			docs, err := t.find()
+			if err == nil {
+				err = t.commit()
+			}
+			if err == nil && len(docs) == 0 {
+				err = fmt.Errorf("transaction read no documents")
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-done:
+			c.Assert(err, gc.IsNil)
+		case <-time.After(10 * time.Second):
+			c.Fatalf("deadlocked")
+		}
+	}
+	n, err := db.C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 501)
+}
+
+func (s *gonzoSuite) TestWriteConflict(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1, "n": 0}, bson.M{"_id": 2, "n": 0}), gc.IsNil)
+
+	// The first transaction to write a document wins.
+	t1, t2 := s.startSession(c), s.startSession(c)
+	t1.start()
+	t2.start()
+	c.Assert(t1.update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"n": 1}}), gc.IsNil)
+	err := t2.update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"n": 2}})
+	c.Assert(err, gc.ErrorMatches, "WriteConflict error: .*")
+	c.Assert(errorCode(err), gc.Equals, 112)
+	c.Assert(t2.commit(), gc.ErrorMatches, "Transaction 1 has been aborted.")
+
+	// Documents written outside a transaction since it started conflict.
+	c.Assert(coll.Update(bson.M{"_id": 2}, bson.M{"$set": bson.M{"n": 3}}), gc.IsNil)
+	err = t1.update(bson.M{"_id": 2}, bson.M{"$set": bson.M{"n": 1}})
+	c.Assert(errorCode(err), gc.Equals, 112)
+
+	// Once the transaction has been retried, it commits.
+	t1.start()
+	c.Assert(t1.update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"n": 1}}), gc.IsNil)
+	c.Assert(t1.update(bson.M{"_id": 2}, bson.M{"$set": bson.M{"n": 1}}), gc.IsNil)
+	c.Assert(t1.commit(), gc.IsNil)
+	var docs []bson.M
+	c.Assert(coll.Find(nil).Sort("_id").All(&docs), gc.IsNil)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"_id": 1, "n": 1}, {"_id": 2, "n": 1}})
+}
@@ -31,6 +31,20 @@ var (
 	OpGetMore     = OpCode(2005)
 	OpDelete      = OpCode(2006)
 	OpKillCursors = OpCode(2007)
+	OpCompressed  = OpCode(2012)
+)
+
+const (
+	// maxBsonObjectSize is the largest document clients may store, and
+	// maxMessageSizeBytes the largest message they may send. Commands and
+	// queries may be as large as maxBsonInternalSize, leaving room around
+	// the largest documents they carry.
+	maxBsonObjectSize   = 16 * 1024 * 1024
+	maxBsonInternalSize = maxBsonObjectSize + 16*1024
+	maxMessageSizeBytes = 48000000
+
+	// maxBsonDepth is how deeply documents and arrays may be nested.
+	maxBsonDepth = 200
 )
 
 type Header struct {
@@ -48,6 +62,13 @@ func readInt32(b []byte) (int32, []byte, bool) {
 	return 0, nil, false
 }
 
+func readInt64(b []byte) (int64, []byte, bool) {
+	if len(b) >= 8 {
+		return int64(binary.LittleEndian.Uint64(b[:8])), b[8:], true
+	}
+	return 0, nil, false
+}
+
 func readCstring(b []byte) (string, []byte, bool) {
 	for i := 0; i < len(b); i++ {
 		if b[i] == 0 {
@@ -57,20 +78,147 @@ func readCstring(b []byte) (string, []byte, bool) {
 	return "", nil, false
 }
 
+// readBsonDoc reads a document, validating it before it is decoded.
 func readBsonDoc(b []byte, out interface{}) ([]byte, error) {
 	l, _, ok := readInt32(b)
 	if !ok {
 		return nil, errTruncMsg
 	}
-	if int(l) > len(b) {
-		l = int32(len(b))
+	if l > maxBsonInternalSize {
+		return nil, errorf(ErrBSONObjectTooLarge, "BSONObj size: %d (0x%X) is invalid. Size must be between 0 and %d(%dMB)",
+			l, l, maxBsonInternalSize, maxBsonInternalSize/(1024*1024))
 	}
-	if err := bson.Unmarshal(b[:l], out); err != nil {
+	if l < 5 || int(l) > len(b) {
+		return nil, errTruncMsg
+	}
+	if err := validateBson(b[:l], 0); err != nil {
 		return nil, err
 	}
+	if err := bson.Unmarshal(b[:l], out); err != nil {
+		return nil, errorf(ErrInvalidBSON, "%v", err)
+	}
 	return b[l:], nil
 }
 
+func errInvalidBson(kind byte) error {
+	return errorf(ErrInvalidBSON, "invalid bson element of type 0x%02x", kind)
+}
+
+// validateBson checks that a document is well formed, as far as its
+// elements are well formed and fit within it, and that it is not nested
+// more deeply than maxBsonDepth. Malformed documents could otherwise crash
+// the decoder.
+func validateBson(b []byte, depth int) error {
+	if depth > maxBsonDepth {
+		return errorf(ErrInvalidBSON, "BSONObj exceeds maximum nested object depth: %d", maxBsonDepth)
+	}
+	l, _, ok := readInt32(b)
+	if !ok || l < 5 || int(l) != len(b) || b[l-1] != 0 {
+		return errorf(ErrInvalidBSON, "invalid bson document length")
+	}
+	b = b[4 : l-1]
+	for len(b) > 0 {
+		kind := b[0]
+		_, rest, ok := readCstring(b[1:])
+		if !ok {
+			return errInvalidBson(kind)
+		}
+		n, err := bsonValueSize(kind, rest, depth)
+		if err != nil {
+			return err
+		}
+		b = rest[n:]
+	}
+	return nil
+}
+
+// bsonValueSize returns the size of the value of an element of a kind at
+// the start of b, validating it.
+func bsonValueSize(kind byte, b []byte, depth int) (int, error) {
+	var n int
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF:
+		// undefined, null, max key, min key
+	case 0x08:
+		if len(b) < 1 || b[0] > 1 {
+			return 0, errInvalidBson(kind)
+		}
+		n = 1
+	case 0x10:
+		n = 4
+	case 0x01, 0x09, 0x11, 0x12:
+		n = 8
+	case 0x07:
+		n = 12
+	case 0x13:
+		n = 16
+	case 0x02, 0x0D, 0x0E:
+		n = bsonStringSize(b)
+	case 0x0C:
+		if n = bsonStringSize(b); n > 0 {
+			n += 12
+		}
+	case 0x0B:
+		if _, rest, ok := readCstring(b); ok {
+			if _, rest, ok = readCstring(rest); ok {
+				n = len(b) - len(rest)
+			}
+		}
+	case 0x03, 0x04:
+		l, _, ok := readInt32(b)
+		if !ok || l < 5 || int(l) > len(b) {
+			return 0, errInvalidBson(kind)
+		}
+		if err := validateBson(b[:l], depth+1); err != nil {
+			return 0, err
+		}
+		n = int(l)
+	case 0x05:
+		l, rest, ok := readInt32(b)
+		if !ok || l < 0 || int(l) >= len(rest) {
+			return 0, errInvalidBson(kind)
+		}
+		// The obsolete binary subtype repeats the length of its data.
+		if rest[0] == 0x02 {
+			if inner, _, ok := readInt32(rest[1 : l+1]); !ok || inner != l-4 {
+				return 0, errInvalidBson(kind)
+			}
+		}
+		n = int(l) + 5
+	case 0x0F:
+		// code with scope: its total length, code and scope document
+		l, rest, ok := readInt32(b)
+		if !ok || l < 14 || int(l) > len(b) {
+			return 0, errInvalidBson(kind)
+		}
+		rest = rest[:l-4]
+		code := bsonStringSize(rest)
+		if code < 0 {
+			return 0, errInvalidBson(kind)
+		}
+		if err := validateBson(rest[code:], depth+1); err != nil {
+			return 0, err
+		}
+		n = int(l)
+	default:
+		return 0, errInvalidBson(kind)
+	}
+	if n < 0 || n > len(b) {
+		return 0, errInvalidBson(kind)
+	}
+	return n, nil
+}
+
+// bsonStringSize returns the size of a string value at the start of b, or
+// -1 if it is malformed.
+func bsonStringSize(b []byte) int {
+	l, rest, ok := readInt32(b)
+	if !ok || l < 1 || int(l) > len(rest) || rest[l-1] != 0 {
+		return -1
+	}
+	return int(l) + 4
+}
+
 func writeInt32(w io.Writer, b []byte, v int32) error {
 	binary.LittleEndian.PutUint32(b, uint32(v))
 	_, err := w.Write(b[:4])
@@ -83,60 +231,66 @@ func writeInt64(w io.Writer, b []byte, v int64) error {
 	return err
 }
 
-var errTruncMsg = fmt.Errorf("truncated message")
+var errTruncMsg = errorf(ErrProtocolError, "truncated message")
 
+// Read reads a message, reading its header and then its body in full,
+// however they are split across reads. A message whose header claims a
+// length outside those allowed is refused with an *Error, without reading
+// its body; the header is still read, so that the message can be replied
+// to. The body is buffered as it arrives, rather than allocated up front
+// for the length claimed.
 func (h *Header) Read(r io.Reader) error {
-	buf := make([]byte, 4)
-	_, err := r.Read(buf)
-	if err != nil {
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return err
 	}
-	var ok bool
-	h.Length, _, ok = readInt32(buf)
-	if !ok {
-		return errTruncMsg
+	h.Length = int32(binary.LittleEndian.Uint32(b[0:]))
+	h.RequestID = int32(binary.LittleEndian.Uint32(b[4:]))
+	h.ResponseTo = int32(binary.LittleEndian.Uint32(b[8:]))
+	h.OpCode = OpCode(binary.LittleEndian.Uint32(b[12:]))
+	if h.Length < 16 || h.Length > maxMessageSizeBytes {
+		return errorf(ErrProtocolError, "recv(): message len %d is invalid. Min 16 Max: %d", h.Length, maxMessageSizeBytes)
 	}
 
-	buf = make([]byte, h.Length-4)
-	_, err = r.Read(buf)
-	if err != nil {
-		return err
+	n := int64(h.Length) - 16
+	var buf bytes.Buffer
+	if n < bytes.MinRead*16 {
+		buf.Grow(int(n))
 	}
-
-	if h.RequestID, buf, ok = readInt32(buf); !ok {
-		return errTruncMsg
-	}
-	if h.ResponseTo, buf, ok = readInt32(buf); !ok {
-		return errTruncMsg
+	if _, err := buf.ReadFrom(io.LimitReader(r, n)); err != nil {
+		return err
 	}
-
-	opCode, buf, ok := readInt32(buf)
-	if !ok {
-		return errTruncMsg
-	} else {
-		h.OpCode = OpCode(opCode)
+	if int64(buf.Len()) < n {
+		return io.ErrUnexpectedEOF
 	}
-
-	h.Contents = buf
+	h.Contents = buf.Bytes()
 	return nil
 }
 
+// messageWriter is implemented by connections which encode the messages
+// written to them, such as with the compressor a client chose.
+type messageWriter interface {
+	writeMessage(h *Header) error
+}
+
+// Write writes a message, encoded as the writer encodes messages if it is
+// a messageWriter.
 func (h *Header) Write(w io.Writer) error {
-	b := make([]byte, 4)
-	var err error
-	if err = writeInt32(w, b, h.Length); err != nil {
-		return err
-	}
-	if err = writeInt32(w, b, h.RequestID); err != nil {
-		return err
-	}
-	if err = writeInt32(w, b, h.ResponseTo); err != nil {
-		return err
-	}
-	if err = writeInt32(w, b, int32(h.OpCode)); err != nil {
-		return err
+	if mw, ok := w.(messageWriter); ok {
+		return mw.writeMessage(h)
 	}
-	_, err = w.Write(h.Contents)
+	return h.writeTo(w)
+}
+
+// writeTo writes a message as it is, in a single write so that messages
+// written concurrently are not interleaved.
+func (h *Header) writeTo(w io.Writer) error {
+	b := make([]byte, 16, 16+len(h.Contents))
+	binary.LittleEndian.PutUint32(b[0:], uint32(h.Length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(h.RequestID))
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.ResponseTo))
+	binary.LittleEndian.PutUint32(b[12:], uint32(h.OpCode))
+	_, err := w.Write(append(b, h.Contents...))
 	return err
 }
 
@@ -259,6 +413,9 @@ func NewOpInsertMsg(h *Header) (*OpInsertMsg, error) {
 
 	var err error
 	for len(b) > 0 {
+		if l, _, ok := readInt32(b); ok && l > maxBsonObjectSize {
+			return nil, errorf(ErrBSONObjectTooLarge, "object to insert too large. size in bytes: %d, max size: %d", l, maxBsonObjectSize)
+		}
 		mdoc := make(bson.M)
 		if b, err = readBsonDoc(b, mdoc); err != nil {
 			return nil, err
@@ -268,6 +425,19 @@ func NewOpInsertMsg(h *Header) (*OpInsertMsg, error) {
 	return m, nil
 }
 
+// ReplyFlags are the flags of an OP_REPLY. mongod sets AwaitCapable on
+// every reply which does not fail, QueryFailure on replies whose only
+// document is an $err, and CursorNotFound on replies to getMores of
+// cursors which do not exist.
+type ReplyFlags int32
+
+const (
+	ReplyFlagCursorNotFound   = 1 << 0
+	ReplyFlagQueryFailure     = 1 << 1
+	ReplyFlagShardConfigStale = 1 << 2
+	ReplyFlagAwaitCapable     = 1 << 3
+)
+
 type OpReplyMsg struct {
 	*Header
 
@@ -296,6 +466,7 @@ func NewOpReplyMsg(responseTo int32, docs ...interface{}) *OpReplyMsg {
 			ResponseTo: responseTo,
 			OpCode:     OpReply,
 		},
+		ResponseFlags:  ReplyFlagAwaitCapable,
 		NumberReturned: int32(len(docs)),
 		Docs:           docs,
 	}
@@ -336,6 +507,11 @@ type WriteResult struct {
 	N               int         `bson:"n"`
 	UpdatedExisting bool        `bson:"updatedExisting"`
 	Upserted        interface{} `bson:"upserted"`
+	Err             interface{} `bson:"err"`
+	Code            ErrorCode   `bson:"code,omitempty"`
+	CodeName        string      `bson:"codeName,omitempty"`
+
+	modified int
 }
 
 type OpUpdateMsg struct {
@@ -453,3 +629,185 @@ func NewOpDeleteMsg(h *Header) (*OpDeleteMsg, error) {
 
 	return m, nil
 }
+
+type OpGetMoreMsg struct {
+	*Header
+
+	zero int32
+
+	// "dbname.collectionname"
+	FullCollectionName string
+
+	// number of documents to return
+	NumberToReturn int32
+
+	// cursor id from the OP_REPLY
+	CursorID int64
+}
+
+func NewOpGetMoreMsg(h *Header) (*OpGetMoreMsg, error) {
+	m := &OpGetMoreMsg{Header: h}
+	b := h.Contents
+
+	var ok bool
+
+	if m.zero, b, ok = readInt32(b); !ok {
+		return nil, errTruncMsg
+	}
+	if m.FullCollectionName, b, ok = readCstring(b); !ok {
+		return nil, errTruncMsg
+	}
+	if m.NumberToReturn, b, ok = readInt32(b); !ok {
+		return nil, errTruncMsg
+	}
+	if m.CursorID, b, ok = readInt64(b); !ok {
+		return nil, errTruncMsg
+	}
+	return m, nil
+}
+
+type OpKillCursorsMsg struct {
+	*Header
+
+	zero int32
+
+	// cursor ids to be closed
+	CursorIDs []int64
+}
+
+func NewOpKillCursorsMsg(h *Header) (*OpKillCursorsMsg, error) {
+	m := &OpKillCursorsMsg{Header: h}
+	b := h.Contents
+
+	var ok bool
+
+	if m.zero, b, ok = readInt32(b); !ok {
+		return nil, errTruncMsg
+	}
+	n, b, ok := readInt32(b)
+	if !ok || n < 0 {
+		return nil, errTruncMsg
+	}
+	for i := int32(0); i < n; i++ {
+		var id int64
+		if id, b, ok = readInt64(b); !ok {
+			return nil, errTruncMsg
+		}
+		m.CursorIDs = append(m.CursorIDs, id)
+	}
+	return m, nil
+}
+
+// OpMsgMsg is a legacy OP_MSG, a diagnostic message which mongod logged and
+// answered before it was deprecated.
+type OpMsgMsg struct {
+	*Header
+
+	// message to the server
+	Message string
+}
+
+func NewOpMsgMsg(h *Header) (*OpMsgMsg, error) {
+	m := &OpMsgMsg{Header: h}
+	var ok bool
+	if m.Message, _, ok = readCstring(h.Contents); !ok {
+		return nil, errTruncMsg
+	}
+	return m, nil
+}
+
+// Compressor identifies the compressor of an OP_COMPRESSED message.
+type Compressor uint8
+
+const (
+	CompressorNoop   = Compressor(0)
+	CompressorSnappy = Compressor(1)
+	CompressorZlib   = Compressor(2)
+)
+
+// OpCompressedMsg is a message of any other opcode, compressed.
+type OpCompressedMsg struct {
+	*Header
+
+	// opcode of the message compressed
+	OriginalOpCode OpCode
+
+	// size of the message compressed, without its header
+	UncompressedSize int32
+
+	// compressor the message was compressed with
+	CompressorID Compressor
+
+	// message compressed, without its header
+	CompressedMessage []byte
+}
+
+func NewOpCompressedMsg(h *Header) (*OpCompressedMsg, error) {
+	m := &OpCompressedMsg{Header: h}
+	buf := h.Contents
+	var opCode int32
+	var ok bool
+	if opCode, buf, ok = readInt32(buf); !ok {
+		return nil, errTruncMsg
+	}
+	m.OriginalOpCode = OpCode(opCode)
+	if m.UncompressedSize, buf, ok = readInt32(buf); !ok {
+		return nil, errTruncMsg
+	}
+	if len(buf) == 0 {
+		return nil, errTruncMsg
+	}
+	m.CompressorID = Compressor(buf[0])
+	m.CompressedMessage = buf[1:]
+	return m, nil
+}
+
+// CompressMessage compresses a message with a compressor.
+func CompressMessage(h *Header, id Compressor) (*OpCompressedMsg, error) {
+	compressed, err := compress(id, h.Contents)
+	if err != nil {
+		return nil, err
+	}
+	return &OpCompressedMsg{
+		Header: &Header{
+			RequestID:  h.RequestID,
+			ResponseTo: h.ResponseTo,
+			OpCode:     OpCompressed,
+		},
+		OriginalOpCode:    h.OpCode,
+		UncompressedSize:  int32(len(h.Contents)),
+		CompressorID:      id,
+		CompressedMessage: compressed,
+	}, nil
+}
+
+// Decompress returns the message which was compressed.
+func (m *OpCompressedMsg) Decompress() (*Header, error) {
+	if m.OriginalOpCode == OpCompressed {
+		return nil, fmt.Errorf("compressed message contains a compressed message")
+	}
+	if m.UncompressedSize < 0 || m.UncompressedSize > maxMessageSizeBytes {
+		return nil, fmt.Errorf("compressed message has an invalid uncompressed size %d", m.UncompressedSize)
+	}
+	contents, err := decompress(m.CompressorID, m.CompressedMessage, int(m.UncompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	return &Header{
+		Length:     int32(16 + len(contents)),
+		RequestID:  m.RequestID,
+		ResponseTo: m.ResponseTo,
+		OpCode:     m.OriginalOpCode,
+		Contents:   contents,
+	}, nil
+}
+
+func (m *OpCompressedMsg) Write(w io.Writer) error {
+	b := make([]byte, 9, 9+len(m.CompressedMessage))
+	binary.LittleEndian.PutUint32(b[0:], uint32(m.OriginalOpCode))
+	binary.LittleEndian.PutUint32(b[4:], uint32(m.UncompressedSize))
+	b[8] = byte(m.CompressorID)
+	m.Header.Contents = append(b, m.CompressedMessage...)
+	m.Header.Length = int32(len(m.Header.Contents) + 16)
+	return m.Header.writeTo(w)
+}
@@ -0,0 +1,691 @@
+package gonzo
+
+import (
+	"net"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// handleUserCommand runs the commands which manage users and roles, on
+// whichever database they are run. Users are stored in admin.system.users
+// and roles in admin.system.roles, as mongod stores them. It returns false
+// for other commands.
+func (b *MemoryBackend) handleUserCommand(c net.Conn, dbname string, query *OpQueryMsg) bool {
+	var run func(dbname string, query *OpQueryMsg) (bson.D, error)
+	switch cmd, _ := query.Command(); cmd {
+	case "createUser":
+		run = b.createUser
+	case "updateUser":
+		run = b.updateUser
+	case "dropUser":
+		run = b.dropUser
+	case "dropAllUsersFromDatabase":
+		run = b.dropAllUsersFromDatabase
+	case "grantRolesToUser":
+		run = b.grantRolesToUser
+	case "revokeRolesFromUser":
+		run = b.revokeRolesFromUser
+	case "createRole":
+		run = b.createRole
+	case "updateRole":
+		run = b.updateRole
+	case "dropRole":
+		run = b.dropRole
+	case "dropAllRolesFromDatabase":
+		run = b.dropAllRolesFromDatabase
+	case "grantRolesToRole":
+		run = b.grantRolesToRole
+	case "revokeRolesFromRole":
+		run = b.revokeRolesFromRole
+	case "grantPrivilegesToRole":
+		run = b.grantPrivilegesToRole
+	case "revokePrivilegesFromRole":
+		run = b.revokePrivilegesFromRole
+	case "usersInfo", "rolesInfo":
+		info := b.usersInfo
+		if cmd == "rolesInfo" {
+			info = b.rolesInfo
+		}
+		reply, err := info(dbname, query)
+		if err != nil {
+			respError(c, query.RequestID, err)
+		} else {
+			respDoc(c, query.RequestID, reply)
+		}
+		return true
+	default:
+		return false
+	}
+	reply, err := b.withWriteConcern(query, func() (bson.D, error) {
+		return run(dbname, query)
+	})
+	if err != nil {
+		respError(c, query.RequestID, err)
+	} else {
+		respDoc(c, query.RequestID, reply)
+	}
+	return true
+}
+
+// commandName returns the name of the user or role a command is run on.
+func commandName(query *OpQueryMsg, field string) (string, error) {
+	cmd, arg := query.Command()
+	name, _ := arg.(string)
+	if name == "" {
+		return "", errorf(ErrBadValue, "%s needs a non-empty %s name", cmd, field)
+	}
+	return name, nil
+}
+
+// commandRoles returns the roles given to a command, which it requires.
+func (b *MemoryBackend) commandRoles(dbname string, query *OpQueryMsg) ([]roleName, error) {
+	v, ok := query.Get("roles")
+	if _, isArray := v.([]interface{}); !ok || !isArray {
+		cmd, _ := query.Command()
+		return nil, errorf(ErrBadValue, "\"%s\" command requires a \"roles\" array", cmd)
+	}
+	roles, err := parseRoleNames(v, dbname)
+	if err != nil {
+		return nil, err
+	}
+	return roles, b.checkRoles(roles)
+}
+
+// commandPrivileges returns the privileges given to a command, which it
+// requires.
+func commandPrivileges(dbname string, query *OpQueryMsg) ([]privilegeDoc, error) {
+	v, ok := query.Get("privileges")
+	if _, isArray := v.([]interface{}); !ok || !isArray {
+		cmd, _ := query.Command()
+		return nil, errorf(ErrBadValue, "\"%s\" command requires a \"privileges\" array", cmd)
+	}
+	return parsePrivileges(v, dbname)
+}
+
+// passwordCredentials returns the credentials for the password given to
+// createUser or updateUser, which drivers may have digested themselves if
+// digestPassword is false. Users of $external may not have passwords.
+func passwordCredentials(dbname, user string, query *OpQueryMsg) (userCredentials, error) {
+	if dbname == "$external" {
+		return userCredentials{}, errorf(ErrBadValue, "Cannot set the password for users defined on the '$external' database")
+	}
+	v, _ := query.Get("pwd")
+	pwd, _ := v.(string)
+	if pwd == "" {
+		return userCredentials{}, errorf(ErrBadValue, "User passwords must not be empty")
+	}
+	if v, ok := query.Get("digestPassword"); ok && !asBool(v) {
+		return newDigestCredentials(pwd)
+	}
+	return newCredentials(user, pwd)
+}
+
+func errUserNotFound(user, dbname string) error {
+	return errorf(ErrUserNotFound, "Could not find user \"%s\" for db \"%s\"", user, dbname)
+}
+
+// addRoles returns roles along with any of more not already among them.
+func addRoles(roles, more []roleName) []roleName {
+	for _, r := range more {
+		if !hasRole(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// removeRoles returns roles without any of those in less.
+func removeRoles(roles, less []roleName) []roleName {
+	kept := []roleName{}
+	for _, r := range roles {
+		if !hasRole(less, r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func hasRole(roles []roleName, r roleName) bool {
+	for _, have := range roles {
+		if have == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *MemoryBackend) createUser(dbname string, query *OpQueryMsg) (bson.D, error) {
+	name, err := commandName(query, "user")
+	if err != nil {
+		return nil, err
+	}
+	var creds userCredentials
+	if _, ok := query.Get("pwd"); ok || dbname != "$external" {
+		if !ok {
+			return nil, errorf(ErrBadValue, "Must provide a 'pwd' field for all user documents, except those with '$external' as the user's source db")
+		}
+		if creds, err = passwordCredentials(dbname, name, query); err != nil {
+			return nil, err
+		}
+	}
+	roles, err := b.commandRoles(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	u := &userDoc{Id: dbname + "." + name, UserId: newUUID(), User: name, DB: dbname, Credentials: creds, Roles: roles}
+	if v, ok := query.Get("customData"); ok {
+		u.CustomData = asDoc(v)
+	}
+	var doc bson.M
+	if err := convertDoc(u, &doc); err != nil {
+		return nil, err
+	}
+	if err := b.DB("admin").C("system.users").Insert(doc); err != nil {
+		if e, ok := err.(*Error); ok && e.Code == ErrDuplicateKey {
+			return nil, errorf(ErrDuplicateKey, "User \"%s@%s\" already exists", name, dbname)
+		}
+		return nil, err
+	}
+	return markOk(nil), nil
+}
+
+func (b *MemoryBackend) updateUser(dbname string, query *OpQueryMsg) (bson.D, error) {
+	name, err := commandName(query, "user")
+	if err != nil {
+		return nil, err
+	}
+	u, ok := b.user(dbname, name)
+	if !ok {
+		return nil, errUserNotFound(name, dbname)
+	}
+	updated := false
+	if _, ok := query.Get("pwd"); ok {
+		if u.Credentials, err = passwordCredentials(dbname, name, query); err != nil {
+			return nil, err
+		}
+		updated = true
+	}
+	if v, ok := query.Get("customData"); ok {
+		u.CustomData = asDoc(v)
+		updated = true
+	}
+	if _, ok := query.Get("roles"); ok {
+		if u.Roles, err = b.commandRoles(dbname, query); err != nil {
+			return nil, err
+		}
+		updated = true
+	}
+	if !updated {
+		return nil, errorf(ErrBadValue, "Must specify at least one field to update in updateUser")
+	}
+	return markOk(nil), b.putUser(u)
+}
+
+func (b *MemoryBackend) dropUser(dbname string, query *OpQueryMsg) (bson.D, error) {
+	name, err := commandName(query, "user")
+	if err != nil {
+		return nil, err
+	}
+	n, err := b.DB("admin").C("system.users").Delete(bson.M{"_id": dbname + "." + name}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errUserNotFound(name, dbname)
+	}
+	return markOk(nil), nil
+}
+
+func (b *MemoryBackend) dropAllUsersFromDatabase(dbname string, query *OpQueryMsg) (bson.D, error) {
+	n, err := b.DB("admin").C("system.users").Delete(bson.M{"db": dbname}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return markOk(bson.D{{"n", n}}), nil
+}
+
+// changeUserRoles runs grantRolesToUser or revokeRolesFromUser, changing
+// the roles of a user with change.
+func (b *MemoryBackend) changeUserRoles(dbname string, query *OpQueryMsg, change func(roles, given []roleName) []roleName) (bson.D, error) {
+	name, err := commandName(query, "user")
+	if err != nil {
+		return nil, err
+	}
+	given, err := b.commandRoles(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := b.user(dbname, name)
+	if !ok {
+		return nil, errUserNotFound(name, dbname)
+	}
+	u.Roles = change(u.Roles, given)
+	return markOk(nil), b.putUser(u)
+}
+
+func (b *MemoryBackend) grantRolesToUser(dbname string, query *OpQueryMsg) (bson.D, error) {
+	return b.changeUserRoles(dbname, query, addRoles)
+}
+
+func (b *MemoryBackend) revokeRolesFromUser(dbname string, query *OpQueryMsg) (bson.D, error) {
+	return b.changeUserRoles(dbname, query, removeRoles)
+}
+
+// userName names a user of a database.
+type userName struct {
+	User string `bson:"user"`
+	DB   string `bson:"db"`
+}
+
+// usersInfo reports users, by name or all those of the database when the
+// command's argument is 1, or of every database with forAllDBs. Their
+// credentials are only shown with showCredentials.
+func (b *MemoryBackend) usersInfo(dbname string, query *OpQueryMsg) (bson.D, error) {
+	_, arg := query.Command()
+	var names []userName
+	// allDBs is set to report the users of every database, and ofDB to
+	// report those of the database.
+	allDBs, ofDB := false, false
+	switch v := arg.(type) {
+	case string:
+		names = append(names, userName{v, dbname})
+	case []interface{}:
+		for _, elem := range v {
+			if s, ok := elem.(string); ok {
+				names = append(names, userName{s, dbname})
+				continue
+			}
+			var name userName
+			if err := convertDoc(asDoc(elem), &name); err != nil || name.User == "" || name.DB == "" {
+				return nil, errorf(ErrBadValue, "User name must be either a string or an object with user and db fields: %s", formatValue(elem))
+			}
+			names = append(names, name)
+		}
+	case bson.D:
+		m := v.Map()
+		if asBool(m["forAllDBs"]) {
+			allDBs = true
+			break
+		}
+		user, _ := m["user"].(string)
+		db, _ := m["db"].(string)
+		if user == "" || db == "" {
+			return nil, errorf(ErrBadValue, "User name must be either a string or an object with user and db fields: %s", formatValue(v))
+		}
+		names = append(names, userName{user, db})
+	default:
+		if _, ok := asInt64(arg); !ok {
+			return nil, errorf(ErrBadValue, "usersInfo argument must be a string, document, array or 1: %s", formatValue(arg))
+		}
+		ofDB = true
+	}
+	v, _ := query.Get("showCredentials")
+	showCredentials := asBool(v)
+
+	var users []*userDoc
+	for _, doc := range b.DB("admin").C("system.users").All() {
+		u := new(userDoc)
+		if err := convertDoc(doc, u); err != nil {
+			return nil, err
+		}
+		include := allDBs || ofDB && u.DB == dbname
+		for _, name := range names {
+			include = include || name == userName{u.User, u.DB}
+		}
+		if include {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	infos := []interface{}{}
+	for _, u := range users {
+		info := bson.D{{"_id", u.Id}, {"userId", u.UserId}, {"user", u.User}, {"db", u.DB}}
+		if showCredentials {
+			info = append(info, bson.DocElem{"credentials", u.Credentials})
+		}
+		info = append(info, bson.DocElem{"roles", u.Roles})
+		if u.CustomData != nil {
+			info = append(info, bson.DocElem{"customData", u.CustomData})
+		}
+		mechanisms := []string{}
+		for _, mechanism := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256"} {
+			if u.Credentials.scram(mechanism) != nil {
+				mechanisms = append(mechanisms, mechanism)
+			}
+		}
+		info = append(info, bson.DocElem{"mechanisms", mechanisms})
+		infos = append(infos, info)
+	}
+	return markOk(bson.D{{"users", infos}}), nil
+}
+
+// errBuiltinRole returns the error for attempts to change a built-in role.
+func errBuiltinRole(r roleName) error {
+	return errorf(ErrBadValue, "Cannot modify built-in role: %s@%s", r.Role, r.DB)
+}
+
+// isBuiltinRoleName returns whether a name is that of a built-in role on
+// any database, which user-defined roles may not take.
+func isBuiltinRoleName(name string) bool {
+	_, ok := builtinPrivileges(roleName{Role: name, DB: "admin"})
+	return ok
+}
+
+// commandRole returns the user-defined role a command is run on.
+func (b *MemoryBackend) commandRole(dbname string, query *OpQueryMsg) (*roleDoc, error) {
+	name, err := commandName(query, "role")
+	if err != nil {
+		return nil, err
+	}
+	r := roleName{Role: name, DB: dbname}
+	if isBuiltinRoleName(name) {
+		return nil, errBuiltinRole(r)
+	}
+	doc, ok := b.role(r)
+	if !ok {
+		return nil, errorf(ErrRoleNotFound, "Role %s@%s not found", name, dbname)
+	}
+	return doc, nil
+}
+
+// putRole stores a role, unless the roles it would inherit include itself.
+func (b *MemoryBackend) putRole(doc *roleDoc) error {
+	self := roleName{Role: doc.Role, DB: doc.DB}
+	cycle := false
+	b.expandRoles(doc.Roles, func(r roleName, _ *roleDoc) {
+		cycle = cycle || r == self
+	})
+	if cycle {
+		return errorf(ErrBadValue, "Granting roles to %s@%s would introduce a cycle in the role graph", doc.Role, doc.DB)
+	}
+	return b.putAuthDoc("system.roles", doc.Id, doc)
+}
+
+func (b *MemoryBackend) createRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	name, err := commandName(query, "role")
+	if err != nil {
+		return nil, err
+	}
+	if isBuiltinRoleName(name) {
+		return nil, errorf(ErrBadValue, "Cannot create roles with the same name as a built-in role")
+	}
+	privileges, err := commandPrivileges(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := b.commandRoles(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := b.role(roleName{Role: name, DB: dbname}); ok {
+		return nil, errorf(ErrDuplicateKey, "Role \"%s@%s\" already exists", name, dbname)
+	}
+	doc := &roleDoc{Id: dbname + "." + name, Role: name, DB: dbname, Privileges: privileges, Roles: roles}
+	return markOk(nil), b.putRole(doc)
+}
+
+func (b *MemoryBackend) updateRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	updated := false
+	if _, ok := query.Get("privileges"); ok {
+		if doc.Privileges, err = commandPrivileges(dbname, query); err != nil {
+			return nil, err
+		}
+		updated = true
+	}
+	if _, ok := query.Get("roles"); ok {
+		if doc.Roles, err = b.commandRoles(dbname, query); err != nil {
+			return nil, err
+		}
+		updated = true
+	}
+	if !updated {
+		return nil, errorf(ErrBadValue, "Must specify at least one field to update in updateRole")
+	}
+	return markOk(nil), b.putRole(doc)
+}
+
+// dropRoles drops the user-defined roles matching a selector, revoking
+// them from the users and roles they were granted to. It returns how many
+// roles were dropped.
+func (b *MemoryBackend) dropRoles(selector bson.M) (int, error) {
+	coll := b.DB("admin").C("system.roles")
+	var dropped []roleName
+	for _, doc := range coll.Match(selector) {
+		var r roleDoc
+		if err := convertDoc(doc, &r); err != nil {
+			return 0, err
+		}
+		dropped = append(dropped, roleName{Role: r.Role, DB: r.DB})
+	}
+	n, err := coll.Delete(selector, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, doc := range b.DB("admin").C("system.users").All() {
+		var u userDoc
+		if err := convertDoc(doc, &u); err != nil {
+			return 0, err
+		}
+		if roles := removeRoles(u.Roles, dropped); len(roles) != len(u.Roles) {
+			u.Roles = roles
+			if err := b.putUser(&u); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, doc := range coll.All() {
+		var r roleDoc
+		if err := convertDoc(doc, &r); err != nil {
+			return 0, err
+		}
+		if roles := removeRoles(r.Roles, dropped); len(roles) != len(r.Roles) {
+			r.Roles = roles
+			if err := b.putAuthDoc("system.roles", r.Id, &r); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (b *MemoryBackend) dropRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	_, err = b.dropRoles(bson.M{"_id": doc.Id})
+	return markOk(nil), err
+}
+
+func (b *MemoryBackend) dropAllRolesFromDatabase(dbname string, query *OpQueryMsg) (bson.D, error) {
+	n, err := b.dropRoles(bson.M{"db": dbname})
+	return markOk(bson.D{{"n", n}}), err
+}
+
+func (b *MemoryBackend) grantRolesToRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	given, err := b.commandRoles(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	doc.Roles = addRoles(doc.Roles, given)
+	return markOk(nil), b.putRole(doc)
+}
+
+func (b *MemoryBackend) revokeRolesFromRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	given, err := b.commandRoles(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	doc.Roles = removeRoles(doc.Roles, given)
+	return markOk(nil), b.putRole(doc)
+}
+
+func (b *MemoryBackend) grantPrivilegesToRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	given, err := commandPrivileges(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range given {
+		i := findPrivilege(doc.Privileges, p.Resource)
+		if i < 0 {
+			doc.Privileges = append(doc.Privileges, p)
+			continue
+		}
+		for _, action := range p.Actions {
+			if !hasAction(doc.Privileges[i].Actions, action) {
+				doc.Privileges[i].Actions = append(doc.Privileges[i].Actions, action)
+			}
+		}
+	}
+	return markOk(nil), b.putRole(doc)
+}
+
+func (b *MemoryBackend) revokePrivilegesFromRole(dbname string, query *OpQueryMsg) (bson.D, error) {
+	doc, err := b.commandRole(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	given, err := commandPrivileges(dbname, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range given {
+		i := findPrivilege(doc.Privileges, p.Resource)
+		if i < 0 {
+			continue
+		}
+		var kept []string
+		for _, action := range doc.Privileges[i].Actions {
+			if !hasAction(p.Actions, action) {
+				kept = append(kept, action)
+			}
+		}
+		if len(kept) == 0 {
+			doc.Privileges = append(doc.Privileges[:i], doc.Privileges[i+1:]...)
+		} else {
+			doc.Privileges[i].Actions = kept
+		}
+	}
+	return markOk(nil), b.putRole(doc)
+}
+
+// findPrivilege returns the index of the privilege on a resource, or -1.
+func findPrivilege(privileges []privilegeDoc, res bson.D) int {
+	want, _ := parseResource(res)
+	for i, p := range privileges {
+		if have, _ := parseResource(p.Resource); have == want {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesInfo reports roles, by name or all the user-defined roles of the
+// database when the command's argument is 1, along with the built-in roles
+// with showBuiltinRoles. Their privileges are only shown with
+// showPrivileges.
+func (b *MemoryBackend) rolesInfo(dbname string, query *OpQueryMsg) (bson.D, error) {
+	_, arg := query.Command()
+	var names []roleName
+	if _, ok := asInt64(arg); ok {
+		for _, doc := range b.DB("admin").C("system.roles").Match(bson.M{"db": dbname}) {
+			var r roleDoc
+			if err := convertDoc(doc, &r); err != nil {
+				return nil, err
+			}
+			names = append(names, roleName{Role: r.Role, DB: r.DB})
+		}
+		if v, _ := query.Get("showBuiltinRoles"); asBool(v) {
+			for name := range builtinRoles {
+				names = append(names, roleName{Role: name, DB: dbname})
+			}
+			if dbname == "admin" {
+				names = append(names, roleName{Role: "root", DB: dbname})
+				for name := range builtinRoles {
+					names = append(names, roleName{Role: name + "AnyDatabase", DB: dbname})
+				}
+			}
+		}
+	} else {
+		elems, ok := arg.([]interface{})
+		if !ok {
+			elems = []interface{}{arg}
+		}
+		var err error
+		if names, err = parseRoleNames(elems, dbname); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].less(names[j]) })
+	v, _ := query.Get("showPrivileges")
+	showPrivileges := asBool(v)
+
+	infos := []interface{}{}
+	for _, r := range names {
+		builtin, isBuiltin := builtinPrivileges(r)
+		roles := []roleName{}
+		var privileges []privilege
+		if isBuiltin {
+			privileges = builtin
+		} else if doc, ok := b.role(r); ok {
+			roles = doc.Roles
+			for _, p := range doc.Privileges {
+				res, _ := parseResource(p.Resource)
+				privileges = append(privileges, privilege{res, p.Actions})
+			}
+		} else {
+			continue
+		}
+		info := bson.D{
+			{"role", r.Role},
+			{"db", r.DB},
+			{"isBuiltin", isBuiltin},
+			{"roles", roles},
+			{"inheritedRoles", b.inheritedRoles([]roleName{r})},
+		}
+		if showPrivileges {
+			info = append(info,
+				bson.DocElem{"privileges", privilegeDocs(privileges)},
+				bson.DocElem{"inheritedPrivileges", privilegeDocs(b.rolePrivileges([]roleName{r}))})
+		}
+		infos = append(infos, info)
+	}
+	return markOk(bson.D{{"roles", infos}}), nil
+}
+
+// privilegeDocs returns privileges as they are given in role documents.
+func privilegeDocs(privileges []privilege) []interface{} {
+	docs := []interface{}{}
+	for _, p := range privileges {
+		actions := append([]string(nil), p.actions...)
+		sort.Strings(actions)
+		docs = append(docs, bson.D{{"resource", p.resource.doc()}, {"actions", actions}})
+	}
+	return docs
+}
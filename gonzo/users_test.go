@@ -0,0 +1,192 @@
+package gonzo_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type userInfo struct {
+	Id         string `bson:"_id"`
+	User       string
+	DB         string
+	Roles      []bson.M
+	CustomData bson.M `bson:"customData"`
+	Mechanisms []string
+}
+
+func (s *gonzoSuite) TestUserCommands(c *gc.C) {
+	db := s.session.DB("db1")
+	c.Assert(db.UpsertUser(&mgo.User{Username: "alice", Password: "secret", Roles: []mgo.Role{mgo.RoleRead}}), gc.IsNil)
+	c.Assert(db.UpsertUser(&mgo.User{Username: "alice", Password: "rotated", Roles: []mgo.Role{mgo.RoleReadWrite}}), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"createUser", "bob"}, {"pwd", "secret"}, {"roles", []interface{}{}}, {"customData", bson.M{"team": "x"}}}, nil), gc.IsNil)
+
+	var result struct {
+		Users []userInfo
+	}
+	c.Assert(db.Run(bson.D{{"usersInfo", 1}}, &result), gc.IsNil)
+	c.Assert(result.Users, gc.DeepEquals, []userInfo{{
+		Id: "db1.alice", User: "alice", DB: "db1",
+		Roles:      []bson.M{{"role": "readWrite", "db": "db1"}},
+		Mechanisms: []string{"SCRAM-SHA-1", "SCRAM-SHA-256"},
+	}, {
+		Id: "db1.bob", User: "bob", DB: "db1",
+		Roles:      []bson.M{},
+		CustomData: bson.M{"team": "x"},
+		Mechanisms: []string{"SCRAM-SHA-1", "SCRAM-SHA-256"},
+	}})
+	c.Assert(db.Run(bson.D{{"grantRolesToUser", "bob"}, {"roles", []interface{}{"read", bson.M{"role": "read", "db": "db2"}}}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"revokeRolesFromUser", "bob"}, {"roles", []string{"read"}}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"usersInfo", "bob"}}, &result), gc.IsNil)
+	c.Assert(result.Users, gc.HasLen, 1)
+	c.Assert(result.Users[0].Roles, gc.DeepEquals, []bson.M{{"role": "read", "db": "db2"}})
+
+	// Users log in with the passwords they were last given.
+	session, err := s.dialUser("db1", "alice", "rotated", "")
+	c.Assert(err, gc.IsNil)
+	session.Close()
+	_, err = s.dialUser("db1", "alice", "secret", "")
+	c.Assert(err, gc.NotNil)
+
+	err = db.Run(bson.D{{"createUser", "bob"}, {"pwd", "secret"}, {"roles", []string{}}}, nil)
+	c.Assert(err, gc.ErrorMatches, `User "bob@db1" already exists`)
+	c.Assert(errorCode(err), gc.Equals, 11000)
+	err = db.Run(bson.D{{"createUser", "carol"}, {"pwd", "secret"}, {"roles", []string{"root"}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Could not find role: root@db1")
+	c.Assert(errorCode(err), gc.Equals, 31)
+	err = db.Run(bson.D{{"updateUser", "carol"}, {"pwd", "secret"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 11)
+
+	c.Assert(db.RemoveUser("bob"), gc.IsNil)
+	c.Assert(db.RemoveUser("bob"), gc.Equals, mgo.ErrNotFound)
+	var dropped struct {
+		N int
+	}
+	c.Assert(db.Run("dropAllUsersFromDatabase", &dropped), gc.IsNil)
+	c.Assert(dropped.N, gc.Equals, 1)
+}
+
+func (s *gonzoSuite) TestRoleCommands(c *gc.C) {
+	db := s.session.DB("db1")
+	insertC1 := bson.M{"resource": bson.M{"db": "db1", "collection": "c1"}, "actions": []string{"insert"}}
+	c.Assert(db.Run(bson.D{{"createRole", "inserter"}, {"privileges", []bson.M{insertC1}}, {"roles", []string{}}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"createRole", "writer"}, {"privileges", []bson.M{}}, {"roles", []string{"inserter", "read"}}}, nil), gc.IsNil)
+
+	var result struct {
+		Roles []struct {
+			Role           string
+			IsBuiltin      bool `bson:"isBuiltin"`
+			Roles          []bson.M
+			InheritedRoles []bson.M `bson:"inheritedRoles"`
+		}
+	}
+	c.Assert(db.Run(bson.D{{"rolesInfo", "writer"}}, &result), gc.IsNil)
+	c.Assert(result.Roles, gc.HasLen, 1)
+	c.Assert(result.Roles[0].InheritedRoles, gc.DeepEquals, []bson.M{{"role": "inserter", "db": "db1"}, {"role": "read", "db": "db1"}})
+	c.Assert(db.Run(bson.D{{"rolesInfo", 1}, {"showBuiltinRoles", true}}, &result), gc.IsNil)
+	c.Assert(result.Roles, gc.HasLen, 7)
+
+	err := db.Run(bson.D{{"grantRolesToRole", "inserter"}, {"roles", []string{"writer"}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Granting roles to inserter@db1 would introduce a cycle in the role graph")
+	err = db.Run(bson.D{{"createRole", "read"}, {"privileges", []bson.M{}}, {"roles", []string{}}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 2)
+	err = db.Run(bson.D{{"createRole", "admin"}, {"privileges", []bson.M{{"resource": bson.M{"cluster": true}, "actions": []string{"shutdown"}}}}, {"roles", []string{}}}, nil)
+	c.Assert(err, gc.ErrorMatches, "Roles on the 'db1' database cannot be granted privileges that target other databases or the cluster")
+
+	// Dropping a role revokes it from the users and roles it was granted
+	// to.
+	c.Assert(db.Run(bson.D{{"createUser", "alice"}, {"pwd", "secret"}, {"roles", []string{"inserter"}}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"dropRole", "inserter"}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"rolesInfo", "writer"}}, &result), gc.IsNil)
+	c.Assert(result.Roles[0].Roles, gc.DeepEquals, []bson.M{{"role": "read", "db": "db1"}})
+	var users struct {
+		Users []userInfo
+	}
+	c.Assert(db.Run(bson.D{{"usersInfo", "alice"}}, &users), gc.IsNil)
+	c.Assert(users.Users[0].Roles, gc.DeepEquals, []bson.M{})
+	err = db.Run(bson.D{{"dropRole", "inserter"}}, nil)
+	c.Assert(errorCode(err), gc.Equals, 31)
+}
+
+func (s *gonzoSuite) TestLeastPrivilege(c *gc.C) {
+	s.server.SetAuth(true)
+	admin := s.session.DB("admin")
+
+	// Until there are users, local clients may create the first.
+	c.Assert(admin.UpsertUser(&mgo.User{Username: "root", Password: "secret", Roles: []mgo.Role{mgo.RoleRoot}}), gc.IsNil)
+	err := admin.UpsertUser(&mgo.User{Username: "other", Password: "secret", Roles: []mgo.Role{mgo.RoleRoot}})
+	c.Assert(errorCode(err), gc.Equals, 13)
+
+	root, err := s.dialUser("admin", "root", "secret", "")
+	c.Assert(err, gc.IsNil)
+	defer root.Close()
+	db := root.DB("db1")
+	c.Assert(db.C("c1").Insert(bson.M{"_id": 1}), gc.IsNil)
+	for user, role := range map[string]string{"reader": "read", "writer": "readWrite", "dba": "dbAdmin", "admin": "userAdmin"} {
+		c.Assert(db.Run(bson.D{{"createUser", user}, {"pwd", "secret"}, {"roles", []string{role}}}, nil), gc.IsNil)
+	}
+	insertC1 := bson.M{"resource": bson.M{"db": "db1", "collection": "c1"}, "actions": []string{"insert"}}
+	c.Assert(db.Run(bson.D{{"createRole", "inserter"}, {"privileges", []bson.M{insertC1}}, {"roles", []string{}}}, nil), gc.IsNil)
+	c.Assert(db.Run(bson.D{{"createUser", "inserter"}, {"pwd", "secret"}, {"roles", []string{"inserter"}}}, nil), gc.IsNil)
+
+	var sessions []*mgo.Session
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+	login := func(user string) *mgo.Database {
+		session, err := s.dialUser("db1", user, "secret", "")
+		c.Assert(err, gc.IsNil)
+		sessions = append(sessions, session)
+		return session.DB("db1")
+	}
+	unauthorized := func(err error) {
+		c.Check(errorCode(err), gc.Equals, 13)
+	}
+
+	reader := login("reader")
+	n, err := reader.C("c1").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	err = reader.C("c1").Insert(bson.M{"_id": 2})
+	c.Assert(err, gc.ErrorMatches, "not authorized for insert on db1.c1")
+	unauthorized(err)
+	err = reader.Run(bson.D{{"insert", "c1"}, {"documents", []bson.M{{"_id": 2}}}}, nil)
+	c.Assert(err, gc.ErrorMatches, `not authorized on db1 to execute command \{ insert: "c1", .*`)
+	unauthorized(err)
+	unauthorized(reader.Run(bson.D{{"create", "c2"}}, nil))
+	unauthorized(reader.Session.DB("db2").C("c1").Find(nil).One(nil))
+	unauthorized(reader.Session.DB("admin").C("system.users").Find(nil).One(nil))
+	unauthorized(reader.Session.Run("replSetGetStatus", nil))
+
+	writer := login("writer")
+	c.Assert(writer.C("c1").Insert(bson.M{"_id": 2}), gc.IsNil)
+	c.Assert(writer.C("c1").Remove(bson.M{"_id": 2}), gc.IsNil)
+	c.Assert(writer.C("c1").EnsureIndexKey("x"), gc.IsNil)
+	unauthorized(writer.DropDatabase())
+	unauthorized(writer.Run(bson.D{{"createUser", "eve"}, {"pwd", "secret"}, {"roles", []string{"dbAdmin"}}}, nil))
+
+	dba := login("dba")
+	c.Assert(dba.C("c2").Create(&mgo.CollectionInfo{}), gc.IsNil)
+	c.Assert(dba.C("c2").DropCollection(), gc.IsNil)
+	unauthorized(dba.C("c1").Find(nil).One(nil))
+
+	inserter := login("inserter")
+	c.Assert(inserter.C("c1").Insert(bson.M{"_id": 3}), gc.IsNil)
+	unauthorized(inserter.C("c2").Insert(bson.M{"_id": 3}))
+	unauthorized(inserter.C("c1").Find(nil).One(nil))
+
+	// Roles granted and revoked apply to users already logged in.
+	userAdmin := login("admin")
+	c.Assert(userAdmin.Run(bson.D{{"grantRolesToUser", "inserter"}, {"roles", []string{"read"}}}, nil), gc.IsNil)
+	c.Assert(inserter.C("c1").Find(nil).One(nil), gc.IsNil)
+	c.Assert(userAdmin.Run(bson.D{{"revokeRolesFromUser", "inserter"}, {"roles", []string{"read"}}}, nil), gc.IsNil)
+	unauthorized(inserter.C("c1").Find(nil).One(nil))
+
+	// User administrators may only grant roles on their own databases.
+	err = userAdmin.Run(bson.D{{"grantRolesToUser", "reader"}, {"roles", []bson.M{{"role": "root", "db": "admin"}}}}, nil)
+	unauthorized(err)
+	c.Assert(userAdmin.Run(bson.D{{"dropUser", "writer"}}, nil), gc.IsNil)
+	unauthorized(writer.C("c1").Insert(bson.M{"_id": 4}))
+}
@@ -0,0 +1,228 @@
+package gonzo_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/cmars/gonzodb/gonzo"
+)
+
+func (s *gonzoSuite) dialRaw(c *gc.C) net.Conn {
+	conn, err := net.Dial("tcp", s.session.LiveServers()[0])
+	c.Assert(err, gc.IsNil)
+	return conn
+}
+
+func int32le(v int32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func int64le(v int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func bsonDoc(doc interface{}) []byte {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// rawMessage encodes a message as it is, however malformed.
+func rawMessage(h *gonzo.Header) []byte {
+	b := make([]byte, 16, 16+len(h.Contents))
+	binary.LittleEndian.PutUint32(b[0:], uint32(h.Length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(h.RequestID))
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.ResponseTo))
+	binary.LittleEndian.PutUint32(b[12:], uint32(h.OpCode))
+	return append(b, h.Contents...)
+}
+
+func (s *gonzoSuite) TestSplitMessages(c *gc.C) {
+	conn := s.dialRaw(c)
+	defer conn.Close()
+
+	// Messages are read however they are split across segments.
+	msg := rawMessage(opQuery(c, 1, "admin.$cmd", bson.M{"ping": 1}))
+	for i := 0; i < len(msg); i += 3 {
+		end := i + 3
+		if end > len(msg) {
+			end = len(msg)
+		}
+		_, err := conn.Write(msg[i:end])
+		c.Assert(err, gc.IsNil)
+		time.Sleep(time.Millisecond)
+	}
+	_, doc := readReply(c, conn)
+	c.Assert(doc["ok"], gc.Equals, 1)
+
+	text := strings.Repeat("x", 8*1024*1024)
+	coll := s.session.DB("db1").C("c1")
+	c.Assert(coll.Insert(bson.M{"_id": 1, "text": text}), gc.IsNil)
+	var result struct {
+		Text string
+	}
+	c.Assert(coll.FindId(1).One(&result), gc.IsNil)
+	c.Assert(result.Text, gc.Equals, text)
+}
+
+func (s *gonzoSuite) TestMessageSizeLimits(c *gc.C) {
+	// Documents larger than maxBsonObjectSize are refused.
+	coll := s.session.DB("db1").C("c1")
+	err := coll.Insert(bson.M{"_id": 1, "text": strings.Repeat("x", 16*1024*1024)})
+	c.Assert(err, gc.ErrorMatches, "object to insert too large. size in bytes: 16777241, max size: 16777216")
+	c.Assert(errorCode(err), gc.Equals, 10334)
+	n, err := coll.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	// Messages larger than maxMessageSizeBytes are refused without reading
+	// them, and the connection closed.
+	conn := s.dialRaw(c)
+	defer conn.Close()
+	_, err = conn.Write(rawMessage(&gonzo.Header{Length: 48000001, RequestID: 1, OpCode: gonzo.OpQuery}))
+	c.Assert(err, gc.IsNil)
+	_, doc := readReply(c, conn)
+	c.Assert(doc["$err"], gc.Equals, "recv(): message len 48000001 is invalid. Min 16 Max: 48000000")
+	c.Assert(doc["code"], gc.Equals, 17)
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+func (s *gonzoSuite) TestMalformedMessages(c *gc.C) {
+	conn := s.dialRaw(c)
+	defer conn.Close()
+
+	// Queries which cannot be parsed are failed, leaving the connection
+	// usable.
+	h := opQuery(c, 1, "admin.$cmd", bson.M{"ping": 1})
+	h.Contents[len(h.Contents)-11] = 0x42
+	_, err := conn.Write(rawMessage(h))
+	c.Assert(err, gc.IsNil)
+	_, doc := readReply(c, conn)
+	c.Assert(doc["$err"], gc.Equals, "invalid bson element of type 0x42")
+	c.Assert(doc["code"], gc.Equals, 22)
+
+	nested := bson.D{{"ping", 1}}
+	for i := 0; i < 250; i++ {
+		nested = bson.D{{"ping", 1}, {"nested", nested}}
+	}
+	_, err = conn.Write(rawMessage(opQuery(c, 2, "admin.$cmd", nested)))
+	c.Assert(err, gc.IsNil)
+	_, doc = readReply(c, conn)
+	c.Assert(doc["$err"], gc.Equals, "BSONObj exceeds maximum nested object depth: 200")
+
+	// Writes which cannot be parsed fail with the error getLastError
+	// reports.
+	b := append([]byte{0, 0, 0, 0}, "db1.c1\x00"...)
+	b = append(b, 0xff, 0, 0, 0, 0)
+	_, err = conn.Write(rawMessage(&gonzo.Header{Length: int32(16 + len(b)), RequestID: 3, OpCode: gonzo.OpInsert, Contents: b}))
+	c.Assert(err, gc.IsNil)
+	_, err = conn.Write(rawMessage(opQuery(c, 4, "admin.$cmd", bson.M{"getLastError": 1})))
+	c.Assert(err, gc.IsNil)
+	_, doc = readReply(c, conn)
+	c.Assert(doc["err"], gc.Equals, "truncated message")
+	c.Assert(doc["code"], gc.Equals, 17)
+}
+
+// readOpReply reads an OP_REPLY which was not compressed.
+func readOpReply(c *gc.C, conn net.Conn) (flags int32, cursorID int64, docs []bson.M) {
+	h := &gonzo.Header{}
+	c.Assert(h.Read(conn), gc.IsNil)
+	c.Assert(h.OpCode, gc.Equals, gonzo.OpReply)
+	flags = int32(binary.LittleEndian.Uint32(h.Contents[0:]))
+	cursorID = int64(binary.LittleEndian.Uint64(h.Contents[4:]))
+	for b := h.Contents[20:]; len(b) > 0; {
+		l := binary.LittleEndian.Uint32(b)
+		var doc bson.M
+		c.Assert(bson.Unmarshal(b[:l], &doc), gc.IsNil)
+		docs = append(docs, doc)
+		b = b[l:]
+	}
+	return flags, cursorID, docs
+}
+
+func (s *gonzoSuite) TestReplyFlags(c *gc.C) {
+	coll := s.session.DB("db1").C("c1")
+	for i := 0; i < 3; i++ {
+		c.Assert(coll.Insert(bson.M{"_id": i}), gc.IsNil)
+	}
+	conn := s.dialRaw(c)
+	defer conn.Close()
+
+	// Replies which do not fail are flagged as await capable.
+	query := opQuery(c, 1, "db1.c1", bson.M{})
+	binary.LittleEndian.PutUint32(query.Contents[4+len("db1.c1\x00")+4:], 2)
+	_, err := conn.Write(rawMessage(query))
+	c.Assert(err, gc.IsNil)
+	flags, cursorID, docs := readOpReply(c, conn)
+	c.Assert(flags, gc.Equals, int32(gonzo.ReplyFlagAwaitCapable))
+	c.Assert(cursorID, gc.Not(gc.Equals), int64(0))
+	c.Assert(docs, gc.HasLen, 2)
+
+	// Queries which fail reply with an $err, flagged as a failure.
+	failing := opQuery(c, 2, "db1.c1", bson.M{"$query": bson.M{}, "$hint": bson.M{"nope": 1}})
+	_, err = conn.Write(rawMessage(failing))
+	c.Assert(err, gc.IsNil)
+	flags, _, docs = readOpReply(c, conn)
+	c.Assert(flags, gc.Equals, int32(gonzo.ReplyFlagQueryFailure))
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0]["$err"], gc.NotNil)
+	err = coll.Find(nil).Select(bson.M{"a": 1, "b": 0}).One(nil)
+	c.Assert(err, gc.FitsTypeOf, &mgo.QueryError{})
+	c.Assert(err.(*mgo.QueryError).Code, gc.Equals, 2)
+
+	// getMores of cursors which do not exist are flagged as such.
+	kill := concat(int32le(0), int32le(1), int64le(cursorID))
+	_, err = conn.Write(rawMessage(&gonzo.Header{Length: int32(16 + len(kill)), RequestID: 3, OpCode: gonzo.OpKillCursors, Contents: kill}))
+	c.Assert(err, gc.IsNil)
+	getMore := concat(int32le(0), cstring("db1.c1"), int32le(0), int64le(cursorID))
+	_, err = conn.Write(rawMessage(&gonzo.Header{Length: int32(16 + len(getMore)), RequestID: 4, OpCode: gonzo.OpGetMore, Contents: getMore}))
+	c.Assert(err, gc.IsNil)
+	flags, killedID, docs := readOpReply(c, conn)
+	c.Assert(flags, gc.Equals, int32(gonzo.ReplyFlagCursorNotFound))
+	c.Assert(killedID, gc.Equals, int64(0))
+	c.Assert(docs, gc.HasLen, 0)
+	iter := coll.NewIter(s.session, nil, cursorID, nil)
+	c.Assert(iter.Next(&bson.M{}), gc.Equals, false)
+	c.Assert(iter.Err(), gc.Equals, mgo.ErrCursor)
+}
+
+func (s *gonzoSuite) TestLegacyOpMsg(c *gc.C) {
+	conn := s.dialRaw(c)
+	defer conn.Close()
+
+	// Diagnostic messages are logged and answered, leaving the connection
+	// usable.
+	msg := cstring("hello, gonzo")
+	_, err := conn.Write(rawMessage(&gonzo.Header{Length: int32(16 + len(msg)), RequestID: 1, OpCode: gonzo.OpMsg, Contents: msg}))
+	c.Assert(err, gc.IsNil)
+	_, _, docs := readOpReply(c, conn)
+	c.Assert(docs, gc.DeepEquals, []bson.M{{"msg": "i am fine - dbMsg deprecated"}})
+
+	_, err = conn.Write(rawMessage(opQuery(c, 2, "admin.$cmd", bson.M{"ping": 1})))
+	c.Assert(err, gc.IsNil)
+	_, _, docs = readOpReply(c, conn)
+	c.Assert(docs[0]["ok"], gc.Equals, 1)
+}
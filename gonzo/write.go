@@ -0,0 +1,258 @@
+package gonzo
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeError is the error a write operation failed with, along with the
+// position of the operation in its batch.
+type writeError struct {
+	index int
+	err   error
+}
+
+// writeErrorResult returns the getLastError result for a write which
+// failed with err.
+func writeErrorResult(n int, err error) *WriteResult {
+	result := &WriteResult{N: n, Err: err.Error()}
+	if err, ok := err.(*Error); ok {
+		result.Code = err.Code
+		result.CodeName = err.CodeName()
+	}
+	return result
+}
+
+// writeErrorsReply returns the writeErrors array of a write command reply.
+func writeErrorsReply(errs []writeError) []bson.D {
+	var result []bson.D
+	for _, werr := range errs {
+		doc := bson.D{{"index", werr.index}}
+		if err, ok := werr.err.(*Error); ok {
+			doc = append(doc, bson.DocElem{"code", err.Code}, bson.DocElem{"codeName", err.CodeName()})
+			doc = append(doc, err.Info...)
+		}
+		doc = append(doc, bson.DocElem{"errmsg", werr.err.Error()})
+		result = append(result, doc)
+	}
+	return result
+}
+
+// insertDocs inserts documents into a collection. Unless ordered is false,
+// it stops at the first document which cannot be inserted. It returns the
+// number of documents inserted, and the errors for those which were not.
+func insertDocs(coll Collection, docs []bson.M, ordered bool) (int, []writeError) {
+	var n int
+	var errs []writeError
+	for i, doc := range docs {
+		err := coll.Insert(doc)
+		if err != nil {
+			errs = append(errs, writeError{index: i, err: err})
+			if ordered {
+				break
+			}
+			continue
+		}
+		n++
+	}
+	return n, errs
+}
+
+// isOperatorUpdate returns whether an update specification uses update
+// operators such as $set, rather than replacing the document.
+func isOperatorUpdate(update bson.M) bool {
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertDoc returns the document an upsert inserts when no document
+// matches its selector. Operator updates are applied to the fields the
+// selector requires to be equal to a value; replacements keep the _id in
+// the selector, if any.
+func upsertDoc(selector, update bson.M) (bson.M, error) {
+	doc := bson.M{}
+	if !isOperatorUpdate(update) {
+		doc = copyDoc(update)
+		if _, ok := doc["_id"]; !ok {
+			if id, ok := selector["_id"]; ok && isIndexableValue(id) {
+				doc["_id"] = id
+			}
+		}
+		return doc, nil
+	}
+	for k, v := range selector {
+		if strings.HasPrefix(k, "$") || strings.Contains(k, ".") || !isIndexableValue(v) {
+			continue
+		}
+		doc[k] = copyValue(v)
+	}
+	if err := applyUpdate(update, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// updateDocs updates the documents in a collection matching selector, or
+// inserts a new document if none match and upsert is set.
+func updateDocs(coll Collection, selector, update bson.M, multi, upsert bool) (*WriteResult, error) {
+	n, modified, err := coll.Update(selector, update, multi)
+	if err != nil {
+		return nil, err
+	}
+	result := &WriteResult{
+		N:               n,
+		UpdatedExisting: n > 0,
+		modified:        modified,
+	}
+	if upsert && n == 0 {
+		doc, err := upsertDoc(selector, update)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		if err := coll.Insert(doc); err != nil {
+			return nil, err
+		}
+		result.N = 1
+		result.Upserted = doc["_id"]
+	}
+	return result, nil
+}
+
+// stmtResult is the result of one statement of a write command.
+type stmtResult struct {
+	n         int
+	nModified int
+	upserted  interface{}
+	err       error
+}
+
+// writeStatements returns the statements of an insert, update or delete
+// command, as functions which run them on a collection.
+func writeStatements(coll Collection, query *OpQueryMsg) ([]func() *stmtResult, error) {
+	var stmts []func() *stmtResult
+	switch cmd, _ := query.Command(); cmd {
+	case "insert":
+		v, _ := query.Get("documents")
+		for _, doc := range asArray(v) {
+			mdoc, err := asBsonM(doc)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, func() *stmtResult {
+				if err := coll.Insert(mdoc); err != nil {
+					return &stmtResult{err: err}
+				}
+				return &stmtResult{n: 1}
+			})
+		}
+	case "update":
+		v, _ := query.Get("updates")
+		for _, stmt := range asArray(v) {
+			op, err := asBsonM(stmt)
+			if err != nil {
+				return nil, err
+			}
+			selector, _ := asBsonM(op["q"])
+			update, _ := asBsonM(op["u"])
+			if selector == nil {
+				selector = bson.M{}
+			}
+			stmts = append(stmts, func() *stmtResult {
+				result, err := updateDocs(coll, selector, update, asBool(op["multi"]), asBool(op["upsert"]))
+				if err != nil {
+					return &stmtResult{err: err}
+				}
+				return &stmtResult{n: result.N, nModified: result.modified, upserted: result.Upserted}
+			})
+		}
+	case "delete":
+		v, _ := query.Get("deletes")
+		for _, stmt := range asArray(v) {
+			op, err := asBsonM(stmt)
+			if err != nil {
+				return nil, err
+			}
+			selector, _ := asBsonM(op["q"])
+			if selector == nil {
+				selector = bson.M{}
+			}
+			stmts = append(stmts, func() *stmtResult {
+				n, err := coll.Delete(selector, int(asFloat64(op["limit"])))
+				return &stmtResult{n: n, err: err}
+			})
+		}
+	}
+	return stmts, nil
+}
+
+// writeCommand executes an insert, update or delete write command.
+func (b *MemoryBackend) writeCommand(db DB, query *OpQueryMsg) (bson.D, error) {
+	return b.runWriteCommand(db, query, func(i int, stmt func() *stmtResult) *stmtResult {
+		return stmt()
+	})
+}
+
+// runWriteCommand executes a write command, running each of its statements
+// with run. Unless the command is unordered, it stops at the first
+// statement which fails.
+func (b *MemoryBackend) runWriteCommand(db DB, query *OpQueryMsg, run func(i int, stmt func() *stmtResult) *stmtResult) (bson.D, error) {
+	cmd, arg := query.Command()
+	cname, ok := arg.(string)
+	if !ok || cname == "" {
+		return nil, errorf(ErrBadValue, "malformed %s command: %v", cmd, query.Doc)
+	}
+	stmts, err := writeStatements(db.C(cname), query)
+	if err != nil {
+		return nil, err
+	}
+	ordered := true
+	if v, ok := query.Get("ordered"); ok {
+		ordered = asBool(v)
+	}
+
+	var n, nModified int
+	var errs []writeError
+	var upserted []bson.D
+	for i, stmt := range stmts {
+		result := run(i, stmt)
+		if result.err != nil {
+			errs = append(errs, writeError{index: i, err: result.err})
+			if ordered {
+				break
+			}
+			continue
+		}
+		n += result.n
+		if result.upserted != nil {
+			upserted = append(upserted, bson.D{{"index", i}, {"_id", result.upserted}})
+		} else {
+			nModified += result.nModified
+		}
+	}
+	reply := bson.D{{"n", n}}
+	if cmd == "update" {
+		reply = append(reply, bson.DocElem{"nModified", nModified})
+		if len(upserted) > 0 {
+			reply = append(reply, bson.DocElem{"upserted", upserted})
+		}
+	}
+	if len(errs) > 0 {
+		reply = append(reply, bson.DocElem{"writeErrors", writeErrorsReply(errs)})
+	}
+	return markOk(reply), nil
+}
+
+// asArray returns a BSON array value as a slice, or nil if it is not an
+// array.
+func asArray(v interface{}) []interface{} {
+	array, _ := v.([]interface{})
+	return array
+}
@@ -1,28 +1,183 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cmars/gonzodb/gonzo"
 )
 
+const defaultBind = ":47017"
+
+// bindAddrs are the addresses to listen on, given by repeated or
+// comma-separated -bind flags.
+type bindAddrs []string
+
+func (b *bindAddrs) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *bindAddrs) Set(v string) error {
+	for _, addr := range strings.Split(v, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			*b = append(*b, addr)
+		}
+	}
+	return nil
+}
+
+var (
+	binds     bindAddrs
+	verbose   = flag.Bool("v", false, "log each connection as it is accepted and closed")
+	quiet     = flag.Bool("quiet", false, "log nothing but the error the server stops with")
+	pidFile   = flag.String("pidfile", "", "write the process ID to `file`")
+	readyFile = flag.String("ready-file", "", "write the addresses listened on to `file`, once clients may connect")
+	drainFor  = flag.Duration("shutdown-timeout", 10*time.Second, "on SIGINT or SIGTERM, give requests in progress `duration` to finish")
+	maxConns  = flag.Int("max-conns", 0, "refuse connections beyond `n` open at once; 0 for no limit")
+	idleFor   = flag.Duration("idle-timeout", 0, "close connections which send no request for `duration`; 0 never to")
+)
+
+func init() {
+	flag.Var(&binds, "bind", "listen on `addr`, a host:port or unix:///path/to/socket; may be repeated (default "+defaultBind+")")
+}
+
 func die(err error) {
 	if err != nil {
-		log.Println(err)
+		fmt.Fprintln(os.Stderr, "gonzodb:", err)
 		os.Exit(1)
 	}
 	os.Exit(0)
 }
 
-func main() {
-	server, err := gonzo.NewServerAddr("tcp", ":47017")
+// listen listens on an address, which is a Unix domain socket if it begins
+// with unix://. A socket left behind by a server which did not stop
+// cleanly is removed, unless a server is still listening on it.
+func listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix://")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// addrString formats an address listened on as it would be given to
+// -bind, with the port chosen for it if port 0 was given.
+func addrString(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return "unix://" + addr.String()
+	}
+	return addr.String()
+}
+
+// writeFile writes a file by renaming it into place, so that scripts
+// waiting for it never read it partly written.
+func writeFile(path, contents string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
 	if err != nil {
-		die(err)
+		return err
+	}
+	_, err = f.WriteString(contents)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
 	}
-	server.Start()
-	err = server.Wait()
 	if err != nil {
-		die(err)
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func run() error {
+	if len(binds) == 0 {
+		binds = bindAddrs{defaultBind}
+	}
+	var lns []net.Listener
+	for _, addr := range binds {
+		ln, err := listen(addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+
+	server := gonzo.NewServer(lns...)
+	server.Verbose = *verbose
+	server.MaxConns = *maxConns
+	server.IdleTimeout = *idleFor
+	server.Start()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// A second signal stops the server without waiting.
+		sig := <-signals
+		log.Printf("%v received, shutting down", sig)
+		go func() {
+			<-signals
+			server.Stop()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), *drainFor)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	var addrs []string
+	for _, addr := range server.Addrs() {
+		addrs = append(addrs, addrString(addr))
+		fmt.Println(addrString(addr))
+	}
+	if *pidFile != "" {
+		if err := writeFile(*pidFile, strconv.Itoa(os.Getpid())+"\n"); err != nil {
+			server.Stop()
+			return err
+		}
+		defer os.Remove(*pidFile)
+	}
+	if *readyFile != "" {
+		if err := writeFile(*readyFile, strings.Join(addrs, "\n")+"\n"); err != nil {
+			server.Stop()
+			return err
+		}
+		defer os.Remove(*readyFile)
+	}
+	return server.Wait()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *quiet {
+		log.SetOutput(ioutil.Discard)
 	}
+	die(run())
 }